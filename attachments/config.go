@@ -0,0 +1,81 @@
+package attachments
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Valores padrão da configuração.
+const (
+	DefaultDir    = "uploads/anexos"
+	DefaultMaxMB  = 10
+	maxAllowedMB  = 100
+	storeLocal    = "local"
+	storeS3       = "s3"
+	mebibyte      = 1 << 20
+	defaultRegion = "us-east-1"
+)
+
+// StoreFromEnv monta o armazenamento escolhido em ATTACHMENT_STORE (padrão "local"). Se o S3 não
+// estiver configurado, os anexos ficam no armazenamento local, com um aviso no log.
+//
+//	local  ATTACHMENT_DIR (padrão uploads/anexos)
+//	s3     S3_ENDPOINT, S3_REGION (padrão us-east-1), S3_BUCKET, S3_ACCESS_KEY_ID, S3_SECRET_ACCESS_KEY
+func StoreFromEnv() (Store, error) {
+	switch kind := strings.TrimSpace(strings.ToLower(os.Getenv("ATTACHMENT_STORE"))); kind {
+	case "", storeLocal:
+	case storeS3:
+		endpoint, bucket := os.Getenv("S3_ENDPOINT"), os.Getenv("S3_BUCKET")
+		if endpoint == "" || bucket == "" {
+			log.Println("AVISO: armazenamento de anexos 's3' selecionado, mas S3_ENDPOINT ou S3_BUCKET não foi encontrado no .env. Usando o armazenamento local.")
+			break
+		}
+		region := os.Getenv("S3_REGION")
+		if region == "" {
+			region = defaultRegion
+		}
+		return NewS3Store(endpoint, region, bucket, os.Getenv("S3_ACCESS_KEY_ID"), os.Getenv("S3_SECRET_ACCESS_KEY"))
+	default:
+		log.Printf("AVISO: armazenamento de anexos desconhecido '%s'. Usando o armazenamento local.", kind)
+	}
+
+	dir := os.Getenv("ATTACHMENT_DIR")
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return NewLocalStore(dir)
+}
+
+// ScannerFromEnv monta a verificação de vírus com o comando de ATTACHMENT_SCAN_COMMAND (por exemplo
+// "clamdscan --no-summary -"). Sem o comando, devolve nil: os anexos são aceitos sem verificação e
+// ficam marcados como não verificados.
+func ScannerFromEnv() Scanner {
+	commandLine := os.Getenv("ATTACHMENT_SCAN_COMMAND")
+	if strings.TrimSpace(commandLine) == "" {
+		log.Println("AVISO: ATTACHMENT_SCAN_COMMAND não foi encontrado no .env. Os anexos não passarão por verificação de vírus.")
+		return nil
+	}
+	scanner, err := NewCommandScanner(commandLine)
+	if err != nil {
+		log.Printf("AVISO: verificação de vírus desabilitada: %v", err)
+		return nil
+	}
+	return scanner
+}
+
+// MaxSizeFromEnv devolve o tamanho máximo de um anexo em bytes, lido de ATTACHMENT_MAX_MB (padrão
+// 10, no máximo 100).
+func MaxSizeFromEnv() int64 {
+	mb := DefaultMaxMB
+	if value := os.Getenv("ATTACHMENT_MAX_MB"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxAllowedMB {
+			log.Printf("AVISO: ATTACHMENT_MAX_MB inválido '%s'. Usando %d MB.", value, DefaultMaxMB)
+		} else {
+			mb = n
+		}
+	}
+	return int64(mb) * mebibyte
+}
@@ -0,0 +1,90 @@
+package attachments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// LocalStore guarda os anexos em um diretório do servidor. Os arquivos são gravados primeiro em um
+// arquivo temporário e só então renomeados, para que um envio interrompido nunca deixe um anexo
+// pela metade sob a chave definitiva. Diretórios e arquivos são acessíveis só pelo usuário do
+// servidor.
+type LocalStore struct {
+	root string
+}
+
+// NewLocalStore cria o armazenamento local com raiz em dir, criando o diretório se preciso.
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("não foi possível criar o diretório de anexos %s: %w", dir, err)
+	}
+	return &LocalStore{root: dir}, nil
+}
+
+// path converte a chave no caminho do arquivo dentro da raiz.
+func (s *LocalStore) path(key string) (string, error) {
+	if err := validKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+// Put implementa Store.
+func (s *LocalStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".envio-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Sem efeito depois do Rename
+
+	written, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if written != size {
+		return fmt.Errorf("anexo %s: esperados %d bytes, recebidos %d", key, size, written)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get implementa Store.
+func (s *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Delete implementa Store.
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
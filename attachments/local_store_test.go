@@ -0,0 +1,109 @@
+package attachments
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestLocalStore(t *testing.T) (*LocalStore, string) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "anexos")
+	store, err := NewLocalStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, dir
+}
+
+func TestLocalStoreRoundTrip(t *testing.T) {
+	store, dir := newTestLocalStore(t)
+	ctx := context.Background()
+	key := "pacientes/7/3f9a0c"
+
+	for _, content := range []string{"primeira versão", "segunda versão, que substitui a primeira"} {
+		if err := store.Put(ctx, key, strings.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+			t.Fatal(err)
+		}
+		r, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Fatalf("leu %q, esperava %q", got, content)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "pacientes", "7", "3f9a0c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		t.Errorf("arquivo gravado com permissão %v, esperava acesso só do dono", info.Mode().Perm())
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, key); err != ErrNotFound {
+		t.Fatalf("Get depois do Delete = %v, esperava ErrNotFound", err)
+	}
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete de chave inexistente = %v, esperava nil", err)
+	}
+}
+
+func TestLocalStoreIncompleteUpload(t *testing.T) {
+	store, dir := newTestLocalStore(t)
+	ctx := context.Background()
+	key := "pacientes/7/incompleto"
+
+	// O envio declarou 100 bytes e chegaram 10: nada pode ficar gravado sob a chave
+	if err := store.Put(ctx, key, bytes.NewReader(make([]byte, 10)), 100, ""); err == nil {
+		t.Fatal("Put aceitou um envio com tamanho diferente do declarado")
+	}
+	if _, err := store.Get(ctx, key); err != ErrNotFound {
+		t.Fatalf("Get = %v, esperava ErrNotFound", err)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "pacientes", "7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("arquivos temporários ficaram no diretório: %v", entries)
+	}
+}
+
+func TestLocalStoreRejectsPathTraversal(t *testing.T) {
+	store, dir := newTestLocalStore(t)
+	ctx := context.Background()
+	outside := filepath.Join(filepath.Dir(dir), "fora")
+	if err := os.WriteFile(outside, []byte("fora do armazenamento"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"../fora", "pacientes/../../fora", "/tmp/fora", `..\fora`, ""} {
+		if err := store.Put(ctx, key, strings.NewReader("x"), 1, ""); err != ErrInvalidKey {
+			t.Errorf("Put(%q) = %v, esperava ErrInvalidKey", key, err)
+		}
+		if _, err := store.Get(ctx, key); err != ErrInvalidKey {
+			t.Errorf("Get(%q) = %v, esperava ErrInvalidKey", key, err)
+		}
+		if err := store.Delete(ctx, key); err != ErrInvalidKey {
+			t.Errorf("Delete(%q) = %v, esperava ErrInvalidKey", key, err)
+		}
+	}
+
+	if got, err := os.ReadFile(outside); err != nil || string(got) != "fora do armazenamento" {
+		t.Fatalf("arquivo fora do armazenamento foi alterado: %q, %v", got, err)
+	}
+}
@@ -0,0 +1,83 @@
+package attachments
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ScanResult é o veredito da verificação de vírus. Threat traz o nome da ameaça encontrada, quando
+// o verificador informa.
+type ScanResult struct {
+	Infected bool
+	Threat   string
+}
+
+// Scanner é o ponto de extensão para a verificação de vírus, chamado antes de o anexo ser gravado.
+// Scan deve devolver erro sempre que não puder dar um veredito; nesse caso o envio é recusado.
+type Scanner interface {
+	Scan(ctx context.Context, fileName string, r io.Reader) (ScanResult, error)
+}
+
+// CommandScanner verifica o arquivo com um programa externo que lê o conteúdo pela entrada padrão,
+// seguindo a convenção do ClamAV (clamscan -, clamdscan -): código de saída 0 para arquivo limpo,
+// 1 para arquivo infectado e qualquer outro para falha da verificação.
+type CommandScanner struct {
+	command []string
+	timeout time.Duration
+}
+
+// NewCommandScanner cria o verificador a partir da linha de comando, por exemplo
+// "clamdscan --no-summary -".
+func NewCommandScanner(commandLine string) (*CommandScanner, error) {
+	command := strings.Fields(commandLine)
+	if len(command) == 0 {
+		return nil, errors.New("comando de verificação de vírus vazio")
+	}
+	return &CommandScanner{command: command, timeout: 2 * time.Minute}, nil
+}
+
+// Scan implementa Scanner.
+func (s *CommandScanner) Scan(ctx context.Context, fileName string, r io.Reader) (ScanResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.command[0], s.command[1:]...)
+	cmd.Stdin = r
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return ScanResult{}, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		return ScanResult{Infected: true, Threat: scanThreat(output.String())}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("verificação de vírus de %s falhou: %v: %s", fileName, err, strings.TrimSpace(output.String()))
+	}
+}
+
+// scanThreat extrai o nome da ameaça da saída do ClamAV ("stream: Eicar-Signature FOUND"); para
+// outros programas, devolve a primeira linha da saída.
+func scanThreat(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasSuffix(line, " FOUND") {
+			line = strings.TrimSuffix(line, " FOUND")
+			if i := strings.LastIndex(line, ": "); i >= 0 {
+				line = line[i+2:]
+			}
+			return line
+		}
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(output), "\n")
+	return line
+}
@@ -0,0 +1,44 @@
+package attachments
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// SniffLen é quantos bytes do início do arquivo bastam para identificar o tipo.
+const SniffLen = 512
+
+// ErrTypeNotAllowed indica um arquivo cujo conteúdo não é de um dos tipos aceitos.
+var ErrTypeNotAllowed = errors.New("tipo de arquivo não permitido")
+
+// allowedTypes são os tipos aceitos como anexo: documentos digitalizados, fotos e texto simples.
+var allowedTypes = map[string]bool{
+	"application/pdf": true,
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"image/bmp":       true,
+	"image/tiff":      true,
+	"text/plain":      true,
+}
+
+// AllowedTypesLabel descreve os tipos aceitos, para mensagens ao usuário.
+const AllowedTypesLabel = "PDF, JPEG, PNG, GIF, WebP, BMP, TIFF ou texto"
+
+// DetectType identifica o tipo do arquivo pelo conteúdo (os primeiros SniffLen bytes), ignorando a
+// extensão e o tipo informados pelo navegador, e recusa os tipos fora da lista permitida.
+func DetectType(head []byte) (string, error) {
+	contentType := http.DetectContentType(head)
+	// DetectContentType não reconhece TIFF, comum em digitalizações
+	if bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*")) {
+		contentType = "image/tiff"
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	if !allowedTypes[mediaType] {
+		return mediaType, ErrTypeNotAllowed
+	}
+	return contentType, nil
+}
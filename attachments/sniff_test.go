@@ -0,0 +1,41 @@
+package attachments
+
+import "testing"
+
+func TestDetectType(t *testing.T) {
+	tests := []struct {
+		name    string
+		head    string
+		want    string // tipo esperado; vazio quando o arquivo deve ser recusado
+		refused string // tipo identificado no arquivo recusado
+	}{
+		{name: "PDF", head: "%PDF-1.7\n%\xe2\xe3\xcf\xd3\n1 0 obj", want: "application/pdf"},
+		{name: "PNG", head: "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", want: "image/png"},
+		{name: "JPEG", head: "\xff\xd8\xff\xe0\x00\x10JFIF\x00", want: "image/jpeg"},
+		{name: "TIFF little-endian", head: "II*\x00\x08\x00\x00\x00", want: "image/tiff"},
+		{name: "TIFF big-endian", head: "MM\x00*\x00\x00\x00\x08", want: "image/tiff"},
+		{name: "texto", head: "Encaminhamento para avaliação psicológica.", want: "text/plain; charset=utf-8"},
+		// O nome e o tipo enviados pelo navegador não importam: vale o conteúdo
+		{name: "HTML renomeado para .pdf", head: "<!DOCTYPE html><html><script>alert(1)</script></html>", refused: "text/html"},
+		{name: "SVG com script", head: `<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"><script/></svg>`, refused: "text/xml"},
+		{name: "executável do Windows", head: "MZ\x90\x00\x03\x00\x00\x00\x04\x00", refused: "application/octet-stream"},
+		{name: "ZIP", head: "PK\x03\x04\x14\x00\x00\x00", refused: "application/zip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DetectType([]byte(tt.head))
+			if tt.want != "" {
+				if err != nil || got != tt.want {
+					t.Fatalf("DetectType = %q, %v; esperava %q", got, err, tt.want)
+				}
+				return
+			}
+			if err != ErrTypeNotAllowed {
+				t.Fatalf("DetectType = %q, %v; esperava ErrTypeNotAllowed", got, err)
+			}
+			if got != tt.refused {
+				t.Errorf("tipo recusado %q, esperava %q", got, tt.refused)
+			}
+		})
+	}
+}
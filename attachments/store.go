@@ -0,0 +1,52 @@
+// Package attachments guarda os arquivos anexados ao prontuário (encaminhamentos digitalizados,
+// exames, desenhos) em um armazenamento intercambiável: o sistema de arquivos local ou um serviço
+// compatível com S3. Também identifica o tipo real do arquivo pelo conteúdo e oferece um ponto de
+// extensão para a verificação de vírus antes da gravação.
+package attachments
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+)
+
+var (
+	// ErrNotFound indica que não há arquivo gravado com a chave pedida.
+	ErrNotFound = errors.New("anexo não encontrado no armazenamento")
+	// ErrInvalidKey indica uma chave vazia ou com caracteres fora de [A-Za-z0-9/._-], ou que tenta
+	// sair do diretório do armazenamento.
+	ErrInvalidKey = errors.New("chave de anexo inválida")
+)
+
+// Store é o contrato de um armazenamento de anexos. As chaves são caminhos relativos gerados pela
+// aplicação (por exemplo "pacientes/12/3f9a..."); o nome original do arquivo fica só no banco.
+type Store interface {
+	// Put grava size bytes lidos de r sob a chave, substituindo o que houver.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get abre o arquivo gravado sob a chave. Devolve ErrNotFound se ele não existe.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete remove o arquivo. Remover uma chave que não existe não é erro.
+	Delete(ctx context.Context, key string) error
+}
+
+// validKey confere se a chave pode virar caminho de arquivo ou de URL sem escapar do armazenamento.
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") {
+		return ErrInvalidKey
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return ErrInvalidKey
+		}
+	}
+	for _, r := range key {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '/', r == '.', r == '_', r == '-':
+		default:
+			return ErrInvalidKey
+		}
+	}
+	return nil
+}
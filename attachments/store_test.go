@@ -0,0 +1,33 @@
+package attachments
+
+import "testing"
+
+func TestValidKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		valid bool
+	}{
+		{"pacientes/12/3f9a0c", true},
+		{"pacientes/12/exame-2024_01.pdf", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"pacientes/12/", false},
+		{"pacientes//12", false},
+		{"../fora", false},
+		{"pacientes/../../fora", false},
+		{"pacientes/./12", false},
+		{`pacientes\..\fora`, false},
+		{"pacientes/12/nome com espaço", false},
+		{"pacientes/12/a?b=c", false},
+		{"pacientes/12/ação", false},
+	}
+	for _, tt := range tests {
+		err := validKey(tt.key)
+		if tt.valid && err != nil {
+			t.Errorf("validKey(%q) = %v, esperava chave válida", tt.key, err)
+		}
+		if !tt.valid && err != ErrInvalidKey {
+			t.Errorf("validKey(%q) = %v, esperava ErrInvalidKey", tt.key, err)
+		}
+	}
+}
@@ -14,11 +14,15 @@ import (
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
+	"mediflow/storage"
 )
 
 // Versão Final e Completa do Schema
 var createTableSQL = `
-DROP TABLE IF EXISTS consultation_summaries, appointments, patient_records, patients, users CASCADE;
+DROP TABLE IF EXISTS patient_attachments, record_goal_progress, treatment_goals, treatment_plans, note_templates, questionnaire_responses, session_checkins, consent_receipts, patient_consents, consent_terms, patient_intakes, portal_login_challenges, portal_tokens, notification_deliveries, waitlist_offers, waitlist_windows, waitlist_entries, consultation_summaries, therapist_availability_exceptions, therapist_availability, appointments, appointment_series, therapist_service_prices, service_types, patient_records, patients, users CASCADE;
+
+-- Necessária para as restrições de exclusão que impedem sobreposição de consultas
+CREATE EXTENSION IF NOT EXISTS btree_gist;
 
 CREATE TABLE IF NOT EXISTS users (
   id SERIAL PRIMARY KEY,
@@ -26,6 +30,9 @@ CREATE TABLE IF NOT EXISTS users (
   email VARCHAR(255) UNIQUE NOT NULL,
   password_hash VARCHAR(255) NOT NULL,
   user_type VARCHAR(50) NOT NULL CHECK (user_type IN ('terapeuta', 'secretaria', 'admin')),
+  calendar_token VARCHAR(64) UNIQUE, -- Link secreto do feed iCalendar do terapeuta
+  calendar_full_names BOOLEAN NOT NULL DEFAULT FALSE, -- Feed com nome completo do paciente em vez das iniciais
+  timezone VARCHAR(64), -- Fuso IANA do terapeuta (atendimento online); NULL = fuso da clínica
   created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
   updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
   deleted_at TIMESTAMP WITH TIME ZONE DEFAULT NULL
@@ -33,7 +40,6 @@ CREATE TABLE IF NOT EXISTS users (
 
 CREATE TABLE IF NOT EXISTS patients (
     id SERIAL PRIMARY KEY,
-    access_token VARCHAR(64) UNIQUE,
     consent_given_at TIMESTAMP WITH TIME ZONE,
     consent_date DATE, consent_name VARCHAR(255), consent_cpf_rg VARCHAR(50),
     signature_date DATE, signature_location VARCHAR(255), name VARCHAR(255),
@@ -50,29 +56,465 @@ CREATE TABLE IF NOT EXISTS patients (
     main_complaint TEXT, complaint_history TEXT, signs_symptoms TEXT, current_treatment TEXT,
     how_found VARCHAR(255), referral_name VARCHAR(255), other_source VARCHAR(255), notes TEXT,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    portal_locked_until TIMESTAMP WITH TIME ZONE,
+    booking_unconfirmed BOOLEAN NOT NULL DEFAULT FALSE, -- Cadastrado por pedido de agendamento online ainda não confirmado
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     deleted_at TIMESTAMP WITH TIME ZONE DEFAULT NULL
 );
 
+-- Links de acesso ao portal do paciente: cada link tem finalidade, validade e pode ser de uso único
+CREATE TABLE IF NOT EXISTS portal_tokens (
+  id SERIAL PRIMARY KEY,
+  patient_id INT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
+  token VARCHAR(64) UNIQUE NOT NULL,
+  purpose VARCHAR(20) NOT NULL CHECK (purpose IN ('consentimento', 'anamnese', 'acesso')),
+  single_use BOOLEAN NOT NULL DEFAULT FALSE,
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  use_count INT NOT NULL DEFAULT 0,
+  last_used_at TIMESTAMP WITH TIME ZONE,
+  revoked_at TIMESTAMP WITH TIME ZONE,
+  created_by INT REFERENCES users(id) ON DELETE SET NULL, -- NULL = emitido pelo sistema
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_portal_tokens_patient ON portal_tokens (patient_id, created_at);
+
+-- Login sem senha do portal: link mágico e código de 6 dígitos (guardado como hash) enviados ao contato do paciente
+CREATE TABLE IF NOT EXISTS portal_login_challenges (
+  id SERIAL PRIMARY KEY,
+  patient_id INT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
+  link_token VARCHAR(64) UNIQUE NOT NULL,
+  code_hash VARCHAR(64) NOT NULL,
+  channel VARCHAR(20) NOT NULL CHECK (channel IN ('email', 'telefone')),
+  recipient VARCHAR(255) NOT NULL,
+  attempts INT NOT NULL DEFAULT 0,
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  used_at TIMESTAMP WITH TIME ZONE,
+  invalidated_at TIMESTAMP WITH TIME ZONE,
+  request_ip VARCHAR(64),
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_portal_login_challenges_patient ON portal_login_challenges (patient_id, created_at);
+
+-- Termos de consentimento versionados: cada versão é imutável; a vigente é a de maior número
+CREATE TABLE IF NOT EXISTS consent_terms (
+  id SERIAL PRIMARY KEY,
+  version INT UNIQUE NOT NULL,
+  title VARCHAR(255) NOT NULL,
+  body TEXT NOT NULL,
+  content_hash CHAR(64) NOT NULL, -- SHA-256 do texto, em hexadecimal
+  requires_reconsent BOOLEAN NOT NULL DEFAULT FALSE, -- Exige novo aceite de quem aceitou versões anteriores
+  created_by INT REFERENCES users(id) ON DELETE SET NULL,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO consent_terms (version, title, body, content_hash)
+SELECT 1, t.title, t.body, encode(sha256(convert_to(t.body, 'UTF8')), 'hex')
+FROM (VALUES ('Termo de Consentimento', 'Por minha livre iniciativa, aceito submeter-me ao tratamento de reiki. Declaro que todas as informações contidas nesta ficha de avaliação são verdadeiras, e também estar ciente de eventuais reações em decorrência dos procedimentos explicados previamente, não podendo futuramente reclamar quanto ao resultado do procedimento, nem reivindicar qualquer tipo de ressarcimento monetário ou de qualquer outra natureza. Estou ciente também, que é minha responsabilidade informar novas advertências que possam vir a ocorrer, para serem acrescentadas a este documento.')) AS t(title, body)
+ON CONFLICT (version) DO NOTHING;
+
+-- Aceites do termo pelo paciente, com a evidência do que foi aceito, quando e de onde
+CREATE TABLE IF NOT EXISTS patient_consents (
+  id SERIAL PRIMARY KEY,
+  patient_id INT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
+  term_id INT NOT NULL REFERENCES consent_terms(id),
+  term_version INT NOT NULL,
+  content_hash CHAR(64) NOT NULL,
+  consent_name VARCHAR(255) NOT NULL,
+  consent_cpf_rg VARCHAR(50) NOT NULL,
+  accepted_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  ip_address VARCHAR(64), -- IP do cliente (X-Forwarded-For apenas de proxies em TRUSTED_PROXIES)
+  remote_addr VARCHAR(64), -- Endereço da conexão recebida pelo servidor, como registrado
+  user_agent TEXT,
+  revoked_at TIMESTAMP WITH TIME ZONE,
+  revocation_reason TEXT,
+  revocation_ip VARCHAR(64),
+  revocation_remote_addr VARCHAR(64),
+  revocation_user_agent TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_patient_consents_patient ON patient_consents (patient_id, accepted_at);
+
+-- Comprovante em PDF de cada aceite, arquivado para que todo download entregue o mesmo arquivo
+CREATE TABLE IF NOT EXISTS consent_receipts (
+  id SERIAL PRIMARY KEY,
+  consent_id INT UNIQUE NOT NULL REFERENCES patient_consents(id) ON DELETE CASCADE,
+  patient_id INT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
+  verification_hash CHAR(64) NOT NULL, -- Código de verificação impresso no comprovante
+  pdf BYTEA NOT NULL,
+  pdf_sha256 CHAR(64) NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Ficha de anamnese preenchida pelo paciente no portal; as respostas só vão para patients após a revisão do terapeuta
+CREATE TABLE IF NOT EXISTS patient_intakes (
+  id SERIAL PRIMARY KEY,
+  patient_id INT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
+  status VARCHAR(20) NOT NULL DEFAULT 'rascunho' CHECK (status IN ('rascunho', 'enviado', 'devolvido', 'aprovado')),
+  data JSONB NOT NULL DEFAULT '{}',
+  submitted_at TIMESTAMP WITH TIME ZONE,
+  reviewed_by INT REFERENCES users(id) ON DELETE SET NULL,
+  reviewed_at TIMESTAMP WITH TIME ZONE,
+  review_notes TEXT,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+-- Cada paciente tem no máximo uma ficha em aberto
+CREATE UNIQUE INDEX IF NOT EXISTS idx_patient_intakes_open ON patient_intakes (patient_id) WHERE status <> 'aprovado';
+
+-- Modelos de nota de sessão (SOAP, DAP...) configurados pelo administrador. sections guarda as
+-- seções e os campos no mesmo formato das etapas da ficha de anamnese.
+CREATE TABLE IF NOT EXISTS note_templates (
+  id SERIAL PRIMARY KEY,
+  name VARCHAR(255) NOT NULL UNIQUE,
+  description TEXT,
+  sections JSONB NOT NULL,
+  active BOOLEAN NOT NULL DEFAULT TRUE,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO note_templates (name, description, sections) VALUES
+  ('SOAP', 'Subjetivo, Objetivo, Avaliação e Plano', '[
+    {"Title": "Subjetivo", "Fields": [
+      {"Name": "s1_f1", "Label": "Relato do paciente", "Kind": "textarea", "Required": true, "MaxLen": 5000},
+      {"Name": "s1_f2", "Label": "Humor referido (0-10)", "Kind": "level", "Max": 10}]},
+    {"Title": "Objetivo", "Fields": [
+      {"Name": "s2_f1", "Label": "Observações do terapeuta", "Kind": "textarea", "Required": true, "MaxLen": 5000},
+      {"Name": "s2_f2", "Label": "Aparência e comportamento", "Kind": "text", "MaxLen": 1000}]},
+    {"Title": "Avaliação", "Fields": [
+      {"Name": "s3_f1", "Label": "Análise clínica", "Kind": "textarea", "Required": true, "MaxLen": 5000},
+      {"Name": "s3_f2", "Label": "Risco", "Kind": "select", "Options": ["Baixo", "Moderado", "Alto"]}]},
+    {"Title": "Plano", "Fields": [
+      {"Name": "s4_f1", "Label": "Intervenções e próximos passos", "Kind": "textarea", "Required": true, "MaxLen": 5000},
+      {"Name": "s4_f2", "Label": "Tarefas para casa", "Kind": "textarea", "MaxLen": 5000}]}
+  ]'),
+  ('DAP', 'Dados, Avaliação e Plano', '[
+    {"Title": "Dados", "Fields": [
+      {"Name": "s1_f1", "Label": "O que o paciente trouxe e o que foi observado", "Kind": "textarea", "Required": true, "MaxLen": 5000}]},
+    {"Title": "Avaliação", "Fields": [
+      {"Name": "s2_f1", "Label": "Interpretação clínica e progresso", "Kind": "textarea", "Required": true, "MaxLen": 5000}]},
+    {"Title": "Plano", "Fields": [
+      {"Name": "s3_f1", "Label": "Próximos passos", "Kind": "textarea", "Required": true, "MaxLen": 5000},
+      {"Name": "s3_f2", "Label": "Encaminhamentos", "Kind": "text", "MaxLen": 1000}]}
+  ]')
+ON CONFLICT (name) DO NOTHING;
+
 CREATE TABLE IF NOT EXISTS patient_records (
     id SERIAL PRIMARY KEY, patient_id INT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
     doctor_id INT NOT NULL REFERENCES users(id), record_date TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
     anxiety_level INT, anger_level INT, fear_level INT, sadness_level INT, joy_level INT,
     energy_level INT, main_complaint TEXT, complaint_history TEXT, signs_symptoms TEXT,
-    current_treatment TEXT, notes TEXT, created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+    current_treatment TEXT, notes TEXT, created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    -- Adendo: correção de uma entrada assinada, gravada como nova entrada que aponta para a original
+    addendum_of INT REFERENCES patient_records(id),
+    -- Nota estruturada: o modelo usado e as respostas, com títulos e rótulos copiados do modelo
+    note_template_id INT REFERENCES note_templates(id),
+    note_data JSONB,
+    -- Assinatura do profissional: a partir daqui a entrada não pode mais ser alterada
+    signed_at TIMESTAMP WITH TIME ZONE,
+    signed_by INT REFERENCES users(id),
+    signature_hash CHAR(64),
+    CHECK ((signed_at IS NULL) = (signature_hash IS NULL) AND (signed_at IS NULL) = (signed_by IS NULL))
+);
+
+CREATE INDEX IF NOT EXISTS idx_patient_records_addendum ON patient_records (addendum_of) WHERE addendum_of IS NOT NULL;
+
+-- Entradas assinadas do prontuário são imutáveis: o banco recusa qualquer UPDATE ou DELETE nelas,
+-- inclusive vindo de fora da aplicação. Correções entram como adendos.
+CREATE OR REPLACE FUNCTION protect_signed_patient_records() RETURNS trigger AS $$
+BEGIN
+  IF OLD.signed_at IS NOT NULL THEN
+    RAISE EXCEPTION 'a entrada % do prontuário está assinada e não pode ser alterada nem removida', OLD.id;
+  END IF;
+  IF TG_OP = 'DELETE' THEN
+    RETURN OLD;
+  END IF;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER patient_records_immutable BEFORE UPDATE OR DELETE ON patient_records
+  FOR EACH ROW EXECUTE FUNCTION protect_signed_patient_records();
+
+-- Plano terapêutico: problemas trabalhados e metas mensuráveis, elaborado pelo terapeuta. Só um
+-- plano ativo por paciente; os concluídos e encerrados ficam como histórico.
+CREATE TABLE IF NOT EXISTS treatment_plans (
+  id SERIAL PRIMARY KEY,
+  patient_id INT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
+  doctor_id INT NOT NULL REFERENCES users(id),
+  problems TEXT NOT NULL,
+  status VARCHAR(20) NOT NULL DEFAULT 'ativo' CHECK (status IN ('ativo', 'concluido', 'encerrado')),
+  review_date DATE, -- Próxima revisão prevista do plano
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_treatment_plans_active ON treatment_plans (patient_id) WHERE status = 'ativo';
+
+-- Metas não são removidas: uma meta que deixa de fazer sentido é suspensa, preservando o progresso
+-- já registrado nas entradas do prontuário
+CREATE TABLE IF NOT EXISTS treatment_goals (
+  id SERIAL PRIMARY KEY,
+  plan_id INT NOT NULL REFERENCES treatment_plans(id) ON DELETE CASCADE,
+  description TEXT NOT NULL,
+  measure TEXT NOT NULL, -- Critério mensurável que indica que a meta foi atingida
+  interventions TEXT,
+  target_date DATE,
+  status VARCHAR(20) NOT NULL DEFAULT 'em_andamento' CHECK (status IN ('em_andamento', 'atingida', 'suspensa')),
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_treatment_goals_plan ON treatment_goals (plan_id);
+
+-- Progresso das metas registrado em cada entrada do prontuário (0 a 100%)
+CREATE TABLE IF NOT EXISTS record_goal_progress (
+  record_id INT NOT NULL REFERENCES patient_records(id) ON DELETE CASCADE,
+  goal_id INT NOT NULL REFERENCES treatment_goals(id),
+  progress INT NOT NULL CHECK (progress BETWEEN 0 AND 100),
+  note TEXT,
+  PRIMARY KEY (record_id, goal_id)
+);
+CREATE INDEX IF NOT EXISTS idx_record_goal_progress_goal ON record_goal_progress (goal_id);
+
+-- O progresso faz parte da entrada: depois da assinatura ele também não pode mudar
+CREATE OR REPLACE FUNCTION protect_signed_goal_progress() RETURNS trigger AS $$
+DECLARE
+  entry_id INT;
+BEGIN
+  IF TG_OP = 'INSERT' THEN
+    entry_id := NEW.record_id;
+  ELSE
+    entry_id := OLD.record_id;
+  END IF;
+  IF EXISTS (SELECT 1 FROM patient_records WHERE id = entry_id AND signed_at IS NOT NULL) THEN
+    RAISE EXCEPTION 'a entrada % do prontuário está assinada; o progresso das metas não pode ser alterado', entry_id;
+  END IF;
+  IF TG_OP = 'DELETE' THEN
+    RETURN OLD;
+  END IF;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER record_goal_progress_immutable BEFORE INSERT OR UPDATE OR DELETE ON record_goal_progress
+  FOR EACH ROW EXECUTE FUNCTION protect_signed_goal_progress();
+
+-- Arquivos anexados ao prontuário. O conteúdo fica no armazenamento de anexos (disco ou S3), sob
+-- storage_key; o tipo é o identificado pelo conteúdo do arquivo. A exclusão remove o arquivo, mas a
+-- linha fica, com quem excluiu e quando, para a trilha de auditoria.
+CREATE TABLE IF NOT EXISTS patient_attachments (
+  id SERIAL PRIMARY KEY,
+  patient_id INT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
+  uploaded_by INT NOT NULL REFERENCES users(id),
+  category VARCHAR(20) NOT NULL DEFAULT 'outro' CHECK (category IN ('encaminhamento', 'exame', 'desenho', 'outro')),
+  description TEXT,
+  file_name VARCHAR(255) NOT NULL, -- Nome original, só para exibição e download
+  content_type VARCHAR(100) NOT NULL,
+  size_bytes BIGINT NOT NULL CHECK (size_bytes > 0),
+  sha256 CHAR(64) NOT NULL,
+  storage_key VARCHAR(255) UNIQUE NOT NULL,
+  scan_status VARCHAR(20) NOT NULL CHECK (scan_status IN ('limpo', 'nao_verificado')),
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  deleted_at TIMESTAMP WITH TIME ZONE,
+  deleted_by INT REFERENCES users(id),
+  CHECK ((deleted_at IS NULL) = (deleted_by IS NULL))
+);
+CREATE INDEX IF NOT EXISTS idx_patient_attachments_patient ON patient_attachments (patient_id) WHERE deleted_at IS NULL;
+
+-- Catálogo de tipos de sessão: duração e preço padrão de cada serviço
+CREATE TABLE IF NOT EXISTS service_types (
+  id SERIAL PRIMARY KEY,
+  name VARCHAR(255) NOT NULL,
+  duration_minutes INT NOT NULL CHECK (duration_minutes > 0),
+  default_price NUMERIC(10, 2) NOT NULL DEFAULT 0.00,
+  active BOOLEAN NOT NULL DEFAULT TRUE,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Preço diferenciado de um serviço para um terapeuta específico
+CREATE TABLE IF NOT EXISTS therapist_service_prices (
+  doctor_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  service_type_id INT NOT NULL REFERENCES service_types(id) ON DELETE CASCADE,
+  price NUMERIC(10, 2) NOT NULL,
+  PRIMARY KEY (doctor_id, service_type_id)
+);
+
+INSERT INTO service_types (name, duration_minutes, default_price) VALUES
+  ('Sessão individual', 50, 150.00),
+  ('Sessão de casal', 90, 250.00),
+  ('Avaliação', 60, 200.00);
+
+-- Série de consultas recorrentes; cada ocorrência é gravada como uma linha em 'appointments'
+CREATE TABLE IF NOT EXISTS appointment_series (
+  id SERIAL PRIMARY KEY,
+  patient_id INT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
+  doctor_id INT NOT NULL REFERENCES users(id),
+  frequency VARCHAR(20) NOT NULL CHECK (frequency IN ('semanal', 'quinzenal', 'mensal')),
+  first_start TIMESTAMP WITH TIME ZONE NOT NULL,
+  until_date DATE,
+  occurrence_count INT,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  CHECK (until_date IS NOT NULL OR occurrence_count IS NOT NULL)
 );
 
 CREATE TABLE IF NOT EXISTS appointments (
   id SERIAL PRIMARY KEY, patient_id INT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
   doctor_id INT NOT NULL REFERENCES users(id), start_time TIMESTAMP WITH TIME ZONE NOT NULL,
   end_time TIMESTAMP WITH TIME ZONE NOT NULL, notes TEXT,
-  status VARCHAR(50) NOT NULL CHECK (status IN ('agendado', 'concluido', 'cancelado')),
+  series_id INT REFERENCES appointment_series(id) ON DELETE SET NULL,
+  service_type_id INT REFERENCES service_types(id),
+  duration_minutes INT,
+  status VARCHAR(50) NOT NULL CHECK (status IN ('pre_agendado', 'agendado', 'pendente_confirmacao', 'concluido', 'cancelado', 'cancelado_tardio', 'faltou')),
+  hold_expires_at TIMESTAMP WITH TIME ZONE, -- Pedido de agendamento online ('pre_agendado'): reserva válida até este momento
   price NUMERIC(10, 2) DEFAULT 0.00,
   payment_status VARCHAR(50) NOT NULL DEFAULT 'pendente' CHECK (payment_status IN ('pendente', 'pago', 'isento')),
+  fee_charged BOOLEAN NOT NULL DEFAULT FALSE, -- O valor em 'price' é uma taxa de falta/cancelamento tardio
+  ical_sequence INT NOT NULL DEFAULT 0, -- SEQUENCE do evento iCalendar (RFC 5545)
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  CHECK (end_time > start_time),
+  -- Impede que o mesmo terapeuta ou o mesmo paciente tenham duas consultas ativas no mesmo intervalo.
+  -- DEFERRABLE permite deslocar várias ocorrências de uma série na mesma transação.
+  CONSTRAINT appointments_doctor_no_overlap EXCLUDE USING gist (
+    doctor_id WITH =, tstzrange(start_time, end_time) WITH &&
+  ) WHERE (status NOT IN ('cancelado', 'cancelado_tardio')) DEFERRABLE INITIALLY IMMEDIATE,
+  CONSTRAINT appointments_patient_no_overlap EXCLUDE USING gist (
+    patient_id WITH =, tstzrange(start_time, end_time) WITH &&
+  ) WHERE (status NOT IN ('cancelado', 'cancelado_tardio')) DEFERRABLE INITIALLY IMMEDIATE
+);
+
+CREATE INDEX IF NOT EXISTS idx_appointments_series ON appointments (series_id, start_time);
+
+-- Incrementa o SEQUENCE do iCalendar sempre que horário, terapeuta ou status mudam,
+-- para que as agendas assinadas atualizem o evento em vez de duplicá-lo.
+CREATE OR REPLACE FUNCTION bump_appointment_ical_sequence() RETURNS trigger AS $$
+BEGIN
+  IF NEW.start_time IS DISTINCT FROM OLD.start_time OR NEW.end_time IS DISTINCT FROM OLD.end_time
+     OR NEW.doctor_id IS DISTINCT FROM OLD.doctor_id OR NEW.status IS DISTINCT FROM OLD.status THEN
+    NEW.ical_sequence := OLD.ical_sequence + 1;
+  END IF;
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER appointments_ical_sequence BEFORE UPDATE ON appointments
+  FOR EACH ROW EXECUTE FUNCTION bump_appointment_ical_sequence();
+
+-- Check-in do paciente antes da sessão: as seis escalas emocionais do prontuário e um texto livre
+CREATE TABLE IF NOT EXISTS session_checkins (
+  id SERIAL PRIMARY KEY,
+  -- O check-in é dado clínico: sobrevive à exclusão da consulta, guardando a data e o terapeuta dela
+  appointment_id INT UNIQUE REFERENCES appointments(id) ON DELETE SET NULL,
+  patient_id INT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
+  session_start TIMESTAMP WITH TIME ZONE NOT NULL,
+  doctor_id INT REFERENCES users(id) ON DELETE SET NULL,
+  anxiety_level INT NOT NULL CHECK (anxiety_level BETWEEN 0 AND 10),
+  anger_level INT NOT NULL CHECK (anger_level BETWEEN 0 AND 10),
+  fear_level INT NOT NULL CHECK (fear_level BETWEEN 0 AND 10),
+  sadness_level INT NOT NULL CHECK (sadness_level BETWEEN 0 AND 10),
+  joy_level INT NOT NULL CHECK (joy_level BETWEEN 0 AND 10),
+  energy_level INT NOT NULL CHECK (energy_level BETWEEN 0 AND 10),
+  notes TEXT,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_session_checkins_patient ON session_checkins (patient_id);
+
+-- Escalas padronizadas (PHQ-9, GAD-7): aplicadas pelo terapeuta na sessão ou enviadas ao paciente
+-- para responder no portal. A pontuação e a gravidade são gravadas no momento da resposta.
+CREATE TABLE IF NOT EXISTS questionnaire_responses (
+  id SERIAL PRIMARY KEY,
+  patient_id INT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
+  questionnaire VARCHAR(20) NOT NULL, -- Código do instrumento: phq9, gad7
+  status VARCHAR(20) NOT NULL DEFAULT 'pendente' CHECK (status IN ('pendente', 'respondido')),
+  source VARCHAR(20) NOT NULL CHECK (source IN ('sessao', 'portal')),
+  requested_by INT REFERENCES users(id) ON DELETE SET NULL,
+  answers JSONB, -- Pontos de cada item, na ordem do instrumento
+  score INT,
+  severity VARCHAR(50),
+  alert BOOLEAN NOT NULL DEFAULT FALSE, -- Item crítico pontuado (ex.: item 9 do PHQ-9)
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  completed_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS idx_questionnaire_responses_patient ON questionnaire_responses (patient_id, completed_at);
+
+-- Lembretes de consulta: uma linha por consulta/horário/lembrete/canal garante que nada é enviado
+-- duas vezes. Como o horário faz parte da chave, uma consulta remarcada recebe os lembretes de novo.
+CREATE TABLE IF NOT EXISTS notification_deliveries (
+  id SERIAL PRIMARY KEY,
+  appointment_id INT NOT NULL REFERENCES appointments(id) ON DELETE CASCADE,
+  start_time TIMESTAMP WITH TIME ZONE NOT NULL, -- Início da consulta para o qual o lembrete foi enviado
+  reminder VARCHAR(20) NOT NULL, -- Antecedência do lembrete, ex.: '48h', '2h'
+  channel VARCHAR(20) NOT NULL, -- email, sms, whatsapp ou log
+  recipient VARCHAR(255),
+  status VARCHAR(20) NOT NULL CHECK (status IN ('enviando', 'enviado', 'falhou', 'sem_contato')),
+  attempts INT NOT NULL DEFAULT 0,
+  last_error TEXT,
+  last_attempt_at TIMESTAMP WITH TIME ZONE,
+  sent_at TIMESTAMP WITH TIME ZONE,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (appointment_id, start_time, reminder, channel)
+);
+
+-- Lista de espera: pacientes que aceitam antecipar a consulta se um horário for liberado
+CREATE TABLE IF NOT EXISTS waitlist_entries (
+  id SERIAL PRIMARY KEY,
+  patient_id INT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
+  doctor_id INT REFERENCES users(id) ON DELETE CASCADE, -- NULL = qualquer terapeuta
+  service_type_id INT REFERENCES service_types(id),
+  priority INT NOT NULL DEFAULT 2 CHECK (priority BETWEEN 1 AND 3), -- 1 = alta, 2 = normal, 3 = baixa
+  notes TEXT,
+  status VARCHAR(20) NOT NULL DEFAULT 'aguardando' CHECK (status IN ('aguardando', 'atendido', 'removido')),
   created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
   updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Dias e horários aceitos pelo paciente; entradas sem janela aceitam qualquer horário
+CREATE TABLE IF NOT EXISTS waitlist_windows (
+  id SERIAL PRIMARY KEY,
+  entry_id INT NOT NULL REFERENCES waitlist_entries(id) ON DELETE CASCADE,
+  weekday INT NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+  start_time TIME NOT NULL,
+  end_time TIME NOT NULL,
+  CHECK (end_time > start_time)
+);
+
+-- Horários liberados por cancelamento que combinam com uma entrada da lista de espera
+CREATE TABLE IF NOT EXISTS waitlist_offers (
+  id SERIAL PRIMARY KEY,
+  entry_id INT NOT NULL REFERENCES waitlist_entries(id) ON DELETE CASCADE,
+  freed_appointment_id INT NOT NULL REFERENCES appointments(id) ON DELETE CASCADE,
+  doctor_id INT NOT NULL REFERENCES users(id),
+  start_time TIMESTAMP WITH TIME ZONE NOT NULL,
+  end_time TIMESTAMP WITH TIME ZONE NOT NULL,
+  status VARCHAR(20) NOT NULL DEFAULT 'pendente' CHECK (status IN ('pendente', 'aceita', 'descartada')),
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (entry_id, freed_appointment_id)
+);
+
+CREATE TABLE IF NOT EXISTS therapist_availability (
+  id SERIAL PRIMARY KEY,
+  doctor_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  weekday INT NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+  start_time TIME NOT NULL,
+  end_time TIME NOT NULL,
+  block_type VARCHAR(20) NOT NULL DEFAULT 'trabalho' CHECK (block_type IN ('trabalho', 'intervalo')),
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  CHECK (end_time > start_time)
+);
+
+CREATE TABLE IF NOT EXISTS therapist_availability_exceptions (
+  id SERIAL PRIMARY KEY,
+  doctor_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  start_date DATE NOT NULL,
+  end_date DATE NOT NULL,
+  start_time TIME, -- NULL = dia inteiro indisponível
+  end_time TIME,
+  reason VARCHAR(255),
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  CHECK (end_date >= start_date)
+);
+
 CREATE TABLE IF NOT EXISTS audit_logs (
   id SERIAL PRIMARY KEY,
   user_id INT,
@@ -85,8 +527,8 @@ CREATE TABLE IF NOT EXISTS audit_logs (
 `
 // newDBConnection agora aceita os parâmetros de conexão diretamente.
 func newDBConnection(dbHost, dbPort, dbUser, dbPass, dbName string) (*sql.DB, error) {
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		dbHost, dbPort, dbUser, dbPass, dbName)
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable timezone=%s",
+		dbHost, dbPort, dbUser, dbPass, dbName, storage.ClinicLocation().String())
 
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
@@ -367,15 +809,21 @@ func populateData(db *sql.DB, patientCount int) error {
             mental_disorder, mental_disorder_treatment, mental_disorder_details, 
             medication, medication_details, surgery, allergies,
             anxiety_level, anger_level, fear_level, sadness_level, joy_level, energy_level,  
-            main_complaint, complaint_history, signs_symptoms, current_treatment, notes,
-            access_token  
-        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33)
+            main_complaint, complaint_history, signs_symptoms, current_treatment, notes
+        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32)
         RETURNING id`)
 	if err != nil {
 		return err
 	}
 	defer patientStmt.Close()
 
+	// Link de consentimento de cada paciente, válido por uma semana
+	tokenStmt, err := tx.Prepare(`INSERT INTO portal_tokens (patient_id, token, purpose, single_use, expires_at) VALUES ($1, $2, 'consentimento', TRUE, $3)`)
+	if err != nil {
+		return err
+	}
+	defer tokenStmt.Close()
+
 	// --- NOVA PREPARED STATEMENT PARA O HISTÓRICO ---
 	recordStmt, err := tx.Prepare(`
 		INSERT INTO patient_records (
@@ -388,12 +836,26 @@ func populateData(db *sql.DB, patientCount int) error {
 	}
 	defer recordStmt.Close()
 
-	appointmentStmt, err := tx.Prepare(`INSERT INTO appointments (patient_id, doctor_id, start_time, end_time, status) VALUES ($1, $2, $3, $4, $5)`)
+	// As consultas de teste usam o primeiro tipo de sessão do catálogo (sessão individual)
+	var serviceTypeID, serviceDuration int
+	var servicePrice float64
+	err = tx.QueryRow("SELECT id, duration_minutes, default_price FROM service_types ORDER BY id LIMIT 1").Scan(&serviceTypeID, &serviceDuration, &servicePrice)
+	if err != nil {
+		return fmt.Errorf("erro ao buscar tipo de sessão padrão: %w", err)
+	}
+
+	appointmentStmt, err := tx.Prepare(`INSERT INTO appointments (patient_id, doctor_id, start_time, end_time, status, service_type_id, duration_minutes, price) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`)
 	if err != nil {
 		return err
 	}
 	defer appointmentStmt.Close()
 
+	// Horários já ocupados por terapeuta, para respeitar a restrição de sobreposição da agenda
+	usedSlots := make(map[string]bool)
+	// As consultas de exemplo caem entre 8h e 18h no fuso da clínica
+	now := time.Now().In(storage.ClinicLocation())
+	baseDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
 	for i := 0; i < patientCount; i++ {
 		nomeCompleto := fmt.Sprintf("%s %s", nomes[rand.Intn(len(nomes))], sobrenomes[rand.Intn(len(sobrenomes))])
 		email := fmt.Sprintf("paciente.%d@example.com", i+1)
@@ -434,13 +896,14 @@ func populateData(db *sql.DB, patientCount int) error {
 			sinaisSintomas,
 			tratamentoAtual,
 			notasMedico,
-			// Token (1)
-			token,
 		).Scan(&patientID)
 
 		if err != nil {
 			return fmt.Errorf("erro ao inserir paciente #%d: %w", i+1, err)
 		}
+		if _, err := tokenStmt.Exec(patientID, token, time.Now().AddDate(0, 0, 7)); err != nil {
+			return fmt.Errorf("erro ao emitir link do portal para o paciente #%d: %w", i+1, err)
+		}
 
 		// --- INSERIR O REGISTRO INICIAL NO HISTÓRICO ---
 		doctorID := doctorIDs[rand.Intn(len(doctorIDs))]
@@ -454,8 +917,16 @@ func populateData(db *sql.DB, patientCount int) error {
 		}
 		// --- FIM DA INSERÇÃO DO HISTÓRICO ---
 
-		consultaData := time.Now().AddDate(0, 0, 7+rand.Intn(60))
-		_, err = appointmentStmt.Exec(patientID, doctorID, consultaData, consultaData.Add(1*time.Hour), "agendado")
+		var consultaData time.Time
+		for {
+			consultaData = baseDay.AddDate(0, 0, 7+rand.Intn(60)).Add(time.Duration(8+rand.Intn(10)) * time.Hour)
+			slotKey := fmt.Sprintf("%d-%s", doctorID, consultaData.Format(time.RFC3339))
+			if !usedSlots[slotKey] {
+				usedSlots[slotKey] = true
+				break
+			}
+		}
+		_, err = appointmentStmt.Exec(patientID, doctorID, consultaData, consultaData.Add(time.Duration(serviceDuration)*time.Minute), "agendado", serviceTypeID, serviceDuration, servicePrice)
 		if err != nil {
 			return fmt.Errorf("erro ao inserir consulta para o paciente #%d: %w", i+1, err)
 		}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/json"
 	"log"
 	"math"
 	"net/http"
@@ -35,6 +36,12 @@ type MonitoringData struct {
 	PendingConsentPatients []PendingConsentPatient
     TotalRevenue         float64 // Faturamento Total no Período
     PendingPaymentsValue float64 // Valor a Receber	
+    NoShowCount          int     // Faltas no período
+    LateCancelCount      int     // Cancelamentos tardios no período
+    NoShowRate           float64 // Faltas sobre o total de sessões realizadas ou perdidas (%)
+    PendingConfirmationCount int // Sessões passadas aguardando confirmação
+    RemindersSent        int     // Lembretes enviados no período
+    RemindersFailed      int     // Lembretes que falharam ou não tinham contato no período
 }
 
 // --- Funções de Gestão de Utilizadores ---
@@ -172,7 +179,7 @@ func (h *AdminHandler) DeleteUser(c *gin.Context) {
 
 	// Verificação 2: Checar se o usuário tem agendamentos (não cancelados).
 	var appointmentCount int
-	appointmentQuery := `SELECT COUNT(*) FROM appointments WHERE doctor_id = $1 AND status != 'cancelado'`
+	appointmentQuery := `SELECT COUNT(*) FROM appointments WHERE doctor_id = $1 AND status NOT IN ('cancelado', 'cancelado_tardio')`
 	err = h.DB.QueryRow(appointmentQuery, id).Scan(&appointmentCount)
 
 	// Se houver agendamentos, bloqueia a exclusão e informa o usuário.
@@ -215,7 +222,7 @@ func (h *AdminHandler) ViewPatients(c *gin.Context) {
 	pageSize := 10
 	offset := (page - 1) * pageSize
 
-	query := `SELECT id, name, email, phone, consent_given_at, access_token FROM patients WHERE deleted_at IS NULL`
+	query := `SELECT id, name, email, phone, consent_given_at, ` + activePortalTokenSQL + ` FROM patients WHERE deleted_at IS NULL`
 	countQuery := `SELECT COUNT(*) FROM patients WHERE deleted_at IS NULL`
 
 	var args []interface{}
@@ -332,13 +339,6 @@ func (h *AdminHandler) PostNewPatient(c *gin.Context) {
 		return
 	}
 
-	token, err := generateSecureToken(32)
-	if err != nil {
-		log.Printf("Erro ao gerar token seguro: %v", err)
-		c.Redirect(http.StatusFound, "/admin/patients")
-		return
-	}
-
 	tx, err := h.DB.Begin()
 	if err != nil {
 		log.Printf("Erro ao iniciar transação: %v", err)
@@ -352,8 +352,8 @@ func (h *AdminHandler) PostNewPatient(c *gin.Context) {
 		name, email, phone, mobile, dob, age, profession,
 		anxiety_level, anger_level, fear_level, sadness_level, joy_level, energy_level,
 		main_complaint, complaint_history, signs_symptoms, current_treatment, notes,
-		created_at, updated_at, access_token
-	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
+		created_at, updated_at
+	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)
 	RETURNING id`
 
 	var patientID int
@@ -361,7 +361,7 @@ func (h *AdminHandler) PostNewPatient(c *gin.Context) {
 		patient.Name, patient.Email, patient.Phone, patient.Mobile, toDate(patient.DOB), patient.Age, patient.Profession,
 		patient.AnxietyLevel, patient.AngerLevel, patient.FearLevel, patient.SadnessLevel, patient.JoyLevel, patient.EnergyLevel,
 		patient.MainComplaint, patient.ComplaintHistory, patient.SignsSymptoms, patient.CurrentTreatment, patient.Notes,
-		time.Now(), time.Now(), token,
+		time.Now(), time.Now(),
 	).Scan(&patientID)
 
 	if err != nil {
@@ -394,11 +394,22 @@ func (h *AdminHandler) PostNewPatient(c *gin.Context) {
 		return
 	}
 
+	// 3. Emitir o link de consentimento do portal
+	defaults := portalTokenDefaults[tokenPurposeConsent]
+	token, err := issuePortalToken(tx, patientID, tokenPurposeConsent, defaults.Validity, defaults.SingleUse, sessionUserID(c))
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Erro ao emitir link do portal do novo paciente: %v", err)
+		c.Redirect(http.StatusFound, "/admin/patients")
+		return
+	}
+
 	if err := tx.Commit(); err != nil {
 		log.Printf("Erro ao comitar a transação: %v", err)
 		c.Redirect(http.StatusFound, "/admin/patients")
 		return
 	}
+	auditPortalTokenIssued(h.DB, c, token)
 
 	c.Redirect(http.StatusFound, "/admin/patients")
 }
@@ -411,14 +422,30 @@ type PendingConsentPatient struct {
 }
 // Estrutura para passar todos os dados necessários para o template
 type PatientEditPageData struct {
-	Title        string
-	Action       string
-	IsNew        bool
-	ActiveNav    string
-	Patient      storage.Patient
-	LatestRecord storage.PatientRecord   // O registro mais recente para preencher o formulário
-	History      []storage.PatientRecord // Todos os registros para exibir na lista de histórico
-	UserType     string // <-- CAMPO ADICIONADO	
+	Title            string
+	Action           string
+	IsNew            bool
+	ActiveNav        string
+	Patient          storage.Patient
+	LatestRecord     storage.PatientRecord           // O registro mais recente para preencher o formulário
+	History          []storage.PatientRecord         // Todos os registros para exibir na lista de histórico
+	Checkins         []storage.SessionCheckin        // Check-ins respondidos pelo paciente antes das sessões
+	Questionnaires   []storage.QuestionnaireResponse // Escalas padronizadas aplicadas ou pendentes
+	Instruments      []Questionnaire                 // Escalas disponíveis para aplicar ou enviar
+	NoteTemplates    []NoteTemplate                  // Modelos de nota ativos, para escolher no formulário
+	NoteTemplateID   int                             // Modelo em uso no formulário (0 = texto livre)
+	NoteTemplateName string
+	NoteSections     []NoteSectionView
+	TreatmentPlan    *storage.TreatmentPlan // Plano terapêutico ativo, se houver
+	GoalInputs       []GoalProgressInput    // Metas em andamento, para registrar o progresso da sessão
+	LevelCharts      []LevelChart     // Evolução de cada nível emocional por sessão
+	LevelFilter      LevelSeriesQuery // Período e média móvel dos gráficos
+	LevelFilterError string
+	Attachments      []storage.PatientAttachment // Arquivos anexados ao prontuário
+	ErrorFlashes     []interface{}
+	SuccessFlashes   []interface{}
+	UserType         string // <-- CAMPO ADICIONADO	
+	UserID           int // Terapeuta logado, para as ações permitidas só a quem criou o item
 }
 
 // handlers/admin_handlers.go
@@ -478,39 +505,66 @@ func GetPatientDataForForm(db *sql.DB, patientID int) (PatientEditPageData, erro
 	if consentGivenAt.Valid { pageData.Patient.ConsentGivenAt = consentGivenAt }
 
 
-	// 2. Buscar o registro clínico MAIS RECENTE
+	// 2. Buscar o registro clínico MAIS RECENTE (adendos não contam: só corrigem uma entrada anterior)
 	latestRecordQuery := `SELECT id, patient_id, doctor_id, record_date, anxiety_level, anger_level, fear_level, sadness_level, 
-		joy_level, energy_level, main_complaint, complaint_history, signs_symptoms, current_treatment, notes
-		FROM patient_records WHERE patient_id = $1 ORDER BY record_date DESC LIMIT 1`
+		joy_level, energy_level, main_complaint, complaint_history, signs_symptoms, current_treatment, notes, note_data::text
+		FROM patient_records WHERE patient_id = $1 AND addendum_of IS NULL ORDER BY record_date DESC LIMIT 1`
 	
+	var latestNote sql.NullString
 	err = db.QueryRow(latestRecordQuery, patientID).Scan(
 		&pageData.LatestRecord.ID, &pageData.LatestRecord.PatientID, &pageData.LatestRecord.DoctorID, &pageData.LatestRecord.RecordDate,
 		&pageData.LatestRecord.AnxietyLevel, &pageData.LatestRecord.AngerLevel, &pageData.LatestRecord.FearLevel, &pageData.LatestRecord.SadnessLevel,
 		&pageData.LatestRecord.JoyLevel, &pageData.LatestRecord.EnergyLevel, &pageData.LatestRecord.MainComplaint, &pageData.LatestRecord.ComplaintHistory,
-		&pageData.LatestRecord.SignsSymptoms, &pageData.LatestRecord.CurrentTreatment, &pageData.LatestRecord.Notes,
+		&pageData.LatestRecord.SignsSymptoms, &pageData.LatestRecord.CurrentTreatment, &pageData.LatestRecord.Notes, &latestNote,
 	)
 	if err != nil && err != sql.ErrNoRows {
 		log.Printf("Erro ao buscar último registro do paciente: %v", err)
 	}
+	if latestNote.Valid {
+		pageData.LatestRecord.Note = &storage.StructuredNote{}
+		if err := json.Unmarshal([]byte(latestNote.String), pageData.LatestRecord.Note); err != nil {
+			log.Printf("Erro ao ler a nota estruturada do último registro: %v", err)
+			pageData.LatestRecord.Note = nil
+		}
+	}
 
-	// 3. Buscar TODO o histórico de registros
-	historyQuery := `SELECT r.id, r.record_date, u.name as doctor_name,
-		r.main_complaint, r.complaint_history, r.signs_symptoms, r.current_treatment, r.notes,
-		r.anxiety_level, r.anger_level, r.fear_level, r.sadness_level, r.joy_level, r.energy_level
-		FROM patient_records r JOIN users u ON r.doctor_id = u.id
-		WHERE r.patient_id = $1 ORDER BY r.record_date DESC`
-
-	rows, err := db.Query(historyQuery, patientID)
+	// 3. Buscar TODO o histórico de registros, com assinaturas e adendos
+	pageData.History, err = loadPatientRecordHistory(db, patientID)
 	if err != nil {
 		log.Printf("Erro ao buscar histórico do paciente: %v", err)
-	} else {
-		defer rows.Close()
-		for rows.Next() {
-			var rec storage.PatientRecord
-			if err := rows.Scan(&rec.ID, &rec.RecordDate, &rec.DoctorName, &rec.MainComplaint, &rec.ComplaintHistory, &rec.SignsSymptoms, &rec.CurrentTreatment, &rec.Notes, &rec.AnxietyLevel, &rec.AngerLevel, &rec.FearLevel, &rec.SadnessLevel, &rec.JoyLevel, &rec.EnergyLevel); err == nil {
-				pageData.History = append(pageData.History, rec)
-			}
+	}
+
+	// 4. Buscar os check-ins que o paciente respondeu no portal antes das sessões
+	pageData.Checkins, err = loadPatientCheckins(db, patientID)
+	if err != nil {
+		log.Printf("Erro ao buscar check-ins do paciente: %v", err)
+	}
+
+	// 5. Buscar as escalas padronizadas (PHQ-9, GAD-7) ao longo do tempo
+	pageData.Instruments = questionnaires
+	pageData.Questionnaires, err = loadPatientQuestionnaires(db, patientID)
+	if err != nil {
+		log.Printf("Erro ao buscar escalas do paciente: %v", err)
+	}
+
+	// 6. Buscar o plano terapêutico ativo; o progresso das metas vem do rascunho mais recente, se houver
+	plan, err := loadActiveTreatmentPlan(db, patientID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Erro ao buscar plano terapêutico do paciente: %v", err)
+	}
+	if err == nil {
+		var draft []storage.GoalProgress
+		if len(pageData.History) > 0 && !pageData.History[0].SignedAt.Valid {
+			draft = pageData.History[0].GoalProgress
 		}
+		pageData.TreatmentPlan = &plan
+		pageData.GoalInputs = goalProgressInputs(plan, draft)
+	}
+
+	// 7. Buscar os arquivos anexados ao prontuário
+	pageData.Attachments, err = loadPatientAttachments(db, patientID)
+	if err != nil {
+		log.Printf("Erro ao buscar anexos do paciente: %v", err)
 	}
 
 	return pageData, nil
@@ -531,6 +585,12 @@ func (h *AdminHandler) GetEditPatientForm(c *gin.Context) {
 	pageData.Action = "/admin/patients/edit/" + idStr
 	pageData.ActiveNav = "patients"
 	pageData.UserType = "admin" // <-- LINHA ADICIONADA AQUI
+	setRecordNoteForm(h.DB, &pageData, c.Query("modelo"))
+	setLevelCharts(h.DB, &pageData, c.Query)
+	session := sessions.Default(c)
+	pageData.ErrorFlashes = session.Flashes("error")
+	pageData.SuccessFlashes = session.Flashes("success")
+	session.Save()
 
 	c.HTML(http.StatusOK, "admin/patient_form.html", pageData)
 }
@@ -583,35 +643,15 @@ func (h *AdminHandler) PostEditPatient(c *gin.Context) {
 		log.Printf("Erro ao atualizar dados do paciente na tabela 'patients': %v", err)
 	}
 
-	// 2. INSERIR o mesmo registro na tabela de histórico 'patient_records'
+	// 2. Gravar a entrada do histórico 'patient_records' (rascunho, ou assinada se o usuário escolheu assinar)
 	session := sessions.Default(c)
 	userID := session.Get("user_id").(int)
 
-	queryRecords := `
-		INSERT INTO patient_records (
-			patient_id, doctor_id, anxiety_level, anger_level, fear_level, sadness_level, 
-			joy_level, energy_level, main_complaint, complaint_history, signs_symptoms, 
-			current_treatment, notes, record_date
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`
-
-	_, err = h.DB.Exec(queryRecords,
-		patientID, userID, anxiety, anger, fear, sadness, joy, energy,
-		c.PostForm("main_complaint"), c.PostForm("complaint_history"), c.PostForm("signs_symptoms"),
-		c.PostForm("current_treatment"), c.PostForm("notes"), time.Now())
-
-	if err != nil {
-		log.Printf("Erro ao inserir novo registro de prontuário (admin): %v", err)
-	} else {
-		// ADICIONE A CHAMADA DE LOG AQUI
-		logInfo := LogAction{
-			DB:         h.DB,
-			Context:    c,
-			Action:     "Adicionou nova entrada ao prontuário",
-			TargetType: "Paciente",
-			TargetID:   patientID,
-		}
-		AddAuditLog(logInfo)
-	}
+	saveRecordEntry(h.DB, c, patientID, userID, storage.PatientRecord{
+		AnxietyLevel: anxiety, AngerLevel: anger, FearLevel: fear, SadnessLevel: sadness, JoyLevel: joy, EnergyLevel: energy,
+		MainComplaint: c.PostForm("main_complaint"), ComplaintHistory: c.PostForm("complaint_history"),
+		SignsSymptoms: c.PostForm("signs_symptoms"), CurrentTreatment: c.PostForm("current_treatment"), Notes: c.PostForm("notes"),
+	})
 
 	c.Redirect(http.StatusFound, "/admin/patients/edit/"+idStr)
 }
@@ -645,7 +685,7 @@ func toDate(dateStr string) interface{} {
     if dateStr == "" {
         return nil
     }
-    t, err := time.Parse("2006-01-02", dateStr)
+    t, err := parseClinicDate(dateStr)
     if err != nil {
         return nil
     }
@@ -735,6 +775,16 @@ func (h *AdminHandler) GetPatientProfile(c *gin.Context) {
 		return
 	}
 
+	session := sessions.Default(c)
+	errorFlashes := session.Flashes("error")
+	successFlashes := session.Flashes("success")
+	session.Save()
+
+	noShows, lateCancels, err := noShowCounts(h.DB, patientID)
+	if err != nil {
+		log.Printf("Erro ao contar faltas do paciente: %v", err)
+	}
+
 	// Busca agendamentos futuros (que têm preço)
 	futureAppointments, err := h.getAppointmentsByTime(patientID, ">=")
 	if err != nil {
@@ -760,13 +810,29 @@ func (h *AdminHandler) GetPatientProfile(c *gin.Context) {
 		}
 	}
 
+	serviceTypes, err := loadServiceTypes(h.DB, true)
+	if err != nil {
+		log.Printf("Erro ao buscar tipos de sessão: %v", err)
+	}
+
+	consents, err := loadPatientConsents(h.DB, patientID)
+	if err != nil {
+		log.Printf("Erro ao buscar aceites do termo de consentimento: %v", err)
+	}
+
 	c.HTML(http.StatusOK, "admin/patient_profile.html", gin.H{
 		"Title":              "Perfil de " + patient.Name,
 		"Patient":            patient,
 		"FutureAppointments": futureAppointments,
 		"PastAppointments":   pastAppointments,
 		"Doctors":            doctors,
+		"ServiceTypes":       serviceTypes,
+		"NoShowCount":        noShows,
+		"LateCancelCount":    lateCancels,
+		"Consents":           consents,
 		"ActiveNav":          "patients",
+		"ErrorFlashes":       errorFlashes,
+		"SuccessFlashes":     successFlashes,
 	})
 }
 
@@ -785,24 +851,91 @@ func (h *AdminHandler) PostNewAppointment(c *gin.Context) {
     doctorID, _ := strconv.Atoi(doctorIDStr)
 	price, _ := strconv.ParseFloat(priceStr, 64)
 		
-    startTime, err := time.Parse("2006-01-02 15:04", dateStr+" "+timeStr)
+    startTime, err := parseClinicDateTime(dateStr, timeStr)
     if err != nil {
+        if err == errNonexistentLocalTime {
+            session := sessions.Default(c)
+            session.AddFlash(err.Error(), "error")
+            session.Save()
+        }
         log.Printf("Erro ao converter data/hora do agendamento: %v", err)
         c.Redirect(http.StatusFound, "/admin/patients/profile/"+patientIDStr)
         return
     }
-    endTime := startTime.Add(1 * time.Hour)
+
+	session := sessions.Default(c)
+
+	// A duração e o preço vêm do tipo de sessão escolhido; um valor digitado no formulário prevalece
+	service, err := serviceFromForm(h.DB, c, doctorID)
+	if err != nil {
+		log.Printf("Erro ao carregar tipo de sessão (admin): %v", err)
+		session.AddFlash("Tipo de sessão inválido.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/admin/patients/profile/"+patientIDStr)
+		return
+	}
+	endTime := startTime.Add(service.Duration)
+	if priceStr == "" {
+		price = service.Price
+	}
 
     if status == "agendado" && startTime.Before(time.Now()) {
         status = "concluido"
     }
 
-	// NOVO: Query agora inclui a coluna 'price'
-	query := `INSERT INTO appointments (patient_id, doctor_id, start_time, end_time, status, notes, price, created_at, updated_at) 
-			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
-	_, err = h.DB.Exec(query, patientID, doctorID, startTime, endTime, status, notes, price, time.Now(), time.Now())
+	// Consultas recorrentes geram uma série com uma linha por ocorrência
+	rule, recurring, err := parseSeriesRule(c)
+	if err != nil {
+		session.AddFlash("Recorrência inválida: "+err.Error()+".", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/admin/patients/profile/"+patientIDStr)
+		return
+	}
+	if recurring {
+		bookSeries(c, h.DB, SeriesBooking{
+			PatientID:     patientID,
+			DoctorID:      doctorID,
+			Start:         startTime,
+			Duration:      service.Duration,
+			ServiceTypeID: service.ServiceTypeID,
+			Status:        status,
+			Notes:         notes,
+			Price:         price,
+			SkipConflicts: c.PostForm("skip_conflicts") != "",
+		}, rule)
+		c.Redirect(http.StatusFound, "/admin/patients/profile/"+patientIDStr)
+		return
+	}
+
+	// Consultas canceladas não ocupam horário, então só as demais são verificadas
+	if status != "cancelado" {
+		message, err := validateAppointmentSlot(h.DB, doctorID, patientID, startTime, endTime)
+		if err != nil {
+			log.Printf("Erro ao validar horário do agendamento (admin): %v", err)
+		} else if message != "" {
+			session.AddFlash(message, "error")
+			session.Save()
+			c.Redirect(http.StatusFound, "/admin/patients/profile/"+patientIDStr)
+			return
+		}
+	}
+
+	_, err = insertAppointment(h.DB, NewAppointment{
+		PatientID:     patientID,
+		DoctorID:      doctorID,
+		Start:         startTime,
+		Duration:      service.Duration,
+		Status:        status,
+		Notes:         notes,
+		ServiceTypeID: service.ServiceTypeID,
+		Price:         price,
+	})
 	if err != nil {
 		log.Printf("Erro ao agendar nova consulta: %v", err)
+		if isOverlapViolation(err) {
+			session.AddFlash(overlapViolationMessage, "error")
+			session.Save()
+		}
 	}
 
     c.Redirect(http.StatusFound, "/admin/patients/profile/"+patientIDStr)
@@ -811,9 +944,11 @@ func (h *AdminHandler) PostNewAppointment(c *gin.Context) {
 // getAppointmentsByTime é uma função de ajuda para buscar consultas.
 func (h *AdminHandler) getAppointmentsByTime(patientID int, comparison string) ([]map[string]interface{}, error) {
 	query := `
-		SELECT a.id, a.start_time, a.status, a.notes, u.name as doctor_name, a.price, a.payment_status
+		SELECT a.id, a.start_time, a.end_time, a.status, a.notes, u.name as doctor_name, a.price, a.payment_status, a.series_id,
+		       COALESCE(st.name, '') as service_name
 		FROM appointments a
 		JOIN users u ON a.doctor_id = u.id
+		LEFT JOIN service_types st ON a.service_type_id = st.id
 		WHERE a.patient_id = $1 AND a.start_time ` + comparison + ` $2
 		ORDER BY a.start_time DESC
 	`
@@ -830,18 +965,22 @@ func (h *AdminHandler) getAppointmentsByTime(patientID int, comparison string) (
 		var notes sql.NullString
 		var price sql.NullFloat64
 		var paymentStatus sql.NullString
-		if err := rows.Scan(&app.ID, &app.StartTime, &app.Status, &notes, &doctorName, &price, &paymentStatus); err != nil {
+		var serviceName string
+		if err := rows.Scan(&app.ID, &app.StartTime, &app.EndTime, &app.Status, &notes, &doctorName, &price, &paymentStatus, &app.SeriesID, &serviceName); err != nil {
 			continue
 		}
         app.Notes = notes.String
         appointments = append(appointments, map[string]interface{}{
             "ID":         app.ID,
             "StartTime":  app.StartTime,
+            "EndTime":    app.EndTime,
+            "ServiceName": serviceName,
             "Status":     app.Status,
             "Notes":      app.Notes,
             "DoctorName": doctorName,
 			"Price":         price.Float64,
 			"PaymentStatus": paymentStatus.String,			
+			"SeriesID":      app.SeriesID.Int64,
         })
     }
     return appointments, nil
@@ -877,11 +1016,11 @@ func (h *AdminHandler) SystemMonitoring(c *gin.Context) {
         data.TotalRevenue = totalRevenue.Float64
     }
 
-    // 2. Calcular Valor a Receber (soma do preço de consultas concluídas mas com pagamento pendente)
+    // 2. Calcular Valor a Receber (consultas concluídas e taxas de falta/cancelamento tardio com pagamento pendente)
     var pendingValue sql.NullFloat64
     pendingQuery := `
         SELECT SUM(price) FROM appointments
-        WHERE status = 'concluido' AND payment_status = 'pendente' AND start_time >= $1`
+        WHERE status IN ('concluido', 'faltou', 'cancelado_tardio') AND payment_status = 'pendente' AND start_time >= $1`
     err = h.DB.QueryRow(pendingQuery, startDate).Scan(&pendingValue)
     if err != nil {
         log.Printf("Erro ao calcular pagamentos pendentes: %v", err)
@@ -893,10 +1032,10 @@ func (h *AdminHandler) SystemMonitoring(c *gin.Context) {
 
 	// --- LÓGICA ATUALIZADA PARA BUSCAR PACIENTES PENDENTES ---
 	var pendingPatients []PendingConsentPatient
-	// Query agora busca também o access_token
+	// Query agora busca também o link ativo do portal
 	query := `
-		SELECT id, name, access_token FROM patients
-		WHERE consent_given_at IS NULL
+		SELECT id, name, ` + activePortalTokenSQL + ` FROM patients
+		WHERE consent_given_at IS NULL AND deleted_at IS NULL
 		ORDER BY created_at ASC
 		LIMIT 10`
 	rowsPending, err := h.DB.Query(query)
@@ -920,7 +1059,7 @@ func (h *AdminHandler) SystemMonitoring(c *gin.Context) {
         FROM appointments a
         JOIN patients p ON a.patient_id = p.id
         JOIN users u ON a.doctor_id = u.id
-        WHERE a.start_time >= NOW() ORDER BY a.start_time ASC LIMIT 10`)
+        WHERE a.start_time >= NOW() AND a.status = 'agendado' ORDER BY a.start_time ASC LIMIT 10`)
     if err != nil {
 		log.Printf("Erro ao buscar próximas consultas: %v", err)
         c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Não foi possível carregar os dados de monitoramento."})
@@ -943,6 +1082,26 @@ func (h *AdminHandler) SystemMonitoring(c *gin.Context) {
         log.Printf("Erro ao contar consultas concluídas: %v", err)
     }
 
+    err = h.DB.QueryRow(`
+        SELECT COUNT(*) FILTER (WHERE status = 'faltou'), COUNT(*) FILTER (WHERE status = 'cancelado_tardio')
+        FROM appointments WHERE start_time >= $1 AND start_time <= NOW()`, startDate).Scan(&data.NoShowCount, &data.LateCancelCount)
+    if err != nil {
+        log.Printf("Erro ao contar faltas e cancelamentos tardios: %v", err)
+    }
+    err = h.DB.QueryRow("SELECT COUNT(*) FROM appointments WHERE status = 'pendente_confirmacao'").Scan(&data.PendingConfirmationCount)
+    if err != nil {
+        log.Printf("Erro ao contar consultas pendentes de confirmação: %v", err)
+    }
+    err = h.DB.QueryRow(`
+        SELECT COUNT(*) FILTER (WHERE status = 'enviado'), COUNT(*) FILTER (WHERE status IN ('falhou', 'sem_contato'))
+        FROM notification_deliveries WHERE created_at >= $1`, startDate).Scan(&data.RemindersSent, &data.RemindersFailed)
+    if err != nil {
+        log.Printf("Erro ao contar lembretes enviados: %v", err)
+    }
+    if total := data.CompletedCount + data.NoShowCount; total > 0 {
+        data.NoShowRate = float64(data.NoShowCount) * 100 / float64(total)
+    }
+
     data.HowFoundStats = make(map[string]int)
     rows, err = h.DB.Query("SELECT how_found, COUNT(*) FROM patients WHERE created_at >= $1 AND how_found IS NOT NULL AND how_found != '' GROUP BY how_found", startDate)
     if err != nil {
@@ -1004,74 +1163,7 @@ func (h *AdminHandler) AdminDashboard(c *gin.Context) {
 
 // ViewAgenda renderiza a agenda para o admin.
 func (h *AdminHandler) ViewAgenda(c *gin.Context) {
-    dateParam := c.Query("date")
-    var referenceDate time.Time
-    if dateParam == "" {
-        referenceDate = time.Now()
-    } else {
-        referenceDate, _ = time.Parse("2006-01-02", dateParam)
-    }
-
-    weekday := int(referenceDate.Weekday())
-    startOfWeek := referenceDate.AddDate(0, 0, -weekday)
-    endOfWeek := startOfWeek.AddDate(0, 0, 7)
-
-    query := `
-        SELECT a.id, a.start_time, a.status, p.name as patient_name, u.name as doctor_name, p.id as patient_id
-        FROM appointments a
-        JOIN patients p ON a.patient_id = p.id
-        JOIN users u ON a.doctor_id = u.id
-        WHERE a.start_time >= $1 AND a.start_time < $2
-        ORDER BY a.start_time ASC
-    `
-    rows, err := h.DB.Query(query, startOfWeek, endOfWeek)
-    if err != nil {
-        log.Printf("Erro ao buscar agendamentos para a agenda (admin): %v", err)
-        c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Não foi possível carregar a agenda."})
-        return
-    }
-    defer rows.Close()
-
-    type AppointmentDetails struct {
-        ID          int
-        StartTime   time.Time
-        PatientName string
-        DoctorName  string
-        Status      string
-        PatientID   int
-    }
-    appointmentsByDay := make(map[string][]AppointmentDetails)
-    for rows.Next() {
-        var app AppointmentDetails
-        if err := rows.Scan(&app.ID, &app.StartTime, &app.Status, &app.PatientName, &app.DoctorName, &app.PatientID); err != nil {
-            continue
-        }
-        dayKey := app.StartTime.Format("2006-01-02")
-        appointmentsByDay[dayKey] = append(appointmentsByDay[dayKey], app)
-    }
-
-    type DaySchedule struct {
-        Date         time.Time
-        Appointments []AppointmentDetails
-    }
-    var weekSchedule []DaySchedule
-    for i := 0; i < 7; i++ {
-        day := startOfWeek.AddDate(0, 0, i)
-        dayKey := day.Format("2006-01-02")
-        weekSchedule = append(weekSchedule, DaySchedule{
-            Date:         day,
-            Appointments: appointmentsByDay[dayKey],
-        })
-    }
-
-    c.HTML(http.StatusOK, "admin/agenda.html", gin.H{
-        "Title":        "Agenda da Clínica",
-        "WeekSchedule": weekSchedule,
-        "PrevWeekLink": "/admin/agenda?date=" + startOfWeek.AddDate(0, 0, -7).Format("2006-01-02"),
-        "NextWeekLink": "/admin/agenda?date=" + startOfWeek.AddDate(0, 0, 7).Format("2006-01-02"),
-        "TodayLink":    "/admin/agenda",
-        "ActiveNav":    "agenda",
-    })
+    renderAgenda(c, h.DB, "admin/agenda.html", "/admin/agenda", "admin", nil)
 }
 
 // handlers/admin_handlers.go
@@ -1085,16 +1177,20 @@ func (h *AdminHandler) GetEditAppointmentForm(c *gin.Context) {
 
 	var app storage.Appointment
 	var patientName string
-	query := `SELECT a.id, a.patient_id, a.doctor_id, a.start_time, p.name 
+	query := `SELECT a.id, a.patient_id, a.doctor_id, a.start_time, a.series_id, p.name 
 			  FROM appointments a JOIN patients p ON a.patient_id = p.id 
 			  WHERE a.id = $1`
-	err := h.DB.QueryRow(query, appointmentID).Scan(&app.ID, &app.PatientID, &app.DoctorID, &app.StartTime, &patientName)
+	err := h.DB.QueryRow(query, appointmentID).Scan(&app.ID, &app.PatientID, &app.DoctorID, &app.StartTime, &app.SeriesID, &patientName)
 	if err != nil {
 		log.Printf("Erro ao buscar consulta para edição (admin): %v", err)
 		c.HTML(http.StatusNotFound, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Consulta não encontrada."})
 		return
 	}
 
+	session := sessions.Default(c)
+	errorFlashes := session.Flashes("error")
+	session.Save()
+
 	var doctors []storage.User
 	rows, _ := h.DB.Query("SELECT id, name FROM users WHERE user_type = 'terapeuta'")
 	if rows != nil {
@@ -1116,6 +1212,7 @@ func (h *AdminHandler) GetEditAppointmentForm(c *gin.Context) {
 		"Doctors":     doctors,
 		"ActiveNav":   "patients",
 		"AdminPath":   true, // Indica que a rota de volta deve ser a do admin
+		"ErrorFlashes": errorFlashes,
 	})
 }
 
@@ -1129,34 +1226,108 @@ func (h *AdminHandler) PostEditAppointment(c *gin.Context) {
 	timeStr := c.PostForm("start_time")
 	doctorID, _ := strconv.Atoi(doctorIDStr)
 
-	startTime, err := time.Parse("2006-01-02 15:04", dateStr+" "+timeStr)
+	startTime, err := parseClinicDateTime(dateStr, timeStr)
 	if err != nil {
+		if err == errNonexistentLocalTime {
+			session := sessions.Default(c)
+			session.AddFlash(err.Error(), "error")
+			session.Save()
+		}
 		log.Printf("Erro ao converter data/hora na edição (admin): %v", err)
 		c.Redirect(http.StatusFound, "/admin/patients/profile/"+patientIDStr)
 		return
 	}
-	endTime := startTime.Add(1 * time.Hour)
+
+	// Ao remarcar, a consulta mantém a duração do tipo de sessão gravada no agendamento
+	duration, err := appointmentDuration(h.DB, appointmentIDStr)
+	if err != nil {
+		log.Printf("Erro ao buscar duração da consulta (admin): %v", err)
+		c.Redirect(http.StatusFound, "/admin/patients/profile/"+patientIDStr)
+		return
+	}
+	endTime := startTime.Add(duration)
+
+	session := sessions.Default(c)
+	editFormURL := "/admin/appointments/edit/" + appointmentIDStr + "?patient_id=" + patientIDStr
+
+	var appointmentPatientID int
+	var appointmentStatus string
+	err = h.DB.QueryRow("SELECT patient_id, status FROM appointments WHERE id = $1", appointmentIDStr).Scan(&appointmentPatientID, &appointmentStatus)
+	if err != nil {
+		log.Printf("Erro ao buscar consulta para edição (admin): %v", err)
+		c.Redirect(http.StatusFound, "/admin/patients/profile/"+patientIDStr)
+		return
+	}
+
+	// Edição de "esta e as seguintes" ou da série inteira
+	if scope := seriesScope(c); scope != scopeOccurrence {
+		if !editSeries(c, h.DB, safeAtoi(appointmentIDStr), scope, doctorID, startTime) {
+			c.Redirect(http.StatusFound, editFormURL)
+			return
+		}
+		c.Redirect(http.StatusFound, "/admin/patients/profile/"+patientIDStr)
+		return
+	}
+
+	if !isCancelledStatus(appointmentStatus) {
+		message, err := validateAppointmentSlot(h.DB, doctorID, appointmentPatientID, startTime, endTime, safeAtoi(appointmentIDStr))
+		if err != nil {
+			log.Printf("Erro ao validar horário na edição (admin): %v", err)
+		} else if message != "" {
+			session.AddFlash(message, "error")
+			session.Save()
+			c.Redirect(http.StatusFound, editFormURL)
+			return
+		}
+	}
 
 	query := `UPDATE appointments SET doctor_id = $1, start_time = $2, end_time = $3, updated_at = $4 WHERE id = $5`
 	_, err = h.DB.Exec(query, doctorID, startTime, endTime, time.Now(), appointmentIDStr)
 	if err != nil {
 		log.Printf("Erro ao atualizar consulta (admin): %v", err)
+		if isOverlapViolation(err) {
+			session.AddFlash(overlapViolationMessage, "error")
+			session.Save()
+			c.Redirect(http.StatusFound, editFormURL)
+			return
+		}
 	}
 
 	c.Redirect(http.StatusFound, "/admin/patients/profile/"+patientIDStr)
 }
 
-// CancelAppointment atualiza o status de uma consulta para 'cancelado'.
+// CancelAppointment cancela uma consulta aplicando a política de cancelamento
+// ('cancelado' ou 'cancelado_tardio', com taxa quando configurada).
 func (h *AdminHandler) CancelAppointment(c *gin.Context) {
 	appointmentID := c.Param("id")
 	patientID := c.Query("patient_id")
 
-	query := `UPDATE appointments SET status = 'cancelado', updated_at = $1 WHERE id = $2`
-	_, err := h.DB.Exec(query, time.Now(), appointmentID)
-	if err != nil {
-		log.Printf("ERRO DE BANCO DE DADOS ao cancelar consulta (admin): %v", err)
+	// Cancelamento de "esta e as seguintes" ou da série inteira
+	if scope := seriesScope(c); scope != scopeOccurrence {
+		cancelSeries(c, h.DB, safeAtoi(appointmentID), scope)
+		c.Redirect(http.StatusFound, "/admin/patients/profile/"+patientID)
+		return
 	}
 
+	recordAppointmentOutcome(c, h.DB, safeAtoi(appointmentID), "cancelado")
+	c.Redirect(http.StatusFound, "/admin/patients/profile/"+patientID)
+}
+
+// MarkNoShow registra a falta do paciente em uma consulta que já passou.
+func (h *AdminHandler) MarkNoShow(c *gin.Context) {
+	appointmentID := c.Param("id")
+	patientID := c.Query("patient_id")
+
+	recordAppointmentOutcome(c, h.DB, safeAtoi(appointmentID), "faltou")
+	c.Redirect(http.StatusFound, "/admin/patients/profile/"+patientID)
+}
+
+// ConfirmAppointment confirma uma consulta que a tarefa automática deixou pendente de confirmação.
+func (h *AdminHandler) ConfirmAppointment(c *gin.Context) {
+	appointmentID := c.Param("id")
+	patientID := c.Query("patient_id")
+
+	confirmAppointment(c, h.DB, safeAtoi(appointmentID))
 	c.Redirect(http.StatusFound, "/admin/patients/profile/"+patientID)
 }
 
@@ -1236,33 +1407,25 @@ func (h *AdminHandler) GetAISummary(c *gin.Context) {
     patientIDstr := c.Param("id")
     patientID, _ := strconv.Atoi(patientIDstr)
 
-    // 1. Buscar e formatar o histórico do paciente
-    query := `
-        SELECT r.record_date, u.name as doctor_name, r.main_complaint, r.notes,
-               r.anxiety_level, r.anger_level, r.fear_level, r.sadness_level, r.joy_level, r.energy_level
-        FROM patient_records r
-        JOIN users u ON r.doctor_id = u.id
-        WHERE r.patient_id = $1 ORDER BY r.record_date ASC
-    `
-    rows, err := h.DB.Query(query, patientID)
+    // 1. Buscar e formatar o histórico do paciente, com as notas estruturadas e os adendos
+    history, err := loadPatientRecordHistory(h.DB, patientID)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Falha ao buscar dados do paciente."})
         return
     }
-    defer rows.Close()
 
     var historico strings.Builder
-    historico.WriteString("Histórico de Sessões do Paciente:\n\n")
-    recordCount := 0
-    for rows.Next() {
-        recordCount++
-        var rec storage.PatientRecord
-        rows.Scan(&rec.RecordDate, &rec.DoctorName, &rec.MainComplaint, &rec.Notes, &rec.AnxietyLevel, &rec.AngerLevel, &rec.FearLevel, &rec.SadnessLevel, &rec.JoyLevel, &rec.EnergyLevel)
-        historico.WriteString(fmt.Sprintf("Sessão em %s (com Dr(a). %s):\n- Níveis (0-10): Ansiedade(%d), Raiva(%d), Medo(%d), Tristeza(%d), Alegria(%d), Energia(%d)\n- Queixa: %s\n- Notas: %s\n\n",
-            rec.RecordDate.Format("02/01/2006"), rec.DoctorName, rec.AnxietyLevel, rec.AngerLevel, rec.FearLevel, rec.SadnessLevel, rec.JoyLevel, rec.EnergyLevel, rec.MainComplaint, rec.Notes))
+    historico.WriteString(recordSummaryText(history))
+    recordCount := len(history)
+
+    // Os check-ins do portal trazem como o próprio paciente avaliou seu estado antes de cada sessão
+    checkins, err := loadPatientCheckins(h.DB, patientID)
+    if err != nil {
+        log.Printf("Erro ao buscar check-ins para resumo de IA: %v", err)
     }
+    historico.WriteString(checkinSummaryText(checkins))
 
-    if recordCount == 0 {
+    if recordCount == 0 && len(checkins) == 0 {
         c.JSON(http.StatusOK, gin.H{"summary": "Não há dados de prontuário suficientes para gerar um resumo."})
         return
     }
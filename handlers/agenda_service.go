@@ -0,0 +1,404 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"mediflow/storage"
+)
+
+// AppointmentDetails é uma struct para organizar os dados da agenda para o template.
+type AppointmentDetails struct {
+	ID            int       `json:"id"`
+	StartTime     time.Time `json:"start"`
+	EndTime       time.Time `json:"end"`
+	PatientName   string    `json:"patient_name"`
+	DoctorName    string    `json:"doctor_name"`
+	Status        string    `json:"status"`
+	PatientID     int       `json:"patient_id"`
+	ServiceName   string    `json:"service_name"`
+	DoctorID      int       `json:"resource_id"`
+	PaymentStatus string    `json:"payment_status"`
+}
+
+// DaySchedule é uma struct para organizar os dados da agenda para o template.
+type DaySchedule struct {
+	Date         time.Time
+	Appointments []AppointmentDetails
+	InPeriod     bool // falso para os dias de outros meses que completam a grade da visão mensal
+}
+
+// Visões suportadas pela agenda.
+const (
+	agendaDay   = "day"
+	agendaWeek  = "week"
+	agendaMonth = "month"
+)
+
+// agendaStatusOptions e agendaPaymentOptions alimentam os filtros da agenda.
+var agendaStatusOptions = []string{"pre_agendado", "agendado", "pendente_confirmacao", "concluido", "cancelado", "cancelado_tardio", "faltou"}
+var agendaPaymentOptions = []string{"pendente", "pago", "isento"}
+
+// AgendaFilter são os parâmetros da agenda lidos da query string: view (day, week ou month),
+// date (AAAA-MM-DD) e os filtros repetíveis doctor_id, status e payment_status.
+type AgendaFilter struct {
+	View            string
+	Date            time.Time
+	DoctorIDs       []int
+	Statuses        []string
+	PaymentStatuses []string
+}
+
+// AgendaResource é um terapeuta exibido como coluna na visão diária (e no JSON).
+type AgendaResource struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// Agenda é o resultado do serviço de agenda, compartilhado pelos painéis da secretária e do
+// administrador e pela variante JSON.
+type Agenda struct {
+	Filter       AgendaFilter
+	Start        time.Time
+	End          time.Time
+	Title        string
+	Days         []DaySchedule
+	Resources    []AgendaResource
+	Appointments []AppointmentDetails
+	Doctors      []storage.User // todos os terapeutas, para o formulário de filtro
+}
+
+// parseAgendaFilter lê os filtros da agenda. Datas inválidas ou ausentes valem hoje e a visão
+// padrão é a semanal.
+func parseAgendaFilter(c *gin.Context) AgendaFilter {
+	filter := AgendaFilter{View: c.DefaultQuery("view", agendaWeek), Date: clinicToday()}
+	if filter.View != agendaDay && filter.View != agendaMonth {
+		filter.View = agendaWeek
+	}
+	if date, err := parseClinicDate(c.Query("date")); err == nil {
+		filter.Date = date
+	}
+	for _, idStr := range c.QueryArray("doctor_id") {
+		if id, err := strconv.Atoi(idStr); err == nil {
+			filter.DoctorIDs = append(filter.DoctorIDs, id)
+		}
+	}
+	filter.Statuses = allowedValues(c.QueryArray("status"), agendaStatusOptions)
+	filter.PaymentStatuses = allowedValues(c.QueryArray("payment_status"), agendaPaymentOptions)
+	return filter
+}
+
+// allowedValues descarta os valores fora da lista permitida.
+func allowedValues(values, allowed []string) []string {
+	var result []string
+	for _, v := range values {
+		for _, a := range allowed {
+			if v == a {
+				result = append(result, v)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Period devolve o intervalo [início, fim) coberto pela visão.
+func (f AgendaFilter) Period() (time.Time, time.Time) {
+	switch f.View {
+	case agendaDay:
+		return f.Date, f.Date.AddDate(0, 0, 1)
+	case agendaMonth:
+		start := time.Date(f.Date.Year(), f.Date.Month(), 1, 0, 0, 0, 0, f.Date.Location())
+		return start, start.AddDate(0, 1, 0)
+	default:
+		start := f.Date.AddDate(0, 0, -int(f.Date.Weekday()))
+		return start, start.AddDate(0, 0, 7)
+	}
+}
+
+// shift devolve a data de referência do período anterior (-1) ou seguinte (+1).
+func (f AgendaFilter) shift(direction int) time.Time {
+	switch f.View {
+	case agendaDay:
+		return f.Date.AddDate(0, 0, direction)
+	case agendaMonth:
+		first := time.Date(f.Date.Year(), f.Date.Month(), 1, 0, 0, 0, 0, f.Date.Location())
+		return first.AddDate(0, direction, 0)
+	default:
+		return f.Date.AddDate(0, 0, 7*direction)
+	}
+}
+
+// Query monta a query string do filtro para outra data (ou outra visão), preservando os filtros.
+func (f AgendaFilter) Query(view string, date time.Time) string {
+	values := url.Values{}
+	values.Set("view", view)
+	values.Set("date", date.Format("2006-01-02"))
+	for _, id := range f.DoctorIDs {
+		values.Add("doctor_id", strconv.Itoa(id))
+	}
+	for _, s := range f.Statuses {
+		values.Add("status", s)
+	}
+	for _, s := range f.PaymentStatuses {
+		values.Add("payment_status", s)
+	}
+	return values.Encode()
+}
+
+// PrevQuery, NextQuery e TodayQuery são usados nos links de navegação da agenda.
+func (f AgendaFilter) PrevQuery() string  { return f.Query(f.View, f.shift(-1)) }
+func (f AgendaFilter) NextQuery() string  { return f.Query(f.View, f.shift(1)) }
+func (f AgendaFilter) TodayQuery() string { return f.Query(f.View, clinicToday()) }
+
+// ViewQuery troca a visão mantendo a data e os filtros.
+func (f AgendaFilter) ViewQuery(view string) string { return f.Query(view, f.Date) }
+
+// HasDoctor, HasStatus e HasPaymentStatus marcam as opções escolhidas no formulário de filtro.
+func (f AgendaFilter) HasDoctor(id int) bool {
+	for _, d := range f.DoctorIDs {
+		if d == id {
+			return true
+		}
+	}
+	return false
+}
+func (f AgendaFilter) HasStatus(status string) bool {
+	return len(allowedValues([]string{status}, f.Statuses)) > 0
+}
+func (f AgendaFilter) HasPaymentStatus(status string) bool {
+	return len(allowedValues([]string{status}, f.PaymentStatuses)) > 0
+}
+
+// loadAgenda busca as consultas do período com os filtros aplicados e organiza por dia.
+func loadAgenda(db *sql.DB, filter AgendaFilter) (Agenda, error) {
+	agenda := Agenda{Filter: filter}
+	loc := storage.ClinicLocation()
+	agenda.Start, agenda.End = filter.Period()
+
+	query := `
+        SELECT a.id, a.start_time, a.end_time, a.status, a.payment_status, p.name as patient_name, p.id as patient_id,
+               u.id as doctor_id, u.name as doctor_name, COALESCE(st.name, '') as service_name
+        FROM appointments a
+        JOIN patients p ON a.patient_id = p.id
+        JOIN users u ON a.doctor_id = u.id
+        LEFT JOIN service_types st ON a.service_type_id = st.id
+        WHERE a.start_time >= $1 AND a.start_time < $2`
+	args := []interface{}{agenda.Start, agenda.End}
+	addFilter := func(column string, values interface{}) {
+		args = append(args, values)
+		query += fmt.Sprintf(" AND %s = ANY($%d)", column, len(args))
+	}
+	if len(filter.DoctorIDs) > 0 {
+		ids := make([]int64, len(filter.DoctorIDs))
+		for i, id := range filter.DoctorIDs {
+			ids[i] = int64(id)
+		}
+		addFilter("a.doctor_id", pq.Array(ids))
+	}
+	if len(filter.Statuses) > 0 {
+		addFilter("a.status", pq.Array(filter.Statuses))
+	}
+	if len(filter.PaymentStatuses) > 0 {
+		addFilter("a.payment_status", pq.Array(filter.PaymentStatuses))
+	}
+	query += " ORDER BY a.start_time ASC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return agenda, err
+	}
+	defer rows.Close()
+
+	appointmentsByDay := make(map[string][]AppointmentDetails)
+	for rows.Next() {
+		var app AppointmentDetails
+		if err := rows.Scan(&app.ID, &app.StartTime, &app.EndTime, &app.Status, &app.PaymentStatus, &app.PatientName, &app.PatientID,
+			&app.DoctorID, &app.DoctorName, &app.ServiceName); err != nil {
+			return agenda, err
+		}
+		// Os dias da agenda são os do calendário da clínica, qualquer que seja o fuso da conexão
+		app.StartTime, app.EndTime = app.StartTime.In(loc), app.EndTime.In(loc)
+		agenda.Appointments = append(agenda.Appointments, app)
+		dayKey := app.StartTime.Format("2006-01-02")
+		appointmentsByDay[dayKey] = append(appointmentsByDay[dayKey], app)
+	}
+	if err := rows.Err(); err != nil {
+		return agenda, err
+	}
+
+	// A visão mensal completa a grade com os dias das semanas vizinhas
+	gridStart, gridEnd := agenda.Start, agenda.End
+	if filter.View == agendaMonth {
+		gridStart = gridStart.AddDate(0, 0, -int(gridStart.Weekday()))
+		for gridEnd.Weekday() != time.Sunday {
+			gridEnd = gridEnd.AddDate(0, 0, 1)
+		}
+	}
+	for day := gridStart; day.Before(gridEnd); day = day.AddDate(0, 0, 1) {
+		inPeriod := !day.Before(agenda.Start) && day.Before(agenda.End)
+		schedule := DaySchedule{Date: day, InPeriod: inPeriod}
+		if inPeriod {
+			schedule.Appointments = appointmentsByDay[day.Format("2006-01-02")]
+		}
+		agenda.Days = append(agenda.Days, schedule)
+	}
+
+	agenda.Doctors, err = loadTherapists(db)
+	if err != nil {
+		return agenda, err
+	}
+	for _, doc := range agenda.Doctors {
+		if len(filter.DoctorIDs) == 0 || filter.HasDoctor(doc.ID) {
+			agenda.Resources = append(agenda.Resources, AgendaResource{ID: doc.ID, Name: doc.Name})
+		}
+	}
+
+	switch filter.View {
+	case agendaDay:
+		agenda.Title = weekdayNames[filter.Date.Weekday()] + ", " + filter.Date.Format("02/01/2006")
+	case agendaMonth:
+		agenda.Title = monthNames[agenda.Start.Month()-1] + " de " + strconv.Itoa(agenda.Start.Year())
+	default:
+		agenda.Title = "Semana de " + agenda.Start.Format("02/01") + " a " + agenda.End.AddDate(0, 0, -1).Format("02/01/2006")
+	}
+	return agenda, nil
+}
+
+// monthNames traduz o mês para o título da visão mensal.
+var monthNames = []string{"Janeiro", "Fevereiro", "Março", "Abril", "Maio", "Junho", "Julho", "Agosto", "Setembro", "Outubro", "Novembro", "Dezembro"}
+
+// loadTherapists lista os terapeutas ativos.
+func loadTherapists(db *sql.DB) ([]storage.User, error) {
+	rows, err := db.Query("SELECT id, name FROM users WHERE user_type = 'terapeuta' AND deleted_at IS NULL ORDER BY name ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var doctors []storage.User
+	for rows.Next() {
+		var doc storage.User
+		if err := rows.Scan(&doc.ID, &doc.Name); err != nil {
+			return nil, err
+		}
+		doctors = append(doctors, doc)
+	}
+	return doctors, rows.Err()
+}
+
+// AppointmentsFor devolve as consultas de um terapeuta em um dia (colunas da visão diária).
+func (d DaySchedule) AppointmentsFor(doctorID int) []AppointmentDetails {
+	var result []AppointmentDetails
+	for _, app := range d.Appointments {
+		if app.DoctorID == doctorID {
+			result = append(result, app)
+		}
+	}
+	return result
+}
+
+// agendaJSON é a variante JSON da agenda, no formato de calendário por recurso (uma coluna por
+// terapeuta): os eventos referenciam o terapeuta por resource_id.
+type agendaJSON struct {
+	View      string               `json:"view"`
+	Start     string               `json:"start"`
+	End       string               `json:"end"`
+	Resources []AgendaResource     `json:"resources"`
+	Events    []AppointmentDetails `json:"events"`
+}
+
+// newAgendaJSON converte a agenda para a resposta JSON.
+func newAgendaJSON(agenda Agenda) agendaJSON {
+	events := agenda.Appointments
+	if events == nil {
+		events = []AppointmentDetails{}
+	}
+	resources := agenda.Resources
+	if resources == nil {
+		resources = []AgendaResource{}
+	}
+	return agendaJSON{
+		View:      agenda.Filter.View,
+		Start:     agenda.Start.Format("2006-01-02"),
+		End:       agenda.End.Format("2006-01-02"),
+		Resources: resources,
+		Events:    events,
+	}
+}
+
+// AgendaOption é uma opção dos seletores da agenda (visão e filtros).
+type AgendaOption struct {
+	Value string
+	Label string
+}
+
+// agendaLabels traduz visões e status para exibição.
+var agendaLabels = map[string]string{
+	agendaDay: "Dia", agendaWeek: "Semana", agendaMonth: "Mês",
+	"pre_agendado": "Pedido online", "agendado": "Agendado", "pendente_confirmacao": "Aguardando confirmação", "concluido": "Concluído",
+	"cancelado": "Cancelado", "cancelado_tardio": "Cancelamento tardio", "faltou": "Faltou",
+	"pendente": "Pendente", "pago": "Pago", "isento": "Isento",
+}
+
+func agendaOptions(values []string) []AgendaOption {
+	options := make([]AgendaOption, len(values))
+	for i, v := range values {
+		options[i] = AgendaOption{Value: v, Label: agendaLabels[v]}
+	}
+	return options
+}
+
+// ViewOptions, StatusOptions e PaymentOptions alimentam o seletor de visão e os filtros.
+func (a Agenda) ViewOptions() []AgendaOption {
+	return agendaOptions([]string{agendaDay, agendaWeek, agendaMonth})
+}
+func (a Agenda) StatusOptions() []AgendaOption  { return agendaOptions(agendaStatusOptions) }
+func (a Agenda) PaymentOptions() []AgendaOption { return agendaOptions(agendaPaymentOptions) }
+
+// renderAgenda carrega a agenda conforme a query string e renderiza a página do painel. basePath
+// é a rota da página (usada nos links de navegação), e extra acrescenta dados próprios do painel.
+func renderAgenda(c *gin.Context, db *sql.DB, page, basePath, panel string, extra gin.H) {
+	filter := parseAgendaFilter(c)
+	agenda, err := loadAgenda(db, filter)
+	if err != nil {
+		log.Printf("Erro ao buscar agendamentos para a agenda (%s): %v", panel, err)
+		c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Não foi possível carregar a agenda."})
+		return
+	}
+
+	data := gin.H{
+		"Title":       "Agenda da Clínica",
+		"Agenda":      agenda,
+		"AgendaPath":  basePath,
+		"ProfilePath": "/" + panel + "/patients/profile/",
+		"JSONLink":    "/" + panel + "/agenda.json?" + filter.Query(filter.View, filter.Date),
+		"ExportLink":  "/" + panel + "/agenda.ics?date=" + agenda.Start.Format("2006-01-02"),
+		"ActiveNav":   "agenda",
+	}
+	for key, value := range extra {
+		data[key] = value
+	}
+	c.HTML(http.StatusOK, page, data)
+}
+
+// AgendaJSON devolve a agenda (mesmos parâmetros da página) em JSON, para calendários por
+// terapeuta no front-end. Usado pelos painéis da secretária e do administrador.
+func AgendaJSON(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		agenda, err := loadAgenda(db, parseAgendaFilter(c))
+		if err != nil {
+			log.Printf("Erro ao buscar agendamentos para a agenda (JSON): %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Não foi possível carregar a agenda."})
+			return
+		}
+		c.JSON(http.StatusOK, newAgendaJSON(agenda))
+	}
+}
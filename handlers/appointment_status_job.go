@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Status intermediário usado quando a clínica prefere confirmar manualmente as sessões realizadas.
+const statusPendingConfirmation = "pendente_confirmacao"
+
+// AppointmentStatusJob move periodicamente as consultas 'agendado' cujo horário já terminou
+// para 'concluido' ou 'pendente_confirmacao', conforme a configuração do .env, e expira os pedidos
+// de agendamento online não confirmados:
+//
+//	APPOINTMENT_AUTO_STATUS                  status de destino: concluido (padrão) ou pendente_confirmacao
+//	APPOINTMENT_STATUS_JOB_INTERVAL_MINUTES  intervalo entre execuções (padrão 15; 0 desativa)
+type AppointmentStatusJob struct {
+	DB           *sql.DB
+	Interval     time.Duration
+	TargetStatus string
+}
+
+// NewAppointmentStatusJob cria a tarefa a partir das variáveis de ambiente.
+func NewAppointmentStatusJob(db *sql.DB) *AppointmentStatusJob {
+	job := &AppointmentStatusJob{DB: db, Interval: 15 * time.Minute, TargetStatus: "concluido"}
+	if minutes, err := strconv.Atoi(os.Getenv("APPOINTMENT_STATUS_JOB_INTERVAL_MINUTES")); err == nil && minutes >= 0 {
+		job.Interval = time.Duration(minutes) * time.Minute
+	}
+	switch target := os.Getenv("APPOINTMENT_AUTO_STATUS"); target {
+	case "", "concluido":
+	case statusPendingConfirmation:
+		job.TargetStatus = target
+	default:
+		log.Printf("AVISO: APPOINTMENT_AUTO_STATUS '%s' inválido; usando 'concluido'.", target)
+	}
+	return job
+}
+
+// Run executa a tarefa imediatamente e depois a cada intervalo, até o contexto ser cancelado.
+func (j *AppointmentStatusJob) Run(ctx context.Context) {
+	if j.Interval <= 0 {
+		log.Println("Tarefa de atualização de status das consultas desativada.")
+		return
+	}
+	log.Printf("Tarefa de atualização de status iniciada (a cada %s, destino '%s').", j.Interval, j.TargetStatus)
+
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := j.RunOnce(ctx, time.Now()); err != nil {
+			log.Printf("Erro na atualização automática de status das consultas: %v", err)
+		}
+		// Pedidos de agendamento online não confirmados a tempo liberam o horário
+		if _, err := expireBookingHolds(ctx, j.DB, time.Now()); err != nil {
+			log.Printf("Erro ao expirar pedidos de agendamento online: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			log.Println("Tarefa de atualização de status encerrada.")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce atualiza as consultas encerradas até 'now' e registra cada alteração na auditoria.
+// Devolve o número de consultas atualizadas.
+func (j *AppointmentStatusJob) RunOnce(ctx context.Context, now time.Time) (int, error) {
+	tx, err := j.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		UPDATE appointments SET status = $1, updated_at = $2
+		WHERE status = 'agendado' AND end_time <= $2
+		RETURNING id`, j.TargetStatus, now)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		AddSystemAuditLog(tx, fmt.Sprintf("Alterou automaticamente a consulta ID %d de 'agendado' para '%s'", id, j.TargetStatus), "Consulta", id)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if len(ids) > 0 {
+		log.Printf("Atualização automática: %d consulta(s) passaram para '%s'.", len(ids), j.TargetStatus)
+	}
+	return len(ids), nil
+}
+
+// confirmAppointment confirma a realização de uma consulta pendente de confirmação, com
+// auditoria e mensagem para o usuário. Compartilhada pelos painéis da secretária e do administrador.
+func confirmAppointment(c *gin.Context, db *sql.DB, appointmentID int) {
+	session := sessions.Default(c)
+	defer session.Save()
+
+	result, err := db.Exec("UPDATE appointments SET status = 'concluido', updated_at = NOW() WHERE id = $1 AND status = $2",
+		appointmentID, statusPendingConfirmation)
+	if err != nil {
+		log.Printf("Erro ao confirmar a consulta ID %d: %v", appointmentID, err)
+		session.AddFlash("Não foi possível confirmar a consulta.", "error")
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		session.AddFlash("A consulta não está pendente de confirmação.", "error")
+		return
+	}
+
+	AddAuditLog(LogAction{
+		DB:         db,
+		Context:    c,
+		Action:     fmt.Sprintf("Confirmou a realização da consulta ID %d", appointmentID),
+		TargetType: "Consulta",
+		TargetID:   appointmentID,
+	})
+	session.AddFlash("Consulta confirmada como realizada.", "success")
+}
@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"mediflow/attachments"
+)
+
+// AttachmentHandler recebe, entrega e exclui os arquivos anexados ao prontuário. As regras de acesso
+// são as do prontuário: o administrador vê todos os pacientes e o terapeuta, só os pacientes com
+// quem tem consulta.
+type AttachmentHandler struct {
+	DB      *sql.DB
+	Store   attachments.Store
+	Scanner attachments.Scanner // nil = sem verificação de vírus
+	MaxSize int64               // Tamanho máximo de um anexo, em bytes
+}
+
+// NewAttachmentHandler cria o handler de anexos.
+func NewAttachmentHandler(db *sql.DB, store attachments.Store, scanner attachments.Scanner, maxSize int64) *AttachmentHandler {
+	return &AttachmentHandler{DB: db, Store: store, Scanner: scanner, MaxSize: maxSize}
+}
+
+// attachmentPatient confere o acesso do usuário ao prontuário do paciente da URL e devolve o
+// endereço do prontuário, para onde as ações voltam.
+func (h *AttachmentHandler) attachmentPatient(c *gin.Context) (int, string, bool) {
+	session := sessions.Default(c)
+	userType, _ := session.Get("user_type").(string)
+	userID, _ := session.Get("user_id").(int)
+	patientID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "layouts/error.html", gin.H{"Title": "Erro", "Message": "ID de paciente inválido."})
+		return 0, "", false
+	}
+
+	switch {
+	case userType == "admin":
+		return patientID, fmt.Sprintf("/admin/patients/edit/%d", patientID), true
+	case userType == "terapeuta" && therapistHasPatient(h.DB, userID, patientID):
+		return patientID, fmt.Sprintf("/terapeuta/pacientes/prontuario/%d", patientID), true
+	}
+	c.HTML(http.StatusForbidden, "layouts/error.html", gin.H{"Title": "Acesso Negado", "Message": "Você não tem permissão para acessar os anexos deste paciente."})
+	return 0, "", false
+}
+
+// UploadAttachment anexa um arquivo ao prontuário. O tipo é identificado pelo conteúdo e precisa
+// estar na lista permitida; com a verificação de vírus configurada, arquivos infectados são
+// recusados antes de chegar ao armazenamento.
+func (h *AttachmentHandler) UploadAttachment(c *gin.Context) {
+	patientID, redirect, ok := h.attachmentPatient(c)
+	if !ok {
+		return
+	}
+	session := sessions.Default(c)
+	defer session.Save()
+	fail := func(message string) {
+		session.AddFlash("Anexo não gravado: "+message+".", "error")
+		c.Redirect(http.StatusFound, redirect)
+	}
+
+	// Folga de 1 MB para os demais campos do formulário multipart
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.MaxSize+1<<20)
+	header, err := c.FormFile("file")
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge) || (err == nil && header.Size > h.MaxSize):
+		fail(fmt.Sprintf("o arquivo passa do limite de %d MB", h.MaxSize>>20))
+		return
+	case err != nil:
+		fail("selecione um arquivo")
+		return
+	case header.Size == 0:
+		fail("o arquivo está vazio")
+		return
+	}
+
+	category := c.PostForm("category")
+	description := strings.TrimSpace(c.PostForm("description"))
+	if !attachmentCategories[category] {
+		fail(errAttachmentCategory.Error())
+		return
+	}
+	if len([]rune(description)) > attachmentDescriptionMaxLen {
+		fail(errAttachmentDescription.Error())
+		return
+	}
+	fileName := attachmentFileName(header.Filename)
+
+	file, err := header.Open()
+	if err != nil {
+		log.Printf("Erro ao abrir o anexo enviado para o paciente %d: %v", patientID, err)
+		fail("não foi possível ler o arquivo")
+		return
+	}
+	defer file.Close()
+
+	head := make([]byte, attachments.SniffLen)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		log.Printf("Erro ao ler o anexo enviado para o paciente %d: %v", patientID, err)
+		fail("não foi possível ler o arquivo")
+		return
+	}
+	contentType, err := attachments.DetectType(head[:n])
+	if err != nil {
+		fail(fmt.Sprintf("o conteúdo do arquivo (%s) não é de um tipo permitido; envie %s", contentType, attachments.AllowedTypesLabel))
+		return
+	}
+
+	scanStatus := attachmentScanSkipped
+	if h.Scanner != nil {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			log.Printf("Erro ao reler o anexo enviado para o paciente %d: %v", patientID, err)
+			fail("não foi possível ler o arquivo")
+			return
+		}
+		result, err := h.Scanner.Scan(c.Request.Context(), fileName, file)
+		if err != nil {
+			log.Printf("Erro na verificação de vírus do anexo do paciente %d: %v", patientID, err)
+			fail("não foi possível concluir a verificação de vírus; tente novamente mais tarde")
+			return
+		}
+		if result.Infected {
+			AddAuditLog(LogAction{
+				DB:         h.DB,
+				Context:    c,
+				Action:     fmt.Sprintf("Envio de anexo recusado: vírus encontrado no arquivo \"%s\" (%s)", fileName, result.Threat),
+				TargetType: "Paciente",
+				TargetID:   patientID,
+			})
+			fail("a verificação encontrou vírus no arquivo")
+			return
+		}
+		scanStatus = attachmentScanClean
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		log.Printf("Erro ao reler o anexo enviado para o paciente %d: %v", patientID, err)
+		fail("não foi possível ler o arquivo")
+		return
+	}
+
+	key, err := newAttachmentKey(patientID)
+	if err != nil {
+		log.Printf("Erro ao gerar a chave do anexo do paciente %d: %v", patientID, err)
+		fail("erro interno")
+		return
+	}
+	hash := sha256.New()
+	if err := h.Store.Put(c.Request.Context(), key, io.TeeReader(file, hash), header.Size, contentType); err != nil {
+		log.Printf("Erro ao gravar o anexo %s no armazenamento: %v", key, err)
+		fail("o armazenamento de anexos está indisponível")
+		return
+	}
+
+	var attachmentID int
+	err = h.DB.QueryRow(`INSERT INTO patient_attachments (patient_id, uploaded_by, category, description, file_name,
+			content_type, size_bytes, sha256, storage_key, scan_status)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, $8, $9, $10) RETURNING id`,
+		patientID, sessionUserID(c), category, description, fileName, contentType, header.Size,
+		hex.EncodeToString(hash.Sum(nil)), key, scanStatus).Scan(&attachmentID)
+	if err != nil {
+		log.Printf("Erro ao registrar o anexo do paciente %d: %v", patientID, err)
+		if err := h.Store.Delete(c.Request.Context(), key); err != nil {
+			log.Printf("Erro ao remover o arquivo %s do anexo não registrado: %v", key, err)
+		}
+		fail("erro ao registrar o anexo")
+		return
+	}
+
+	AddAuditLog(LogAction{
+		DB:         h.DB,
+		Context:    c,
+		Action:     fmt.Sprintf("Anexou o arquivo \"%s\" (anexo ID %d, %s, %d bytes) ao prontuário", fileName, attachmentID, contentType, header.Size),
+		TargetType: "Paciente",
+		TargetID:   patientID,
+	})
+	message := "Arquivo anexado ao prontuário."
+	if scanStatus == attachmentScanSkipped {
+		message = "Arquivo anexado ao prontuário (sem verificação de vírus configurada)."
+	}
+	session.AddFlash(message, "success")
+	c.Redirect(http.StatusFound, redirect)
+}
+
+// DownloadAttachment entrega o arquivo anexado, sempre como download: o navegador não tenta
+// interpretar o conteúdo na página da aplicação.
+func (h *AttachmentHandler) DownloadAttachment(c *gin.Context) {
+	patientID, _, ok := h.attachmentPatient(c)
+	if !ok {
+		return
+	}
+	attachmentID, _ := strconv.Atoi(c.Param("attachmentId"))
+	a, err := loadPatientAttachment(h.DB, patientID, attachmentID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Erro ao buscar o anexo %d: %v", attachmentID, err)
+		}
+		c.HTML(http.StatusNotFound, "layouts/error.html", gin.H{"Title": "Não Encontrado", "Message": "Anexo não encontrado."})
+		return
+	}
+
+	file, err := h.Store.Get(c.Request.Context(), a.StorageKey)
+	if err != nil {
+		log.Printf("Erro ao abrir o arquivo %s do anexo %d: %v", a.StorageKey, a.ID, err)
+		status, message := http.StatusInternalServerError, "O armazenamento de anexos está indisponível."
+		if err == attachments.ErrNotFound {
+			status, message = http.StatusNotFound, "O arquivo deste anexo não foi encontrado no armazenamento."
+		}
+		c.HTML(status, "layouts/error.html", gin.H{"Title": "Erro", "Message": message})
+		return
+	}
+	defer file.Close()
+
+	AddAuditLog(LogAction{
+		DB:         h.DB,
+		Context:    c,
+		Action:     fmt.Sprintf("Baixou o anexo ID %d (\"%s\") do prontuário", a.ID, a.FileName),
+		TargetType: "Paciente",
+		TargetID:   patientID,
+	})
+	c.DataFromReader(http.StatusOK, a.SizeBytes, a.ContentType, file, map[string]string{
+		"Content-Disposition":    attachmentDisposition(a.FileName),
+		"X-Content-Type-Options": "nosniff",
+		"Cache-Control":          "private, no-store",
+	})
+}
+
+// DeleteAttachment exclui um anexo. O terapeuta só exclui os anexos que ele mesmo enviou; o
+// administrador, qualquer um. O arquivo sai do armazenamento e o registro fica marcado como excluído.
+func (h *AttachmentHandler) DeleteAttachment(c *gin.Context) {
+	patientID, redirect, ok := h.attachmentPatient(c)
+	if !ok {
+		return
+	}
+	session := sessions.Default(c)
+	defer session.Save()
+
+	attachmentID, _ := strconv.Atoi(c.Param("attachmentId"))
+	a, err := loadPatientAttachment(h.DB, patientID, attachmentID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Erro ao buscar o anexo %d: %v", attachmentID, err)
+		}
+		session.AddFlash("Anexo não encontrado ou já excluído.", "error")
+		c.Redirect(http.StatusFound, redirect)
+		return
+	}
+	userID, _ := session.Get("user_id").(int)
+	if session.Get("user_type") != "admin" && a.UploadedBy != userID {
+		session.AddFlash("Só quem enviou o anexo ou o administrador pode excluí-lo.", "error")
+		c.Redirect(http.StatusFound, redirect)
+		return
+	}
+
+	result, err := h.DB.Exec(`UPDATE patient_attachments SET deleted_at = NOW(), deleted_by = $1
+		WHERE id = $2 AND patient_id = $3 AND deleted_at IS NULL`, sessionUserID(c), a.ID, patientID)
+	if err == nil {
+		if n, _ := result.RowsAffected(); n == 0 {
+			session.AddFlash("Anexo não encontrado ou já excluído.", "error")
+			c.Redirect(http.StatusFound, redirect)
+			return
+		}
+	}
+	if err != nil {
+		log.Printf("Erro ao excluir o anexo %d: %v", a.ID, err)
+		session.AddFlash("Não foi possível excluir o anexo.", "error")
+		c.Redirect(http.StatusFound, redirect)
+		return
+	}
+	if err := h.Store.Delete(c.Request.Context(), a.StorageKey); err != nil {
+		log.Printf("AVISO: anexo %d excluído, mas o arquivo %s continua no armazenamento: %v", a.ID, a.StorageKey, err)
+	}
+
+	AddAuditLog(LogAction{
+		DB:         h.DB,
+		Context:    c,
+		Action:     fmt.Sprintf("Excluiu o anexo ID %d (\"%s\", SHA-256 %s) do prontuário", a.ID, a.FileName, a.SHA256),
+		TargetType: "Paciente",
+		TargetID:   patientID,
+	})
+	session.AddFlash("Anexo excluído.", "success")
+	c.Redirect(http.StatusFound, redirect)
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+	"unicode"
+
+	"mediflow/storage"
+)
+
+// Situações da verificação de vírus gravadas com o anexo.
+const (
+	attachmentScanClean   = "limpo"
+	attachmentScanSkipped = "nao_verificado"
+)
+
+// attachmentCategories são as categorias aceitas no formulário de anexo.
+var attachmentCategories = map[string]bool{"encaminhamento": true, "exame": true, "desenho": true, "outro": true}
+
+// Limites dos campos de texto do anexo.
+const (
+	attachmentFileNameMaxLen    = 255
+	attachmentDescriptionMaxLen = 500
+)
+
+var (
+	errAttachmentCategory    = errors.New("categoria de anexo inválida")
+	errAttachmentDescription = fmt.Errorf("a descrição pode ter no máximo %d caracteres", attachmentDescriptionMaxLen)
+)
+
+// attachmentFileName limpa o nome enviado pelo navegador: sem diretórios nem caracteres de
+// controle e com no máximo attachmentFileNameMaxLen caracteres (cortando o início, para preservar a
+// extensão). O nome serve só para exibição e
+// download; o arquivo é gravado sob uma chave gerada.
+func attachmentFileName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' {
+			return -1
+		}
+		return r
+	}, name))
+	if runes := []rune(name); len(runes) > attachmentFileNameMaxLen {
+		name = string(runes[len(runes)-attachmentFileNameMaxLen:])
+	}
+	if name == "" || name == "." || name == "/" {
+		return "anexo"
+	}
+	return name
+}
+
+// newAttachmentKey gera a chave de armazenamento de um novo anexo do paciente.
+func newAttachmentKey(patientID int) (string, error) {
+	token, err := generateSecureToken(16)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pacientes/%d/%s", patientID, token), nil
+}
+
+// attachmentDisposition monta o Content-Disposition do download com o nome original do arquivo.
+func attachmentDisposition(fileName string) string {
+	if value := mime.FormatMediaType("attachment", map[string]string{"filename": fileName}); value != "" {
+		return value
+	}
+	return "attachment"
+}
+
+const attachmentSelectSQL = `SELECT a.id, a.patient_id, a.uploaded_by, u.name, a.category, COALESCE(a.description, ''),
+	a.file_name, a.content_type, a.size_bytes, a.sha256, a.storage_key, a.scan_status, a.created_at
+	FROM patient_attachments a
+	JOIN users u ON a.uploaded_by = u.id `
+
+// scanPatientAttachment lê uma linha de attachmentSelectSQL.
+func scanPatientAttachment(scan func(dest ...interface{}) error) (storage.PatientAttachment, error) {
+	var a storage.PatientAttachment
+	err := scan(&a.ID, &a.PatientID, &a.UploadedBy, &a.UploadedByName, &a.Category, &a.Description,
+		&a.FileName, &a.ContentType, &a.SizeBytes, &a.SHA256, &a.StorageKey, &a.ScanStatus, &a.CreatedAt)
+	a.CreatedAt = a.CreatedAt.In(storage.ClinicLocation())
+	return a, err
+}
+
+// loadPatientAttachments lista os anexos do paciente que não foram excluídos, do mais recente para o
+// mais antigo.
+func loadPatientAttachments(db *sql.DB, patientID int) ([]storage.PatientAttachment, error) {
+	rows, err := db.Query(attachmentSelectSQL+"WHERE a.patient_id = $1 AND a.deleted_at IS NULL ORDER BY a.created_at DESC, a.id DESC", patientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []storage.PatientAttachment
+	for rows.Next() {
+		a, err := scanPatientAttachment(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+// loadPatientAttachment busca um anexo do paciente que não foi excluído. Devolve sql.ErrNoRows se o
+// anexo não existe ou pertence a outro paciente.
+func loadPatientAttachment(db *sql.DB, patientID, attachmentID int) (storage.PatientAttachment, error) {
+	return scanPatientAttachment(db.QueryRow(attachmentSelectSQL+"WHERE a.id = $1 AND a.patient_id = $2 AND a.deleted_at IS NULL",
+		attachmentID, patientID).Scan)
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 	"strconv"
 
@@ -44,4 +45,36 @@ func AddAuditLog(logInfo LogAction) {
 func safeAtoi(s string) int {
 	i, _ := strconv.Atoi(s)
 	return i
-}
\ No newline at end of file
+}
+
+// AddSystemAuditLog registra uma ação executada pelo próprio sistema (tarefas em segundo plano),
+// sem usuário autenticado. Aceita *sql.DB ou *sql.Tx.
+func AddSystemAuditLog(db execer, action, targetType string, targetID int) {
+	query := `INSERT INTO audit_logs (user_id, user_name, action, target_type, target_id) 
+			  VALUES (NULL, $1, $2, $3, $4)`
+
+	_, err := db.Exec(query, systemUserName, action, targetType, targetID)
+	if err != nil {
+		log.Printf("ERRO CRÍTICO: Falha ao registrar log de auditoria do sistema: %v", err)
+	}
+}
+
+// AddPatientAuditLog registra uma ação feita pelo próprio paciente no portal. O paciente não é
+// um usuário da equipe: user_id fica NULL e user_name identifica o paciente logado. Aceita *sql.DB
+// ou *sql.Tx.
+func AddPatientAuditLog(db execer, c *gin.Context, action, targetType string, targetID int) {
+	session := sessions.Default(c)
+	patientID, _ := session.Get("patient_id").(int)
+	patientName, _ := session.Get("patient_name").(string)
+
+	query := `INSERT INTO audit_logs (user_id, user_name, action, target_type, target_id) 
+			  VALUES (NULL, $1, $2, $3, $4)`
+
+	_, err := db.Exec(query, fmt.Sprintf("Paciente: %s (ID %d)", patientName, patientID), action, targetType, targetID)
+	if err != nil {
+		log.Printf("ERRO CRÍTICO: Falha ao registrar log de auditoria do paciente: %v", err)
+	}
+}
+
+// systemUserName identifica nos logs de auditoria as ações automáticas do sistema.
+const systemUserName = "Sistema (automático)"
@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"mediflow/storage"
+)
+
+// AvailabilityHandler gerencia o expediente dos terapeutas e a consulta de horários livres.
+type AvailabilityHandler struct {
+	DB *sql.DB
+}
+
+// ShowAvailability exibe o expediente semanal e as ausências de um terapeuta.
+func (h *AvailabilityHandler) ShowAvailability(c *gin.Context) {
+	session := sessions.Default(c)
+	errorFlashes := session.Flashes("error")
+	successFlashes := session.Flashes("success")
+	session.Save()
+
+	doctorID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Redirect(http.StatusFound, "/admin/users")
+		return
+	}
+
+	var therapist storage.User
+	err = h.DB.QueryRow("SELECT id, name, email, user_type, COALESCE(timezone, '') FROM users WHERE id = $1 AND user_type = 'terapeuta' AND deleted_at IS NULL", doctorID).
+		Scan(&therapist.ID, &therapist.Name, &therapist.Email, &therapist.UserType, &therapist.Timezone)
+	if err != nil {
+		log.Printf("Erro ao buscar terapeuta %d para disponibilidade: %v", doctorID, err)
+		c.HTML(http.StatusNotFound, "layouts/error.html", gin.H{"Title": "Não Encontrado", "Message": "Terapeuta não encontrado."})
+		return
+	}
+
+	today := clinicToday()
+	schedule, err := loadTherapistSchedule(h.DB, doctorID, today, today.AddDate(1, 0, 0))
+	if err != nil {
+		log.Printf("Erro ao carregar disponibilidade do terapeuta %d: %v", doctorID, err)
+		c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Não foi possível carregar a disponibilidade."})
+		return
+	}
+
+	c.HTML(http.StatusOK, "admin/availability.html", gin.H{
+		"Title":          "Disponibilidade de " + therapist.Name,
+		"Therapist":      therapist,
+		"Blocks":         schedule.Blocks,
+		"Exceptions":     schedule.Exceptions,
+		"Configured":     schedule.Configured(),
+		"WeekdayNames":   weekdayNames,
+		"ClinicTimezone": storage.ClinicLocation().String(),
+		"Timezones":      timezoneSuggestions,
+		"ActiveNav":      "users",
+		"ErrorFlashes":   errorFlashes,
+		"SuccessFlashes": successFlashes,
+	})
+}
+
+// PostAvailabilityBlock cadastra um bloco semanal de atendimento ou de intervalo.
+func (h *AvailabilityHandler) PostAvailabilityBlock(c *gin.Context) {
+	session := sessions.Default(c)
+	doctorIDStr := c.Param("id")
+	redirectURL := "/admin/users/availability/" + doctorIDStr
+
+	weekday, err := strconv.Atoi(c.PostForm("weekday"))
+	startClock := c.PostForm("start_time")
+	endClock := c.PostForm("end_time")
+	blockType := c.PostForm("block_type")
+
+	if err != nil || weekday < 0 || weekday > 6 || (blockType != "trabalho" && blockType != "intervalo") {
+		session.AddFlash("Dia da semana ou tipo de bloco inválido.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, redirectURL)
+		return
+	}
+	if !validClock(startClock) || !validClock(endClock) || endClock <= startClock {
+		session.AddFlash("O horário de término deve ser posterior ao horário de início.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, redirectURL)
+		return
+	}
+
+	var blockID int
+	err = h.DB.QueryRow(`INSERT INTO therapist_availability (doctor_id, weekday, start_time, end_time, block_type)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`, doctorIDStr, weekday, startClock, endClock, blockType).Scan(&blockID)
+	if err != nil {
+		log.Printf("Erro ao inserir bloco de disponibilidade: %v", err)
+		session.AddFlash("Não foi possível salvar o bloco de horário.", "error")
+	} else {
+		AddAuditLog(LogAction{
+			DB:         h.DB,
+			Context:    c,
+			Action:     fmt.Sprintf("Adicionou bloco de %s (%s %s–%s) ao terapeuta ID %s", blockType, weekdayNames[weekday], startClock, endClock, doctorIDStr),
+			TargetType: "Disponibilidade",
+			TargetID:   blockID,
+		})
+		session.AddFlash("Bloco de horário adicionado com sucesso!", "success")
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, redirectURL)
+}
+
+// DeleteAvailabilityBlock remove um bloco semanal do terapeuta.
+func (h *AvailabilityHandler) DeleteAvailabilityBlock(c *gin.Context) {
+	session := sessions.Default(c)
+	doctorIDStr := c.Param("id")
+	blockIDStr := c.Param("blockId")
+
+	result, err := h.DB.Exec("DELETE FROM therapist_availability WHERE id = $1 AND doctor_id = $2", blockIDStr, doctorIDStr)
+	if err != nil {
+		log.Printf("Erro ao remover bloco de disponibilidade: %v", err)
+		session.AddFlash("Não foi possível remover o bloco de horário.", "error")
+	} else if affected, _ := result.RowsAffected(); affected > 0 {
+		AddAuditLog(LogAction{
+			DB:         h.DB,
+			Context:    c,
+			Action:     fmt.Sprintf("Removeu bloco de disponibilidade do terapeuta ID %s", doctorIDStr),
+			TargetType: "Disponibilidade",
+			TargetID:   safeAtoi(blockIDStr),
+		})
+		session.AddFlash("Bloco de horário removido.", "success")
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, "/admin/users/availability/"+doctorIDStr)
+}
+
+// PostAvailabilityException cadastra uma ausência (férias, feriado, compromisso) do terapeuta.
+// Sem horários informados, a ausência vale para o dia inteiro.
+func (h *AvailabilityHandler) PostAvailabilityException(c *gin.Context) {
+	session := sessions.Default(c)
+	doctorIDStr := c.Param("id")
+	redirectURL := "/admin/users/availability/" + doctorIDStr
+
+	startDate, errStart := parseClinicDate(c.PostForm("start_date"))
+	endDateStr := c.PostForm("end_date")
+	if endDateStr == "" {
+		endDateStr = c.PostForm("start_date")
+	}
+	endDate, errEnd := parseClinicDate(endDateStr)
+	startClock := c.PostForm("start_time")
+	endClock := c.PostForm("end_time")
+	reason := c.PostForm("reason")
+
+	if errStart != nil || errEnd != nil || endDate.Before(startDate) {
+		session.AddFlash("Período de ausência inválido.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, redirectURL)
+		return
+	}
+
+	// Horários são opcionais, mas precisam vir em par e em ordem
+	var startValue, endValue interface{}
+	if startClock != "" || endClock != "" {
+		if !validClock(startClock) || !validClock(endClock) || endClock <= startClock {
+			session.AddFlash("Informe início e término válidos para a ausência parcial, ou deixe ambos em branco para o dia inteiro.", "error")
+			session.Save()
+			c.Redirect(http.StatusFound, redirectURL)
+			return
+		}
+		startValue, endValue = startClock, endClock
+	}
+
+	var exceptionID int
+	err := h.DB.QueryRow(`INSERT INTO therapist_availability_exceptions (doctor_id, start_date, end_date, start_time, end_time, reason)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		doctorIDStr, startDate.Format("2006-01-02"), endDate.Format("2006-01-02"), startValue, endValue, reason).Scan(&exceptionID)
+	if err != nil {
+		log.Printf("Erro ao inserir exceção de disponibilidade: %v", err)
+		session.AddFlash("Não foi possível salvar a ausência.", "error")
+	} else {
+		AddAuditLog(LogAction{
+			DB:         h.DB,
+			Context:    c,
+			Action:     fmt.Sprintf("Registrou ausência do terapeuta ID %s de %s a %s", doctorIDStr, startDate.Format("02/01/2006"), endDate.Format("02/01/2006")),
+			TargetType: "Disponibilidade",
+			TargetID:   exceptionID,
+		})
+		session.AddFlash("Ausência registrada com sucesso!", "success")
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, redirectURL)
+}
+
+// PostTherapistTimezone define o fuso próprio do terapeuta, para quem atende online de outro fuso.
+// O expediente e as ausências passam a ser lidos nesse fuso. Vazio volta ao fuso da clínica.
+func (h *AvailabilityHandler) PostTherapistTimezone(c *gin.Context) {
+	session := sessions.Default(c)
+	doctorIDStr := c.Param("id")
+	redirectURL := "/admin/users/availability/" + doctorIDStr
+
+	name := strings.TrimSpace(c.PostForm("timezone"))
+	var value interface{}
+	if name != "" {
+		if _, err := storage.LoadTimezone(name); err != nil {
+			session.AddFlash("Fuso horário inválido. Use um nome IANA, como America/Sao_Paulo.", "error")
+			session.Save()
+			c.Redirect(http.StatusFound, redirectURL)
+			return
+		}
+		value = name
+	}
+
+	result, err := h.DB.Exec("UPDATE users SET timezone = $1, updated_at = NOW() WHERE id = $2 AND user_type = 'terapeuta'", value, doctorIDStr)
+	if err != nil {
+		log.Printf("Erro ao salvar o fuso do terapeuta %s: %v", doctorIDStr, err)
+		session.AddFlash("Não foi possível salvar o fuso horário.", "error")
+	} else if affected, _ := result.RowsAffected(); affected > 0 {
+		if name == "" {
+			name = "fuso da clínica"
+		}
+		AddAuditLog(LogAction{
+			DB:         h.DB,
+			Context:    c,
+			Action:     fmt.Sprintf("Alterou o fuso horário do terapeuta ID %s para %s", doctorIDStr, name),
+			TargetType: "Usuário",
+			TargetID:   safeAtoi(doctorIDStr),
+		})
+		session.AddFlash("Fuso horário atualizado.", "success")
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, redirectURL)
+}
+
+// DeleteAvailabilityException remove uma ausência cadastrada.
+func (h *AvailabilityHandler) DeleteAvailabilityException(c *gin.Context) {
+	session := sessions.Default(c)
+	doctorIDStr := c.Param("id")
+	exceptionIDStr := c.Param("exceptionId")
+
+	result, err := h.DB.Exec("DELETE FROM therapist_availability_exceptions WHERE id = $1 AND doctor_id = $2", exceptionIDStr, doctorIDStr)
+	if err != nil {
+		log.Printf("Erro ao remover exceção de disponibilidade: %v", err)
+		session.AddFlash("Não foi possível remover a ausência.", "error")
+	} else if affected, _ := result.RowsAffected(); affected > 0 {
+		AddAuditLog(LogAction{
+			DB:         h.DB,
+			Context:    c,
+			Action:     fmt.Sprintf("Removeu ausência do terapeuta ID %s", doctorIDStr),
+			TargetType: "Disponibilidade",
+			TargetID:   safeAtoi(exceptionIDStr),
+		})
+		session.AddFlash("Ausência removida.", "success")
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, "/admin/users/availability/"+doctorIDStr)
+}
+
+// FreeSlotsAPI devolve em JSON os horários livres de um terapeuta.
+// Parâmetros: doctor_id (obrigatório), from e to (AAAA-MM-DD, padrão: próximos 7 dias)
+// e duration (minutos, padrão 60).
+func (h *AvailabilityHandler) FreeSlotsAPI(c *gin.Context) {
+	doctorID, err := strconv.Atoi(c.Query("doctor_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "doctor_id inválido"})
+		return
+	}
+
+	from := clinicToday()
+	if fromStr := c.Query("from"); fromStr != "" {
+		from, err = parseClinicDate(fromStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Data inicial inválida"})
+			return
+		}
+	}
+	to := from.AddDate(0, 0, 7)
+	if toStr := c.Query("to"); toStr != "" {
+		parsed, err := parseClinicDate(toStr)
+		if err != nil || parsed.Before(from) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Data final inválida"})
+			return
+		}
+		to = parsed.AddDate(0, 0, 1) // A data final é inclusiva
+	}
+	// Limita a janela para evitar consultas muito pesadas
+	if to.Sub(from) > 31*24*time.Hour {
+		to = from.AddDate(0, 0, 31)
+	}
+
+	duration := 60 * time.Minute
+	if minutes, err := strconv.Atoi(c.Query("duration")); err == nil && minutes > 0 && minutes <= 480 {
+		duration = time.Duration(minutes) * time.Minute
+	}
+
+	schedule, err := loadTherapistSchedule(h.DB, doctorID, from, to)
+	if err != nil {
+		log.Printf("Erro ao carregar disponibilidade para horários livres: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Erro ao carregar disponibilidade"})
+		return
+	}
+	if !schedule.Configured() {
+		c.JSON(http.StatusOK, gin.H{"configured": false, "slots": []gin.H{}})
+		return
+	}
+
+	slots, err := findFreeSlots(h.DB, schedule, doctorID, from, to, duration)
+	if err != nil {
+		log.Printf("Erro ao calcular horários livres: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Erro ao calcular horários livres"})
+		return
+	}
+
+	// Os horários voltam no fuso da clínica, o mesmo em que o formulário de agendamento é lido
+	loc := storage.ClinicLocation()
+	result := []gin.H{}
+	for _, slot := range slots {
+		start, end := slot.Start.In(loc), slot.End.In(loc)
+		result = append(result, gin.H{
+			"date":       start.Format("2006-01-02"),
+			"start_time": start.Format("15:04"),
+			"end_time":   end.Format("15:04"),
+			"start":      start.Format(time.RFC3339),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"configured": true, "slots": result})
+}
+
+// validClock verifica se o texto está no formato "HH:MM".
+func validClock(clock string) bool {
+	_, err := time.Parse("15:04", clock)
+	return err == nil
+}
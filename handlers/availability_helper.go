@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"mediflow/storage"
+)
+
+// weekdayNames traduz o número do dia da semana (time.Weekday) para exibição.
+var weekdayNames = []string{"Domingo", "Segunda-feira", "Terça-feira", "Quarta-feira", "Quinta-feira", "Sexta-feira", "Sábado"}
+
+// outsideAvailabilityMessage é exibida quando o horário pedido não está dentro do expediente do terapeuta.
+const outsideAvailabilityMessage = "O horário escolhido está fora da disponibilidade do terapeuta (expediente, intervalo ou período de ausência)."
+
+// TimeRange é um intervalo de tempo fechado no início e aberto no fim: [Start, End).
+type TimeRange struct {
+	Start time.Time
+	End   time.Time
+}
+
+// TherapistSchedule agrega a disponibilidade semanal e as exceções de um terapeuta. Os blocos e
+// as exceções são horários de parede no fuso do terapeuta (Location), que é o da clínica a menos
+// que ele atenda de outro fuso.
+type TherapistSchedule struct {
+	Blocks     []storage.AvailabilityBlock
+	Exceptions []storage.AvailabilityException
+	Location   *time.Location
+}
+
+// Configured indica se o terapeuta possui expediente cadastrado. Terapeutas sem nenhum
+// bloco de trabalho não têm a agenda restringida, preservando o comportamento anterior.
+func (s TherapistSchedule) Configured() bool {
+	for _, block := range s.Blocks {
+		if block.BlockType == "trabalho" {
+			return true
+		}
+	}
+	return false
+}
+
+// WorkingRanges devolve os intervalos de atendimento do dia informado, já descontando
+// intervalos (pausas) e exceções. Os horários são montados no fuso de 'day'.
+func (s TherapistSchedule) WorkingRanges(day time.Time) []TimeRange {
+	weekday := int(day.Weekday())
+
+	var ranges []TimeRange
+	for _, block := range s.Blocks {
+		if block.Weekday == weekday && block.BlockType == "trabalho" {
+			ranges = append(ranges, clockRange(day, block.StartTime, block.EndTime))
+		}
+	}
+	for _, block := range s.Blocks {
+		if block.Weekday == weekday && block.BlockType == "intervalo" {
+			ranges = subtractRange(ranges, clockRange(day, block.StartTime, block.EndTime))
+		}
+	}
+
+	// As datas das exceções são comparadas como texto (AAAA-MM-DD) para não depender do fuso do banco
+	dayKey := day.Format("2006-01-02")
+	for _, exception := range s.Exceptions {
+		if dayKey < exception.StartDate.Format("2006-01-02") || dayKey > exception.EndDate.Format("2006-01-02") {
+			continue
+		}
+		if exception.StartTime == "" || exception.EndTime == "" {
+			return nil // Dia inteiro indisponível
+		}
+		ranges = subtractRange(ranges, clockRange(day, exception.StartTime, exception.EndTime))
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start.Before(ranges[j].Start) })
+	return ranges
+}
+
+// Covers indica se o intervalo [start, end) cabe inteiramente em um dos intervalos de atendimento.
+// O dia da semana e o horário são avaliados no fuso do terapeuta.
+func (s TherapistSchedule) Covers(start, end time.Time) bool {
+	for _, r := range s.WorkingRanges(s.in(start)) {
+		if !start.Before(r.Start) && !end.After(r.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// in converte o instante para o fuso do terapeuta.
+func (s TherapistSchedule) in(t time.Time) time.Time {
+	if s.Location == nil {
+		return t.In(storage.ClinicLocation())
+	}
+	return t.In(s.Location)
+}
+
+// loadTherapistSchedule carrega os blocos semanais do terapeuta e as exceções que tocam o período [from, to].
+func loadTherapistSchedule(db *sql.DB, doctorID int, from, to time.Time) (TherapistSchedule, error) {
+	schedule := TherapistSchedule{Location: therapistLocation(db, doctorID)}
+
+	rows, err := db.Query(`
+		SELECT id, doctor_id, weekday, to_char(start_time, 'HH24:MI'), to_char(end_time, 'HH24:MI'), block_type
+		FROM therapist_availability
+		WHERE doctor_id = $1
+		ORDER BY weekday, start_time`, doctorID)
+	if err != nil {
+		return schedule, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var block storage.AvailabilityBlock
+		if err := rows.Scan(&block.ID, &block.DoctorID, &block.Weekday, &block.StartTime, &block.EndTime, &block.BlockType); err != nil {
+			return schedule, err
+		}
+		schedule.Blocks = append(schedule.Blocks, block)
+	}
+	if err := rows.Err(); err != nil {
+		return schedule, err
+	}
+
+	// As datas das exceções são as do calendário do terapeuta
+	exceptions, err := loadAvailabilityExceptions(db, doctorID, schedule.in(from), schedule.in(to))
+	if err != nil {
+		return schedule, err
+	}
+	schedule.Exceptions = exceptions
+	return schedule, nil
+}
+
+// loadAvailabilityExceptions busca as exceções do terapeuta que se sobrepõem às datas [from, to].
+func loadAvailabilityExceptions(db *sql.DB, doctorID int, from, to time.Time) ([]storage.AvailabilityException, error) {
+	rows, err := db.Query(`
+		SELECT id, doctor_id, start_date, end_date,
+		       COALESCE(to_char(start_time, 'HH24:MI'), ''), COALESCE(to_char(end_time, 'HH24:MI'), ''), COALESCE(reason, '')
+		FROM therapist_availability_exceptions
+		WHERE doctor_id = $1 AND start_date <= $3::date AND end_date >= $2::date
+		ORDER BY start_date`, doctorID, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exceptions []storage.AvailabilityException
+	for rows.Next() {
+		var exception storage.AvailabilityException
+		if err := rows.Scan(&exception.ID, &exception.DoctorID, &exception.StartDate, &exception.EndDate,
+			&exception.StartTime, &exception.EndTime, &exception.Reason); err != nil {
+			return nil, err
+		}
+		exceptions = append(exceptions, exception)
+	}
+	return exceptions, rows.Err()
+}
+
+// findFreeSlots calcula os horários livres do terapeuta entre as datas [from, to), com a duração pedida.
+// Os horários respeitam o expediente, descontam consultas ativas e ignoram horários que já passaram.
+func findFreeSlots(db *sql.DB, schedule TherapistSchedule, doctorID int, from, to time.Time, duration time.Duration) ([]TimeRange, error) {
+	rows, err := db.Query(`
+		SELECT start_time, end_time FROM appointments
+		WHERE doctor_id = $1 AND status NOT IN ('cancelado', 'cancelado_tardio') AND start_time < $3 AND end_time > $2`,
+		doctorID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var busy []TimeRange
+	for rows.Next() {
+		var r TimeRange
+		if err := rows.Scan(&r.Start, &r.End); err != nil {
+			return nil, err
+		}
+		busy = append(busy, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return freeSlots(schedule, busy, from, to, duration, time.Now()), nil
+}
+
+// freeSlots divide o expediente de cada dia de [from, to) em horários com a duração pedida,
+// descartando os que se sobrepõem a 'busy' e os que começam antes de 'now'. Os horários avançam
+// em tempo real: num dia de mudança de horário de verão, o expediente tem uma hora a mais ou a menos.
+func freeSlots(schedule TherapistSchedule, busy []TimeRange, from, to time.Time, duration time.Duration, now time.Time) []TimeRange {
+	// Os dias são percorridos no calendário do terapeuta, que pode começar antes de 'from' se o
+	// fuso dele estiver atrasado em relação ao da clínica; horários fora de [from, to) são ignorados
+	var slots []TimeRange
+	for day := dateOnly(schedule.in(from)); day.Before(to); day = addWallDate(day, 0, 0, 1) {
+		for _, working := range schedule.WorkingRanges(day) {
+			for start := working.Start; !start.Add(duration).After(working.End); start = start.Add(duration) {
+				slot := TimeRange{Start: start, End: start.Add(duration)}
+				if slot.Start.Before(now) || slot.Start.Before(from) || !slot.Start.Before(to) || overlapsAny(slot, busy) {
+					continue
+				}
+				slots = append(slots, slot)
+			}
+		}
+	}
+	return slots
+}
+
+// overlapsAny indica se o intervalo se sobrepõe a algum dos intervalos da lista.
+func overlapsAny(r TimeRange, others []TimeRange) bool {
+	for _, other := range others {
+		if r.Start.Before(other.End) && r.End.After(other.Start) {
+			return true
+		}
+	}
+	return false
+}
+
+// subtractRange remove 'cut' de cada intervalo da lista, dividindo-os quando necessário.
+func subtractRange(ranges []TimeRange, cut TimeRange) []TimeRange {
+	var result []TimeRange
+	for _, r := range ranges {
+		if !cut.Start.Before(r.End) || !cut.End.After(r.Start) {
+			result = append(result, r) // Sem interseção
+			continue
+		}
+		if r.Start.Before(cut.Start) {
+			result = append(result, TimeRange{Start: r.Start, End: cut.Start})
+		}
+		if cut.End.Before(r.End) {
+			result = append(result, TimeRange{Start: cut.End, End: r.End})
+		}
+	}
+	return result
+}
+
+// clockRange monta um intervalo no dia informado a partir de dois horários "HH:MM".
+func clockRange(day time.Time, startClock, endClock string) TimeRange {
+	return TimeRange{Start: atClock(day, startClock), End: atClock(day, endClock)}
+}
+
+// atClock devolve o instante do dia informado no horário "HH:MM", no fuso de 'day'.
+func atClock(day time.Time, clock string) time.Time {
+	var hour, minute int
+	fmt.Sscanf(clock, "%d:%d", &hour, &minute)
+	return wallTime(day.Year(), day.Month(), day.Day(), hour, minute, 0, day.Location())
+}
+
+// dateOnly zera o horário mantendo o fuso (veja wallTime para os dias sem meia-noite).
+func dateOnly(t time.Time) time.Time {
+	return wallTime(t.Year(), t.Month(), t.Day(), 0, 0, 0, t.Location())
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"mediflow/storage"
+)
+
+// sundaySchedule é um expediente de domingo de madrugada, que cobre a hora de mudança do horário de
+// verão de Nova York, com um intervalo das 03:00 às 03:30.
+func sundaySchedule(loc *time.Location) TherapistSchedule {
+	return TherapistSchedule{
+		Location: loc,
+		Blocks: []storage.AvailabilityBlock{
+			{Weekday: 0, StartTime: "00:00", EndTime: "05:00", BlockType: "trabalho"},
+			{Weekday: 0, StartTime: "03:00", EndTime: "03:30", BlockType: "intervalo"},
+		},
+	}
+}
+
+func TestWorkingRangesDST(t *testing.T) {
+	ny := mustLoad(t, "America/New_York")
+	schedule := sundaySchedule(ny)
+	tests := []struct {
+		name  string
+		day   string
+		hours []time.Duration // Duração real de cada intervalo de atendimento
+	}{
+		{"domingo comum", "2024-03-17", []time.Duration{3 * time.Hour, 90 * time.Minute}},
+		{"início do horário de verão (dia de 23h)", "2024-03-10", []time.Duration{2 * time.Hour, 90 * time.Minute}},
+		{"fim do horário de verão (dia de 25h)", "2024-11-03", []time.Duration{4 * time.Hour, 90 * time.Minute}},
+		{"segunda-feira sem expediente", "2024-03-11", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			day, _ := time.ParseInLocation("2006-01-02", tt.day, ny)
+			ranges := schedule.WorkingRanges(day)
+			if len(ranges) != len(tt.hours) {
+				t.Fatalf("recebeu %v", ranges)
+			}
+			for i, r := range ranges {
+				if got := r.End.Sub(r.Start); got != tt.hours[i] {
+					t.Errorf("intervalo %d (%v–%v) dura %v, esperava %v", i, r.Start, r.End, got, tt.hours[i])
+				}
+				if r.Start.In(ny).Format("2006-01-02") != tt.day {
+					t.Errorf("intervalo %d começa em outro dia: %v", i, r.Start)
+				}
+			}
+		})
+	}
+}
+
+func TestWorkingRangesDayWithoutMidnight(t *testing.T) {
+	// 04/11/2018 em America/Sao_Paulo: o relógio pulou de 00:00 para 01:00
+	sp := mustLoad(t, "America/Sao_Paulo")
+	schedule := TherapistSchedule{Location: sp, Blocks: []storage.AvailabilityBlock{
+		{Weekday: 0, StartTime: "00:00", EndTime: "02:00", BlockType: "trabalho"},
+	}}
+	day := wallTime(2018, time.November, 4, 0, 0, 0, sp)
+	ranges := schedule.WorkingRanges(day)
+	if len(ranges) != 1 {
+		t.Fatalf("recebeu %v", ranges)
+	}
+	if got := ranges[0].Start.In(sp).Format("2006-01-02 15:04"); got != "2018-11-04 01:00" {
+		t.Errorf("o expediente começa em %s, esperava 2018-11-04 01:00", got)
+	}
+	if got := ranges[0].End.Sub(ranges[0].Start); got != time.Hour {
+		t.Errorf("o expediente dura %v, esperava 1h", got)
+	}
+}
+
+func TestFreeSlotsDST(t *testing.T) {
+	ny := mustLoad(t, "America/New_York")
+	schedule := sundaySchedule(ny)
+	past := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		day  string
+		busy []TimeRange
+		want []string // Início de cada horário livre, em Nova York
+	}{
+		{
+			name: "domingo comum",
+			day:  "2024-03-17",
+			want: []string{"00:00 EDT", "01:00 EDT", "02:00 EDT", "03:30 EDT"},
+		},
+		{
+			name: "início do horário de verão: 02:00 não existe",
+			day:  "2024-03-10",
+			want: []string{"00:00 EST", "01:00 EST", "03:30 EDT"},
+		},
+		{
+			name: "fim do horário de verão: 01:00 acontece duas vezes",
+			day:  "2024-11-03",
+			want: []string{"00:00 EDT", "01:00 EDT", "01:00 EST", "02:00 EST", "03:30 EST"},
+		},
+		{
+			name: "consulta na hora repetida (01:00 EST) ocupa só ela",
+			day:  "2024-11-03",
+			busy: []TimeRange{{Start: utc(t, "2024-11-03 06:00"), End: utc(t, "2024-11-03 07:00")}},
+			want: []string{"00:00 EDT", "01:00 EDT", "02:00 EST", "03:30 EST"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, _ := time.ParseInLocation("2006-01-02", tt.day, ny)
+			to := addWallDate(from, 0, 0, 1)
+			slots := freeSlots(schedule, tt.busy, from, to, time.Hour, past)
+			var got []string
+			for _, s := range slots {
+				got = append(got, s.Start.In(ny).Format("15:04 MST"))
+				if s.End.Sub(s.Start) != time.Hour {
+					t.Errorf("horário %v não dura 1h", s)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("recebeu %v, esperava %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("recebeu %v, esperava %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFreeSlotsSkipsPast(t *testing.T) {
+	ny := mustLoad(t, "America/New_York")
+	from, _ := time.ParseInLocation("2006-01-02", "2024-11-03", ny)
+	now := utc(t, "2024-11-03 06:30") // 01:30 EST, a segunda 01:30 do dia
+	slots := freeSlots(sundaySchedule(ny), nil, from, addWallDate(from, 0, 0, 1), time.Hour, now)
+	if len(slots) != 2 || slots[0].Start.In(ny).Format("15:04 MST") != "02:00 EST" {
+		t.Fatalf("recebeu %v", slots)
+	}
+}
@@ -0,0 +1,422 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"mediflow/storage"
+)
+
+// BookingHandler cuida do agendamento online: a página pública em que pacientes (logados no
+// portal) e interessados escolhem terapeuta e horário livre, e a confirmação dos pedidos pela
+// secretária. Os pedidos entram como 'pre_agendado' e reservam o horário até expirar.
+//
+//	BOOKING_HOLD_HOURS             validade da reserva sem confirmação (padrão 24)
+//	BOOKING_RATE_LIMIT_PER_HOUR    pedidos aceitos por IP a cada hora (padrão 5; 0 desativa)
+//	BOOKING_MAX_PENDING_ANONYMOUS  pedidos sem login aguardando confirmação, de todos os IPs (padrão 20; 0 desativa)
+type BookingHandler struct {
+	DB         *sql.DB
+	Limiter    *RateLimiter
+	Hold       time.Duration
+	MaxPending int // Limite global de pedidos anônimos pendentes, que não depende do IP
+}
+
+// BookingTherapist é um terapeuta com expediente cadastrado, disponível para agendamento online.
+type BookingTherapist struct {
+	ID   int
+	Name string
+}
+
+// NewBookingHandler cria o handler a partir das variáveis de ambiente.
+func NewBookingHandler(db *sql.DB) *BookingHandler {
+	limit := bookingEnvInt("BOOKING_RATE_LIMIT_PER_HOUR", 5)
+	return &BookingHandler{DB: db, Limiter: NewRateLimiter(limit, time.Hour), Hold: bookingHoldDuration(),
+		MaxPending: bookingEnvInt("BOOKING_MAX_PENDING_ANONYMOUS", 20)}
+}
+
+// bookingEnvInt lê um limite inteiro não negativo do ambiente, com valor padrão.
+func bookingEnvInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("AVISO: %s '%s' inválido; usando %d.", name, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// ShowBookingPage exibe os terapeutas e, escolhido um terapeuta, os horários livres dos próximos dias.
+func (h *BookingHandler) ShowBookingPage(c *gin.Context) {
+	session := sessions.Default(c)
+	errorFlashes := session.Flashes("error")
+	successFlashes := session.Flashes("success")
+	session.Save()
+
+	// Reservas vencidas liberam o horário antes do cálculo, sem esperar a tarefa periódica
+	if _, err := expireBookingHolds(c.Request.Context(), h.DB, time.Now()); err != nil {
+		log.Printf("Erro ao expirar pedidos de agendamento online: %v", err)
+	}
+
+	therapists, err := h.bookingTherapists()
+	if err != nil {
+		log.Printf("Erro ao buscar terapeutas para o agendamento online: %v", err)
+		c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Não foi possível carregar a página de agendamento."})
+		return
+	}
+	serviceTypes, err := loadServiceTypes(h.DB, true)
+	if err != nil {
+		log.Printf("Erro ao buscar tipos de sessão para o agendamento online: %v", err)
+	}
+
+	doctorID, _ := strconv.Atoi(c.Query("doctor_id"))
+	serviceTypeID, _ := strconv.Atoi(c.Query("service_type_id"))
+	data := gin.H{
+		"Title":          "Agendar Consulta",
+		"PatientName":    session.Get("patient_name"),
+		"LoggedIn":       session.Get("patient_id") != nil,
+		"Therapists":     therapists,
+		"ServiceTypes":   serviceTypes,
+		"DoctorID":       doctorID,
+		"ServiceTypeID":  serviceTypeID,
+		"HoldHours":      int(h.Hold.Hours()),
+		"WeekdayNames":   weekdayNames,
+		"ErrorFlashes":   errorFlashes,
+		"SuccessFlashes": successFlashes,
+	}
+
+	if doctorID != 0 && bookingTherapistListed(therapists, doctorID) {
+		service, err := h.bookingService(serviceTypeID, doctorID)
+		if err != nil {
+			c.HTML(http.StatusBadRequest, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Tipo de sessão inválido."})
+			return
+		}
+		slots, _, err := upcomingFreeSlots(h.DB, doctorID, service.Duration, onlineBookingDays)
+		if err != nil {
+			log.Printf("Erro ao calcular horários livres do terapeuta %d para o agendamento online: %v", doctorID, err)
+			c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Não foi possível carregar os horários livres."})
+			return
+		}
+		data["Selected"] = true
+		data["Days"] = groupSlotsByDay(slots)
+		if service.ServiceTypeID.Valid {
+			data["Price"] = service.Price
+		}
+	}
+
+	c.HTML(http.StatusOK, "portal/booking.html", data)
+}
+
+// PostBooking grava o pedido de agendamento e volta para a página de agendamento.
+func (h *BookingHandler) PostBooking(c *gin.Context) {
+	session := sessions.Default(c)
+	if h.book(c) && session.Get("patient_id") != nil {
+		c.Redirect(http.StatusFound, "/portal/appointments")
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/agendar?doctor_id=%d&service_type_id=%d", safeAtoi(c.PostForm("doctor_id")), safeAtoi(c.PostForm("service_type_id"))))
+}
+
+// book valida o pedido e cria a consulta 'pre_agendado', deixando as mensagens na sessão. Um
+// paciente logado no portal agenda para si; um interessado informa nome e contato e é cadastrado
+// como novo paciente, para a secretária conferir (e unificar, se já existir) ao confirmar.
+func (h *BookingHandler) book(c *gin.Context) bool {
+	session := sessions.Default(c)
+	defer session.Save()
+
+	now := time.Now()
+	if !h.Limiter.Allow(c.ClientIP(), now) {
+		log.Printf("Agendamento online: limite de pedidos atingido para o IP %s", c.ClientIP())
+		session.AddFlash("Muitas solicitações a partir da sua conexão. Tente novamente mais tarde ou entre em contato com a clínica.", "error")
+		return false
+	}
+	if _, err := expireBookingHolds(c.Request.Context(), h.DB, now); err != nil {
+		log.Printf("Erro ao expirar pedidos de agendamento online: %v", err)
+	}
+
+	patientID, loggedIn := session.Get("patient_id").(int)
+	name := strings.TrimSpace(c.PostForm("name"))
+	email := strings.TrimSpace(c.PostForm("email"))
+	phone := strings.TrimSpace(c.PostForm("phone"))
+	if !loggedIn {
+		if message := validateBookingContact(name, email, phone); message != "" {
+			session.AddFlash(message, "error")
+			return false
+		}
+		// Cada pedido anônimo cadastra um paciente e reserva um horário: o limite global contém quem
+		// troca de IP para escapar do limite por conexão
+		if h.MaxPending > 0 {
+			pending, err := countAnonymousBookingHolds(h.DB, now)
+			if err != nil {
+				log.Printf("Erro ao contar pedidos de agendamento online pendentes: %v", err)
+				session.AddFlash("Não foi possível registrar o pedido. Tente novamente.", "error")
+				return false
+			}
+			if pending >= h.MaxPending {
+				log.Printf("Agendamento online: limite de %d pedidos anônimos pendentes atingido", h.MaxPending)
+				session.AddFlash("No momento não é possível registrar novos pedidos online. Tente novamente mais tarde ou entre em contato com a clínica.", "error")
+				return false
+			}
+		}
+	}
+
+	doctorID, _ := strconv.Atoi(c.PostForm("doctor_id"))
+	therapists, err := h.bookingTherapists()
+	if err != nil || !bookingTherapistListed(therapists, doctorID) {
+		if err != nil {
+			log.Printf("Erro ao buscar terapeutas para o agendamento online: %v", err)
+		}
+		session.AddFlash("Escolha um dos terapeutas disponíveis.", "error")
+		return false
+	}
+	serviceTypeID, _ := strconv.Atoi(c.PostForm("service_type_id"))
+	service, err := h.bookingService(serviceTypeID, doctorID)
+	if err != nil {
+		session.AddFlash("Tipo de sessão inválido.", "error")
+		return false
+	}
+	start, err := time.Parse(time.RFC3339, c.PostForm("start"))
+	if err != nil {
+		session.AddFlash("Escolha um dos horários disponíveis.", "error")
+		return false
+	}
+
+	// Só são aceitos horários que continuam livres no momento do pedido
+	slots, _, err := upcomingFreeSlots(h.DB, doctorID, service.Duration, onlineBookingDays)
+	if err != nil {
+		log.Printf("Erro ao calcular horários livres do terapeuta %d para o agendamento online: %v", doctorID, err)
+		session.AddFlash("Não foi possível registrar o pedido. Tente novamente.", "error")
+		return false
+	}
+	if !slotOffered(slots, start) {
+		session.AddFlash("O horário escolhido não está mais disponível. Escolha outro horário.", "error")
+		return false
+	}
+	if loggedIn {
+		if message, err := validateAppointmentSlot(h.DB, doctorID, patientID, start, start.Add(service.Duration)); err != nil || message != "" {
+			if err != nil {
+				log.Printf("Erro ao validar horário do agendamento online: %v", err)
+			}
+			session.AddFlash("Você já tem uma consulta neste horário. Escolha outro horário.", "error")
+			return false
+		}
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		log.Printf("Erro ao iniciar transação do agendamento online: %v", err)
+		session.AddFlash("Não foi possível registrar o pedido. Tente novamente.", "error")
+		return false
+	}
+	defer tx.Rollback()
+
+	if !loggedIn {
+		err := tx.QueryRow(`INSERT INTO patients (name, email, mobile, booking_unconfirmed, created_at, updated_at)
+			VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), TRUE, $4, $4) RETURNING id`, name, email, phone, now).Scan(&patientID)
+		if err != nil {
+			log.Printf("Erro ao cadastrar paciente do agendamento online: %v", err)
+			session.AddFlash("Não foi possível registrar o pedido. Tente novamente.", "error")
+			return false
+		}
+	}
+
+	appointmentID, err := insertAppointment(tx, NewAppointment{
+		PatientID:     patientID,
+		DoctorID:      doctorID,
+		Start:         start,
+		Duration:      service.Duration,
+		Status:        statusBookingHold,
+		ServiceTypeID: service.ServiceTypeID,
+		Price:         service.Price,
+		HoldExpiresAt: sql.NullTime{Time: bookingHoldExpiry(start, now, h.Hold), Valid: true},
+	})
+	if err == nil {
+		action := fmt.Sprintf("Pedido de agendamento online da consulta ID %d para %s", appointmentID, start.In(storage.ClinicLocation()).Format("02/01/2006 15:04"))
+		if !loggedIn {
+			action += fmt.Sprintf(" por novo paciente '%s' (ID %d, IP %s)", name, patientID, c.ClientIP())
+			AddSystemAuditLog(tx, action, "Consulta", appointmentID)
+		}
+		err = tx.Commit()
+		if err == nil && loggedIn {
+			AddPatientAuditLog(h.DB, c, action, "Consulta", appointmentID)
+		}
+	}
+	if err != nil {
+		if isOverlapViolation(err) {
+			session.AddFlash("O horário escolhido acabou de ser ocupado. Escolha outro horário.", "error")
+			return false
+		}
+		log.Printf("Erro ao gravar pedido de agendamento online: %v", err)
+		session.AddFlash("Não foi possível registrar o pedido. Tente novamente.", "error")
+		return false
+	}
+
+	session.AddFlash(fmt.Sprintf("Pedido registrado para %s. O horário fica reservado enquanto a clínica confirma o agendamento.",
+		start.In(storage.ClinicLocation()).Format("02/01/2006 às 15:04")), "success")
+	return true
+}
+
+// ConfirmBookingRequest confirma um pedido de agendamento online, que passa a 'agendado'.
+func (h *BookingHandler) ConfirmBookingRequest(c *gin.Context) {
+	h.resolveBookingRequest(c, "agendado")
+	c.Redirect(http.StatusFound, "/secretaria/dashboard")
+}
+
+// RejectBookingRequest recusa um pedido de agendamento online, liberando o horário.
+func (h *BookingHandler) RejectBookingRequest(c *gin.Context) {
+	h.resolveBookingRequest(c, "cancelado")
+	c.Redirect(http.StatusFound, "/secretaria/dashboard")
+}
+
+// resolveBookingRequest grava a decisão da secretária sobre o pedido, com auditoria. Pedidos com a
+// reserva vencida não podem mais ser confirmados: o horário pode já ter sido oferecido a outros.
+func (h *BookingHandler) resolveBookingRequest(c *gin.Context, status string) {
+	session := sessions.Default(c)
+	defer session.Save()
+
+	appointmentID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		session.AddFlash("Pedido de agendamento não encontrado.", "error")
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		log.Printf("Erro ao iniciar transação do pedido de agendamento online ID %d: %v", appointmentID, err)
+		session.AddFlash("Não foi possível atualizar o pedido de agendamento.", "error")
+		return
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE appointments SET status = $1, hold_expires_at = NULL, updated_at = NOW() WHERE id = $2 AND status = $3 AND hold_expires_at > NOW() RETURNING patient_id"
+	if status == "cancelado" {
+		query = "UPDATE appointments SET status = $1, payment_status = 'isento', updated_at = NOW() WHERE id = $2 AND status = $3 RETURNING patient_id"
+	}
+	var patientID int
+	err = tx.QueryRow(query, status, appointmentID, statusBookingHold).Scan(&patientID)
+	if err == sql.ErrNoRows {
+		session.AddFlash("O pedido não está mais aguardando confirmação (a reserva pode ter expirado).", "error")
+		return
+	}
+	if err == nil {
+		// Confirmado, o cadastro passa a ser de um paciente da clínica; recusado, o cadastro criado
+		// pelo pedido anônimo é descartado
+		if status == "cancelado" {
+			_, err = discardBookingPatient(tx, patientID)
+		} else {
+			_, err = tx.Exec("UPDATE patients SET booking_unconfirmed = FALSE WHERE id = $1", patientID)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Erro ao resolver o pedido de agendamento online ID %d: %v", appointmentID, err)
+		session.AddFlash("Não foi possível atualizar o pedido de agendamento.", "error")
+		return
+	}
+
+	action, message := "Confirmou", "Agendamento confirmado."
+	if status == "cancelado" {
+		action, message = "Recusou", "Pedido de agendamento recusado; o horário foi liberado."
+	}
+	AddAuditLog(LogAction{
+		DB:         h.DB,
+		Context:    c,
+		Action:     fmt.Sprintf("%s o pedido de agendamento online da consulta ID %d", action, appointmentID),
+		TargetType: "Consulta",
+		TargetID:   appointmentID,
+	})
+	session.AddFlash(message, "success")
+}
+
+// bookingTherapists lista os terapeutas ativos com expediente cadastrado: sem expediente, não há
+// como calcular horários livres.
+func (h *BookingHandler) bookingTherapists() ([]BookingTherapist, error) {
+	rows, err := h.DB.Query(`
+		SELECT u.id, u.name FROM users u
+		WHERE u.user_type = 'terapeuta' AND u.deleted_at IS NULL
+		  AND EXISTS (SELECT 1 FROM therapist_availability ta WHERE ta.doctor_id = u.id AND ta.block_type = 'trabalho')
+		ORDER BY u.name ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var therapists []BookingTherapist
+	for rows.Next() {
+		var t BookingTherapist
+		if err := rows.Scan(&t.ID, &t.Name); err != nil {
+			return nil, err
+		}
+		therapists = append(therapists, t)
+	}
+	return therapists, rows.Err()
+}
+
+// bookingService resolve o tipo de sessão escolhido no agendamento online. Só tipos ativos são
+// aceitos; sem tipo, vale a duração padrão.
+func (h *BookingHandler) bookingService(serviceTypeID, doctorID int) (appointmentService, error) {
+	service := appointmentService{Duration: defaultAppointmentDuration}
+	if serviceTypeID == 0 {
+		return service, nil
+	}
+	st, price, err := resolveServiceType(h.DB, serviceTypeID, doctorID)
+	if err != nil {
+		return service, err
+	}
+	if !st.Active {
+		return service, fmt.Errorf("tipo de sessão %d inativo", serviceTypeID)
+	}
+	service.ServiceTypeID = sql.NullInt64{Int64: int64(st.ID), Valid: true}
+	service.Duration = time.Duration(st.DurationMinutes) * time.Minute
+	service.Price = price
+	return service, nil
+}
+
+// bookingTherapistListed indica se o terapeuta está entre os disponíveis para agendamento online.
+func bookingTherapistListed(therapists []BookingTherapist, doctorID int) bool {
+	for _, t := range therapists {
+		if t.ID == doctorID {
+			return true
+		}
+	}
+	return false
+}
+
+// validateBookingContact confere os dados do interessado sem cadastro. Devolve a mensagem de erro,
+// ou "" quando os dados são válidos.
+func validateBookingContact(name, email, phone string) string {
+	if len(strings.Fields(name)) < 2 {
+		return "Informe seu nome completo."
+	}
+	if email == "" && phone == "" {
+		return "Informe um e-mail ou telefone para contato."
+	}
+	if email != "" {
+		if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+			return "O e-mail informado é inválido."
+		}
+	}
+	digits := 0
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	if phone != "" && (digits < 10 || digits > 13) {
+		return "O telefone informado é inválido. Inclua o DDD."
+	}
+	return ""
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"mediflow/storage"
+)
+
+// Status dos pedidos de agendamento online: o horário fica reservado (as restrições de exclusão
+// valem para ele) até a secretária confirmar o pedido ou a reserva expirar.
+const statusBookingHold = "pre_agendado"
+
+// Quantos dias à frente o agendamento online oferece horários.
+const onlineBookingDays = 30
+
+// BookingRequest é um pedido de agendamento online aguardando a confirmação da secretária.
+type BookingRequest struct {
+	ID            int
+	PatientID     int
+	PatientName   string
+	Email         string
+	Phone         string
+	DoctorName    string
+	ServiceName   string
+	StartTime     time.Time
+	EndTime       time.Time
+	HoldExpiresAt time.Time
+	NewPatient    bool // Paciente sem outras consultas nem consentimento: cadastrado pelo próprio pedido
+	Duplicates    int  // Outros pacientes com o mesmo e-mail ou telefone
+}
+
+// bookingHoldDuration lê BOOKING_HOLD_HOURS: por quanto tempo um pedido online reserva o horário
+// antes de expirar sem confirmação (padrão 24 horas).
+func bookingHoldDuration() time.Duration {
+	hold := 24 * time.Hour
+	if value := os.Getenv("BOOKING_HOLD_HOURS"); value != "" {
+		hours, err := strconv.ParseFloat(value, 64)
+		if err != nil || hours <= 0 {
+			log.Printf("AVISO: BOOKING_HOLD_HOURS '%s' inválido; usando 24 horas.", value)
+		} else {
+			hold = time.Duration(hours * float64(time.Hour))
+		}
+	}
+	return hold
+}
+
+// bookingHoldExpiry calcula quando a reserva de um pedido expira: após a duração configurada ou
+// no início da consulta, o que vier primeiro.
+func bookingHoldExpiry(start, now time.Time, hold time.Duration) time.Time {
+	if expiry := now.Add(hold); expiry.Before(start) {
+		return expiry
+	}
+	return start
+}
+
+// expireBookingHolds cancela os pedidos de agendamento online cuja reserva expirou sem
+// confirmação, liberando os horários. Roda com a tarefa de status e antes de calcular os horários
+// livres do agendamento online. Devolve quantos pedidos expiraram.
+func expireBookingHolds(ctx context.Context, db *sql.DB, now time.Time) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		UPDATE appointments SET status = 'cancelado', payment_status = 'isento', updated_at = $2
+		WHERE status = $1 AND hold_expires_at <= $2
+		RETURNING id, patient_id`, statusBookingHold, now)
+	if err != nil {
+		return 0, err
+	}
+	var ids, patientIDs []int
+	for rows.Next() {
+		var id, patientID int
+		if err := rows.Scan(&id, &patientID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		patientIDs = append(patientIDs, patientID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, id := range ids {
+		AddSystemAuditLog(tx, fmt.Sprintf("Pedido de agendamento online da consulta ID %d expirou sem confirmação", id), "Consulta", id)
+		if _, err := discardBookingPatient(tx, patientIDs[i]); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if len(ids) > 0 {
+		log.Printf("Agendamento online: %d pedido(s) expiraram sem confirmação.", len(ids))
+	}
+	return len(ids), nil
+}
+
+// countAnonymousBookingHolds conta os pedidos de agendamento online com reserva em vigor feitos sem
+// login, isto é, de pacientes cadastrados pelo próprio pedido.
+func countAnonymousBookingHolds(db *sql.DB, now time.Time) (int, error) {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM appointments a JOIN patients p ON a.patient_id = p.id
+		WHERE a.status = $1 AND a.hold_expires_at > $2 AND p.booking_unconfirmed`, statusBookingHold, now).Scan(&count)
+	return count, err
+}
+
+// discardBookingPatient exclui, como as demais exclusões de paciente (deleted_at), o cadastro criado
+// por um pedido de agendamento online sem login que foi recusado ou expirou. O paciente só é
+// excluído se nunca teve consulta confirmada, consentimento nem anexos. Devolve se excluiu.
+func discardBookingPatient(db execer, patientID int) (bool, error) {
+	result, err := db.Exec(`
+		UPDATE patients p SET deleted_at = NOW(), updated_at = NOW()
+		WHERE p.id = $1 AND p.deleted_at IS NULL AND p.booking_unconfirmed AND p.consent_given_at IS NULL
+		  AND NOT EXISTS (SELECT 1 FROM appointments a WHERE a.patient_id = p.id AND a.status <> 'cancelado')
+		  AND NOT EXISTS (SELECT 1 FROM patient_attachments pa WHERE pa.patient_id = p.id)`, patientID)
+	if err != nil {
+		return false, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return false, nil
+	}
+	AddSystemAuditLog(db, fmt.Sprintf("Excluiu o cadastro do paciente ID %d, criado por pedido de agendamento online não confirmado", patientID), "Paciente", patientID)
+	return true, nil
+}
+
+// loadBookingRequests lista os pedidos de agendamento online com reserva em vigor, dos mais
+// próximos aos mais distantes.
+func loadBookingRequests(db *sql.DB) ([]BookingRequest, error) {
+	rows, err := db.Query(`
+		SELECT a.id, a.patient_id, p.name, COALESCE(p.email, ''), COALESCE(NULLIF(p.mobile, ''), p.phone, ''),
+		       u.name, COALESCE(st.name, ''), a.start_time, a.end_time, a.hold_expires_at,
+		       p.consent_given_at IS NULL AND NOT EXISTS (
+		           SELECT 1 FROM appointments o WHERE o.patient_id = a.patient_id AND o.id <> a.id AND o.status <> $1),
+		       (SELECT COUNT(*) FROM patients d
+		        WHERE d.id <> p.id AND d.deleted_at IS NULL
+		          AND ((p.email <> '' AND LOWER(d.email) = LOWER(p.email))
+		            OR (COALESCE(NULLIF(p.mobile, ''), p.phone, '') <> '' AND COALESCE(NULLIF(p.mobile, ''), p.phone, '') IN (d.phone, d.mobile))))
+		FROM appointments a
+		JOIN patients p ON a.patient_id = p.id
+		JOIN users u ON a.doctor_id = u.id
+		LEFT JOIN service_types st ON a.service_type_id = st.id
+		WHERE a.status = $1 AND a.hold_expires_at > NOW()
+		ORDER BY a.start_time ASC`, statusBookingHold)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	loc := storage.ClinicLocation()
+	var requests []BookingRequest
+	for rows.Next() {
+		var r BookingRequest
+		if err := rows.Scan(&r.ID, &r.PatientID, &r.PatientName, &r.Email, &r.Phone, &r.DoctorName, &r.ServiceName,
+			&r.StartTime, &r.EndTime, &r.HoldExpiresAt, &r.NewPatient, &r.Duplicates); err != nil {
+			return nil, err
+		}
+		r.StartTime, r.EndTime, r.HoldExpiresAt = r.StartTime.In(loc), r.EndTime.In(loc), r.HoldExpiresAt.In(loc)
+		requests = append(requests, r)
+	}
+	return requests, rows.Err()
+}
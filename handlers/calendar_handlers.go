@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// Janela de consultas publicada no feed de assinatura do terapeuta.
+const (
+	calendarFeedPast   = 60 * 24 * time.Hour
+	calendarFeedFuture = 365 * 24 * time.Hour
+)
+
+// CalendarHandler exporta a agenda em iCalendar (.ics): o download da semana exibida na agenda
+// da clínica e o feed de assinatura individual de cada terapeuta.
+type CalendarHandler struct {
+	DB *sql.DB
+}
+
+// ExportWeek baixa em .ics a mesma semana exibida em ViewAgenda (parâmetro "date"),
+// opcionalmente filtrada por terapeuta ("doctor_id"). Usado pelos painéis da secretária e do admin.
+func (h *CalendarHandler) ExportWeek(c *gin.Context) {
+	referenceDate := clinicNow()
+	if dateParam := c.Query("date"); dateParam != "" {
+		parsed, err := parseClinicDate(dateParam)
+		if err != nil {
+			c.HTML(http.StatusBadRequest, "layouts/error.html", gin.H{"Title": "Data Inválida", "Message": "Use o formato AAAA-MM-DD."})
+			return
+		}
+		referenceDate = parsed
+	}
+	startOfWeek := dateOnly(referenceDate.AddDate(0, 0, -int(referenceDate.Weekday())))
+	endOfWeek := startOfWeek.AddDate(0, 0, 7)
+
+	query := "SELECT " + calendarEventColumns + " " + calendarEventJoins + " WHERE a.start_time >= $1 AND a.start_time < $2"
+	args := []interface{}{startOfWeek, endOfWeek}
+	if doctorID, err := strconv.Atoi(c.Query("doctor_id")); err == nil {
+		query += " AND a.doctor_id = $3"
+		args = append(args, doctorID)
+	}
+	query += " ORDER BY a.start_time ASC"
+
+	events, err := scanCalendarEvents(h.DB, query, args...)
+	if err != nil {
+		log.Printf("Erro ao exportar a agenda em iCalendar: %v", err)
+		c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Não foi possível exportar a agenda."})
+		return
+	}
+
+	name := "Agenda MediFlow - semana de " + startOfWeek.Format("02/01/2006")
+	serveICalendar(c, "agenda-"+startOfWeek.Format("2006-01-02")+".ics", buildICalendar(name, events, true), true)
+}
+
+// TherapistFeed publica o feed de assinatura de um terapeuta, identificado apenas pelo token
+// secreto da URL (aplicativos de agenda não enviam cookies). Inclui as consultas canceladas
+// para que elas sejam removidas das agendas que já as importaram.
+func (h *CalendarHandler) TherapistFeed(c *gin.Context) {
+	token := strings.TrimSuffix(c.Param("token"), ".ics")
+
+	var doctorID int
+	var doctorName string
+	var fullNames bool
+	err := h.DB.QueryRow(`
+		SELECT id, name, calendar_full_names FROM users
+		WHERE calendar_token = $1 AND user_type = 'terapeuta' AND deleted_at IS NULL`, token).
+		Scan(&doctorID, &doctorName, &fullNames)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Erro ao buscar o feed de agenda: %v", err)
+		}
+		c.String(http.StatusNotFound, "Agenda não encontrada.")
+		return
+	}
+
+	now := time.Now()
+	events, err := scanCalendarEvents(h.DB, "SELECT "+calendarEventColumns+" "+calendarEventJoins+`
+		WHERE a.doctor_id = $1 AND a.start_time >= $2 AND a.start_time < $3
+		ORDER BY a.start_time ASC`, doctorID, now.Add(-calendarFeedPast), now.Add(calendarFeedFuture))
+	if err != nil {
+		log.Printf("Erro ao montar o feed de agenda do terapeuta %d: %v", doctorID, err)
+		c.String(http.StatusInternalServerError, "Erro ao gerar a agenda.")
+		return
+	}
+
+	serveICalendar(c, "mediflow.ics", buildICalendar("MediFlow - "+doctorName, events, fullNames), false)
+}
+
+// PostCalendarFeed gera (ou troca) o link secreto de assinatura do terapeuta logado e grava a
+// preferência de exibir nomes completos. Trocar o link invalida o anterior.
+func (h *CalendarHandler) PostCalendarFeed(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id").(int)
+	fullNames := c.PostForm("full_names") == "on"
+
+	token, err := generateSecureToken(24)
+	if err != nil {
+		log.Printf("Erro ao gerar token de agenda: %v", err)
+		session.AddFlash("Não foi possível gerar o link da agenda.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/terapeuta/dashboard")
+		return
+	}
+
+	_, err = h.DB.Exec("UPDATE users SET calendar_token = $1, calendar_full_names = $2, updated_at = NOW() WHERE id = $3", token, fullNames, userID)
+	if err != nil {
+		log.Printf("Erro ao salvar token de agenda do usuário %d: %v", userID, err)
+		session.AddFlash("Não foi possível gerar o link da agenda.", "error")
+	} else {
+		AddAuditLog(LogAction{
+			DB:         h.DB,
+			Context:    c,
+			Action:     fmt.Sprintf("Gerou novo link de assinatura da agenda (nomes completos: %t)", fullNames),
+			TargetType: "Usuário",
+			TargetID:   userID,
+		})
+		session.AddFlash("Novo link da agenda gerado. Links anteriores deixaram de funcionar.", "success")
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, "/terapeuta/dashboard")
+}
+
+// RevokeCalendarFeed desativa o link de assinatura do terapeuta logado.
+func (h *CalendarHandler) RevokeCalendarFeed(c *gin.Context) {
+	session := sessions.Default(c)
+	userID := session.Get("user_id").(int)
+
+	_, err := h.DB.Exec("UPDATE users SET calendar_token = NULL, updated_at = NOW() WHERE id = $1", userID)
+	if err != nil {
+		log.Printf("Erro ao revogar token de agenda do usuário %d: %v", userID, err)
+		session.AddFlash("Não foi possível desativar o link da agenda.", "error")
+	} else {
+		AddAuditLog(LogAction{
+			DB:         h.DB,
+			Context:    c,
+			Action:     "Desativou o link de assinatura da agenda",
+			TargetType: "Usuário",
+			TargetID:   userID,
+		})
+		session.AddFlash("Link da agenda desativado.", "success")
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, "/terapeuta/dashboard")
+}
+
+// calendarFeedURL monta a URL do feed sobre o endereço público configurado em PORTAL_BASE_URL,
+// nunca sobre o cabeçalho Host da requisição. Sem o endereço configurado, devolve só o caminho.
+func calendarFeedURL(token string) string {
+	return fmt.Sprintf("%s/calendar/%s.ics", portalBaseURL(), token)
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// CancellationPolicy define a janela de cancelamento e as taxas cobradas por cancelamentos
+// tardios e faltas. É lida do .env:
+//
+//	CANCELLATION_WINDOW_HOURS      antecedência mínima para cancelar sem custo (padrão 24)
+//	LATE_CANCELLATION_FEE_PERCENT  percentual do valor da sessão cobrado no cancelamento tardio (padrão 0 = sem taxa)
+//	NO_SHOW_FEE_PERCENT            percentual do valor da sessão cobrado na falta (padrão 0 = sem taxa)
+type CancellationPolicy struct {
+	Window               time.Duration
+	LateCancelFeePercent float64
+	NoShowFeePercent     float64
+}
+
+// loadCancellationPolicy lê a política de cancelamento das variáveis de ambiente.
+func loadCancellationPolicy() CancellationPolicy {
+	policy := CancellationPolicy{Window: 24 * time.Hour}
+	if hours, err := strconv.Atoi(os.Getenv("CANCELLATION_WINDOW_HOURS")); err == nil && hours >= 0 {
+		policy.Window = time.Duration(hours) * time.Hour
+	}
+	policy.LateCancelFeePercent = envPercent("LATE_CANCELLATION_FEE_PERCENT")
+	policy.NoShowFeePercent = envPercent("NO_SHOW_FEE_PERCENT")
+	return policy
+}
+
+// envPercent lê um percentual entre 0 e 100; valores ausentes ou inválidos valem 0.
+func envPercent(name string) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil || value < 0 || value > 100 {
+		return 0
+	}
+	return value
+}
+
+// CancellationStatus classifica o cancelamento: dentro da janela é 'cancelado_tardio'.
+func (p CancellationPolicy) CancellationStatus(start, now time.Time) string {
+	if start.Sub(now) < p.Window {
+		return "cancelado_tardio"
+	}
+	return "cancelado"
+}
+
+// Fee calcula a taxa devida para o status final da consulta (zero quando não há cobrança).
+func (p CancellationPolicy) Fee(status string, price float64) float64 {
+	percent := 0.0
+	switch status {
+	case "cancelado_tardio":
+		percent = p.LateCancelFeePercent
+	case "faltou":
+		percent = p.NoShowFeePercent
+	}
+	return math.Round(price*percent) / 100
+}
+
+// isCancelledStatus indica se o status libera o horário da consulta.
+func isCancelledStatus(status string) bool {
+	return status == "cancelado" || status == "cancelado_tardio"
+}
+
+// execer é satisfeita tanto por *sql.DB quanto por *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// errAppointmentChanged indica que a consulta mudou de status entre a leitura e a gravação (outra
+// pessoa a cancelou, confirmou ou registrou falta ao mesmo tempo).
+var errAppointmentChanged = errors.New("a consulta foi alterada por outra pessoa ou já está encerrada; recarregue a página")
+
+// closeAppointment grava o desfecho de cancelamento ou falta de uma consulta, aplicando a política.
+// Com taxa, o valor da consulta passa a ser a taxa e o pagamento fica pendente; sem taxa, uma
+// consulta ainda não paga fica isenta. Devolve o status gravado. A linha é travada (FOR UPDATE)
+// quando chamada dentro de uma transação e, em todo caso, só é gravada se o status ainda for o
+// lido: dois encerramentos simultâneos nunca se sobrepõem nem cobram a taxa duas vezes.
+func closeAppointment(db execer, policy CancellationPolicy, appointmentID int, outcome string, now time.Time) (string, float64, error) {
+	var start time.Time
+	var price float64
+	var currentStatus, paymentStatus string
+	err := db.QueryRow("SELECT start_time, COALESCE(price, 0), status, payment_status FROM appointments WHERE id = $1 FOR UPDATE", appointmentID).
+		Scan(&start, &price, &currentStatus, &paymentStatus)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if isCancelledStatus(currentStatus) || currentStatus == "faltou" {
+		return "", 0, fmt.Errorf("a consulta já está encerrada como '%s'", currentStatus)
+	}
+
+	status := outcome
+	if outcome == "cancelado" && currentStatus != statusBookingHold {
+		// Pedidos de agendamento online ainda não confirmados nunca geram cancelamento tardio
+		status = policy.CancellationStatus(start, now)
+	}
+	if outcome == "faltou" && start.After(now) {
+		return "", 0, fmt.Errorf("não é possível registrar falta em uma consulta que ainda não aconteceu")
+	}
+
+	fee := policy.Fee(status, price)
+	var result sql.Result
+	switch {
+	case paymentStatus == "pago":
+		// Pagamentos já recebidos não são alterados; estornos são tratados fora do sistema
+		result, err = db.Exec("UPDATE appointments SET status = $1, updated_at = $2 WHERE id = $3 AND status = $4",
+			status, now, appointmentID, currentStatus)
+	case fee > 0:
+		result, err = db.Exec("UPDATE appointments SET status = $1, price = $2, payment_status = 'pendente', fee_charged = TRUE, updated_at = $3 WHERE id = $4 AND status = $5",
+			status, fee, now, appointmentID, currentStatus)
+	default:
+		result, err = db.Exec("UPDATE appointments SET status = $1, payment_status = 'isento', updated_at = $2 WHERE id = $3 AND status = $4",
+			status, now, appointmentID, currentStatus)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return "", 0, err
+	} else if n != 1 {
+		return "", 0, errAppointmentChanged
+	}
+	if currentStatus != status {
+		log.Printf("Consulta ID %d: status '%s' → '%s' (taxa R$ %.2f)", appointmentID, currentStatus, status, fee)
+	}
+	return status, fee, nil
+}
+
+// outcomeMessage descreve para o usuário o resultado de um cancelamento ou falta.
+func outcomeMessage(status string, fee float64) string {
+	var message string
+	switch status {
+	case "cancelado_tardio":
+		message = "Consulta cancelada fora do prazo (cancelamento tardio)."
+	case "faltou":
+		message = "Falta registrada."
+	default:
+		return "Consulta desmarcada."
+	}
+	if fee > 0 {
+		message += fmt.Sprintf(" Taxa de R$ %.2f lançada como pagamento pendente.", fee)
+	}
+	return message
+}
+
+// recordAppointmentOutcome aplica um cancelamento ou falta vindo dos painéis, com auditoria
+// e mensagem para o usuário. Compartilhada pelos painéis da secretária e do administrador.
+func recordAppointmentOutcome(c *gin.Context, db *sql.DB, appointmentID int, outcome string) {
+	session := sessions.Default(c)
+	defer session.Save()
+
+	status, fee, err := closeAppointment(db, loadCancellationPolicy(), appointmentID, outcome, time.Now())
+	if err != nil {
+		log.Printf("Erro ao registrar '%s' na consulta ID %d: %v", outcome, appointmentID, err)
+		session.AddFlash("Não foi possível atualizar a consulta: "+err.Error()+".", "error")
+		return
+	}
+
+	action := fmt.Sprintf("Alterou a consulta ID %d para '%s'", appointmentID, status)
+	if fee > 0 {
+		action += fmt.Sprintf(" com taxa de R$ %.2f", fee)
+	}
+	AddAuditLog(LogAction{
+		DB:         db,
+		Context:    c,
+		Action:     action,
+		TargetType: "Consulta",
+		TargetID:   appointmentID,
+	})
+	session.AddFlash(outcomeMessage(status, fee), "success")
+
+	// O horário liberado é oferecido aos pacientes compatíveis da lista de espera
+	if isCancelledStatus(status) {
+		if offers := notifyWaitlist(db, appointmentID); offers > 0 {
+			session.AddFlash(waitlistOffersMessage(offers), "success")
+		}
+	}
+}
+
+// noShowCounts devolve o número de faltas e de cancelamentos tardios do paciente.
+func noShowCounts(db *sql.DB, patientID int) (int, int, error) {
+	var noShows, lateCancels int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FILTER (WHERE status = 'faltou'), COUNT(*) FILTER (WHERE status = 'cancelado_tardio')
+		FROM appointments WHERE patient_id = $1`, patientID).Scan(&noShows, &lateCancels)
+	return noShows, lateCancels, err
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCancellationStatusWindow(t *testing.T) {
+	policy := CancellationPolicy{Window: 24 * time.Hour}
+	start := utc(t, "2024-06-10 14:00")
+	tests := []struct {
+		name string
+		now  time.Time
+		want string
+	}{
+		{"dois dias antes", start.Add(-48 * time.Hour), "cancelado"},
+		{"exatamente no limite da janela", start.Add(-24 * time.Hour), "cancelado"},
+		{"um segundo dentro da janela", start.Add(-24*time.Hour + time.Second), "cancelado_tardio"},
+		{"uma hora antes", start.Add(-time.Hour), "cancelado_tardio"},
+		{"depois do início", start.Add(time.Minute), "cancelado_tardio"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.CancellationStatus(start, tt.now); got != tt.want {
+				t.Fatalf("recebeu %s, esperava %s", got, tt.want)
+			}
+		})
+	}
+
+	// Sem janela, só o cancelamento depois do início é tardio
+	noWindow := CancellationPolicy{}
+	if got := noWindow.CancellationStatus(start, start); got != "cancelado" {
+		t.Errorf("janela zero no horário da consulta: recebeu %s, esperava cancelado", got)
+	}
+	if got := noWindow.CancellationStatus(start, start.Add(time.Second)); got != "cancelado_tardio" {
+		t.Errorf("janela zero depois do início: recebeu %s, esperava cancelado_tardio", got)
+	}
+}
+
+func TestCancellationFee(t *testing.T) {
+	policy := CancellationPolicy{Window: 24 * time.Hour, LateCancelFeePercent: 50, NoShowFeePercent: 100}
+	tests := []struct {
+		status string
+		price  float64
+		want   float64
+	}{
+		{"cancelado", 150, 0},
+		{"cancelado_tardio", 150, 75},
+		{"faltou", 150, 150},
+		{"concluido", 150, 0},
+		{"agendado", 150, 0},
+		{"cancelado_tardio", 0, 0},
+		{"cancelado_tardio", 99.99, 50}, // 49,995 arredonda para 50,00
+	}
+	for _, tt := range tests {
+		if got := policy.Fee(tt.status, tt.price); got != tt.want {
+			t.Errorf("Fee(%s, %.2f) = %.2f, esperava %.2f", tt.status, tt.price, got, tt.want)
+		}
+	}
+
+	if got := (CancellationPolicy{LateCancelFeePercent: 33}).Fee("cancelado_tardio", 99.99); got != 33 {
+		t.Errorf("33%% de 99,99 = %.2f, esperava 33,00", got)
+	}
+	if got := (CancellationPolicy{}).Fee("faltou", 150); got != 0 {
+		t.Errorf("sem taxa configurada, a falta custou %.2f", got)
+	}
+}
+
+func TestLoadCancellationPolicy(t *testing.T) {
+	tests := []struct {
+		window, late, noShow string
+		want                 CancellationPolicy
+	}{
+		{"", "", "", CancellationPolicy{Window: 24 * time.Hour}},
+		{"48", "50", "100", CancellationPolicy{Window: 48 * time.Hour, LateCancelFeePercent: 50, NoShowFeePercent: 100}},
+		{"0", "12.5", "0", CancellationPolicy{LateCancelFeePercent: 12.5}},
+		{"-1", "101", "-5", CancellationPolicy{Window: 24 * time.Hour}},
+		{"abc", "x", "", CancellationPolicy{Window: 24 * time.Hour}},
+	}
+	for _, tt := range tests {
+		t.Setenv("CANCELLATION_WINDOW_HOURS", tt.window)
+		t.Setenv("LATE_CANCELLATION_FEE_PERCENT", tt.late)
+		t.Setenv("NO_SHOW_FEE_PERCENT", tt.noShow)
+		if got := loadCancellationPolicy(); got != tt.want {
+			t.Errorf("janela %q, tardio %q, falta %q: recebeu %+v, esperava %+v", tt.window, tt.late, tt.noShow, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"mediflow/storage"
+)
+
+// checkinFields são as perguntas do check-in antes da sessão: as mesmas seis escalas emocionais do
+// prontuário e um campo livre.
+var checkinFields = []IntakeField{
+	{Name: "anxiety_level", Label: "Ansiedade", Kind: intakeLevel, Required: true, Max: 10},
+	{Name: "anger_level", Label: "Raiva", Kind: intakeLevel, Required: true, Max: 10},
+	{Name: "fear_level", Label: "Medo", Kind: intakeLevel, Required: true, Max: 10},
+	{Name: "sadness_level", Label: "Tristeza", Kind: intakeLevel, Required: true, Max: 10},
+	{Name: "joy_level", Label: "Alegria", Kind: intakeLevel, Required: true, Max: 10},
+	{Name: "energy_level", Label: "Energia", Kind: intakeLevel, Required: true, Max: 10},
+	{Name: "notes", Label: "Como você chega para esta sessão? Conte o que quiser que o terapeuta saiba.", Kind: intakeTextarea, MaxLen: 2000},
+}
+
+// checkinOpensBefore é quanto tempo antes da consulta o check-in fica disponível no portal
+// (PORTAL_CHECKIN_OPENS_HOURS, padrão 48). Ele fecha no horário de início da sessão.
+func checkinOpensBefore() time.Duration {
+	if hours, err := strconv.Atoi(os.Getenv("PORTAL_CHECKIN_OPENS_HOURS")); err == nil && hours > 0 {
+		return time.Duration(hours) * time.Hour
+	}
+	return 48 * time.Hour
+}
+
+// checkinOpen indica se o paciente pode responder (ou corrigir) o check-in da consulta agora.
+func checkinOpen(status string, start, now time.Time) bool {
+	return status == "agendado" && start.After(now) && start.Sub(now) <= checkinOpensBefore()
+}
+
+// checkinValues devolve as respostas do check-in no formato do formulário.
+func checkinValues(ci storage.SessionCheckin) map[string]string {
+	return map[string]string{
+		"anxiety_level": strconv.Itoa(ci.AnxietyLevel),
+		"anger_level":   strconv.Itoa(ci.AngerLevel),
+		"fear_level":    strconv.Itoa(ci.FearLevel),
+		"sadness_level": strconv.Itoa(ci.SadnessLevel),
+		"joy_level":     strconv.Itoa(ci.JoyLevel),
+		"energy_level":  strconv.Itoa(ci.EnergyLevel),
+		"notes":         ci.Notes,
+	}
+}
+
+// checkinSelectSQL usa a data e o terapeuta da consulta e, se ela foi excluída, os copiados no
+// check-in ao respondê-lo.
+const checkinSelectSQL = `SELECT sc.id, COALESCE(sc.appointment_id, 0), sc.patient_id, COALESCE(a.start_time, sc.session_start),
+	COALESCE(u.name, ''), sc.anxiety_level, sc.anger_level, sc.fear_level, sc.sadness_level, sc.joy_level, sc.energy_level,
+	COALESCE(sc.notes, ''), sc.created_at, sc.updated_at
+	FROM session_checkins sc
+	LEFT JOIN appointments a ON sc.appointment_id = a.id
+	LEFT JOIN users u ON u.id = COALESCE(a.doctor_id, sc.doctor_id) `
+
+// scanCheckin lê uma linha de checkinSelectSQL.
+func scanCheckin(scan func(dest ...interface{}) error) (storage.SessionCheckin, error) {
+	var ci storage.SessionCheckin
+	err := scan(&ci.ID, &ci.AppointmentID, &ci.PatientID, &ci.AppointmentStart, &ci.DoctorName,
+		&ci.AnxietyLevel, &ci.AngerLevel, &ci.FearLevel, &ci.SadnessLevel, &ci.JoyLevel, &ci.EnergyLevel,
+		&ci.Notes, &ci.CreatedAt, &ci.UpdatedAt)
+	loc := storage.ClinicLocation()
+	ci.AppointmentStart, ci.CreatedAt, ci.UpdatedAt = ci.AppointmentStart.In(loc), ci.CreatedAt.In(loc), ci.UpdatedAt.In(loc)
+	return ci, err
+}
+
+// loadAppointmentCheckin busca o check-in de uma consulta; o segundo retorno é falso se não houver.
+func loadAppointmentCheckin(db *sql.DB, appointmentID int) (storage.SessionCheckin, bool, error) {
+	ci, err := scanCheckin(db.QueryRow(checkinSelectSQL+"WHERE sc.appointment_id = $1", appointmentID).Scan)
+	if err == sql.ErrNoRows {
+		return ci, false, nil
+	}
+	return ci, err == nil, err
+}
+
+// loadPatientCheckins lista os check-ins do paciente, da consulta mais recente para a mais antiga.
+func loadPatientCheckins(db *sql.DB, patientID int) ([]storage.SessionCheckin, error) {
+	rows, err := db.Query(checkinSelectSQL+"WHERE sc.patient_id = $1 ORDER BY COALESCE(a.start_time, sc.session_start) DESC", patientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var checkins []storage.SessionCheckin
+	for rows.Next() {
+		ci, err := scanCheckin(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		checkins = append(checkins, ci)
+	}
+	return checkins, rows.Err()
+}
+
+// checkinSummaryText descreve os check-ins, em ordem cronológica, para a entrada do resumo por IA.
+func checkinSummaryText(checkins []storage.SessionCheckin) string {
+	if len(checkins) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("Check-ins respondidos pelo paciente antes das sessões:\n\n")
+	for i := len(checkins) - 1; i >= 0; i-- {
+		ci := checkins[i]
+		b.WriteString(fmt.Sprintf("Antes da sessão de %s (com Dr(a). %s):\n", ci.AppointmentStart.Format("02/01/2006"), ci.DoctorName))
+		b.WriteString(fmt.Sprintf("- Níveis (0-10): Ansiedade(%d), Raiva(%d), Medo(%d), Tristeza(%d), Alegria(%d), Energia(%d)\n",
+			ci.AnxietyLevel, ci.AngerLevel, ci.FearLevel, ci.SadnessLevel, ci.JoyLevel, ci.EnergyLevel))
+		if ci.Notes != "" {
+			b.WriteString(fmt.Sprintf("- Relato do Paciente: %s\n", ci.Notes))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
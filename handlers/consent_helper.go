@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"strings"
+
+	"mediflow/storage"
+)
+
+// consentTermHash é a impressão digital do texto do termo (SHA-256 em hexadecimal). O mesmo cálculo
+// é feito em SQL ao criar a primeira versão: encode(sha256(convert_to(body, 'UTF8')), 'hex').
+func consentTermHash(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeConsentBody padroniza as quebras de linha do texto digitado, para que o mesmo texto gere
+// sempre o mesmo hash.
+func normalizeConsentBody(body string) string {
+	return strings.TrimSpace(strings.ReplaceAll(body, "\r\n", "\n"))
+}
+
+const consentTermSelectSQL = `SELECT t.id, t.version, t.title, t.body, t.content_hash, t.requires_reconsent,
+	COALESCE(u.name, ''), t.created_at
+	FROM consent_terms t LEFT JOIN users u ON t.created_by = u.id `
+
+// scanConsentTerm lê uma linha de consentTermSelectSQL.
+func scanConsentTerm(scan func(dest ...interface{}) error) (storage.ConsentTerm, error) {
+	var t storage.ConsentTerm
+	err := scan(&t.ID, &t.Version, &t.Title, &t.Body, &t.ContentHash, &t.RequiresReconsent, &t.CreatedByName, &t.CreatedAt)
+	t.CreatedAt = t.CreatedAt.In(storage.ClinicLocation())
+	return t, err
+}
+
+// loadCurrentConsentTerm devolve a versão vigente do termo (a de maior número).
+func loadCurrentConsentTerm(db execer) (storage.ConsentTerm, error) {
+	return scanConsentTerm(db.QueryRow(consentTermSelectSQL + "ORDER BY t.version DESC LIMIT 1").Scan)
+}
+
+// loadConsentTerms lista todas as versões do termo, da mais recente para a mais antiga.
+func loadConsentTerms(db *sql.DB) ([]storage.ConsentTerm, error) {
+	rows, err := db.Query(consentTermSelectSQL + "ORDER BY t.version DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var terms []storage.ConsentTerm
+	for rows.Next() {
+		t, err := scanConsentTerm(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, t)
+	}
+	return terms, rows.Err()
+}
+
+// publishConsentTerm grava uma nova versão do termo. Quando a versão exige novo aceite, o
+// consentimento de todos os pacientes deixa de valer até que aceitem o novo texto; devolve quantos
+// pacientes foram afetados.
+func publishConsentTerm(tx *sql.Tx, title, body string, requiresReconsent bool, createdBy sql.NullInt64) (storage.ConsentTerm, int64, error) {
+	term := storage.ConsentTerm{Title: title, Body: body, ContentHash: consentTermHash(body), RequiresReconsent: requiresReconsent}
+	err := tx.QueryRow(`INSERT INTO consent_terms (version, title, body, content_hash, requires_reconsent, created_by)
+		SELECT COALESCE(MAX(version), 0) + 1, $1, $2, $3, $4, $5 FROM consent_terms
+		RETURNING id, version, created_at`, title, body, term.ContentHash, requiresReconsent, createdBy).
+		Scan(&term.ID, &term.Version, &term.CreatedAt)
+	if err != nil || !requiresReconsent {
+		return term, 0, err
+	}
+
+	result, err := tx.Exec("UPDATE patients SET consent_given_at = NULL WHERE consent_given_at IS NOT NULL")
+	if err != nil {
+		return term, 0, err
+	}
+	affected, err := result.RowsAffected()
+	return term, affected, err
+}
+
+// loadPatientConsents lista os aceites do paciente, do mais recente para o mais antigo. Um aceite
+// não revogado fica "substituído" quando uma versão posterior do termo exige novo aceite.
+func loadPatientConsents(db *sql.DB, patientID int) ([]storage.PatientConsent, error) {
+	rows, err := db.Query(`
+		SELECT pc.id, pc.patient_id, pc.term_id, pc.term_version, t.title, pc.content_hash, pc.consent_name, pc.consent_cpf_rg,
+		       pc.accepted_at, COALESCE(pc.ip_address, ''), COALESCE(pc.remote_addr, ''), COALESCE(pc.user_agent, ''), pc.revoked_at,
+		       COALESCE(pc.revocation_reason, ''), COALESCE(pc.revocation_ip, ''), COALESCE(pc.revocation_remote_addr, ''),
+		       EXISTS (SELECT 1 FROM consent_terms n WHERE n.version > pc.term_version AND n.requires_reconsent)
+		FROM patient_consents pc
+		JOIN consent_terms t ON pc.term_id = t.id
+		WHERE pc.patient_id = $1
+		ORDER BY pc.accepted_at DESC`, patientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	loc := storage.ClinicLocation()
+	var consents []storage.PatientConsent
+	for rows.Next() {
+		var pc storage.PatientConsent
+		if err := rows.Scan(&pc.ID, &pc.PatientID, &pc.TermID, &pc.TermVersion, &pc.TermTitle, &pc.ContentHash, &pc.ConsentName,
+			&pc.ConsentCpfRg, &pc.AcceptedAt, &pc.IPAddress, &pc.RemoteAddr, &pc.UserAgent, &pc.RevokedAt, &pc.RevocationReason,
+			&pc.RevocationIP, &pc.RevocationRemote, &pc.Superseded); err != nil {
+			return nil, err
+		}
+		pc.AcceptedAt = pc.AcceptedAt.In(loc)
+		if pc.RevokedAt.Valid {
+			pc.RevokedAt.Time = pc.RevokedAt.Time.In(loc)
+		}
+		consents = append(consents, pc)
+	}
+	return consents, rows.Err()
+}
+
+// activePatientConsent devolve o aceite vigente do paciente, se houver.
+func activePatientConsent(db *sql.DB, patientID int) (storage.PatientConsent, bool, error) {
+	consents, err := loadPatientConsents(db, patientID)
+	if err != nil {
+		return storage.PatientConsent{}, false, err
+	}
+	for _, pc := range consents {
+		if pc.State() == "vigente" {
+			return pc, true, nil
+		}
+	}
+	return storage.PatientConsent{}, false, nil
+}
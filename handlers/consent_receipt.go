@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"mediflow/storage"
+)
+
+// maskCPF mostra só os dígitos centrais do CPF (***.456.789-**), o suficiente para o paciente
+// reconhecer o documento sem expô-lo no comprovante.
+func maskCPF(cpf string) string {
+	digits := onlyDigits(cpf)
+	if len(digits) != 11 {
+		if len(digits) <= 2 {
+			return strings.Repeat("*", len(digits))
+		}
+		return strings.Repeat("*", len(digits)-2) + digits[len(digits)-2:]
+	}
+	return "***." + digits[3:6] + "." + digits[6:9] + "-**"
+}
+
+// consentVerificationHash resume o aceite (quem, qual texto e quando) num SHA-256 impresso no
+// comprovante. Recalculado a partir de patient_consents, confirma que o comprovante corresponde ao
+// aceite registrado.
+func consentVerificationHash(pc storage.PatientConsent) string {
+	payload := strings.Join([]string{
+		fmt.Sprint(pc.ID),
+		fmt.Sprint(pc.PatientID),
+		fmt.Sprint(pc.TermVersion),
+		pc.ContentHash,
+		pc.ConsentName,
+		onlyDigits(pc.ConsentCpfRg),
+		pc.AcceptedAt.UTC().Format(time.RFC3339),
+	}, "|")
+	sum := sha256.Sum256([]byte(payload))
+	return hex.EncodeToString(sum[:])
+}
+
+// buildConsentReceiptPDF monta o comprovante do aceite com o texto integral da versão aceita.
+func buildConsentReceiptPDF(pc storage.PatientConsent, term storage.ConsentTerm, verificationHash string) []byte {
+	acceptedAt := pc.AcceptedAt.In(storage.ClinicLocation())
+	doc := newPDFDocument("Comprovante de Consentimento", acceptedAt)
+
+	doc.Heading("Comprovante de Consentimento", 16)
+	doc.Paragraph(fmt.Sprintf("Aceite nº %d registrado pelo portal do paciente.", pc.ID), 10)
+	doc.Space(6)
+
+	doc.Field("Paciente", pc.ConsentName, 11)
+	doc.Field("CPF", maskCPF(pc.ConsentCpfRg), 11)
+	doc.Field("Data e hora do aceite", acceptedAt.Format("02/01/2006 às 15:04:05 (UTC-07:00)"), 11)
+	doc.Field("Termo aceito", fmt.Sprintf("%s — versão %d", term.Title, term.Version), 11)
+	doc.Space(6)
+
+	doc.Heading(term.Title, 12)
+	doc.Paragraph(term.Body, 10)
+	doc.Space(6)
+
+	doc.Field("Hash do texto do termo (SHA-256)", term.ContentHash, 9)
+	doc.Field("Código de verificação (SHA-256)", verificationHash, 9)
+	doc.Paragraph("O código de verificação é calculado a partir do número do aceite, do paciente, da versão e do hash "+
+		"do termo, do nome, do CPF e da data do aceite. A clínica pode recalculá-lo a partir dos registros para confirmar "+
+		"a autenticidade deste comprovante.", 8)
+	return doc.Bytes()
+}
+
+// createConsentReceipt gera e arquiva o comprovante do aceite. O PDF fica guardado no banco, para
+// que cada novo download entregue exatamente o mesmo arquivo.
+func createConsentReceipt(db execer, pc storage.PatientConsent, term storage.ConsentTerm) error {
+	verificationHash := consentVerificationHash(pc)
+	pdf := buildConsentReceiptPDF(pc, term, verificationHash)
+	sum := sha256.Sum256(pdf)
+	_, err := db.Exec(`INSERT INTO consent_receipts (consent_id, patient_id, verification_hash, pdf, pdf_sha256)
+		VALUES ($1, $2, $3, $4, $5)`, pc.ID, pc.PatientID, verificationHash, pdf, hex.EncodeToString(sum[:]))
+	return err
+}
+
+// loadConsentReceipt devolve o PDF arquivado de um aceite do paciente.
+func loadConsentReceipt(db *sql.DB, patientID, consentID int) ([]byte, error) {
+	var pdf []byte
+	err := db.QueryRow("SELECT pdf FROM consent_receipts WHERE consent_id = $1 AND patient_id = $2", consentID, patientID).Scan(&pdf)
+	return pdf, err
+}
+
+// consentReceiptFilename é o nome sugerido para o download do comprovante.
+func consentReceiptFilename(consentID int) string {
+	return fmt.Sprintf("comprovante-consentimento-%d.pdf", consentID)
+}
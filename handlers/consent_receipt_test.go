@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"mediflow/storage"
+)
+
+func TestMaskCPF(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"123.456.789-09", "***.456.789-**"},
+		{"12345678909", "***.456.789-**"},
+		{"12.345.678-9", "*******89"}, // RG: só os dois últimos dígitos aparecem
+		{"12345", "***45"},
+		{"7", "*"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := maskCPF(tt.value); got != tt.want {
+			t.Errorf("maskCPF(%q) = %q, esperava %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func testConsent() storage.PatientConsent {
+	return storage.PatientConsent{
+		ID: 1, PatientID: 2, TermVersion: 3, ContentHash: "abc123", ConsentName: "Maria da Silva",
+		ConsentCpfRg: "123.456.789-09", AcceptedAt: time.Date(2024, time.May, 1, 13, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestConsentVerificationHash(t *testing.T) {
+	pc := testConsent()
+	sum := sha256.Sum256([]byte("1|2|3|abc123|Maria da Silva|12345678909|2024-05-01T13:00:00Z"))
+	want := hex.EncodeToString(sum[:])
+	if got := consentVerificationHash(pc); got != want {
+		t.Fatalf("recebeu %s, esperava %s", got, want)
+	}
+
+	// A pontuação do CPF e o fuso da data não mudam o aceite
+	same := pc
+	same.ConsentCpfRg = "12345678909"
+	same.AcceptedAt = pc.AcceptedAt.In(time.FixedZone("BRT", -3*3600))
+	if consentVerificationHash(same) != want {
+		t.Error("o hash mudou com a formatação do CPF ou o fuso da data")
+	}
+
+	changes := map[string]func(*storage.PatientConsent){
+		"nome":   func(p *storage.PatientConsent) { p.ConsentName = "Maria da Silva " },
+		"CPF":    func(p *storage.PatientConsent) { p.ConsentCpfRg = "123.456.789-00" },
+		"versão": func(p *storage.PatientConsent) { p.TermVersion = 4 },
+		"texto":  func(p *storage.PatientConsent) { p.ContentHash = "abc124" },
+		"data":   func(p *storage.PatientConsent) { p.AcceptedAt = p.AcceptedAt.Add(time.Second) },
+	}
+	for name, change := range changes {
+		changed := pc
+		change(&changed)
+		if consentVerificationHash(changed) == want {
+			t.Errorf("o hash não mudou ao alterar %s", name)
+		}
+	}
+}
+
+func TestBuildConsentReceiptPDF(t *testing.T) {
+	pc := testConsent()
+	term := storage.ConsentTerm{Version: 3, Title: "Termo de Consentimento", Body: "Declaro que li (e aceito) o termo."}
+	hash := consentVerificationHash(pc)
+	pdf := buildConsentReceiptPDF(pc, term, hash)
+
+	checkPDFStructure(t, pdf)
+	if !bytes.Equal(pdf, buildConsentReceiptPDF(pc, term, hash)) {
+		t.Error("o comprovante não é determinístico")
+	}
+	for _, want := range []string{"(Maria da Silva)", "(***.456.789-**)", `\(e aceito\)`, hash} {
+		if !bytes.Contains(pdf, []byte(want)) {
+			t.Errorf("comprovante sem %q", want)
+		}
+	}
+	if bytes.Contains(pdf, []byte("123.456.789-09")) || bytes.Contains(pdf, []byte("12345678909")) {
+		t.Error("o comprovante expõe o CPF completo")
+	}
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// ConsentTermHandler gerencia as versões do termo de consentimento exibido no portal.
+type ConsentTermHandler struct {
+	DB *sql.DB
+}
+
+// ViewConsentTerms lista as versões do termo e o formulário para publicar uma nova.
+func (h *ConsentTermHandler) ViewConsentTerms(c *gin.Context) {
+	session := sessions.Default(c)
+	errorFlashes := session.Flashes("error")
+	successFlashes := session.Flashes("success")
+	session.Save()
+
+	terms, err := loadConsentTerms(h.DB)
+	if err != nil {
+		log.Printf("Erro ao buscar termos de consentimento: %v", err)
+		c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Não foi possível carregar os termos de consentimento."})
+		return
+	}
+
+	// O formulário parte do texto vigente, para que a nova versão seja uma edição dele
+	var title, body string
+	if len(terms) > 0 {
+		title, body = terms[0].Title, terms[0].Body
+	}
+
+	c.HTML(http.StatusOK, "admin/consent_terms.html", gin.H{
+		"Title":          "Termos de Consentimento",
+		"Terms":          terms,
+		"FormTitle":      title,
+		"FormBody":       body,
+		"ActiveNav":      "consent",
+		"ErrorFlashes":   errorFlashes,
+		"SuccessFlashes": successFlashes,
+	})
+}
+
+// PostConsentTerm publica uma nova versão do termo. As versões anteriores nunca são alteradas, pois
+// os aceites dos pacientes apontam para elas.
+func (h *ConsentTermHandler) PostConsentTerm(c *gin.Context) {
+	session := sessions.Default(c)
+
+	title := strings.TrimSpace(c.PostForm("title"))
+	body := normalizeConsentBody(c.PostForm("body"))
+	requiresReconsent := c.PostForm("requires_reconsent") == "on"
+	if title == "" || body == "" {
+		session.AddFlash("Informe o título e o texto do termo.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/admin/consent-terms")
+		return
+	}
+
+	if current, err := loadCurrentConsentTerm(h.DB); err == nil && current.ContentHash == consentTermHash(body) && current.Title == title {
+		session.AddFlash("O texto é idêntico ao da versão vigente; nenhuma versão nova foi criada.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/admin/consent-terms")
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		log.Printf("Erro ao iniciar transação: %v", err)
+		session.AddFlash("Não foi possível publicar o termo.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/admin/consent-terms")
+		return
+	}
+	defer tx.Rollback()
+
+	term, affected, err := publishConsentTerm(tx, title, body, requiresReconsent, sessionUserID(c))
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Erro ao publicar termo de consentimento: %v", err)
+		session.AddFlash("Não foi possível publicar o termo.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/admin/consent-terms")
+		return
+	}
+
+	action := fmt.Sprintf("Publicou a versão %d do termo de consentimento (hash %s)", term.Version, term.ContentHash[:12])
+	if requiresReconsent {
+		action += fmt.Sprintf(", exigindo novo aceite de %d paciente(s)", affected)
+	}
+	AddAuditLog(LogAction{
+		DB:         h.DB,
+		Context:    c,
+		Action:     action,
+		TargetType: "Termo de Consentimento",
+		TargetID:   term.ID,
+	})
+
+	if requiresReconsent {
+		session.AddFlash(fmt.Sprintf("Versão %d publicada. %d paciente(s) precisarão aceitar o novo termo.", term.Version, affected), "success")
+	} else {
+		session.AddFlash(fmt.Sprintf("Versão %d publicada. Os aceites anteriores continuam válidos.", term.Version), "success")
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, "/admin/consent-terms")
+}
+
+// DownloadPatientConsentReceipt entrega à equipe o comprovante em PDF de um aceite do paciente,
+// o mesmo arquivo que o paciente baixa no portal.
+func (h *ConsentTermHandler) DownloadPatientConsentReceipt(c *gin.Context) {
+	patientID, err := strconv.Atoi(c.Param("id"))
+	consentID, err2 := strconv.Atoi(c.Param("consentId"))
+	if err != nil || err2 != nil {
+		c.HTML(http.StatusBadRequest, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Comprovante inválido."})
+		return
+	}
+
+	pdf, err := loadConsentReceipt(h.DB, patientID, consentID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Erro ao buscar o comprovante do aceite %d: %v", consentID, err)
+		}
+		c.HTML(http.StatusNotFound, "layouts/error.html", gin.H{"Title": "Não Encontrado", "Message": "Comprovante não encontrado."})
+		return
+	}
+
+	AddAuditLog(LogAction{
+		DB:         h.DB,
+		Context:    c,
+		Action:     fmt.Sprintf("Baixou o comprovante do aceite ID %d do termo de consentimento", consentID),
+		TargetType: "Paciente",
+		TargetID:   patientID,
+	})
+	c.Header("Content-Disposition", `attachment; filename="`+consentReceiptFilename(consentID)+`"`)
+	c.Data(http.StatusOK, "application/pdf", pdf)
+}
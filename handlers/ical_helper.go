@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// calendarEvent é uma consulta pronta para ser exportada em iCalendar (RFC 5545).
+type calendarEvent struct {
+	ID          int
+	Start       time.Time
+	End         time.Time
+	Status      string
+	PatientName string
+	DoctorName  string
+	ServiceName string
+	Sequence    int
+	UpdatedAt   time.Time
+}
+
+// calendarEventColumns são as colunas lidas por scanCalendarEvents, nesta ordem.
+const calendarEventColumns = `a.id, a.start_time, a.end_time, a.status, p.name, u.name, COALESCE(st.name, ''),
+	a.ical_sequence, COALESCE(a.updated_at, a.created_at)`
+
+// calendarEventJoins liga as tabelas usadas por calendarEventColumns.
+const calendarEventJoins = `FROM appointments a
+	JOIN patients p ON a.patient_id = p.id
+	JOIN users u ON a.doctor_id = u.id
+	LEFT JOIN service_types st ON a.service_type_id = st.id`
+
+// scanCalendarEvents lê as consultas de uma query que seleciona calendarEventColumns.
+func scanCalendarEvents(db *sql.DB, query string, args ...interface{}) ([]calendarEvent, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []calendarEvent
+	for rows.Next() {
+		var ev calendarEvent
+		if err := rows.Scan(&ev.ID, &ev.Start, &ev.End, &ev.Status, &ev.PatientName, &ev.DoctorName, &ev.ServiceName, &ev.Sequence, &ev.UpdatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+// patientInitials reduz o nome do paciente às iniciais ("Maria da Silva" → "M. S."),
+// ignorando preposições, para não expor o nome completo em calendários externos.
+func patientInitials(name string) string {
+	var initials []string
+	for _, part := range strings.Fields(name) {
+		switch strings.ToLower(part) {
+		case "da", "de", "do", "das", "dos", "e":
+			continue
+		}
+		r, _ := utf8.DecodeRuneInString(part)
+		initials = append(initials, string(unicode.ToUpper(r))+".")
+	}
+	return strings.Join(initials, " ")
+}
+
+// buildICalendar monta o VCALENDAR com um VEVENT por consulta. O UID é estável por consulta
+// e o SEQUENCE cresce a cada remarcação ou cancelamento, para que os aplicativos de agenda
+// atualizem o evento existente em vez de duplicá-lo. Com fullNames falso, o paciente aparece
+// apenas pelas iniciais.
+func buildICalendar(calendarName string, events []calendarEvent, fullNames bool) []byte {
+	var buf bytes.Buffer
+	line := func(content string) { writeICalLine(&buf, content) }
+
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//MediFlow//Agenda//PT-BR")
+	line("CALSCALE:GREGORIAN")
+	line("METHOD:PUBLISH")
+	line("X-WR-CALNAME:" + escapeICalText(calendarName))
+	for _, ev := range events {
+		patient := ev.PatientName
+		if !fullNames {
+			patient = patientInitials(patient)
+		}
+		summary := "Sessão - " + patient
+		if ev.ServiceName != "" {
+			summary = ev.ServiceName + " - " + patient
+		}
+		switch ev.Status {
+		case "faltou":
+			summary += " (falta)"
+		case statusBookingHold:
+			summary += " (pedido online)"
+		}
+
+		line("BEGIN:VEVENT")
+		line(fmt.Sprintf("UID:appointment-%d@mediflow", ev.ID))
+		line("SEQUENCE:" + fmt.Sprint(ev.Sequence))
+		line("DTSTAMP:" + stamp)
+		line("LAST-MODIFIED:" + ev.UpdatedAt.UTC().Format("20060102T150405Z"))
+		line("DTSTART:" + ev.Start.UTC().Format("20060102T150405Z"))
+		line("DTEND:" + ev.End.UTC().Format("20060102T150405Z"))
+		line("SUMMARY:" + escapeICalText(summary))
+		line("DESCRIPTION:" + escapeICalText("Terapeuta: "+ev.DoctorName))
+		switch {
+		case isCancelledStatus(ev.Status):
+			line("STATUS:CANCELLED")
+		case ev.Status == statusBookingHold || ev.Status == statusPendingConfirmation:
+			// Pedidos online ainda não aceitos e sessões aguardando confirmação não são compromissos firmes
+			line("STATUS:TENTATIVE")
+		default:
+			line("STATUS:CONFIRMED")
+		}
+		line("TRANSP:OPAQUE")
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	return buf.Bytes()
+}
+
+// escapeICalText aplica o escape de valores TEXT da RFC 5545.
+func escapeICalText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// writeICalLine grava uma linha terminada em CRLF, dobrando-a a cada 75 octetos sem
+// quebrar caracteres UTF-8 no meio.
+func writeICalLine(buf *bytes.Buffer, content string) {
+	limit := 75
+	for len(content) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(content[cut]) {
+			cut--
+		}
+		buf.WriteString(content[:cut])
+		buf.WriteString("\r\n ")
+		content = content[cut:]
+		limit = 74 // o espaço inicial da continuação conta no limite
+	}
+	buf.WriteString(content)
+	buf.WriteString("\r\n")
+}
+
+// serveICalendar responde com o arquivo .ics. Com download verdadeiro, o navegador salva o
+// arquivo em vez de abri-lo.
+func serveICalendar(c *gin.Context, filename string, body []byte, download bool) {
+	disposition := "inline"
+	if download {
+		disposition = "attachment"
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`%s; filename="%s"`, disposition, filename))
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", body)
+}
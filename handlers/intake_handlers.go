@@ -0,0 +1,467 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"mediflow/storage"
+)
+
+// IntakeFieldView é uma pergunta da ficha com a resposta atual e o erro de validação, se houver.
+type IntakeFieldView struct {
+	IntakeField
+	Value string
+	Error string
+}
+
+// intakeFieldViews monta as perguntas de uma etapa para o template.
+func intakeFieldViews(step IntakeStep, data, errors map[string]string) []IntakeFieldView {
+	views := make([]IntakeFieldView, 0, len(step.Fields))
+	for _, field := range step.Fields {
+		views = append(views, IntakeFieldView{IntakeField: field, Value: data[field.Name], Error: errors[field.Name]})
+	}
+	return views
+}
+
+// IntakeSummaryStep é uma etapa da ficha na tela de revisão antes do envio.
+type IntakeSummaryStep struct {
+	Number int
+	Title  string
+	Fields []IntakeFieldView
+}
+
+// ShowPortalIntake exibe a situação da ficha de anamnese do paciente e o caminho para preenchê-la.
+func (h *PortalHandler) ShowPortalIntake(c *gin.Context) {
+	session := sessions.Default(c)
+	patientID, _ := session.Get("patient_id").(int)
+	errorFlashes := session.Flashes("error")
+	successFlashes := session.Flashes("success")
+	session.Save()
+
+	intake, err := loadLatestIntake(h.DB, patientID)
+	hasIntake := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Erro ao carregar a ficha de anamnese do paciente %d: %v", patientID, err)
+		c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Não foi possível carregar sua ficha de anamnese."})
+		return
+	}
+
+	c.HTML(http.StatusOK, "portal/intake.html", gin.H{
+		"Title":          "Ficha de Anamnese",
+		"Mode":           "overview",
+		"PatientName":    session.Get("patient_name"),
+		"HasIntake":      hasIntake,
+		"Intake":         intake,
+		"Editable":       !hasIntake || intakeEditable(intake) || intake.Status == intakeApproved,
+		"Steps":          intakeSteps,
+		"ErrorFlashes":   errorFlashes,
+		"SuccessFlashes": successFlashes,
+	})
+}
+
+// intakeStepParam lê o número da etapa da URL (a partir de 1).
+func intakeStepParam(c *gin.Context) (int, bool) {
+	number, err := strconv.Atoi(c.Param("step"))
+	return number, err == nil && number >= 1 && number <= len(intakeSteps)
+}
+
+// editableIntakeData carrega as respostas que o paciente pode editar: as do rascunho ou, sem ficha
+// em aberto, o cadastro atual. Devolve falso quando a ficha já foi enviada e aguarda revisão.
+func (h *PortalHandler) editableIntakeData(patientID int) (map[string]string, bool, error) {
+	intake, err := loadLatestIntake(h.DB, patientID)
+	switch {
+	case err == nil && intake.Status == intakeSubmitted:
+		return nil, false, nil
+	case err == nil && intakeEditable(intake):
+		return intake.Data, true, nil
+	case err != nil && err != sql.ErrNoRows:
+		return nil, false, err
+	}
+	data, err := loadPatientIntakeValues(h.DB, patientID)
+	return data, err == nil, err
+}
+
+// ShowPortalIntakeStep exibe uma etapa do questionário.
+func (h *PortalHandler) ShowPortalIntakeStep(c *gin.Context) {
+	session := sessions.Default(c)
+	patientID, _ := session.Get("patient_id").(int)
+	number, ok := intakeStepParam(c)
+	if !ok {
+		c.Redirect(http.StatusFound, "/portal/anamnese")
+		return
+	}
+
+	data, editable, err := h.editableIntakeData(patientID)
+	if err != nil {
+		log.Printf("Erro ao carregar a ficha de anamnese do paciente %d: %v", patientID, err)
+	}
+	if !editable {
+		c.Redirect(http.StatusFound, "/portal/anamnese")
+		return
+	}
+	h.renderIntakeStep(c, http.StatusOK, number, data, nil)
+}
+
+// renderIntakeStep desenha a etapa com as respostas e os erros de validação.
+func (h *PortalHandler) renderIntakeStep(c *gin.Context, status, number int, data, errors map[string]string) {
+	session := sessions.Default(c)
+	successFlashes := session.Flashes("success")
+	session.Save()
+
+	step := intakeSteps[number-1]
+	c.HTML(status, "portal/intake.html", gin.H{
+		"Title":          "Ficha de Anamnese",
+		"Mode":           "step",
+		"PatientName":    session.Get("patient_name"),
+		"Step":           step,
+		"StepNumber":     number,
+		"StepCount":      len(intakeSteps),
+		"Fields":         intakeFieldViews(step, data, errors),
+		"HasErrors":      len(errors) > 0,
+		"SuccessFlashes": successFlashes,
+	})
+}
+
+// PostPortalIntakeStep grava as respostas da etapa no rascunho e segue conforme o botão usado:
+// "voltar" e "salvar" gravam sem exigir a etapa completa; "avancar" só segue com a etapa válida.
+func (h *PortalHandler) PostPortalIntakeStep(c *gin.Context) {
+	session := sessions.Default(c)
+	patientID, _ := session.Get("patient_id").(int)
+	number, ok := intakeStepParam(c)
+	if !ok {
+		c.Redirect(http.StatusFound, "/portal/anamnese")
+		return
+	}
+
+	step := intakeSteps[number-1]
+	intake, err := saveIntakeDraft(h.DB, patientID, intakeStepValues(step, c.PostForm))
+	if err == sql.ErrNoRows {
+		session.AddFlash("Sua ficha já foi enviada e está aguardando a revisão do terapeuta.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/portal/anamnese")
+		return
+	}
+	if err != nil {
+		log.Printf("Erro ao salvar o rascunho da ficha de anamnese do paciente %d: %v", patientID, err)
+		session.AddFlash("Não foi possível salvar suas respostas. Tente novamente.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/portal/anamnese")
+		return
+	}
+
+	switch c.PostForm("action") {
+	case "voltar":
+		if number == 1 {
+			c.Redirect(http.StatusFound, "/portal/anamnese")
+			return
+		}
+		c.Redirect(http.StatusFound, fmt.Sprintf("/portal/anamnese/etapa/%d", number-1))
+	case "salvar":
+		session.AddFlash("Rascunho salvo. Você pode continuar depois de onde parou.", "success")
+		session.Save()
+		c.Redirect(http.StatusFound, fmt.Sprintf("/portal/anamnese/etapa/%d", number))
+	default:
+		if errors := validateIntakeStep(step, intake.Data); len(errors) > 0 {
+			h.renderIntakeStep(c, http.StatusBadRequest, number, intake.Data, errors)
+			return
+		}
+		if number == len(intakeSteps) {
+			c.Redirect(http.StatusFound, "/portal/anamnese/revisao")
+			return
+		}
+		c.Redirect(http.StatusFound, fmt.Sprintf("/portal/anamnese/etapa/%d", number+1))
+	}
+}
+
+// ShowPortalIntakeReview mostra todas as respostas antes do envio ao terapeuta.
+func (h *PortalHandler) ShowPortalIntakeReview(c *gin.Context) {
+	session := sessions.Default(c)
+	patientID, _ := session.Get("patient_id").(int)
+	errorFlashes := session.Flashes("error")
+	session.Save()
+
+	intake, err := loadLatestIntake(h.DB, patientID)
+	if err != nil || !intakeEditable(intake) {
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Erro ao carregar a ficha de anamnese do paciente %d: %v", patientID, err)
+		}
+		c.Redirect(http.StatusFound, "/portal/anamnese")
+		return
+	}
+
+	summary := make([]IntakeSummaryStep, 0, len(intakeSteps))
+	for i, step := range intakeSteps {
+		summary = append(summary, IntakeSummaryStep{Number: i + 1, Title: step.Title, Fields: intakeFieldViews(step, intake.Data, validateIntakeStep(step, intake.Data))})
+	}
+	c.HTML(http.StatusOK, "portal/intake.html", gin.H{
+		"Title":        "Ficha de Anamnese",
+		"Mode":         "review",
+		"PatientName":  session.Get("patient_name"),
+		"Summary":      summary,
+		"Complete":     firstInvalidIntakeStep(intake.Data) == 0,
+		"ErrorFlashes": errorFlashes,
+	})
+}
+
+// SubmitPortalIntake envia a ficha para a revisão do terapeuta. A ficha inteira é validada de novo:
+// havendo respostas inválidas, o paciente volta para a primeira etapa com problema.
+func (h *PortalHandler) SubmitPortalIntake(c *gin.Context) {
+	session := sessions.Default(c)
+	patientID, _ := session.Get("patient_id").(int)
+
+	intake, err := loadLatestIntake(h.DB, patientID)
+	if err != nil || !intakeEditable(intake) {
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Erro ao carregar a ficha de anamnese do paciente %d: %v", patientID, err)
+		}
+		c.Redirect(http.StatusFound, "/portal/anamnese")
+		return
+	}
+	if invalid := firstInvalidIntakeStep(intake.Data); invalid > 0 {
+		step := intakeSteps[invalid-1]
+		h.renderIntakeStep(c, http.StatusBadRequest, invalid, intake.Data, validateIntakeStep(step, intake.Data))
+		return
+	}
+
+	result, err := h.DB.Exec("UPDATE patient_intakes SET status = $1, submitted_at = NOW(), updated_at = NOW() WHERE id = $2 AND status IN ($3, $4)",
+		intakeSubmitted, intake.ID, intakeDraft, intakeReturned)
+	var affected int64
+	if err == nil {
+		affected, err = result.RowsAffected()
+	}
+	if err != nil || affected == 0 {
+		if err != nil {
+			log.Printf("Erro ao enviar a ficha de anamnese ID %d: %v", intake.ID, err)
+		}
+		session.AddFlash("Não foi possível enviar sua ficha. Tente novamente.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/portal/anamnese/revisao")
+		return
+	}
+
+	AddPatientAuditLog(h.DB, c, fmt.Sprintf("Paciente enviou a ficha de anamnese ID %d pelo portal", intake.ID), "Paciente", patientID)
+	session.AddFlash("Ficha enviada! Seu terapeuta vai revisar as informações antes da sessão.", "success")
+	session.Save()
+	c.Redirect(http.StatusFound, "/portal/anamnese")
+}
+
+// therapistHasPatient confere se o terapeuta tem ou teve consultas com o paciente. Pedidos de
+// agendamento online ainda não confirmados e consultas canceladas não contam: um pedido anônimo não
+// pode dar acesso ao prontuário de um paciente.
+func therapistHasPatient(db *sql.DB, therapistID, patientID int) bool {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM appointments
+		WHERE patient_id = $1 AND doctor_id = $2 AND status NOT IN ($3, 'cancelado', 'cancelado_tardio')`,
+		patientID, therapistID, statusBookingHold).Scan(&count)
+	return err == nil && count > 0
+}
+
+// PendingIntake é uma ficha enviada aguardando a revisão do terapeuta, listada no dashboard.
+type PendingIntake struct {
+	PatientID   int
+	PatientName string
+	SubmittedAt sql.NullTime
+}
+
+// loadPendingIntakes lista as fichas enviadas pelos pacientes do terapeuta.
+func loadPendingIntakes(db *sql.DB, therapistID int) ([]PendingIntake, error) {
+	rows, err := db.Query(`
+		SELECT p.id, p.name, i.submitted_at
+		FROM patient_intakes i
+		JOIN patients p ON i.patient_id = p.id
+		WHERE i.status = $1 AND p.deleted_at IS NULL
+		  AND EXISTS (SELECT 1 FROM appointments a WHERE a.patient_id = p.id AND a.doctor_id = $2)
+		ORDER BY i.submitted_at ASC`, intakeSubmitted, therapistID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	loc := storage.ClinicLocation()
+	var pending []PendingIntake
+	for rows.Next() {
+		var p PendingIntake
+		if err := rows.Scan(&p.PatientID, &p.PatientName, &p.SubmittedAt); err != nil {
+			return nil, err
+		}
+		if p.SubmittedAt.Valid {
+			p.SubmittedAt.Time = p.SubmittedAt.Time.In(loc)
+		}
+		pending = append(pending, p)
+	}
+	return pending, rows.Err()
+}
+
+// ShowIntakeReview exibe a ficha mais recente do paciente, comparando cada resposta com o cadastro atual.
+func (h *TerapeutaHandler) ShowIntakeReview(c *gin.Context) {
+	session := sessions.Default(c)
+	therapistID := session.Get("user_id").(int)
+	patientID, _ := strconv.Atoi(c.Param("id"))
+	if !therapistHasPatient(h.DB, therapistID, patientID) {
+		c.HTML(http.StatusForbidden, "layouts/error.html", gin.H{"Title": "Acesso Negado", "Message": "Você não tem permissão para ver a ficha deste paciente."})
+		return
+	}
+	errorFlashes := session.Flashes("error")
+	successFlashes := session.Flashes("success")
+	session.Save()
+
+	var patientName string
+	if err := h.DB.QueryRow("SELECT name FROM patients WHERE id = $1", patientID).Scan(&patientName); err != nil {
+		log.Printf("Erro ao buscar paciente %d para revisão da ficha: %v", patientID, err)
+		c.HTML(http.StatusNotFound, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Paciente não encontrado."})
+		return
+	}
+
+	intake, err := loadLatestIntake(h.DB, patientID)
+	hasIntake := err == nil
+	var changes []IntakeChange
+	if hasIntake {
+		var current map[string]string
+		current, err = loadPatientIntakeValues(h.DB, patientID)
+		changes = diffIntake(current, intake.Data)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Erro ao carregar a ficha de anamnese do paciente %d: %v", patientID, err)
+		c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Não foi possível carregar a ficha de anamnese."})
+		return
+	}
+
+	c.HTML(http.StatusOK, "terapeuta/intake_review.html", gin.H{
+		"Title":          "Ficha de Anamnese",
+		"ActiveNav":      "dashboard",
+		"PatientID":      patientID,
+		"PatientName":    patientName,
+		"HasIntake":      hasIntake,
+		"Intake":         intake,
+		"Changes":        changes,
+		"ErrorFlashes":   errorFlashes,
+		"SuccessFlashes": successFlashes,
+	})
+}
+
+// submittedIntake carrega a ficha indicada no formulário, que precisa ser do paciente da URL,
+// pertencer a um paciente do terapeuta e estar aguardando revisão.
+func (h *TerapeutaHandler) submittedIntake(c *gin.Context) (storage.PatientIntake, int, bool) {
+	session := sessions.Default(c)
+	therapistID := session.Get("user_id").(int)
+	patientID, _ := strconv.Atoi(c.Param("id"))
+	intakeID, _ := strconv.Atoi(c.PostForm("intake_id"))
+	if !therapistHasPatient(h.DB, therapistID, patientID) {
+		c.HTML(http.StatusForbidden, "layouts/error.html", gin.H{"Title": "Acesso Negado", "Message": "Você não tem permissão para revisar a ficha deste paciente."})
+		return storage.PatientIntake{}, therapistID, false
+	}
+
+	intake, err := scanPatientIntake(h.DB.QueryRow(intakeSelectSQL+"WHERE i.id = $1 AND i.patient_id = $2", intakeID, patientID))
+	if err != nil || intake.Status != intakeSubmitted {
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Erro ao carregar a ficha de anamnese ID %d: %v", intakeID, err)
+		}
+		session.AddFlash("Esta ficha não está mais aguardando revisão.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, fmt.Sprintf("/terapeuta/pacientes/%d/anamnese", patientID))
+		return intake, therapistID, false
+	}
+	return intake, therapistID, true
+}
+
+// ApproveIntake aprova a ficha, gravando no cadastro do paciente as respostas marcadas pelo terapeuta.
+func (h *TerapeutaHandler) ApproveIntake(c *gin.Context) {
+	intake, therapistID, ok := h.submittedIntake(c)
+	if !ok {
+		return
+	}
+	session := sessions.Default(c)
+	redirect := fmt.Sprintf("/terapeuta/pacientes/%d/anamnese", intake.PatientID)
+
+	selected := make(map[string]bool)
+	for _, name := range c.PostFormArray("apply") {
+		selected[name] = true
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		log.Printf("Erro ao iniciar transação: %v", err)
+		session.AddFlash("Não foi possível aprovar a ficha. Tente novamente.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, redirect)
+		return
+	}
+	defer tx.Rollback()
+
+	// A comparação é refeita dentro da transação: vale o cadastro no momento da aprovação
+	current, err := loadPatientIntakeValues(tx, intake.PatientID)
+	var applied []IntakeChange
+	var names []string
+	if err == nil {
+		for _, change := range diffIntake(current, intake.Data) {
+			if selected[change.Field.Name] {
+				applied = append(applied, change)
+				names = append(names, change.Field.Label)
+			}
+		}
+		err = applyIntakeChanges(tx, intake.PatientID, therapistID, applied)
+	}
+	if err == nil {
+		_, err = tx.Exec(`UPDATE patient_intakes SET status = $1, reviewed_by = $2, reviewed_at = NOW(), review_notes = NULLIF($3, ''), updated_at = NOW()
+			WHERE id = $4 AND status = $5`, intakeApproved, therapistID, strings.TrimSpace(c.PostForm("review_notes")), intake.ID, intakeSubmitted)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Erro ao aprovar a ficha de anamnese ID %d: %v", intake.ID, err)
+		session.AddFlash("Não foi possível aprovar a ficha. Tente novamente.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, redirect)
+		return
+	}
+
+	action := fmt.Sprintf("Aprovou a ficha de anamnese ID %d sem alterar o cadastro", intake.ID)
+	if len(names) > 0 {
+		action = fmt.Sprintf("Aprovou a ficha de anamnese ID %d e atualizou: %s", intake.ID, strings.Join(names, ", "))
+	}
+	AddAuditLog(LogAction{DB: h.DB, Context: c, Action: action, TargetType: "Paciente", TargetID: intake.PatientID})
+	session.AddFlash(fmt.Sprintf("Ficha aprovada. %d informação(ões) atualizada(s) no cadastro.", len(applied)), "success")
+	session.Save()
+	c.Redirect(http.StatusFound, redirect)
+}
+
+// ReturnIntake devolve a ficha ao paciente para correção, com a orientação do terapeuta.
+func (h *TerapeutaHandler) ReturnIntake(c *gin.Context) {
+	intake, therapistID, ok := h.submittedIntake(c)
+	if !ok {
+		return
+	}
+	session := sessions.Default(c)
+	redirect := fmt.Sprintf("/terapeuta/pacientes/%d/anamnese", intake.PatientID)
+
+	notes := strings.TrimSpace(c.PostForm("review_notes"))
+	if notes == "" {
+		session.AddFlash("Explique ao paciente o que precisa ser corrigido.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, redirect)
+		return
+	}
+
+	_, err := h.DB.Exec(`UPDATE patient_intakes SET status = $1, reviewed_by = $2, reviewed_at = NOW(), review_notes = $3, updated_at = NOW()
+		WHERE id = $4 AND status = $5`, intakeReturned, therapistID, notes, intake.ID, intakeSubmitted)
+	if err != nil {
+		log.Printf("Erro ao devolver a ficha de anamnese ID %d: %v", intake.ID, err)
+		session.AddFlash("Não foi possível devolver a ficha. Tente novamente.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, redirect)
+		return
+	}
+
+	AddAuditLog(LogAction{DB: h.DB, Context: c, Action: fmt.Sprintf("Devolveu a ficha de anamnese ID %d ao paciente para correção", intake.ID),
+		TargetType: "Paciente", TargetID: intake.PatientID})
+	session.AddFlash("Ficha devolvida. O paciente verá sua orientação no portal.", "success")
+	session.Save()
+	c.Redirect(http.StatusFound, redirect)
+}
@@ -0,0 +1,432 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"mediflow/storage"
+)
+
+// Situações da ficha de anamnese preenchida no portal.
+const (
+	intakeDraft     = "rascunho"
+	intakeSubmitted = "enviado"
+	intakeReturned  = "devolvido" // Devolvida pelo terapeuta para o paciente corrigir
+	intakeApproved  = "aprovado"
+)
+
+// Tipos de campo da ficha. Definem o controle exibido, a validação e a conversão ao gravar em patients.
+const (
+	intakeText     = "text"
+	intakeTextarea = "textarea"
+	intakeDate     = "date"
+	intakeNumber   = "number"
+	intakeEmail    = "email"
+	intakePhone    = "tel"
+	intakeSelect   = "select"
+	intakeLevel    = "level" // Escala de 0 a 10
+)
+
+// IntakeField é uma pergunta da ficha. Name é a coluna da tabela patients que recebe a resposta
+// quando o terapeuta aprova a ficha.
+type IntakeField struct {
+	Name        string
+	Label       string
+	Kind        string
+	Options     []string
+	Required    bool
+	RequiredIf  string // Obrigatório quando o campo indicado foi respondido com "Sim"
+	MaxLen      int
+	Min, Max    int
+	Placeholder string
+}
+
+// IntakeStep é uma etapa do questionário.
+type IntakeStep struct {
+	Title  string
+	Intro  string
+	Fields []IntakeField
+}
+
+var yesNo = []string{"Sim", "Não"}
+
+// intakeSteps é o questionário, na ordem das etapas. Os campos de consentimento, o nome e as notas
+// da equipe ficam de fora: o consentimento tem o próprio termo e o resto é preenchido pela clínica.
+var intakeSteps = []IntakeStep{
+	{
+		Title: "Dados pessoais",
+		Fields: []IntakeField{
+			{Name: "dob", Label: "Data de nascimento", Kind: intakeDate, Required: true},
+			{Name: "gender", Label: "Sexo", Kind: intakeSelect, Options: []string{"F", "M", "Outro"}},
+			{Name: "marital_status", Label: "Estado civil", Kind: intakeSelect, Options: []string{"Solteiro(a)", "Casado(a)", "União estável", "Divorciado(a)", "Viúvo(a)"}},
+			{Name: "children", Label: "Tem filhos?", Kind: intakeSelect, Options: yesNo},
+			{Name: "num_children", Label: "Quantos filhos?", Kind: intakeNumber, RequiredIf: "children", Min: 1, Max: 20},
+			{Name: "profession", Label: "Profissão", Kind: intakeText, MaxLen: 255},
+		},
+	},
+	{
+		Title: "Endereço e contatos",
+		Intro: "Confira seus contatos: a clínica os usa para lembretes e para o acesso ao portal.",
+		Fields: []IntakeField{
+			{Name: "address_street", Label: "Endereço", Kind: intakeText, MaxLen: 255},
+			{Name: "address_number", Label: "Número", Kind: intakeText, MaxLen: 50},
+			{Name: "address_neighborhood", Label: "Bairro", Kind: intakeText, MaxLen: 255},
+			{Name: "address_city", Label: "Cidade", Kind: intakeText, MaxLen: 255},
+			{Name: "address_state", Label: "Estado", Kind: intakeText, MaxLen: 50},
+			{Name: "email", Label: "E-mail", Kind: intakeEmail, MaxLen: 255},
+			{Name: "mobile", Label: "Celular", Kind: intakePhone, MaxLen: 50, Placeholder: "(XX) XXXXX-XXXX"},
+			{Name: "phone", Label: "Telefone fixo", Kind: intakePhone, MaxLen: 50},
+			{Name: "emergency_contact", Label: "Contato de emergência (nome)", Kind: intakeText, Required: true, MaxLen: 255},
+			{Name: "emergency_phone", Label: "Telefone do contato de emergência", Kind: intakePhone, Required: true, MaxLen: 50},
+			{Name: "emergency_other", Label: "Relação com o contato de emergência", Kind: intakeText, MaxLen: 255},
+		},
+	},
+	{
+		Title: "Hábitos e saúde",
+		Fields: []IntakeField{
+			{Name: "repetitive_effort", Label: "Faz esforço repetitivo no trabalho ou no dia a dia?", Kind: intakeText, MaxLen: 1000},
+			{Name: "physical_activity", Label: "Pratica atividade física? Qual e com que frequência?", Kind: intakeText, MaxLen: 1000},
+			{Name: "smoker", Label: "Fuma?", Kind: intakeSelect, Options: []string{"Não", "Sim", "Ex-fumante"}},
+			{Name: "alcohol", Label: "Consome bebida alcoólica?", Kind: intakeSelect, Options: []string{"Não", "Socialmente", "Frequentemente"}},
+			{Name: "mental_disorder", Label: "Já teve diagnóstico de transtorno mental?", Kind: intakeSelect, Options: yesNo},
+			{Name: "mental_disorder_treatment", Label: "Faz ou fez tratamento para ele?", Kind: intakeSelect, Options: yesNo},
+			{Name: "mental_disorder_details", Label: "Qual diagnóstico e tratamento?", Kind: intakeTextarea, RequiredIf: "mental_disorder", MaxLen: 5000},
+			{Name: "medication", Label: "Toma algum medicamento?", Kind: intakeSelect, Options: yesNo},
+			{Name: "medication_details", Label: "Quais medicamentos e doses?", Kind: intakeTextarea, RequiredIf: "medication", MaxLen: 5000},
+			{Name: "surgery", Label: "Já fez alguma cirurgia?", Kind: intakeSelect, Options: yesNo},
+			{Name: "surgery_details", Label: "Quais cirurgias e quando?", Kind: intakeTextarea, RequiredIf: "surgery", MaxLen: 5000},
+			{Name: "allergies", Label: "Tem alguma alergia?", Kind: intakeSelect, Options: yesNo},
+			{Name: "allergies_details", Label: "A que é alérgico(a)?", Kind: intakeTextarea, RequiredIf: "allergies", MaxLen: 5000},
+			{Name: "religion", Label: "Segue alguma religião ou prática espiritual?", Kind: intakeSelect, Options: yesNo},
+			{Name: "religion_details", Label: "Qual?", Kind: intakeText, RequiredIf: "religion", MaxLen: 1000},
+		},
+	},
+	{
+		Title: "Como você está se sentindo",
+		Intro: "De 0 (nada) a 10 (muito), como você avalia cada sentimento nos últimos dias?",
+		Fields: []IntakeField{
+			{Name: "anxiety_level", Label: "Ansiedade", Kind: intakeLevel, Required: true, Max: 10},
+			{Name: "anger_level", Label: "Raiva", Kind: intakeLevel, Required: true, Max: 10},
+			{Name: "fear_level", Label: "Medo", Kind: intakeLevel, Required: true, Max: 10},
+			{Name: "sadness_level", Label: "Tristeza", Kind: intakeLevel, Required: true, Max: 10},
+			{Name: "joy_level", Label: "Alegria", Kind: intakeLevel, Required: true, Max: 10},
+			{Name: "energy_level", Label: "Energia", Kind: intakeLevel, Required: true, Max: 10},
+		},
+	},
+	{
+		Title: "Motivo da procura",
+		Fields: []IntakeField{
+			{Name: "main_complaint", Label: "O que motivou você a procurar a clínica?", Kind: intakeTextarea, Required: true, MaxLen: 5000},
+			{Name: "complaint_history", Label: "Desde quando isso acontece e como evoluiu?", Kind: intakeTextarea, MaxLen: 5000},
+			{Name: "signs_symptoms", Label: "Quais sinais e sintomas você percebe?", Kind: intakeTextarea, MaxLen: 5000},
+			{Name: "current_treatment", Label: "Está fazendo algum tratamento atualmente?", Kind: intakeTextarea, MaxLen: 5000},
+			{Name: "how_found", Label: "Como nos encontrou?", Kind: intakeSelect, Options: []string{"Instagram", "Google", "Indicação de conhecido", "Outro"}},
+			{Name: "referral_name", Label: "Quem indicou?", Kind: intakeText, MaxLen: 255},
+			{Name: "other_source", Label: "Outra forma (qual?)", Kind: intakeText, MaxLen: 255},
+		},
+	},
+}
+
+// Campos que também entram no prontuário (patient_records) quando a ficha é aprovada.
+var intakeRecordFields = []string{"anxiety_level", "anger_level", "fear_level", "sadness_level", "joy_level", "energy_level",
+	"main_complaint", "complaint_history", "signs_symptoms", "current_treatment"}
+
+// intakeFields devolve todas as perguntas, na ordem do questionário.
+func intakeFields() []IntakeField {
+	var fields []IntakeField
+	for _, step := range intakeSteps {
+		fields = append(fields, step.Fields...)
+	}
+	return fields
+}
+
+var intakeEmailRegex = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+// validateIntakeField confere uma resposta e devolve a mensagem de erro, ou "" quando é válida.
+func validateIntakeField(field IntakeField, data map[string]string, today time.Time) string {
+	value := strings.TrimSpace(data[field.Name])
+	if value == "" {
+		if field.Required || (field.RequiredIf != "" && data[field.RequiredIf] == "Sim") {
+			return "Campo obrigatório."
+		}
+		return ""
+	}
+	if field.MaxLen > 0 && len([]rune(value)) > field.MaxLen {
+		return fmt.Sprintf("Use no máximo %d caracteres.", field.MaxLen)
+	}
+
+	switch field.Kind {
+	case intakeDate:
+		date, err := parseClinicDate(value)
+		if err != nil {
+			return "Data inválida."
+		}
+		if date.After(today) || date.Year() < 1900 {
+			return "Informe uma data entre 1900 e hoje."
+		}
+	case intakeNumber, intakeLevel:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < field.Min || n > field.Max {
+			return fmt.Sprintf("Informe um número de %d a %d.", field.Min, field.Max)
+		}
+	case intakeEmail:
+		if !intakeEmailRegex.MatchString(value) {
+			return "E-mail inválido."
+		}
+	case intakePhone:
+		if digits := len(onlyDigits(value)); digits < 10 || digits > 13 {
+			return "Informe o telefone com DDD."
+		}
+	case intakeSelect:
+		for _, option := range field.Options {
+			if value == option {
+				return ""
+			}
+		}
+		return "Escolha uma das opções."
+	}
+	return ""
+}
+
+// validateIntakeStep confere as respostas de uma etapa. As chaves do mapa devolvido são as colunas.
+func validateIntakeStep(step IntakeStep, data map[string]string) map[string]string {
+	errors := make(map[string]string)
+	today := clinicToday()
+	for _, field := range step.Fields {
+		if msg := validateIntakeField(field, data, today); msg != "" {
+			errors[field.Name] = msg
+		}
+	}
+	return errors
+}
+
+// firstInvalidIntakeStep devolve o número (a partir de 1) da primeira etapa com respostas
+// inválidas, ou 0 quando a ficha inteira está válida.
+func firstInvalidIntakeStep(data map[string]string) int {
+	for i, step := range intakeSteps {
+		if len(validateIntakeStep(step, data)) > 0 {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// intakeStepValues lê do formulário as respostas de uma etapa.
+func intakeStepValues(step IntakeStep, form func(string) string) map[string]string {
+	values := make(map[string]string, len(step.Fields))
+	for _, field := range step.Fields {
+		values[field.Name] = strings.TrimSpace(form(field.Name))
+	}
+	return values
+}
+
+// loadPatientIntakeValues lê da tabela patients os valores atuais de todas as perguntas, como
+// texto: servem para pré-preencher a ficha e para comparar com as respostas na revisão.
+func loadPatientIntakeValues(db execer, patientID int) (map[string]string, error) {
+	fields := intakeFields()
+	columns := make([]string, len(fields))
+	targets := make([]interface{}, len(fields))
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		// Os nomes vêm do questionário fixo acima, nunca da requisição
+		columns[i] = fmt.Sprintf("COALESCE(%s::text, '')", field.Name)
+		targets[i] = &values[i]
+	}
+	err := db.QueryRow("SELECT "+strings.Join(columns, ", ")+" FROM patients WHERE id = $1", patientID).Scan(targets...)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]string, len(fields))
+	for i, field := range fields {
+		data[field.Name] = values[i]
+	}
+	// Níveis zerados são o padrão da tabela, não uma resposta do paciente
+	for _, field := range fields {
+		if field.Kind == intakeLevel && data[field.Name] == "0" {
+			data[field.Name] = ""
+		}
+	}
+	return data, nil
+}
+
+// intakeSelectSQL é a consulta base das fichas, com o nome de quem revisou.
+const intakeSelectSQL = `SELECT i.id, i.patient_id, i.status, i.data, i.submitted_at, COALESCE(u.name, ''), i.reviewed_at,
+	COALESCE(i.review_notes, ''), i.created_at, i.updated_at
+	FROM patient_intakes i LEFT JOIN users u ON i.reviewed_by = u.id `
+
+// scanPatientIntake lê uma linha de intakeSelectSQL.
+func scanPatientIntake(row *sql.Row) (storage.PatientIntake, error) {
+	var intake storage.PatientIntake
+	var data []byte
+	err := row.Scan(&intake.ID, &intake.PatientID, &intake.Status, &data, &intake.SubmittedAt, &intake.ReviewedBy,
+		&intake.ReviewedAt, &intake.ReviewNotes, &intake.CreatedAt, &intake.UpdatedAt)
+	if err != nil {
+		return intake, err
+	}
+	if err := json.Unmarshal(data, &intake.Data); err != nil {
+		return intake, err
+	}
+	loc := storage.ClinicLocation()
+	intake.CreatedAt, intake.UpdatedAt = intake.CreatedAt.In(loc), intake.UpdatedAt.In(loc)
+	if intake.SubmittedAt.Valid {
+		intake.SubmittedAt.Time = intake.SubmittedAt.Time.In(loc)
+	}
+	if intake.ReviewedAt.Valid {
+		intake.ReviewedAt.Time = intake.ReviewedAt.Time.In(loc)
+	}
+	return intake, nil
+}
+
+// loadLatestIntake devolve a ficha mais recente do paciente: a que está em aberto ou, se não houver,
+// a última aprovada. Devolve sql.ErrNoRows quando o paciente nunca começou uma ficha.
+func loadLatestIntake(db *sql.DB, patientID int) (storage.PatientIntake, error) {
+	return scanPatientIntake(db.QueryRow(intakeSelectSQL+`WHERE i.patient_id = $1
+		ORDER BY (i.status <> $2) DESC, i.created_at DESC LIMIT 1`, patientID, intakeApproved))
+}
+
+// intakeEditable indica se o paciente pode alterar a ficha.
+func intakeEditable(intake storage.PatientIntake) bool {
+	return intake.Status == intakeDraft || intake.Status == intakeReturned
+}
+
+// saveIntakeDraft grava as respostas de uma etapa no rascunho do paciente, criando-o (pré-preenchido
+// com o cadastro atual) quando não há ficha em aberto. Devolve a ficha atualizada.
+func saveIntakeDraft(db *sql.DB, patientID int, values map[string]string) (storage.PatientIntake, error) {
+	prefill, err := loadPatientIntakeValues(db, patientID)
+	if err != nil {
+		return storage.PatientIntake{}, err
+	}
+	prefillJSON, err := json.Marshal(prefill)
+	if err != nil {
+		return storage.PatientIntake{}, err
+	}
+	// O índice único garante uma só ficha em aberto, mesmo com duas abas enviando ao mesmo tempo
+	if _, err := db.Exec(`INSERT INTO patient_intakes (patient_id, data) VALUES ($1, $2)
+		ON CONFLICT (patient_id) WHERE status <> 'aprovado' DO NOTHING`, patientID, string(prefillJSON)); err != nil {
+		return storage.PatientIntake{}, err
+	}
+
+	valuesJSON, err := json.Marshal(values)
+	if err != nil {
+		return storage.PatientIntake{}, err
+	}
+	var intakeID int
+	err = db.QueryRow(`UPDATE patient_intakes SET data = data || $2::jsonb, updated_at = NOW()
+		WHERE patient_id = $1 AND status IN ($3, $4) RETURNING id`, patientID, string(valuesJSON), intakeDraft, intakeReturned).Scan(&intakeID)
+	if err != nil {
+		return storage.PatientIntake{}, err
+	}
+	return scanPatientIntake(db.QueryRow(intakeSelectSQL+"WHERE i.id = $1", intakeID))
+}
+
+// IntakeChange é uma linha da comparação entre a ficha enviada e o cadastro atual.
+type IntakeChange struct {
+	Field    IntakeField
+	Step     string
+	Current  string
+	Proposed string
+}
+
+// diffIntake compara as respostas da ficha com os valores atuais do paciente e devolve apenas as
+// perguntas cuja resposta mudou, na ordem do questionário.
+func diffIntake(current, proposed map[string]string) []IntakeChange {
+	var changes []IntakeChange
+	for _, step := range intakeSteps {
+		for _, field := range step.Fields {
+			value, answered := proposed[field.Name]
+			if !answered || strings.TrimSpace(value) == strings.TrimSpace(current[field.Name]) {
+				continue
+			}
+			changes = append(changes, IntakeChange{Field: field, Step: step.Title, Current: current[field.Name], Proposed: value})
+		}
+	}
+	return changes
+}
+
+// intakeColumnValue converte a resposta para o tipo da coluna: texto vazio vira NULL nas datas e
+// números, e a data de nascimento também atualiza a idade.
+func intakeColumnValue(field IntakeField, value string) interface{} {
+	value = strings.TrimSpace(value)
+	switch field.Kind {
+	case intakeDate:
+		return toDate(value)
+	case intakeNumber, intakeLevel:
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+		if field.Kind == intakeLevel {
+			return 0
+		}
+		return nil
+	}
+	return value
+}
+
+// applyIntakeChanges grava em patients as respostas escolhidas pelo terapeuta e, quando há
+// respostas clínicas entre elas, abre uma entrada no prontuário com o estado resultante, já assinada
+// pelo terapeuta que aprovou a ficha.
+func applyIntakeChanges(tx *sql.Tx, patientID, therapistID int, changes []IntakeChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	sets := make([]string, 0, len(changes)+2)
+	args := make([]interface{}, 0, len(changes)+3)
+	clinical := false
+	for _, change := range changes {
+		args = append(args, intakeColumnValue(change.Field, change.Proposed))
+		sets = append(sets, fmt.Sprintf("%s = $%d", change.Field.Name, len(args)))
+		if change.Field.Name == "dob" {
+			if dob, err := parseClinicDate(change.Proposed); err == nil {
+				args = append(args, ageOn(dob, clinicToday()))
+				sets = append(sets, fmt.Sprintf("age = $%d", len(args)))
+			}
+		}
+		for _, name := range intakeRecordFields {
+			if change.Field.Name == name {
+				clinical = true
+			}
+		}
+	}
+	args = append(args, time.Now(), patientID)
+	query := fmt.Sprintf("UPDATE patients SET %s, updated_at = $%d WHERE id = $%d", strings.Join(sets, ", "), len(args)-1, len(args))
+	if _, err := tx.Exec(query, args...); err != nil {
+		return err
+	}
+	if !clinical {
+		return nil
+	}
+
+	var recordID int
+	err := tx.QueryRow(`
+		INSERT INTO patient_records (
+			patient_id, doctor_id, anxiety_level, anger_level, fear_level, sadness_level,
+			joy_level, energy_level, main_complaint, complaint_history, signs_symptoms,
+			current_treatment, notes, record_date
+		)
+		SELECT id, $2, COALESCE(anxiety_level, 0), COALESCE(anger_level, 0), COALESCE(fear_level, 0), COALESCE(sadness_level, 0),
+			COALESCE(joy_level, 0), COALESCE(energy_level, 0), main_complaint, complaint_history, signs_symptoms,
+			current_treatment, $3, NOW()
+		FROM patients WHERE id = $1
+		RETURNING id`,
+		patientID, therapistID, "Respostas da ficha de anamnese preenchida pelo paciente no portal.").Scan(&recordID)
+	if err != nil {
+		return err
+	}
+	_, err = signPatientRecord(tx, recordID, therapistID)
+	return err
+}
+
+// ageOn calcula a idade completa na data informada.
+func ageOn(dob, day time.Time) int {
+	age := day.Year() - dob.Year()
+	if day.Month() < dob.Month() || (day.Month() == dob.Month() && day.Day() < dob.Day()) {
+		age--
+	}
+	return age
+}
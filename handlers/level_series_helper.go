@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"mediflow/storage"
+)
+
+// emotionLevels são as seis escalas 0-10 de cada entrada do prontuário, na ordem do formulário, com
+// a coluna, o nome usado na API e a cor do gráfico.
+var emotionLevels = []struct {
+	Key, Label, Column, Color string
+}{
+	{"anxiety", "Ansiedade", "anxiety_level", "#e67e22"},
+	{"anger", "Raiva", "anger_level", "#c0392b"},
+	{"fear", "Medo", "fear_level", "#8e44ad"},
+	{"sadness", "Tristeza", "sadness_level", "#2980b9"},
+	{"joy", "Alegria", "joy_level", "#b7950b"},
+	{"energy", "Energia", "energy_level", "#27ae60"},
+}
+
+// levelWindowMax limita a janela da média móvel, em sessões.
+const levelWindowMax = 20
+
+var (
+	errLevelFromDate = errors.New("data inicial inválida; use AAAA-MM-DD")
+	errLevelToDate   = errors.New("data final inválida; use AAAA-MM-DD")
+	errLevelRange    = errors.New("a data inicial deve ser anterior à data final")
+	errLevelWindow   = fmt.Errorf("a janela da média móvel deve ser um número de 2 a %d sessões", levelWindowMax)
+)
+
+// LevelSeriesQuery é o filtro da série: período opcional (datas no fuso da clínica, inclusivas) e
+// a janela da média móvel em sessões (0 = sem média).
+type LevelSeriesQuery struct {
+	From   string
+	To     string
+	Window int
+	from   time.Time
+	to     time.Time
+}
+
+// parseLevelSeriesQuery lê os parâmetros from, to e window da URL.
+func parseLevelSeriesQuery(get func(string) string) (LevelSeriesQuery, error) {
+	q := LevelSeriesQuery{From: strings.TrimSpace(get("from")), To: strings.TrimSpace(get("to"))}
+	var err error
+	if q.From != "" {
+		if q.from, err = parseClinicDate(q.From); err != nil {
+			return q, errLevelFromDate
+		}
+	}
+	if q.To != "" {
+		if q.to, err = parseClinicDate(q.To); err != nil {
+			return q, errLevelToDate
+		}
+	}
+	if !q.from.IsZero() && !q.to.IsZero() && q.to.Before(q.from) {
+		return q, errLevelRange
+	}
+	if window := strings.TrimSpace(get("window")); window != "" {
+		q.Window, err = strconv.Atoi(window)
+		if err != nil || q.Window == 1 || q.Window < 0 || q.Window > levelWindowMax {
+			return q, errLevelWindow
+		}
+	}
+	return q, nil
+}
+
+// LevelSession é uma sessão da série: a entrada do prontuário de onde vêm os níveis.
+type LevelSession struct {
+	RecordID int       `json:"record_id"`
+	Date     time.Time `json:"date"`
+	Signed   bool      `json:"signed"`
+}
+
+// LevelSeries são os valores de uma escala, um por sessão (nulo quando não registrado), e a média
+// móvel, quando pedida.
+type LevelSeries struct {
+	Level         string     `json:"level"`
+	Label         string     `json:"label"`
+	Color         string     `json:"-"`
+	Values        []*int     `json:"values"`
+	MovingAverage []*float64 `json:"moving_average,omitempty"`
+}
+
+// loadLevelSeries busca os níveis de cada sessão do paciente no período, em ordem cronológica.
+// Adendos ficam de fora: eles não registram níveis.
+func loadLevelSeries(db *sql.DB, patientID int, q LevelSeriesQuery) ([]LevelSession, []LevelSeries, error) {
+	columns := make([]string, len(emotionLevels))
+	for i, level := range emotionLevels {
+		columns[i] = level.Column
+	}
+	query := "SELECT id, record_date, signed_at IS NOT NULL, " + strings.Join(columns, ", ") +
+		" FROM patient_records WHERE patient_id = $1 AND addendum_of IS NULL"
+	args := []interface{}{patientID}
+	if !q.from.IsZero() {
+		args = append(args, q.from)
+		query += fmt.Sprintf(" AND record_date >= $%d", len(args))
+	}
+	if !q.to.IsZero() {
+		args = append(args, q.to.AddDate(0, 0, 1))
+		query += fmt.Sprintf(" AND record_date < $%d", len(args))
+	}
+	rows, err := db.Query(query+" ORDER BY record_date, id", args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	series := make([]LevelSeries, len(emotionLevels))
+	for i, level := range emotionLevels {
+		series[i] = LevelSeries{Level: level.Key, Label: level.Label, Color: level.Color, Values: []*int{}}
+	}
+	sessions := []LevelSession{}
+	loc := storage.ClinicLocation()
+	for rows.Next() {
+		var s LevelSession
+		values := make([]sql.NullInt64, len(emotionLevels))
+		dest := []interface{}{&s.RecordID, &s.Date, &s.Signed}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, nil, err
+		}
+		s.Date = s.Date.In(loc)
+		sessions = append(sessions, s)
+		for i, v := range values {
+			var value *int
+			if v.Valid {
+				n := int(v.Int64)
+				value = &n
+			}
+			series[i].Values = append(series[i].Values, value)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if q.Window > 0 {
+		for i := range series {
+			series[i].MovingAverage = movingAverage(series[i].Values, q.Window)
+		}
+	}
+	return sessions, series, nil
+}
+
+// movingAverage calcula a média móvel simples das últimas window sessões, ignorando as sessões sem
+// valor. As primeiras window-1 sessões não têm média.
+func movingAverage(values []*int, window int) []*float64 {
+	averages := make([]*float64, len(values))
+	for i := window - 1; i < len(values); i++ {
+		sum, count := 0, 0
+		for _, v := range values[i-window+1 : i+1] {
+			if v != nil {
+				sum += *v
+				count++
+			}
+		}
+		if count > 0 {
+			avg := math.Round(float64(sum)/float64(count)*100) / 100
+			averages[i] = &avg
+		}
+	}
+	return averages
+}
+
+// LevelChart é o gráfico de uma escala já desenhado em SVG, para o prontuário.
+type LevelChart struct {
+	Label  string
+	Latest *int // Valor da sessão mais recente, se registrado
+	SVG    template.HTML
+}
+
+// Dimensões dos gráficos de nível, em pixels.
+const (
+	levelChartWidth  = 320
+	levelChartHeight = 150
+	levelChartLeft   = 28
+	levelChartRight  = 10
+	levelChartTop    = 10
+	levelChartBottom = 24
+)
+
+// levelCharts desenha um gráfico por escala. Sem sessões no período, não há gráficos.
+func levelCharts(sessions []LevelSession, series []LevelSeries) []LevelChart {
+	if len(sessions) == 0 {
+		return nil
+	}
+	charts := make([]LevelChart, len(series))
+	for i, s := range series {
+		charts[i] = LevelChart{Label: s.Label, Latest: s.Values[len(s.Values)-1], SVG: levelChartSVG(sessions, s)}
+	}
+	return charts
+}
+
+// levelChartSVG desenha a evolução de uma escala: linha com um ponto por sessão (vazado nos
+// rascunhos), a média móvel tracejada, se houver, e grade em 0, 5 e 10.
+func levelChartSVG(sessions []LevelSession, s LevelSeries) template.HTML {
+	plotWidth := float64(levelChartWidth - levelChartLeft - levelChartRight)
+	plotHeight := float64(levelChartHeight - levelChartTop - levelChartBottom)
+	x := func(i int) float64 {
+		if len(sessions) == 1 {
+			return levelChartLeft + plotWidth/2
+		}
+		return levelChartLeft + plotWidth*float64(i)/float64(len(sessions)-1)
+	}
+	y := func(v float64) float64 {
+		return levelChartTop + plotHeight*(10-v)/10
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="100%%" role="img" aria-label="Evolução de %s (0 a 10) por sessão" style="max-width: %dpx; font-family: sans-serif;">`,
+		levelChartWidth, levelChartHeight, template.HTMLEscapeString(s.Label), levelChartWidth)
+	for _, v := range []float64{0, 5, 10} {
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#ddd" stroke-width="1"/>`,
+			levelChartLeft, y(v), levelChartWidth-levelChartRight, y(v))
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" font-size="10" fill="#777" text-anchor="end">%.0f</text>`,
+			levelChartLeft-4, y(v)+3, v)
+	}
+
+	// Datas da primeira e da última sessão no eixo horizontal
+	labelY := levelChartHeight - 6
+	first := sessions[0].Date.Format("02/01/06")
+	if len(sessions) == 1 {
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" font-size="10" fill="#777" text-anchor="middle">%s</text>`, x(0), labelY, first)
+	} else {
+		fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="10" fill="#777" text-anchor="start">%s</text>`, levelChartLeft, labelY, first)
+		fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="10" fill="#777" text-anchor="end">%s</text>`,
+			levelChartWidth-levelChartRight, labelY, sessions[len(sessions)-1].Date.Format("02/01/06"))
+	}
+
+	if s.MovingAverage != nil {
+		if path := levelChartPath(len(sessions), x, func(i int) (float64, bool) {
+			if s.MovingAverage[i] == nil {
+				return 0, false
+			}
+			return y(*s.MovingAverage[i]), true
+		}); path != "" {
+			fmt.Fprintf(&b, `<path d="%s" fill="none" stroke="#555" stroke-width="1.5" stroke-dasharray="4 3"/>`, path)
+		}
+	}
+	if path := levelChartPath(len(sessions), x, func(i int) (float64, bool) {
+		if s.Values[i] == nil {
+			return 0, false
+		}
+		return y(float64(*s.Values[i])), true
+	}); path != "" {
+		fmt.Fprintf(&b, `<path d="%s" fill="none" stroke="%s" stroke-width="2"/>`, path, s.Color)
+	}
+
+	for i, v := range s.Values {
+		if v == nil {
+			continue
+		}
+		fill := s.Color
+		status := ""
+		if !sessions[i].Signed {
+			fill, status = "#fff", " (rascunho)"
+		}
+		fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="3.5" fill="%s" stroke="%s" stroke-width="1.5"><title>%s: %d%s</title></circle>`,
+			x(i), y(float64(*v)), fill, s.Color, sessions[i].Date.Format("02/01/2006"), *v, status)
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// levelChartPath monta o traçado SVG ligando os pontos com valor; uma sessão sem valor interrompe a linha.
+func levelChartPath(n int, x func(int) float64, y func(int) (float64, bool)) string {
+	var b strings.Builder
+	move := true
+	for i := 0; i < n; i++ {
+		py, ok := y(i)
+		if !ok {
+			move = true
+			continue
+		}
+		command := "L"
+		if move {
+			command, move = "M", false
+		}
+		fmt.Fprintf(&b, "%s%.1f %.1f ", command, x(i), py)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// setLevelCharts monta os gráficos de nível do prontuário com o filtro da URL. Um filtro inválido
+// vira mensagem de erro na página e os gráficos mostram todo o histórico.
+func setLevelCharts(db *sql.DB, page *PatientEditPageData, get func(string) string) {
+	q, err := parseLevelSeriesQuery(get)
+	if err != nil {
+		page.LevelFilterError = "Filtro dos gráficos ignorado: " + err.Error() + "."
+		q = LevelSeriesQuery{}
+	}
+	page.LevelFilter = q
+	sessions, series, err := loadLevelSeries(db, page.Patient.ID, q)
+	if err != nil {
+		log.Printf("Erro ao buscar a série de níveis do paciente %d: %v", page.Patient.ID, err)
+		return
+	}
+	page.LevelCharts = levelCharts(sessions, series)
+}
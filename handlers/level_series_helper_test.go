@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func TestParseLevelSeriesQuery(t *testing.T) {
+	tests := []struct {
+		name           string
+		from, to       string
+		window         string
+		want           int
+		err            error
+		fromUTC, toUTC string // Início do dia no fuso da clínica, em UTC
+	}{
+		{name: "sem filtro"},
+		{name: "janela vazia com espaços", window: "  ", want: 0},
+		{name: "janela 0 (sem média)", window: "0", want: 0},
+		{name: "janela 1", window: "1", err: errLevelWindow},
+		{name: "janela 2", window: "2", want: 2},
+		{name: "janela máxima", window: strconv.Itoa(levelWindowMax), want: levelWindowMax},
+		{name: "janela acima do máximo", window: strconv.Itoa(levelWindowMax + 1), err: errLevelWindow},
+		{name: "janela negativa", window: "-3", err: errLevelWindow},
+		{name: "janela não numérica", window: "três", err: errLevelWindow},
+		{name: "período", from: "2024-03-01", to: "2024-03-31", window: "3", want: 3,
+			fromUTC: "2024-03-01 05:00", toUTC: "2024-03-31 04:00"},
+		{name: "mesmo dia", from: "2024-03-10", to: "2024-03-10", fromUTC: "2024-03-10 05:00", toUTC: "2024-03-10 05:00"},
+		{name: "período invertido", from: "2024-03-31", to: "2024-03-01", err: errLevelRange},
+		{name: "data inicial inválida", from: "01/03/2024", err: errLevelFromDate},
+		{name: "data final inválida", to: "2024-02-30", err: errLevelToDate},
+		{name: "só a data final", to: "2024-03-31", toUTC: "2024-03-31 04:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := map[string]string{"from": tt.from, "to": tt.to, "window": tt.window}
+			q, err := parseLevelSeriesQuery(func(name string) string { return params[name] })
+			if err != tt.err {
+				t.Fatalf("erro %v, esperava %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if q.Window != tt.want {
+				t.Errorf("janela %d, esperava %d", q.Window, tt.want)
+			}
+			if tt.fromUTC != "" && !q.from.Equal(utc(t, tt.fromUTC)) || tt.fromUTC == "" && !q.from.IsZero() {
+				t.Errorf("from = %v, esperava %s UTC", q.from, tt.fromUTC)
+			}
+			if tt.toUTC != "" && !q.to.Equal(utc(t, tt.toUTC)) || tt.toUTC == "" && !q.to.IsZero() {
+				t.Errorf("to = %v, esperava %s UTC", q.to, tt.toUTC)
+			}
+		})
+	}
+}
+
+// levels monta uma série de níveis; -1 representa uma sessão sem valor registrado.
+func levels(values ...int) []*int {
+	series := make([]*int, len(values))
+	for i, v := range values {
+		if v >= 0 {
+			n := v
+			series[i] = &n
+		}
+	}
+	return series
+}
+
+// formatAverages escreve a média móvel como texto, com "-" nas sessões sem média.
+func formatAverages(averages []*float64) string {
+	s := ""
+	for i, avg := range averages {
+		if i > 0 {
+			s += " "
+		}
+		if avg == nil {
+			s += "-"
+			continue
+		}
+		s += fmt.Sprintf("%g", *avg)
+	}
+	return s
+}
+
+func TestMovingAverage(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []*int
+		window int
+		want   string
+	}{
+		{"janela 2", levels(2, 4, 6, 8), 2, "- 3 5 7"},
+		{"janela 3", levels(1, 2, 3, 4, 10), 3, "- - 2 3 5.67"},
+		{"janela do tamanho da série", levels(3, 5, 10), 3, "- - 6"},
+		{"menos sessões que a janela", levels(3, 5), 3, "- -"},
+		{"série vazia", levels(), 3, ""},
+		{"lacuna ignorada na média", levels(4, -1, 8, 6), 3, "- - 6 7"},
+		{"lacuna no início da janela", levels(-1, 5, 7), 2, "- 5 6"},
+		{"janela inteira sem valor", levels(5, -1, -1, 9), 2, "- 5 - 9"},
+		{"arredonda para duas casas", levels(1, 1, 2), 3, "- - 1.33"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := movingAverage(tt.values, tt.window)
+			if len(got) != len(tt.values) {
+				t.Fatalf("%d médias para %d sessões", len(got), len(tt.values))
+			}
+			if s := formatAverages(got); s != tt.want {
+				t.Errorf("média móvel %q, esperava %q", s, tt.want)
+			}
+		})
+	}
+}
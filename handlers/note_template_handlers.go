@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// NoteTemplateHandler gerencia os modelos de nota de sessão (SOAP, DAP...) usados no prontuário.
+type NoteTemplateHandler struct {
+	DB *sql.DB
+}
+
+// noteTemplateForm são os valores do formulário de modelo, devolvidos à tela quando há erro.
+type noteTemplateForm struct {
+	Name        string
+	Description string
+	Definition  string
+	Error       string
+}
+
+// ViewNoteTemplates lista os modelos de nota e o formulário de cadastro.
+func (h *NoteTemplateHandler) ViewNoteTemplates(c *gin.Context) {
+	h.renderNoteTemplates(c, http.StatusOK, noteTemplateForm{})
+}
+
+// PostNoteTemplate cadastra um novo modelo de nota.
+func (h *NoteTemplateHandler) PostNoteTemplate(c *gin.Context) {
+	form, sectionsJSON, ok := noteTemplateFromForm(c)
+	if !ok {
+		h.renderNoteTemplates(c, http.StatusBadRequest, form)
+		return
+	}
+
+	var id int
+	err := h.DB.QueryRow("INSERT INTO note_templates (name, description, sections) VALUES ($1, NULLIF($2, ''), $3) RETURNING id",
+		form.Name, form.Description, sectionsJSON).Scan(&id)
+	if err != nil {
+		if isUniqueViolation(err) {
+			form.Error = "Já existe um modelo com esse nome."
+		} else {
+			log.Printf("Erro ao inserir modelo de nota: %v", err)
+			form.Error = "Não foi possível salvar o modelo."
+		}
+		h.renderNoteTemplates(c, http.StatusBadRequest, form)
+		return
+	}
+
+	AddAuditLog(LogAction{
+		DB:         h.DB,
+		Context:    c,
+		Action:     fmt.Sprintf("Criou o modelo de nota '%s'", form.Name),
+		TargetType: "Modelo de Nota",
+		TargetID:   id,
+	})
+	session := sessions.Default(c)
+	session.AddFlash("Modelo de nota criado com sucesso!", "success")
+	session.Save()
+	c.Redirect(http.StatusFound, "/admin/note-templates")
+}
+
+// GetEditNoteTemplateForm exibe o modelo com a definição em texto para edição.
+func (h *NoteTemplateHandler) GetEditNoteTemplateForm(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	template, err := loadNoteTemplate(h.DB, id)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Erro ao buscar modelo de nota %d: %v", id, err)
+		}
+		c.HTML(http.StatusNotFound, "layouts/error.html", gin.H{"Title": "Não Encontrado", "Message": "Modelo de nota não encontrado."})
+		return
+	}
+	h.renderNoteTemplateForm(c, http.StatusOK, template, noteTemplateForm{
+		Name:        template.Name,
+		Description: template.Description,
+		Definition:  formatNoteTemplate(template.Sections),
+	})
+}
+
+// PostEditNoteTemplate atualiza o modelo. As entradas já gravadas guardam uma cópia das seções e dos
+// rótulos, então não mudam.
+func (h *NoteTemplateHandler) PostEditNoteTemplate(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	template, err := loadNoteTemplate(h.DB, id)
+	if err != nil {
+		c.HTML(http.StatusNotFound, "layouts/error.html", gin.H{"Title": "Não Encontrado", "Message": "Modelo de nota não encontrado."})
+		return
+	}
+
+	form, sectionsJSON, ok := noteTemplateFromForm(c)
+	if !ok {
+		h.renderNoteTemplateForm(c, http.StatusBadRequest, template, form)
+		return
+	}
+
+	_, err = h.DB.Exec("UPDATE note_templates SET name = $1, description = NULLIF($2, ''), sections = $3, updated_at = NOW() WHERE id = $4",
+		form.Name, form.Description, sectionsJSON, id)
+	if err != nil {
+		if isUniqueViolation(err) {
+			form.Error = "Já existe um modelo com esse nome."
+		} else {
+			log.Printf("Erro ao atualizar modelo de nota %d: %v", id, err)
+			form.Error = "Não foi possível salvar o modelo."
+		}
+		h.renderNoteTemplateForm(c, http.StatusBadRequest, template, form)
+		return
+	}
+
+	AddAuditLog(LogAction{
+		DB:         h.DB,
+		Context:    c,
+		Action:     fmt.Sprintf("Atualizou o modelo de nota '%s'", form.Name),
+		TargetType: "Modelo de Nota",
+		TargetID:   id,
+	})
+	session := sessions.Default(c)
+	session.AddFlash("Modelo de nota atualizado!", "success")
+	session.Save()
+	c.Redirect(http.StatusFound, "/admin/note-templates")
+}
+
+// ToggleNoteTemplate ativa ou desativa um modelo. Modelos inativos deixam de ser oferecidos no
+// prontuário, mas as entradas que já os usaram continuam exibidas normalmente.
+func (h *NoteTemplateHandler) ToggleNoteTemplate(c *gin.Context) {
+	session := sessions.Default(c)
+	idStr := c.Param("id")
+
+	var active bool
+	err := h.DB.QueryRow("UPDATE note_templates SET active = NOT active, updated_at = NOW() WHERE id = $1 RETURNING active", idStr).Scan(&active)
+	if err != nil {
+		log.Printf("Erro ao alterar situação do modelo de nota: %v", err)
+		session.AddFlash("Não foi possível alterar o modelo de nota.", "error")
+	} else {
+		action := "Desativou"
+		if active {
+			action = "Reativou"
+		}
+		AddAuditLog(LogAction{
+			DB:         h.DB,
+			Context:    c,
+			Action:     fmt.Sprintf("%s o modelo de nota ID %s", action, idStr),
+			TargetType: "Modelo de Nota",
+			TargetID:   safeAtoi(idStr),
+		})
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, "/admin/note-templates")
+}
+
+// renderNoteTemplates desenha a lista de modelos com o formulário de cadastro.
+func (h *NoteTemplateHandler) renderNoteTemplates(c *gin.Context, status int, form noteTemplateForm) {
+	session := sessions.Default(c)
+	errorFlashes := session.Flashes("error")
+	successFlashes := session.Flashes("success")
+	session.Save()
+
+	templates, err := loadNoteTemplates(h.DB, false)
+	if err != nil {
+		log.Printf("Erro ao buscar modelos de nota: %v", err)
+	}
+	c.HTML(status, "admin/note_templates.html", gin.H{
+		"Title":          "Modelos de Nota",
+		"ActiveNav":      "notes",
+		"Templates":      templates,
+		"Form":           form,
+		"FieldKinds":     noteFieldKinds,
+		"ErrorFlashes":   errorFlashes,
+		"SuccessFlashes": successFlashes,
+	})
+}
+
+// renderNoteTemplateForm desenha o formulário de edição do modelo.
+func (h *NoteTemplateHandler) renderNoteTemplateForm(c *gin.Context, status int, template NoteTemplate, form noteTemplateForm) {
+	c.HTML(status, "admin/note_template_form.html", gin.H{
+		"Title":      "Editar Modelo de Nota",
+		"ActiveNav":  "notes",
+		"Template":   template,
+		"Form":       form,
+		"FieldKinds": noteFieldKinds,
+	})
+}
+
+// noteTemplateFromForm lê e valida o formulário de modelo. Devolve as seções já em JSON para o banco.
+func noteTemplateFromForm(c *gin.Context) (noteTemplateForm, string, bool) {
+	form := noteTemplateForm{
+		Name:        strings.TrimSpace(c.PostForm("name")),
+		Description: strings.TrimSpace(c.PostForm("description")),
+		Definition:  c.PostForm("definition"),
+	}
+	if form.Name == "" {
+		form.Error = "Informe o nome do modelo."
+		return form, "", false
+	}
+	sections, err := parseNoteTemplate(form.Definition)
+	if err != nil {
+		form.Error = "Definição inválida: " + err.Error() + "."
+		return form, "", false
+	}
+	sectionsJSON, err := json.Marshal(sections)
+	if err != nil {
+		form.Error = "Não foi possível salvar o modelo."
+		return form, "", false
+	}
+	return form, string(sectionsJSON), true
+}
+
+// isUniqueViolation indica se o banco recusou a gravação por violar uma restrição UNIQUE.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505" // unique_violation
+	}
+	return false
+}
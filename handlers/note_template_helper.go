@@ -0,0 +1,350 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"mediflow/storage"
+)
+
+// NoteTemplate é um modelo de nota de sessão (SOAP, DAP...) configurado pelo administrador. As
+// seções usam os mesmos tipos de campo e a mesma validação da ficha de anamnese.
+type NoteTemplate struct {
+	ID          int
+	Name        string
+	Description string
+	Sections    []IntakeStep
+	Active      bool
+	UpdatedAt   time.Time
+}
+
+// FieldCount é o total de campos do modelo, somando todas as seções.
+func (t NoteTemplate) FieldCount() int {
+	count := 0
+	for _, section := range t.Sections {
+		count += len(section.Fields)
+	}
+	return count
+}
+
+// noteFieldKinds são os tipos de campo aceitos nos modelos, com a palavra usada na definição em
+// texto. Datas ficam de fora: a validação da anamnese só aceita datas passadas.
+var noteFieldKinds = []struct{ Kind, Word string }{
+	{intakeText, "texto"},
+	{intakeTextarea, "texto longo"},
+	{intakeLevel, "nível"},
+	{intakeNumber, "número"},
+	{intakeSelect, "opções"},
+}
+
+// noteWordReplacer tira os acentos das palavras-chave, para aceitar "nivel", "numero" e "opcoes".
+var noteWordReplacer = strings.NewReplacer("í", "i", "ú", "u", "õ", "o", "ç", "c", "ó", "o")
+
+func normalizeNoteWord(word string) string {
+	return noteWordReplacer.Replace(strings.ToLower(strings.TrimSpace(word)))
+}
+
+// parseNoteTemplate lê a definição em texto do modelo. Cada seção começa com uma linha "# Título";
+// as linhas seguintes são os campos, no formato "Rótulo | tipo | obrigatório | opção 1; opção 2".
+// Só o rótulo é obrigatório (o tipo padrão é texto longo).
+func parseNoteTemplate(definition string) ([]IntakeStep, error) {
+	var sections []IntakeStep
+	for i, line := range strings.Split(definition, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			title := strings.TrimSpace(strings.TrimLeft(line, "#"))
+			if title == "" {
+				return nil, fmt.Errorf("linha %d: informe o título da seção depois do #", i+1)
+			}
+			sections = append(sections, IntakeStep{Title: title})
+			continue
+		}
+		if len(sections) == 0 {
+			return nil, fmt.Errorf("linha %d: comece a definição com uma seção (# Título)", i+1)
+		}
+
+		section := &sections[len(sections)-1]
+		field, err := parseNoteField(line, len(sections), len(section.Fields)+1)
+		if err != nil {
+			return nil, fmt.Errorf("linha %d: %v", i+1, err)
+		}
+		section.Fields = append(section.Fields, field)
+	}
+
+	if len(sections) == 0 {
+		return nil, errors.New("o modelo precisa de ao menos uma seção com um campo")
+	}
+	for _, section := range sections {
+		if len(section.Fields) == 0 {
+			return nil, fmt.Errorf("a seção \"%s\" não tem campos", section.Title)
+		}
+	}
+	return sections, nil
+}
+
+// parseNoteField lê uma linha de campo. O nome interno (s1_f2) vem da posição na definição.
+func parseNoteField(line string, sectionNumber, fieldNumber int) (IntakeField, error) {
+	parts := strings.Split(line, "|")
+	field := IntakeField{
+		Name:  fmt.Sprintf("s%d_f%d", sectionNumber, fieldNumber),
+		Label: strings.TrimSpace(parts[0]),
+		Kind:  intakeTextarea,
+	}
+	if field.Label == "" {
+		return field, errors.New("informe o rótulo do campo antes do primeiro |")
+	}
+
+	if len(parts) > 1 && strings.TrimSpace(parts[1]) != "" {
+		word := normalizeNoteWord(parts[1])
+		field.Kind = ""
+		for _, kind := range noteFieldKinds {
+			if normalizeNoteWord(kind.Word) == word {
+				field.Kind = kind.Kind
+			}
+		}
+		if field.Kind == "" {
+			return field, fmt.Errorf("tipo \"%s\" desconhecido", strings.TrimSpace(parts[1]))
+		}
+	}
+
+	var extras []string
+	if len(parts) > 2 {
+		extras = parts[2:]
+	}
+	for _, part := range extras {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == "":
+			continue
+		case normalizeNoteWord(part) == "obrigatorio":
+			field.Required = true
+		case field.Kind == intakeSelect:
+			for _, option := range strings.Split(part, ";") {
+				if option = strings.TrimSpace(option); option != "" {
+					field.Options = append(field.Options, option)
+				}
+			}
+		default:
+			return field, fmt.Errorf("\"%s\" não é válido aqui; use \"obrigatório\" ou, em campos de opções, a lista separada por ;", part)
+		}
+	}
+
+	switch field.Kind {
+	case intakeText:
+		field.MaxLen = 1000
+	case intakeTextarea:
+		field.MaxLen = 5000
+	case intakeLevel:
+		field.Max = 10
+	case intakeNumber:
+		field.Max = 9999
+	case intakeSelect:
+		if len(field.Options) < 2 {
+			return field, errors.New("campos de opções precisam de ao menos duas opções separadas por ;")
+		}
+	}
+	return field, nil
+}
+
+// formatNoteTemplate devolve a definição em texto do modelo, no formato lido por parseNoteTemplate.
+func formatNoteTemplate(sections []IntakeStep) string {
+	var b strings.Builder
+	for i, section := range sections {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString("# " + section.Title + "\n")
+		for _, field := range section.Fields {
+			b.WriteString(field.Label)
+			for _, kind := range noteFieldKinds {
+				if kind.Kind == field.Kind {
+					b.WriteString(" | " + kind.Word)
+				}
+			}
+			if field.Required {
+				b.WriteString(" | obrigatório")
+			}
+			if len(field.Options) > 0 {
+				b.WriteString(" | " + strings.Join(field.Options, "; "))
+			}
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+const noteTemplateSelectSQL = `SELECT id, name, COALESCE(description, ''), sections::text, active, updated_at FROM note_templates `
+
+// scanNoteTemplate lê uma linha de noteTemplateSelectSQL.
+func scanNoteTemplate(scan func(dest ...interface{}) error) (NoteTemplate, error) {
+	var t NoteTemplate
+	var sections string
+	if err := scan(&t.ID, &t.Name, &t.Description, &sections, &t.Active, &t.UpdatedAt); err != nil {
+		return t, err
+	}
+	t.UpdatedAt = t.UpdatedAt.In(storage.ClinicLocation())
+	return t, json.Unmarshal([]byte(sections), &t.Sections)
+}
+
+// loadNoteTemplates lista os modelos de nota por nome; com onlyActive, só os disponíveis para uso.
+func loadNoteTemplates(db *sql.DB, onlyActive bool) ([]NoteTemplate, error) {
+	query := noteTemplateSelectSQL
+	if onlyActive {
+		query += "WHERE active "
+	}
+	rows, err := db.Query(query + "ORDER BY name ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var templates []NoteTemplate
+	for rows.Next() {
+		t, err := scanNoteTemplate(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+// loadNoteTemplate busca um modelo de nota, ativo ou não.
+func loadNoteTemplate(db *sql.DB, id int) (NoteTemplate, error) {
+	return scanNoteTemplate(db.QueryRow(noteTemplateSelectSQL+"WHERE id = $1", id).Scan)
+}
+
+// NoteSectionView é uma seção do modelo no formulário do prontuário.
+type NoteSectionView struct {
+	Title  string
+	Fields []IntakeFieldView
+}
+
+// noteFieldPrefix separa os campos do modelo dos demais campos do formulário do prontuário.
+const noteFieldPrefix = "note_"
+
+// noteValueKey identifica um campo pela seção e pelo rótulo, e não pelo nome interno: se o modelo
+// for alterado, o nome (que vem da posição) pode mudar, mas o rascunho continua caindo no campo certo.
+func noteValueKey(section, label string) string {
+	return section + " › " + label
+}
+
+// noteSectionViews monta as seções do modelo para o formulário, preenchidas com values (indexado
+// por noteValueKey).
+func noteSectionViews(t NoteTemplate, values map[string]string) []NoteSectionView {
+	views := make([]NoteSectionView, 0, len(t.Sections))
+	for _, section := range t.Sections {
+		view := NoteSectionView{Title: section.Title}
+		for _, field := range section.Fields {
+			value := values[noteValueKey(section.Title, field.Label)]
+			field.Name = noteFieldPrefix + field.Name
+			view.Fields = append(view.Fields, IntakeFieldView{IntakeField: field, Value: value})
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+// noteFromForm lê as respostas do modelo enviadas pelo formulário. O segundo retorno lista o que
+// impede a assinatura (campos obrigatórios vazios ou valores inválidos); o rascunho é gravado mesmo assim.
+func noteFromForm(t NoteTemplate, postForm func(string) string) (*storage.StructuredNote, []string) {
+	values := map[string]string{}
+	for _, section := range t.Sections {
+		for _, field := range section.Fields {
+			values[field.Name] = strings.TrimSpace(postForm(noteFieldPrefix + field.Name))
+		}
+	}
+
+	note := &storage.StructuredNote{TemplateID: t.ID, Template: t.Name}
+	var problems []string
+	today := clinicToday()
+	for _, section := range t.Sections {
+		noteSection := storage.NoteSection{Title: section.Title}
+		for _, field := range section.Fields {
+			if msg := validateIntakeField(field, values, today); msg != "" {
+				problems = append(problems, fmt.Sprintf("%s › %s: %s", section.Title, field.Label, strings.TrimSuffix(msg, ".")))
+			}
+			noteSection.Fields = append(noteSection.Fields, storage.NoteField{Name: field.Name, Label: field.Label, Kind: field.Kind, Value: values[field.Name]})
+		}
+		note.Sections = append(note.Sections, noteSection)
+	}
+	return note, problems
+}
+
+// noteValues devolve as respostas da nota indexadas por noteValueKey.
+func noteValues(note *storage.StructuredNote) map[string]string {
+	values := map[string]string{}
+	if note == nil {
+		return values
+	}
+	for _, section := range note.Sections {
+		for _, field := range section.Fields {
+			values[noteValueKey(section.Title, field.Label)] = field.Value
+		}
+	}
+	return values
+}
+
+// noteText achata a nota estruturada em texto, seção por seção, omitindo os campos vazios.
+func noteText(note *storage.StructuredNote) string {
+	if note == nil {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("- Nota da Sessão (%s):\n", note.Template))
+	for _, section := range note.Sections {
+		var lines []string
+		for _, field := range section.Fields {
+			if field.Value != "" {
+				lines = append(lines, fmt.Sprintf("    %s: %s\n", field.Label, field.Value))
+			}
+		}
+		if len(lines) > 0 {
+			b.WriteString("  " + section.Title + ":\n" + strings.Join(lines, ""))
+		}
+	}
+	return b.String()
+}
+
+// setRecordNoteForm escolhe o modelo de nota exibido no formulário do prontuário: o pedido na URL
+// (?modelo=ID, ou 0 para texto livre) ou, sem ele, o da entrada mais recente. Quando o modelo é o
+// mesmo da entrada mais recente, os campos vêm preenchidos com as respostas dela.
+func setRecordNoteForm(db *sql.DB, page *PatientEditPageData, modelo string) {
+	templates, err := loadNoteTemplates(db, true)
+	if err != nil {
+		log.Printf("Erro ao buscar modelos de nota: %v", err)
+	}
+	page.NoteTemplates = templates
+
+	templateID := 0
+	if page.LatestRecord.Note != nil {
+		templateID = page.LatestRecord.Note.TemplateID
+	}
+	if modelo != "" {
+		templateID, _ = strconv.Atoi(modelo)
+	}
+	if templateID <= 0 {
+		return
+	}
+
+	template, err := loadNoteTemplate(db, templateID)
+	if err != nil {
+		log.Printf("Erro ao buscar o modelo de nota ID %d: %v", templateID, err)
+		return
+	}
+	var values map[string]string
+	if page.LatestRecord.Note != nil && page.LatestRecord.Note.TemplateID == template.ID {
+		values = noteValues(page.LatestRecord.Note)
+	}
+	page.NoteTemplateID, page.NoteTemplateName = template.ID, template.Name
+	page.NoteSections = noteSectionViews(template, values)
+}
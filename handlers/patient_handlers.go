@@ -48,26 +48,34 @@ func (h *PatientHandler) CreatePatient(c *gin.Context) {
 		return
 	}
 
-	// Gera o token de acesso único
-	token, err := generateSecureToken(32)
+	tx, err := h.DB.Begin()
 	if err != nil {
-		log.Printf("Erro ao gerar token seguro: %v", err)
+		log.Printf("Erro ao iniciar transação do cadastro de paciente: %v", err)
 		c.Redirect(http.StatusFound, "/secretaria/dashboard")
 		return
 	}
+	defer tx.Rollback()
 
-	// Query de inserção agora inclui o access_token
 	query := `
 		INSERT INTO patients (
-			name, email, phone, mobile, access_token, created_at, updated_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+			name, email, phone, mobile, created_at, updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
 
 	var patientID int
-	err = h.DB.QueryRow(query,
+	err = tx.QueryRow(query,
 		patientData.Name, patientData.Email, patientData.Phone, patientData.Mobile,
-		token, time.Now(), time.Now(),
+		time.Now(), time.Now(),
 	).Scan(&patientID)
 
+	// Link de consentimento do portal, exibido em seguida para ser enviado ao paciente
+	var token storage.PortalToken
+	if err == nil {
+		defaults := portalTokenDefaults[tokenPurposeConsent]
+		token, err = issuePortalToken(tx, patientID, tokenPurposeConsent, defaults.Validity, defaults.SingleUse, sessionUserID(c))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
 		log.Printf("Erro ao inserir novo paciente (secretária): %v", err)
 		c.Redirect(http.StatusFound, "/secretaria/dashboard")
@@ -85,6 +93,7 @@ func (h *PatientHandler) CreatePatient(c *gin.Context) {
 		TargetID:   patientID,
 	}
 	AddAuditLog(logInfo)
+	auditPortalTokenIssued(h.DB, c, token)
 	// ======================================================
 	
 	c.Redirect(http.StatusFound, "/secretaria/pacientes/token/"+strconv.Itoa(patientID))
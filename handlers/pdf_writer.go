@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// pdfDocument gera PDFs simples de texto (A4, Helvetica) sem dependências externas. Serve para
+// documentos como o comprovante de consentimento: títulos, parágrafos com quebra automática de
+// linha e novas páginas quando o texto não cabe.
+type pdfDocument struct {
+	title   string
+	created time.Time
+	pages   []*bytes.Buffer
+	y       float64
+}
+
+const (
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+	pdfMargin     = 56.0
+)
+
+// helveticaWidths traz as larguras (em milésimos do tamanho da fonte) dos caracteres 32 a 126 da
+// Helvetica, conforme as métricas padrão da fonte.
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+// winAnsiSpecial mapeia os caracteres fora do Latin-1 que a WinAnsiEncoding também cobre.
+var winAnsiSpecial = map[rune]byte{
+	'€': 0x80, '…': 0x85, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97,
+}
+
+func newPDFDocument(title string, created time.Time) *pdfDocument {
+	d := &pdfDocument{title: title, created: created}
+	d.newPage()
+	return d
+}
+
+func (d *pdfDocument) newPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.y = pdfPageHeight - pdfMargin
+}
+
+// winAnsi converte o texto para a codificação das fontes padrão do PDF; o que não existe nela vira '?'.
+func winAnsi(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r == '\t':
+			out = append(out, ' ')
+		case r >= 32 && r < 127, r >= 0xA0 && r <= 0xFF:
+			out = append(out, byte(r))
+		case winAnsiSpecial[r] != 0:
+			out = append(out, winAnsiSpecial[r])
+		default:
+			out = append(out, '?')
+		}
+	}
+	return out
+}
+
+// textWidth mede o texto já codificado. Letras acentuadas usam a largura média das minúsculas.
+func textWidth(text []byte, size float64) float64 {
+	total := 0
+	for _, b := range text {
+		if b >= 32 && b <= 126 {
+			total += helveticaWidths[b-32]
+		} else {
+			total += 556
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// wrapText quebra um parágrafo em linhas que caibam na largura útil da página.
+func wrapText(text []byte, size, width float64) [][]byte {
+	var lines [][]byte
+	var line []byte
+	for _, word := range bytes.Fields(text) {
+		candidate := word
+		if len(line) > 0 {
+			candidate = append(append(append([]byte{}, line...), ' '), word...)
+		}
+		if len(line) > 0 && textWidth(candidate, size) > width {
+			lines = append(lines, line)
+			candidate = word
+		}
+		line = candidate
+	}
+	if len(line) > 0 {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// escapePDFString escreve o texto como string literal do PDF, com os bytes fora do ASCII em octal.
+func escapePDFString(text []byte) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, c := range text {
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 32 || c > 126:
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// writeLines escreve as linhas a partir da posição atual, abrindo novas páginas quando preciso.
+func (d *pdfDocument) writeLines(lines [][]byte, font string, size float64) {
+	leading := size * 1.4
+	for _, line := range lines {
+		if d.y-leading < pdfMargin {
+			d.newPage()
+		}
+		d.y -= leading
+		fmt.Fprintf(d.pages[len(d.pages)-1], "BT /%s %.1f Tf %.2f %.2f Td %s Tj ET\n", font, size, pdfMargin, d.y, escapePDFString(line))
+	}
+}
+
+// Heading escreve um título em negrito.
+func (d *pdfDocument) Heading(text string, size float64) {
+	d.writeLines(wrapText(winAnsi(text), size, pdfPageWidth-2*pdfMargin), "F2", size)
+	d.Space(size / 2)
+}
+
+// Paragraph escreve o texto com quebra automática; cada "\n" inicia uma nova linha.
+func (d *pdfDocument) Paragraph(text string, size float64) {
+	for _, part := range strings.Split(text, "\n") {
+		lines := wrapText(winAnsi(part), size, pdfPageWidth-2*pdfMargin)
+		if len(lines) == 0 {
+			d.Space(size * 1.4)
+			continue
+		}
+		d.writeLines(lines, "F1", size)
+	}
+	d.Space(size / 2)
+}
+
+// Field escreve um par "rótulo: valor", com o rótulo em negrito.
+func (d *pdfDocument) Field(label, value string, size float64) {
+	d.writeLines([][]byte{winAnsi(label)}, "F2", size)
+	d.Paragraph(value, size)
+}
+
+// Space avança verticalmente, sem escrever nada.
+func (d *pdfDocument) Space(points float64) {
+	d.y -= points
+	if d.y < pdfMargin {
+		d.newPage()
+	}
+}
+
+// Bytes monta o arquivo PDF. O resultado depende apenas do conteúdo e da data informada na
+// criação do documento.
+func (d *pdfDocument) Bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xE2\xE3\xCF\xD3\n")
+
+	const firstPage = 6
+	var kids []string
+	for i := range d.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", firstPage+2*i))
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	object(fmt.Sprintf("<< /Title %s /Producer (MediFlow) /CreationDate (D:%s) >>",
+		escapePDFString(winAnsi(d.title)), d.created.UTC().Format("20060102150405Z")))
+	for i, page := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, firstPage+2*i+1))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkPDFStructure confere o cabeçalho, a tabela xref, o trailer e o /Length de cada stream.
+func checkPDFStructure(t *testing.T, pdf []byte) {
+	t.Helper()
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) {
+		t.Fatalf("cabeçalho inválido: %q", pdf[:min(len(pdf), 16)])
+	}
+	if !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Fatal("o arquivo não termina com o marcador de fim (EOF)")
+	}
+
+	m := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(pdf)
+	if m == nil {
+		t.Fatal("startxref não encontrado")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(pdf[xref:], []byte("xref\n0 ")) {
+		t.Fatalf("startxref aponta para %q", pdf[xref:min(len(pdf), xref+10)])
+	}
+	lines := strings.Split(string(pdf[xref:]), "\n")
+	count, err := strconv.Atoi(strings.Fields(lines[1])[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines[2] != "0000000000 65535 f " {
+		t.Fatalf("primeira entrada da xref: %q", lines[2])
+	}
+	for i := 1; i < count; i++ {
+		entry := lines[2+i]
+		if len(entry) != 19 || !strings.HasSuffix(entry, " 00000 n ") {
+			t.Fatalf("entrada %d da xref mal formada: %q", i, entry)
+		}
+		offset, _ := strconv.Atoi(entry[:10])
+		if want := strconv.Itoa(i) + " 0 obj\n"; !bytes.HasPrefix(pdf[offset:], []byte(want)) {
+			t.Fatalf("xref do objeto %d aponta para %q", i, pdf[offset:min(len(pdf), offset+12)])
+		}
+	}
+	trailer := strings.Join(lines[2+count:], "\n")
+	if !strings.HasPrefix(trailer, "trailer\n<< /Size "+strconv.Itoa(count)+" /Root 1 0 R /Info 5 0 R >>") {
+		t.Fatalf("trailer inválido: %q", trailer)
+	}
+
+	for _, s := range regexp.MustCompile(`(?s)<< /Length (\d+) >>\nstream\n(.*?)endstream`).FindAllSubmatch(pdf, -1) {
+		if length, _ := strconv.Atoi(string(s[1])); length != len(s[2]) {
+			t.Fatalf("/Length %d, mas o stream tem %d bytes", length, len(s[2]))
+		}
+	}
+}
+
+func TestPDFDocumentStructure(t *testing.T) {
+	created := time.Date(2024, time.May, 1, 13, 0, 0, 0, time.UTC)
+	doc := newPDFDocument("Documento de teste", created)
+	doc.Heading("Título", 16)
+	doc.Paragraph(strings.Repeat("Um parágrafo longo que precisa de várias linhas e páginas. ", 400), 10)
+	pdf := doc.Bytes()
+
+	checkPDFStructure(t, pdf)
+	if len(doc.pages) < 2 {
+		t.Fatalf("o texto longo deveria ocupar mais de uma página, ocupou %d", len(doc.pages))
+	}
+	if want := "/Count " + strconv.Itoa(len(doc.pages)) + " >>"; !bytes.Contains(pdf, []byte(want)) {
+		t.Errorf("catálogo de páginas sem %q", want)
+	}
+	if !bytes.Contains(pdf, []byte("/CreationDate (D:20240501130000Z)")) {
+		t.Error("data de criação ausente ou fora do formato")
+	}
+	if !bytes.Equal(pdf, doc.Bytes()) {
+		t.Error("Bytes não é determinístico")
+	}
+}
+
+func TestEscapePDFString(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Texto simples", "(Texto simples)"},
+		{"Parênteses (e) barra \\", `(Par\352nteses \(e\) barra \\)`},
+		{"Ação de saúde", `(A\347\343o de sa\372de)`},
+		{"Preço: 10 € — “ok”", `(Pre\347o: 10 \200 \227 \223ok\224)`},
+		{"日本\tfim", "(?? fim)"}, // Fora da WinAnsiEncoding vira '?'; tabulação vira espaço
+	}
+	for _, tt := range tests {
+		if got := escapePDFString(winAnsi(tt.text)); got != tt.want {
+			t.Errorf("%q: recebeu %s, esperava %s", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestWrapTextFitsWidth(t *testing.T) {
+	const size, width = 10.0, 200.0
+	lines := wrapText(winAnsi(strings.Repeat("palavra comprida ", 30)), size, width)
+	if len(lines) < 2 {
+		t.Fatalf("esperava várias linhas, recebeu %d", len(lines))
+	}
+	for _, line := range lines {
+		if textWidth(line, size) > width {
+			t.Errorf("linha %q mede %.1f, mais que %.1f", line, textWidth(line, size), width)
+		}
+	}
+}
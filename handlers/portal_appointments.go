@@ -0,0 +1,343 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"mediflow/storage"
+)
+
+// Quantos dias à frente o paciente pode escolher ao remarcar pelo portal.
+const portalRescheduleDays = 14
+
+// PortalAppointment é uma consulta exibida no portal, com a indicação de que o paciente ainda
+// pode desmarcá-la ou remarcá-la sozinho (fora da janela da política de cancelamento) e a situação
+// do check-in.
+type PortalAppointment struct {
+	AppointmentDetails
+	CanChange   bool
+	CheckinOpen bool // O check-in antes da sessão pode ser respondido agora
+	CheckinDone bool
+}
+
+// PortalSlotDay agrupa por dia os horários livres oferecidos na remarcação.
+type PortalSlotDay struct {
+	Date  time.Time
+	Slots []TimeRange
+}
+
+// portalAppointment é a consulta do paciente logado que ele quer alterar.
+type portalAppointment struct {
+	ID       int
+	DoctorID int
+	Start    time.Time
+	End      time.Time
+	Status   string
+}
+
+// ShowPortalAppointments lista as próximas consultas do paciente e o histórico recente.
+func (h *PortalHandler) ShowPortalAppointments(c *gin.Context) {
+	session := sessions.Default(c)
+	patientID, _ := session.Get("patient_id").(int)
+	errorFlashes := session.Flashes("error")
+	successFlashes := session.Flashes("success")
+	session.Save()
+
+	rows, err := h.DB.Query(`
+		SELECT a.id, a.start_time, a.end_time, a.status, u.name, COALESCE(st.name, ''),
+		       EXISTS (SELECT 1 FROM session_checkins sc WHERE sc.appointment_id = a.id)
+		FROM appointments a
+		JOIN users u ON a.doctor_id = u.id
+		LEFT JOIN service_types st ON a.service_type_id = st.id
+		WHERE a.patient_id = $1 AND a.start_time >= NOW() - INTERVAL '90 days'
+		ORDER BY a.start_time ASC`, patientID)
+	if err != nil {
+		log.Printf("Erro ao buscar consultas do paciente %d no portal: %v", patientID, err)
+		c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Não foi possível carregar suas consultas."})
+		return
+	}
+	defer rows.Close()
+
+	policy := loadCancellationPolicy()
+	now := time.Now()
+	loc := storage.ClinicLocation()
+	var upcoming, past []PortalAppointment
+	for rows.Next() {
+		var app PortalAppointment
+		if err := rows.Scan(&app.ID, &app.StartTime, &app.EndTime, &app.Status, &app.DoctorName, &app.ServiceName, &app.CheckinDone); err != nil {
+			log.Printf("Erro ao ler consulta do portal: %v", err)
+			continue
+		}
+		app.StartTime, app.EndTime = app.StartTime.In(loc), app.EndTime.In(loc)
+		if (app.Status == "agendado" || app.Status == statusBookingHold) && app.StartTime.After(now) {
+			app.CanChange = app.Status == "agendado" && policy.CancellationStatus(app.StartTime, now) == "cancelado"
+			app.CheckinOpen = checkinOpen(app.Status, app.StartTime, now)
+			upcoming = append(upcoming, app)
+		} else {
+			past = append([]PortalAppointment{app}, past...) // Histórico do mais recente para o mais antigo
+		}
+	}
+
+	c.HTML(http.StatusOK, "portal/appointments.html", gin.H{
+		"Title":          "Minhas Consultas",
+		"PatientName":    session.Get("patient_name"),
+		"Upcoming":       upcoming,
+		"Past":           past,
+		"WindowHours":    int(policy.Window.Hours()),
+		"ErrorFlashes":   errorFlashes,
+		"SuccessFlashes": successFlashes,
+	})
+}
+
+// CancelPortalAppointment desmarca uma consulta do paciente logado, desde que fora da janela da
+// política de cancelamento. Cancelamentos tardios continuam sendo feitos pela clínica.
+func (h *PortalHandler) CancelPortalAppointment(c *gin.Context) {
+	if appointmentID, ok := h.cancelAppointment(c); ok {
+		// O horário liberado é oferecido aos pacientes compatíveis da lista de espera
+		notifyWaitlist(h.DB, appointmentID)
+	}
+	c.Redirect(http.StatusFound, "/portal/appointments")
+}
+
+// cancelAppointment aplica o cancelamento e grava as mensagens na sessão antes do redirecionamento.
+func (h *PortalHandler) cancelAppointment(c *gin.Context) (int, bool) {
+	session := sessions.Default(c)
+	defer session.Save()
+
+	appt, message := h.changeableAppointment(c)
+	if message != "" {
+		session.AddFlash(message, "error")
+		return 0, false
+	}
+
+	status, _, err := closeAppointment(h.DB, loadCancellationPolicy(), appt.ID, "cancelado", time.Now())
+	if err != nil {
+		if err == errAppointmentChanged {
+			session.AddFlash("Esta consulta não pode mais ser desmarcada pelo portal.", "error")
+			return 0, false
+		}
+		log.Printf("Erro ao cancelar a consulta ID %d pelo portal: %v", appt.ID, err)
+		session.AddFlash("Não foi possível desmarcar a consulta. Entre em contato com a clínica.", "error")
+		return 0, false
+	}
+	AddPatientAuditLog(h.DB, c, fmt.Sprintf("Paciente desmarcou pelo portal a consulta ID %d ('%s')", appt.ID, status), "Consulta", appt.ID)
+	session.AddFlash("Consulta desmarcada.", "success")
+	return appt.ID, true
+}
+
+// ShowPortalReschedule exibe os horários livres do mesmo terapeuta para a remarcação.
+func (h *PortalHandler) ShowPortalReschedule(c *gin.Context) {
+	session := sessions.Default(c)
+	appt, message := h.changeableAppointment(c)
+	if message != "" {
+		session.AddFlash(message, "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/portal/appointments")
+		return
+	}
+
+	slots, configured, err := h.rescheduleSlots(appt)
+	if err != nil {
+		log.Printf("Erro ao calcular horários livres para remarcação da consulta ID %d: %v", appt.ID, err)
+		c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Não foi possível carregar os horários livres."})
+		return
+	}
+
+	var doctorName string
+	h.DB.QueryRow("SELECT name FROM users WHERE id = $1", appt.DoctorID).Scan(&doctorName)
+
+	c.HTML(http.StatusOK, "portal/reschedule.html", gin.H{
+		"Title":        "Remarcar Consulta",
+		"PatientName":  session.Get("patient_name"),
+		"Appointment":  appt,
+		"CurrentStart": appt.Start.In(storage.ClinicLocation()),
+		"DoctorName":   doctorName,
+		"Configured":   configured,
+		"Days":         groupSlotsByDay(slots),
+		"WeekdayNames": weekdayNames,
+	})
+}
+
+// PostPortalReschedule move a consulta para um dos horários livres oferecidos.
+func (h *PortalHandler) PostPortalReschedule(c *gin.Context) {
+	h.reschedule(c)
+	c.Redirect(http.StatusFound, "/portal/appointments")
+}
+
+// reschedule valida o horário escolhido e grava a remarcação, deixando as mensagens na sessão.
+func (h *PortalHandler) reschedule(c *gin.Context) {
+	session := sessions.Default(c)
+	defer session.Save()
+
+	appt, message := h.changeableAppointment(c)
+	if message != "" {
+		session.AddFlash(message, "error")
+		return
+	}
+
+	newStart, err := time.Parse(time.RFC3339, c.PostForm("start"))
+	if err != nil {
+		session.AddFlash("Escolha um dos horários disponíveis.", "error")
+		return
+	}
+
+	// Só são aceitos horários que continuam livres no momento da confirmação
+	slots, _, err := h.rescheduleSlots(appt)
+	if err != nil {
+		log.Printf("Erro ao calcular horários livres para remarcação da consulta ID %d: %v", appt.ID, err)
+		session.AddFlash("Não foi possível remarcar a consulta. Tente novamente.", "error")
+		return
+	}
+	if !slotOffered(slots, newStart) {
+		session.AddFlash("O horário escolhido não está mais disponível. Escolha outro horário.", "error")
+		return
+	}
+
+	patientID, _ := session.Get("patient_id").(int)
+	newEnd := newStart.Add(appt.End.Sub(appt.Start))
+	if message, err := validateAppointmentSlot(h.DB, appt.DoctorID, patientID, newStart, newEnd, appt.ID); err != nil || message != "" {
+		if err != nil {
+			log.Printf("Erro ao validar remarcação da consulta ID %d: %v", appt.ID, err)
+		}
+		session.AddFlash("O horário escolhido não está mais disponível. Escolha outro horário.", "error")
+		return
+	}
+
+	// A remarcação e a auditoria são gravadas juntas; a condição de status garante que a consulta não
+	// foi cancelada, confirmada ou remarcada pela equipe depois de carregada
+	tx, err := h.DB.Begin()
+	if err != nil {
+		log.Printf("Erro ao iniciar a remarcação da consulta ID %d pelo portal: %v", appt.ID, err)
+		session.AddFlash("Não foi possível remarcar a consulta. Entre em contato com a clínica.", "error")
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE appointments SET start_time = $1, end_time = $2, updated_at = $3 WHERE id = $4 AND status = 'agendado' AND start_time = $5",
+		newStart, newEnd, time.Now(), appt.ID, appt.Start)
+	var updated int64
+	if err == nil {
+		updated, err = result.RowsAffected()
+	}
+	if err != nil {
+		if isOverlapViolation(err) {
+			session.AddFlash("O horário escolhido acabou de ser ocupado. Escolha outro horário.", "error")
+			return
+		}
+		log.Printf("Erro ao remarcar a consulta ID %d pelo portal: %v", appt.ID, err)
+		session.AddFlash("Não foi possível remarcar a consulta. Entre em contato com a clínica.", "error")
+		return
+	}
+	if updated != 1 {
+		session.AddFlash("Esta consulta não pode mais ser remarcada pelo portal.", "error")
+		return
+	}
+
+	loc := storage.ClinicLocation()
+	AddPatientAuditLog(tx, c, fmt.Sprintf("Paciente remarcou pelo portal a consulta ID %d de %s para %s",
+		appt.ID, appt.Start.In(loc).Format("02/01/2006 15:04"), newStart.In(loc).Format("02/01/2006 15:04")), "Consulta", appt.ID)
+	if err := tx.Commit(); err != nil {
+		log.Printf("Erro ao gravar a remarcação da consulta ID %d pelo portal: %v", appt.ID, err)
+		session.AddFlash("Não foi possível remarcar a consulta. Entre em contato com a clínica.", "error")
+		return
+	}
+	session.AddFlash("Consulta remarcada para "+newStart.In(loc).Format("02/01/2006 às 15:04")+".", "success")
+}
+
+// changeableAppointment carrega a consulta da URL, garantindo que pertence ao paciente logado,
+// ainda está agendada e está fora da janela da política de cancelamento. Devolve a mensagem de
+// erro para o paciente quando a alteração não é permitida.
+func (h *PortalHandler) changeableAppointment(c *gin.Context) (portalAppointment, string) {
+	var appt portalAppointment
+	patientID, _ := sessions.Default(c).Get("patient_id").(int)
+	appointmentID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return appt, "Consulta não encontrada."
+	}
+
+	err = h.DB.QueryRow("SELECT id, doctor_id, start_time, end_time, status FROM appointments WHERE id = $1 AND patient_id = $2",
+		appointmentID, patientID).Scan(&appt.ID, &appt.DoctorID, &appt.Start, &appt.End, &appt.Status)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Erro ao buscar a consulta ID %d no portal: %v", appointmentID, err)
+		}
+		return appt, "Consulta não encontrada."
+	}
+
+	now := time.Now()
+	if appt.Status != "agendado" || !appt.Start.After(now) {
+		return appt, "Esta consulta não pode mais ser alterada."
+	}
+	policy := loadCancellationPolicy()
+	if policy.CancellationStatus(appt.Start, now) != "cancelado" {
+		return appt, fmt.Sprintf("Alterações com menos de %d horas de antecedência precisam ser feitas com a clínica.", int(policy.Window.Hours()))
+	}
+	return appt, ""
+}
+
+// rescheduleSlots calcula os horários livres do terapeuta da consulta nos próximos dias, com a
+// mesma duração. O segundo retorno é falso quando o terapeuta não tem expediente cadastrado (e a
+// remarcação precisa ser combinada com a clínica).
+func (h *PortalHandler) rescheduleSlots(appt portalAppointment) ([]TimeRange, bool, error) {
+	return upcomingFreeSlots(h.DB, appt.DoctorID, appt.End.Sub(appt.Start), portalRescheduleDays)
+}
+
+// upcomingFreeSlots calcula os horários livres do terapeuta de hoje até 'days' dias à frente, no
+// fuso da clínica. É a base das telas de autoatendimento (remarcação e agendamento online). O
+// segundo retorno é falso quando o terapeuta não tem expediente cadastrado.
+func upcomingFreeSlots(db *sql.DB, doctorID int, duration time.Duration, days int) ([]TimeRange, bool, error) {
+	from := clinicToday()
+	to := from.AddDate(0, 0, days+1)
+	schedule, err := loadTherapistSchedule(db, doctorID, from, to)
+	if err != nil || !schedule.Configured() {
+		return nil, false, err
+	}
+
+	slots, err := findFreeSlots(db, schedule, doctorID, from, to, duration)
+	if err != nil {
+		return nil, true, err
+	}
+	loc := storage.ClinicLocation()
+	for i := range slots {
+		slots[i].Start, slots[i].End = slots[i].Start.In(loc), slots[i].End.In(loc)
+	}
+	return slots, true, nil
+}
+
+// groupSlotsByDay agrupa por dia os horários livres, já ordenados, para exibição.
+func groupSlotsByDay(slots []TimeRange) []PortalSlotDay {
+	var days []PortalSlotDay
+	for _, slot := range slots {
+		day := dateOnly(slot.Start)
+		if len(days) == 0 || !days[len(days)-1].Date.Equal(day) {
+			days = append(days, PortalSlotDay{Date: day})
+		}
+		days[len(days)-1].Slots = append(days[len(days)-1].Slots, slot)
+	}
+	return days
+}
+
+// slotOffered indica se o horário escolhido está entre os horários livres calculados.
+func slotOffered(slots []TimeRange, start time.Time) bool {
+	for _, slot := range slots {
+		if slot.Start.Equal(start) {
+			return true
+		}
+	}
+	return false
+}
+
+// PortalLogout encerra a sessão do paciente.
+func (h *PortalHandler) PortalLogout(c *gin.Context) {
+	session := sessions.Default(c)
+	session.Delete("patient_id")
+	session.Delete("patient_name")
+	session.Save()
+	c.Redirect(http.StatusFound, "/portal/login")
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"mediflow/storage"
+)
+
+// checkinAppointment é a consulta do paciente logado cujo check-in está sendo respondido.
+type checkinAppointment struct {
+	ID         int
+	Start      time.Time
+	Status     string
+	DoctorName string
+}
+
+// openCheckinAppointment busca a consulta da URL e confere se o check-in está aberto. Devolve a
+// mensagem a exibir quando não está.
+func (h *PortalHandler) openCheckinAppointment(c *gin.Context) (checkinAppointment, string) {
+	var appt checkinAppointment
+	patientID, _ := sessions.Default(c).Get("patient_id").(int)
+	appointmentID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return appt, "Consulta não encontrada."
+	}
+
+	err = h.DB.QueryRow(`SELECT a.id, a.start_time, a.status, u.name FROM appointments a JOIN users u ON a.doctor_id = u.id
+		WHERE a.id = $1 AND a.patient_id = $2`, appointmentID, patientID).Scan(&appt.ID, &appt.Start, &appt.Status, &appt.DoctorName)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Erro ao buscar a consulta ID %d para o check-in: %v", appointmentID, err)
+		}
+		return appt, "Consulta não encontrada."
+	}
+	appt.Start = appt.Start.In(storage.ClinicLocation())
+
+	if !checkinOpen(appt.Status, appt.Start, time.Now()) {
+		return appt, fmt.Sprintf("O check-in fica disponível nas %d horas antes da sessão, até o horário de início.", int(checkinOpensBefore().Hours()))
+	}
+	return appt, ""
+}
+
+// ShowPortalCheckin exibe o check-in da consulta, já preenchido se o paciente o respondeu antes.
+func (h *PortalHandler) ShowPortalCheckin(c *gin.Context) {
+	session := sessions.Default(c)
+	appt, message := h.openCheckinAppointment(c)
+	if message != "" {
+		session.AddFlash(message, "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/portal/appointments")
+		return
+	}
+
+	values := map[string]string{}
+	checkin, found, err := loadAppointmentCheckin(h.DB, appt.ID)
+	if err != nil {
+		log.Printf("Erro ao buscar o check-in da consulta ID %d: %v", appt.ID, err)
+	}
+	if found {
+		values = checkinValues(checkin)
+	}
+	h.renderCheckin(c, http.StatusOK, appt, values, nil, found)
+}
+
+// PostPortalCheckin grava o check-in. Enquanto a sessão não começa, o paciente pode corrigi-lo.
+func (h *PortalHandler) PostPortalCheckin(c *gin.Context) {
+	session := sessions.Default(c)
+	patientID, _ := session.Get("patient_id").(int)
+	appt, message := h.openCheckinAppointment(c)
+	if message != "" {
+		session.AddFlash(message, "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/portal/appointments")
+		return
+	}
+
+	values := map[string]string{}
+	errors := map[string]string{}
+	today := clinicToday()
+	for _, field := range checkinFields {
+		values[field.Name] = strings.TrimSpace(c.PostForm(field.Name))
+	}
+	for _, field := range checkinFields {
+		if msg := validateIntakeField(field, values, today); msg != "" {
+			errors[field.Name] = msg
+		}
+	}
+	if len(errors) > 0 {
+		h.renderCheckin(c, http.StatusBadRequest, appt, values, errors, false)
+		return
+	}
+
+	levels := make([]int, 0, 6)
+	for _, field := range checkinFields[:6] {
+		n, _ := strconv.Atoi(values[field.Name])
+		levels = append(levels, n)
+	}
+	var checkinID int
+	err := h.DB.QueryRow(`
+		INSERT INTO session_checkins (appointment_id, patient_id, session_start, doctor_id, anxiety_level, anger_level, fear_level, sadness_level, joy_level, energy_level, notes)
+		SELECT a.id, $2, a.start_time, a.doctor_id, $3, $4, $5, $6, $7, $8, NULLIF($9, '') FROM appointments a WHERE a.id = $1
+		ON CONFLICT (appointment_id) DO UPDATE SET
+			session_start = EXCLUDED.session_start, doctor_id = EXCLUDED.doctor_id,
+			anxiety_level = EXCLUDED.anxiety_level, anger_level = EXCLUDED.anger_level, fear_level = EXCLUDED.fear_level,
+			sadness_level = EXCLUDED.sadness_level, joy_level = EXCLUDED.joy_level, energy_level = EXCLUDED.energy_level,
+			notes = EXCLUDED.notes, updated_at = NOW()
+		RETURNING id`,
+		appt.ID, patientID, levels[0], levels[1], levels[2], levels[3], levels[4], levels[5], values["notes"]).Scan(&checkinID)
+	if err != nil {
+		log.Printf("Erro ao salvar o check-in da consulta ID %d: %v", appt.ID, err)
+		session.AddFlash("Não foi possível salvar o check-in. Tente novamente.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/portal/appointments")
+		return
+	}
+
+	AddPatientAuditLog(h.DB, c, fmt.Sprintf("Paciente respondeu pelo portal o check-in ID %d da consulta ID %d", checkinID, appt.ID), "Consulta", appt.ID)
+	session.AddFlash("Check-in registrado. Obrigado! Seu terapeuta verá suas respostas antes da sessão.", "success")
+	session.Save()
+	c.Redirect(http.StatusFound, "/portal/appointments")
+}
+
+// renderCheckin desenha o formulário do check-in com as respostas e os erros de validação.
+func (h *PortalHandler) renderCheckin(c *gin.Context, status int, appt checkinAppointment, values, errors map[string]string, answered bool) {
+	fields := make([]IntakeFieldView, 0, len(checkinFields))
+	for _, field := range checkinFields {
+		fields = append(fields, IntakeFieldView{IntakeField: field, Value: values[field.Name], Error: errors[field.Name]})
+	}
+
+	c.HTML(status, "portal/checkin.html", gin.H{
+		"Title":       "Check-in da Sessão",
+		"PatientName": sessions.Default(c).Get("patient_name"),
+		"Appointment": appt,
+		"Fields":      fields,
+		"Answered":    answered,
+		"HasErrors":   len(errors) > 0,
+	})
+}
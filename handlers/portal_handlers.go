@@ -2,17 +2,42 @@ package handlers
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"mediflow/notifications"
 	"mediflow/storage"
 )
 
 type PortalHandler struct {
-	DB *sql.DB
+	DB           *sql.DB
+	Notifiers    []notifications.Notifier // Canais usados para enviar os códigos de acesso e os alertas das escalas
+	LoginLimiter *RateLimiter             // Pedidos de código e tentativas por IP; os limites por paciente ficam no banco
+}
+
+// NewPortalHandler cria o handler do portal a partir das variáveis de ambiente.
+func NewPortalHandler(db *sql.DB, notifiers []notifications.Notifier) *PortalHandler {
+	limit := 20
+	if value := os.Getenv("PORTAL_LOGIN_RATE_LIMIT_PER_HOUR"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+			limit = n
+		} else {
+			log.Printf("AVISO: PORTAL_LOGIN_RATE_LIMIT_PER_HOUR '%s' inválido; usando %d.", value, limit)
+		}
+	}
+	if portalBaseURL() == "" {
+		log.Printf("AVISO: PORTAL_BASE_URL não configurado; o login do portal enviará só o código, sem link.")
+	}
+	loginCodeKey() // Lê a chave dos códigos já na inicialização, para o aviso sair no log de partida
+	return &PortalHandler{DB: db, Notifiers: notifiers, LoginLimiter: NewRateLimiter(limit, time.Hour)}
 }
 
 // ShowTokenLoginPage exibe a página de login por token para o paciente.
@@ -24,32 +49,46 @@ func (h *PortalHandler) ShowTokenLoginPage(c *gin.Context) {
 	})
 }
 
-// ProcessTokenLogin valida o token e cria uma sessão para o paciente.
+// ProcessTokenLogin valida o link do portal (ativo, dentro da validade e, se de uso único, ainda
+// não usado) e cria uma sessão para o paciente. Quem ainda não forneceu o consentimento é levado
+// ao termo; os demais, às suas consultas.
 func (h *PortalHandler) ProcessTokenLogin(c *gin.Context) {
 	token := c.PostForm("token")
-	session := sessions.Default(c)
-
-	var patientID int
-	err := h.DB.QueryRow("SELECT id FROM patients WHERE access_token = $1 AND consent_given_at IS NULL", token).Scan(&patientID)
-
+	portalToken, err := consumePortalToken(h.DB, token)
 	if err != nil {
-		log.Printf("Tentativa de login com token inválido ou já utilizado: %s", token)
+		if err != errPortalTokenInvalid {
+			log.Printf("Erro ao validar link do portal: %v", err)
+		}
+		log.Printf("Tentativa de login com token inválido: %s", token)
 		c.HTML(http.StatusUnauthorized, "portal/token_login.html", gin.H{
 			"Title": "Acesso ao Portal do Paciente",
-			"Error": "Token inválido, expirado ou já utilizado. Por favor, solicite um novo link.",
+			"Error": "Token inválido ou expirado. Por favor, solicite um novo link.",
 		})
 		return
 	}
 
-	session.Set("patient_id", patientID)
-	session.Save()
-	c.Redirect(http.StatusFound, "/portal/consent")
+	// Links de anamnese levam direto à ficha
+	next := "/portal/appointments"
+	if portalToken.Purpose == tokenPurposeIntake {
+		next = "/portal/anamnese"
+	}
+	h.startPatientSession(c, portalToken.PatientID, fmt.Sprintf("Paciente acessou o portal com o link ID %d (%s, uso nº %d)",
+		portalToken.ID, portalToken.Purpose, portalToken.UseCount), next)
 }
 
-// ShowConsentForm exibe o formulário de consentimento.
+// ShowConsentForm exibe a versão vigente do termo de consentimento ou, para quem já aceitou, o
+// aceite registrado e a opção de revogá-lo.
 func (h *PortalHandler) ShowConsentForm(c *gin.Context) {
+	h.renderConsentForm(c, http.StatusOK, nil, "", "")
+}
+
+// renderConsentForm desenha a página do termo com os erros de validação, se houver.
+func (h *PortalHandler) renderConsentForm(c *gin.Context, status int, errors map[string]string, nameValue, cpfValue string) {
 	session := sessions.Default(c)
-	patientID := session.Get("patient_id")
+	patientID, _ := session.Get("patient_id").(int)
+	errorFlashes := session.Flashes("error")
+	successFlashes := session.Flashes("success")
+	session.Save()
 
 	var patient storage.Patient
 	err := h.DB.QueryRow("SELECT id, name, consent_given_at FROM patients WHERE id = $1", patientID).Scan(&patient.ID, &patient.Name, &patient.ConsentGivenAt)
@@ -57,14 +96,50 @@ func (h *PortalHandler) ShowConsentForm(c *gin.Context) {
 		c.String(http.StatusInternalServerError, "Erro ao buscar dados do paciente.")
 		return
 	}
+	term, err := loadCurrentConsentTerm(h.DB)
+	if err != nil {
+		log.Printf("Erro ao carregar o termo de consentimento vigente: %v", err)
+		c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "O termo de consentimento não está disponível. Entre em contato com a clínica."})
+		return
+	}
+	consents, err := loadPatientConsents(h.DB, patientID)
+	if err != nil {
+		log.Printf("Erro ao carregar os aceites do paciente %d: %v", patientID, err)
+	}
 
-	c.HTML(http.StatusOK, "portal/consent_form.html", gin.H{
-		"Title":   "Termo de Consentimento",
-		"Patient": patient,
+	var active *storage.PatientConsent
+	reconsent := false
+	for i := range consents {
+		switch consents[i].State() {
+		case "vigente":
+			if active == nil {
+				active = &consents[i]
+			}
+		case "substituído":
+			reconsent = true
+		}
+	}
+	if nameValue == "" {
+		nameValue = patient.Name
+	}
+
+	c.HTML(status, "portal/consent_form.html", gin.H{
+		"Title":          "Termo de Consentimento",
+		"PatientName":    patient.Name,
+		"Patient":        patient,
+		"Term":           term,
+		"Active":         active,
+		"Reconsent":      reconsent && active == nil,
+		"Errors":         errors,
+		"NameValue":      nameValue,
+		"CpfValue":       cpfValue,
+		"ErrorFlashes":   errorFlashes,
+		"SuccessFlashes": successFlashes,
 	})
 }
 
-// ProcessConsentForm salva os dados do formulário de consentimento e REGISTRA A AÇÃO NA AUDITORIA.
+// ProcessConsentForm registra o aceite da versão vigente do termo, com a evidência do aceite
+// (versão, hash do texto, data, IP e navegador), e REGISTRA A AÇÃO NA AUDITORIA.
 func (h *PortalHandler) ProcessConsentForm(c *gin.Context) {
 	session := sessions.Default(c)
 	patientID := session.Get("patient_id")
@@ -90,53 +165,146 @@ func (h *PortalHandler) ProcessConsentForm(c *gin.Context) {
 		errors["CPF"] = "O CPF informado é inválido. Por favor, verifique."
 	}
 
+	// O aceite vale para o texto exibido ao paciente: se o termo mudou enquanto ele lia, exibe o novo
+	term, err := loadCurrentConsentTerm(h.DB)
+	if err != nil {
+		log.Printf("Erro ao carregar o termo de consentimento vigente: %v", err)
+		c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "O termo de consentimento não está disponível. Entre em contato com a clínica."})
+		return
+	}
+	if c.PostForm("content_hash") != term.ContentHash || consentTermHash(term.Body) != term.ContentHash {
+		errors["Term"] = "O termo foi atualizado enquanto você o lia. Leia a nova versão abaixo antes de aceitar."
+	}
+
 	if len(errors) > 0 {
-		var patient storage.Patient
-		h.DB.QueryRow("SELECT name FROM patients WHERE id = $1", patientID).Scan(&patient.Name)
-
-		c.HTML(http.StatusBadRequest, "portal/consent_form.html", gin.H{
-			"Title":     "Termo de Consentimento",
-			"Patient":   patient,
-			"Errors":    errors,
-			"NameValue": consentName,
-			"CpfValue":  consentCpfRg,
-		})
+		h.renderConsentForm(c, http.StatusBadRequest, errors, consentName, consentCpfRg)
 		return
 	}
 
 	re := regexp.MustCompile(`[^0-9]`)
 	cpfClean := re.ReplaceAllString(consentCpfRg, "")
 
-	query := `UPDATE patients SET 
-		consent_name = $1, consent_cpf_rg = $2, how_found = $3, 
-		consent_given_at = NOW(), consent_date = NOW(), signature_date = NOW()
-		WHERE id = $4`
+	tx, err := h.DB.Begin()
+	if err != nil {
+		log.Printf("Erro ao iniciar transação: %v", err)
+		return
+	}
+	defer tx.Rollback()
 
-	_, err := h.DB.Exec(query, consentName, cpfClean, howFound, patientID)
+	consent := storage.PatientConsent{PatientID: patientIDInt, TermID: term.ID, TermVersion: term.Version, TermTitle: term.Title,
+		ContentHash: term.ContentHash, ConsentName: consentName, ConsentCpfRg: cpfClean}
+	err = tx.QueryRow(`INSERT INTO patient_consents (patient_id, term_id, term_version, content_hash, consent_name, consent_cpf_rg, ip_address, remote_addr, user_agent)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id, accepted_at`,
+		patientIDInt, term.ID, term.Version, term.ContentHash, consentName, cpfClean, c.ClientIP(), c.Request.RemoteAddr, c.Request.UserAgent()).Scan(&consent.ID, &consent.AcceptedAt)
+	if err == nil {
+		err = createConsentReceipt(tx, consent, term)
+	}
+	if err == nil {
+		query := `UPDATE patients SET 
+			consent_name = $1, consent_cpf_rg = $2, how_found = COALESCE(NULLIF($3, ''), how_found), 
+			consent_given_at = NOW(), consent_date = NOW(), signature_date = NOW()
+			WHERE id = $4`
+		_, err = tx.Exec(query, consentName, cpfClean, howFound, patientIDInt)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
 		log.Printf("Erro ao salvar consentimento do paciente %d: %v", patientIDInt, err)
 		return
 	}
 
-	logInfo := LogAction{
-		DB:         h.DB,
-		Context:    c,
-		Action:     "Paciente forneceu o termo de consentimento através do portal.",
-		TargetType: "Paciente",
-		TargetID:   patientIDInt,
-	}
-	AddAuditLog(logInfo)
+	AddPatientAuditLog(h.DB, c, fmt.Sprintf("Paciente aceitou a versão %d do termo de consentimento através do portal (aceite ID %d, hash %s)",
+		term.Version, consent.ID, term.ContentHash[:12]), "Paciente", patientIDInt)
 
 	c.Redirect(http.StatusFound, "/portal/success")
 }
 
-// ShowSuccessPage exibe a página de agradecimento.
+// RevokeConsent revoga o aceite vigente do paciente. O registro do aceite é mantido como evidência,
+// com a data, o IP, o endereço da conexão, o navegador e o motivo da revogação.
+func (h *PortalHandler) RevokeConsent(c *gin.Context) {
+	session := sessions.Default(c)
+	patientID, _ := session.Get("patient_id").(int)
+
+	active, found, err := activePatientConsent(h.DB, patientID)
+	if err != nil || !found {
+		if err != nil {
+			log.Printf("Erro ao buscar o aceite vigente do paciente %d: %v", patientID, err)
+		}
+		session.AddFlash("Não há consentimento vigente para revogar.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/portal/consent")
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		log.Printf("Erro ao iniciar transação: %v", err)
+		c.Redirect(http.StatusFound, "/portal/consent")
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`UPDATE patient_consents SET revoked_at = NOW(), revocation_reason = NULLIF($1, ''), revocation_ip = $2, revocation_remote_addr = $3,
+		revocation_user_agent = $4 WHERE id = $5 AND revoked_at IS NULL`,
+		strings.TrimSpace(c.PostForm("reason")), c.ClientIP(), c.Request.RemoteAddr, c.Request.UserAgent(), active.ID)
+	if err == nil {
+		_, err = tx.Exec("UPDATE patients SET consent_given_at = NULL WHERE id = $1", patientID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Erro ao revogar o consentimento ID %d: %v", active.ID, err)
+		session.AddFlash("Não foi possível revogar o consentimento. Tente novamente.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/portal/consent")
+		return
+	}
+
+	AddPatientAuditLog(h.DB, c, fmt.Sprintf("Paciente revogou pelo portal o aceite ID %d (versão %d do termo de consentimento)", active.ID, active.TermVersion),
+		"Paciente", patientID)
+	session.AddFlash("Seu consentimento foi revogado. Entre em contato com a clínica para tratar das próximas sessões.", "success")
+	session.Save()
+	c.Redirect(http.StatusFound, "/portal/consent")
+}
+
+// ShowSuccessPage exibe a página de agradecimento, com o link para o comprovante do aceite.
 func (h *PortalHandler) ShowSuccessPage(c *gin.Context) {
+	patientID, _ := sessions.Default(c).Get("patient_id").(int)
+	active, found, err := activePatientConsent(h.DB, patientID)
+	if err != nil {
+		log.Printf("Erro ao buscar o aceite vigente do paciente %d: %v", patientID, err)
+	}
+
 	c.HTML(http.StatusOK, "portal/success.html", gin.H{
-		"Title": "Sucesso!",
+		"Title":      "Sucesso!",
+		"HasReceipt": found,
+		"ConsentID":  active.ID,
 	})
 }
 
+// DownloadConsentReceipt entrega o comprovante em PDF de um aceite do próprio paciente.
+func (h *PortalHandler) DownloadConsentReceipt(c *gin.Context) {
+	patientID, _ := sessions.Default(c).Get("patient_id").(int)
+	consentID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.HTML(http.StatusNotFound, "layouts/error.html", gin.H{"Title": "Não Encontrado", "Message": "Comprovante não encontrado."})
+		return
+	}
+
+	pdf, err := loadConsentReceipt(h.DB, patientID, consentID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Erro ao buscar o comprovante do aceite %d: %v", consentID, err)
+		}
+		c.HTML(http.StatusNotFound, "layouts/error.html", gin.H{"Title": "Não Encontrado", "Message": "Comprovante não encontrado."})
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="`+consentReceiptFilename(consentID)+`"`)
+	c.Data(http.StatusOK, "application/pdf", pdf)
+}
+
 // AuthPatientRequired é um middleware para proteger as rotas do portal.
 func AuthPatientRequired() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -148,4 +316,29 @@ func AuthPatientRequired() gin.HandlerFunc {
 		}
 		c.Next()
 	}
-}
\ No newline at end of file
+}
+
+// ConsentRequired exige, depois de AuthPatientRequired, um aceite vigente do termo de consentimento:
+// sem aceite, com o aceite revogado ou com uma versão nova do termo que exige novo aceite, o
+// paciente volta para /portal/consent antes de usar o restante do portal.
+func ConsentRequired(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session := sessions.Default(c)
+		patientID, _ := session.Get("patient_id").(int)
+		_, found, err := activePatientConsent(db, patientID)
+		if err != nil {
+			log.Printf("Erro ao conferir o consentimento do paciente %d: %v", patientID, err)
+			c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Não foi possível carregar o portal. Tente novamente."})
+			c.Abort()
+			return
+		}
+		if !found {
+			session.AddFlash("Para continuar, leia e aceite o termo de consentimento vigente.", "error")
+			session.Save()
+			c.Redirect(http.StatusFound, "/portal/consent")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
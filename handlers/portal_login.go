@@ -0,0 +1,501 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"mediflow/notifications"
+)
+
+// PortalLoginPolicy define os limites do login sem senha do portal (link mágico ou código de 6
+// dígitos enviado ao e-mail ou celular cadastrado). É lida do .env:
+//
+//	PORTAL_LOGIN_CODE_MINUTES         validade do link e do código (padrão 15)
+//	PORTAL_LOGIN_MAX_ATTEMPTS         tentativas de código erradas por paciente, em uma hora, antes do bloqueio (padrão 5)
+//	PORTAL_LOGIN_LOCKOUT_MINUTES      duração do bloqueio do paciente (padrão 30)
+//	PORTAL_LOGIN_REQUESTS_PER_HOUR    códigos enviados por paciente a cada hora (padrão 5)
+//	PORTAL_LOGIN_RATE_LIMIT_PER_HOUR  pedidos e tentativas aceitos por IP a cada hora (padrão 20; 0 desativa)
+//	PORTAL_BASE_URL                   endereço público usado no link enviado (vazio: só o código é enviado)
+//	PORTAL_LOGIN_SECRET               chave do HMAC dos códigos guardados no banco (padrão: aleatória a cada início)
+type PortalLoginPolicy struct {
+	CodeValidity    time.Duration
+	MaxAttempts     int
+	Lockout         time.Duration
+	RequestsPerHour int
+}
+
+// loadPortalLoginPolicy lê a política de login do portal das variáveis de ambiente.
+func loadPortalLoginPolicy() PortalLoginPolicy {
+	policy := PortalLoginPolicy{CodeValidity: 15 * time.Minute, MaxAttempts: 5, Lockout: 30 * time.Minute, RequestsPerHour: 5}
+	if minutes, err := strconv.Atoi(os.Getenv("PORTAL_LOGIN_CODE_MINUTES")); err == nil && minutes > 0 {
+		policy.CodeValidity = time.Duration(minutes) * time.Minute
+	}
+	if attempts, err := strconv.Atoi(os.Getenv("PORTAL_LOGIN_MAX_ATTEMPTS")); err == nil && attempts > 0 {
+		policy.MaxAttempts = attempts
+	}
+	if minutes, err := strconv.Atoi(os.Getenv("PORTAL_LOGIN_LOCKOUT_MINUTES")); err == nil && minutes >= 0 {
+		policy.Lockout = time.Duration(minutes) * time.Minute
+	}
+	if requests, err := strconv.Atoi(os.Getenv("PORTAL_LOGIN_REQUESTS_PER_HOUR")); err == nil && requests > 0 {
+		policy.RequestsPerHour = requests
+	}
+	return policy
+}
+
+// Mensagem exibida depois de qualquer pedido de código, exista ou não o contato: a resposta não
+// revela quais e-mails e telefones estão cadastrados.
+const portalCodeSentMessage = "Se o contato informado estiver cadastrado, você receberá em instantes um código de acesso para entrar."
+
+// portalContact é o contato informado na tela de login, já normalizado.
+type portalContact struct {
+	Email string
+	Phone string // Apenas dígitos, sem o código do país
+}
+
+// parsePortalContact interpreta o e-mail ou celular digitado pelo paciente.
+func parsePortalContact(value string) (portalContact, bool) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "@") {
+		return portalContact{Email: strings.ToLower(value)}, true
+	}
+	digits := onlyDigits(value)
+	if len(digits) > 11 && strings.HasPrefix(digits, "55") {
+		digits = digits[2:]
+	}
+	if len(digits) < 10 || len(digits) > 11 {
+		return portalContact{}, false
+	}
+	return portalContact{Phone: digits}, true
+}
+
+// onlyDigits remove tudo o que não é dígito.
+func onlyDigits(value string) string {
+	var b strings.Builder
+	for _, r := range value {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// findPortalPatient busca o paciente ativo dono do contato. Devolve o contato como está gravado
+// (o destinatário da mensagem) e falso quando nenhum ou mais de um paciente usa o contato: contatos
+// compartilhados continuam usando o link emitido pela clínica.
+func findPortalPatient(db *sql.DB, contact portalContact) (int, string, bool, error) {
+	query := `SELECT id, email FROM patients WHERE deleted_at IS NULL AND LOWER(email) = $1 LIMIT 2`
+	arg := contact.Email
+	if contact.Phone != "" {
+		query = `SELECT id, CASE WHEN RIGHT(regexp_replace(COALESCE(mobile, ''), '\D', '', 'g'), 11) = $1 THEN mobile ELSE phone END
+			FROM patients WHERE deleted_at IS NULL
+			  AND $1 IN (RIGHT(regexp_replace(COALESCE(mobile, ''), '\D', '', 'g'), 11), RIGHT(regexp_replace(COALESCE(phone, ''), '\D', '', 'g'), 11))
+			LIMIT 2`
+		arg = contact.Phone
+	}
+	rows, err := db.Query(query, arg)
+	if err != nil {
+		return 0, "", false, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	var recipient string
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id, &recipient); err != nil {
+			return 0, "", false, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil || len(ids) != 1 {
+		return 0, "", false, err
+	}
+	return ids[0], recipient, true, nil
+}
+
+// RequestPortalCode recebe o e-mail ou celular e envia o código e o link de acesso. A resposta é a
+// mesma para contatos cadastrados ou não.
+func (h *PortalHandler) RequestPortalCode(c *gin.Context) {
+	session := sessions.Default(c)
+	if !h.LoginLimiter.Allow(c.ClientIP(), time.Now()) {
+		log.Printf("Login do portal: limite de tentativas atingido para o IP %s", c.ClientIP())
+		c.HTML(http.StatusTooManyRequests, "portal/token_login.html", gin.H{
+			"Title": "Acesso ao Portal do Paciente",
+			"Error": "Muitas tentativas a partir da sua conexão. Aguarde alguns minutos e tente novamente.",
+		})
+		return
+	}
+
+	contact, ok := parsePortalContact(c.PostForm("contact"))
+	if !ok {
+		c.HTML(http.StatusBadRequest, "portal/token_login.html", gin.H{
+			"Title": "Acesso ao Portal do Paciente",
+			"Error": "Informe o e-mail ou o celular (com DDD) cadastrado na clínica.",
+		})
+		return
+	}
+
+	challengeID, err := h.issueLoginChallenge(c, contact)
+	if err != nil {
+		log.Printf("Erro ao emitir código de acesso do portal: %v", err)
+	}
+	// Sem paciente, o ID 0 leva à tela do código do mesmo jeito, que recusará qualquer código
+	session.Set("login_challenge_id", challengeID)
+	session.AddFlash(portalCodeSentMessage, "success")
+	session.Save()
+	c.Redirect(http.StatusFound, "/portal/entrar/codigo")
+}
+
+// issueLoginChallenge cria o desafio de login (link e código) e o envia ao paciente. Devolve 0
+// quando nada foi enviado: contato desconhecido ou compartilhado, paciente bloqueado ou com pedidos
+// demais na última hora.
+func (h *PortalHandler) issueLoginChallenge(c *gin.Context, contact portalContact) (int, error) {
+	patientID, recipient, found, err := findPortalPatient(h.DB, contact)
+	if err != nil || !found {
+		return 0, err
+	}
+
+	policy := loadPortalLoginPolicy()
+	var locked bool
+	var recentRequests int
+	err = h.DB.QueryRow(`SELECT COALESCE(p.portal_locked_until > NOW(), FALSE),
+		(SELECT COUNT(*) FROM portal_login_challenges WHERE patient_id = p.id AND created_at > NOW() - INTERVAL '1 hour')
+		FROM patients p WHERE p.id = $1`, patientID).Scan(&locked, &recentRequests)
+	if err != nil {
+		return 0, err
+	}
+	if locked || recentRequests >= policy.RequestsPerHour {
+		log.Printf("Login do portal: código não enviado ao paciente %d (bloqueado: %t, pedidos na última hora: %d)", patientID, locked, recentRequests)
+		return 0, nil
+	}
+
+	code, err := randomLoginCode()
+	if err != nil {
+		return 0, err
+	}
+	linkToken, err := generateSecureToken(32)
+	if err != nil {
+		return 0, err
+	}
+	channel := "email"
+	if contact.Phone != "" {
+		channel = "telefone"
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	// Um novo pedido invalida os códigos anteriores ainda pendentes
+	_, err = tx.Exec("UPDATE portal_login_challenges SET invalidated_at = NOW() WHERE patient_id = $1 AND used_at IS NULL AND invalidated_at IS NULL",
+		patientID)
+	var challengeID int
+	if err == nil {
+		err = tx.QueryRow(`INSERT INTO portal_login_challenges (patient_id, link_token, code_hash, channel, recipient, expires_at, request_ip)
+			VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+			patientID, linkToken, hashLoginCode(linkToken, code), channel, recipient, time.Now().Add(policy.CodeValidity), c.ClientIP()).Scan(&challengeID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var link string
+	if base := portalBaseURL(); base != "" {
+		link = base + "/portal/entrar/link/" + linkToken
+	}
+	if err := h.sendLoginMessage(c.Request.Context(), contact, recipient, code, link, policy.CodeValidity); err != nil {
+		log.Printf("Erro ao enviar código de acesso ao paciente %d: %v", patientID, err)
+		return challengeID, nil
+	}
+	AddSystemAuditLog(h.DB, fmt.Sprintf("Enviou código de acesso ao portal (desafio ID %d, por %s, IP %s)", challengeID, channel, c.ClientIP()), "Paciente", patientID)
+	return challengeID, nil
+}
+
+// sendLoginMessage envia o código pelo primeiro canal configurado que alcança o contato: e-mail
+// para e-mails; WhatsApp ou SMS para celulares. O canal de log serve de último recurso. Sem link
+// (PORTAL_BASE_URL vazio), a mensagem leva só o código.
+func (h *PortalHandler) sendLoginMessage(ctx context.Context, contact portalContact, recipient, code, link string, validity time.Duration) error {
+	preferred := []string{notifications.ChannelEmail, notifications.ChannelLog}
+	if contact.Phone != "" {
+		preferred = []string{notifications.ChannelWhatsApp, notifications.ChannelSMS, notifications.ChannelLog}
+	}
+	body := fmt.Sprintf("Seu código de acesso ao portal do paciente é %s.\n\n"+
+		"O código vale por %d minutos e só pode ser usado uma vez. Se você não pediu este acesso, ignore esta mensagem.",
+		code, int(validity.Minutes()))
+	if link != "" {
+		body = fmt.Sprintf("Seu código de acesso ao portal do paciente é %s.\n\nOu entre pelo link: %s\n\n"+
+			"O código e o link valem por %d minutos e só podem ser usados uma vez. Se você não pediu este acesso, ignore esta mensagem.",
+			code, link, int(validity.Minutes()))
+	}
+	msg := notifications.Message{
+		To:      recipient,
+		Subject: "Seu código de acesso ao portal",
+		Body:    body,
+	}
+
+	lastErr := fmt.Errorf("nenhum canal de notificação configurado alcança o contato")
+	for _, channel := range preferred {
+		for _, notifier := range h.Notifiers {
+			if notifier.Channel() != channel {
+				continue
+			}
+			sendCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			err := notifier.Send(sendCtx, msg)
+			cancel()
+			if err == nil {
+				return nil
+			}
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// ShowPortalCodeForm exibe o campo para digitar o código recebido.
+func (h *PortalHandler) ShowPortalCodeForm(c *gin.Context) {
+	session := sessions.Default(c)
+	if session.Get("login_challenge_id") == nil {
+		c.Redirect(http.StatusFound, "/portal/login")
+		return
+	}
+	successFlashes := session.Flashes("success")
+	errorFlashes := session.Flashes("error")
+	session.Save()
+	c.HTML(http.StatusOK, "portal/login_code.html", gin.H{
+		"Title":          "Código de Acesso",
+		"SuccessFlashes": successFlashes,
+		"ErrorFlashes":   errorFlashes,
+	})
+}
+
+// PostPortalCode confere o código digitado. Cada desafio aceita poucas tentativas; ao esgotá-las,
+// o paciente fica bloqueado por um tempo e os códigos pendentes deixam de valer.
+func (h *PortalHandler) PostPortalCode(c *gin.Context) {
+	session := sessions.Default(c)
+	challengeID, _ := session.Get("login_challenge_id").(int)
+	if session.Get("login_challenge_id") == nil {
+		c.Redirect(http.StatusFound, "/portal/login")
+		return
+	}
+	if !h.LoginLimiter.Allow(c.ClientIP(), time.Now()) {
+		session.AddFlash("Muitas tentativas a partir da sua conexão. Aguarde alguns minutos e tente novamente.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/portal/entrar/codigo")
+		return
+	}
+
+	patientID, message, err := h.verifyLoginCode(challengeID, strings.TrimSpace(c.PostForm("code")))
+	if err != nil {
+		log.Printf("Erro ao conferir código de acesso do portal (desafio %d): %v", challengeID, err)
+		message = "Não foi possível conferir o código. Tente novamente."
+	}
+	if message != "" {
+		session.AddFlash(message, "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/portal/entrar/codigo")
+		return
+	}
+
+	session.Delete("login_challenge_id")
+	h.startPatientSession(c, patientID, fmt.Sprintf("Paciente entrou no portal com código de acesso (desafio ID %d)", challengeID), "/portal/appointments")
+}
+
+// verifyLoginCode registra a tentativa e confere o código. Devolve a mensagem para o paciente
+// quando o código não é aceito.
+func (h *PortalHandler) verifyLoginCode(challengeID int, code string) (int, string, error) {
+	const invalid = "Código inválido ou expirado. Confira a mensagem recebida ou peça um novo código."
+	if challengeID == 0 || len(code) != 6 {
+		return 0, invalid, nil
+	}
+
+	policy := loadPortalLoginPolicy()
+	var patientID, attempts int
+	var linkToken, codeHash string
+	err := h.DB.QueryRow(`
+		UPDATE portal_login_challenges c SET attempts = c.attempts + 1
+		FROM patients p
+		WHERE c.id = $1 AND p.id = c.patient_id AND p.deleted_at IS NULL
+		  AND c.used_at IS NULL AND c.invalidated_at IS NULL AND c.expires_at > NOW()
+		  AND c.attempts < $2 AND (p.portal_locked_until IS NULL OR p.portal_locked_until <= NOW())
+		RETURNING c.patient_id, c.attempts, c.link_token, c.code_hash`, challengeID, policy.MaxAttempts).
+		Scan(&patientID, &attempts, &linkToken, &codeHash)
+	if err == sql.ErrNoRows {
+		return 0, invalid, nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashLoginCode(linkToken, code)), []byte(codeHash)) == 1 {
+		result, err := h.DB.Exec("UPDATE portal_login_challenges SET used_at = NOW() WHERE id = $1 AND used_at IS NULL", challengeID)
+		if err != nil {
+			return 0, "", err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			return 0, invalid, nil
+		}
+		return patientID, "", nil
+	}
+
+	// O bloqueio conta os erros de todos os códigos do paciente na última hora, e não só os deste
+	// desafio nem os deste IP: pedir um código novo ou trocar de conexão não renova as tentativas
+	var failed int
+	err = h.DB.QueryRow(`SELECT COALESCE(SUM(attempts), 0) FROM portal_login_challenges
+		WHERE patient_id = $1 AND used_at IS NULL AND created_at > NOW() - INTERVAL '1 hour'
+		  AND created_at > COALESCE((SELECT portal_locked_until FROM patients WHERE id = $1), '-infinity')`, patientID).Scan(&failed)
+	if err != nil {
+		return 0, "", err
+	}
+	if failed < attempts {
+		failed = attempts
+	}
+	if failed >= policy.MaxAttempts {
+		if err := lockPortalLogin(h.DB, patientID, policy.Lockout); err != nil {
+			return 0, "", err
+		}
+		AddSystemAuditLog(h.DB, fmt.Sprintf("Bloqueou o login do portal por %d minutos após %d tentativas de código inválidas (desafio ID %d)",
+			int(policy.Lockout.Minutes()), failed, challengeID), "Paciente", patientID)
+		return 0, "Muitas tentativas inválidas. Por segurança, o acesso foi bloqueado temporariamente. Tente mais tarde ou fale com a clínica.", nil
+	}
+	return 0, fmt.Sprintf("Código incorreto. Você ainda tem %d tentativa(s).", policy.MaxAttempts-failed), nil
+}
+
+// lockPortalLogin bloqueia o login sem senha do paciente e invalida os desafios pendentes.
+func lockPortalLogin(db *sql.DB, patientID int, lockout time.Duration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE patients SET portal_locked_until = $1 WHERE id = $2", time.Now().Add(lockout), patientID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE portal_login_challenges SET invalidated_at = NOW() WHERE patient_id = $1 AND used_at IS NULL AND invalidated_at IS NULL",
+		patientID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ShowPortalMagicLink pede a confirmação antes de usar o link recebido. O link não é consumido no
+// GET: leitores de e-mail e antivírus costumam abrir os links das mensagens automaticamente.
+func (h *PortalHandler) ShowPortalMagicLink(c *gin.Context) {
+	c.HTML(http.StatusOK, "portal/login_link.html", gin.H{
+		"Title": "Acesso ao Portal do Paciente",
+		"Token": c.Param("token"),
+	})
+}
+
+// PostPortalMagicLink usa o link mágico e entra no portal.
+func (h *PortalHandler) PostPortalMagicLink(c *gin.Context) {
+	var challengeID, patientID int
+	err := h.DB.QueryRow(`
+		UPDATE portal_login_challenges c SET used_at = NOW()
+		FROM patients p
+		WHERE c.link_token = $1 AND p.id = c.patient_id AND p.deleted_at IS NULL
+		  AND c.used_at IS NULL AND c.invalidated_at IS NULL AND c.expires_at > NOW()
+		  AND (p.portal_locked_until IS NULL OR p.portal_locked_until <= NOW())
+		RETURNING c.id, c.patient_id`, c.PostForm("token")).Scan(&challengeID, &patientID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Erro ao validar link de acesso do portal: %v", err)
+		}
+		c.HTML(http.StatusUnauthorized, "portal/token_login.html", gin.H{
+			"Title": "Acesso ao Portal do Paciente",
+			"Error": "Este link de acesso é inválido, expirou ou já foi usado. Peça um novo código abaixo.",
+		})
+		return
+	}
+	h.startPatientSession(c, patientID, fmt.Sprintf("Paciente entrou no portal com link de acesso (desafio ID %d)", challengeID), "/portal/appointments")
+}
+
+// startPatientSession abre a sessão do paciente, registra o acesso na auditoria e leva quem
+// ainda não forneceu o consentimento ao termo; os demais, à página next.
+func (h *PortalHandler) startPatientSession(c *gin.Context, patientID int, auditAction, next string) {
+	var patientName string
+	var consentGiven bool
+	err := h.DB.QueryRow("SELECT name, consent_given_at IS NOT NULL FROM patients WHERE id = $1", patientID).Scan(&patientName, &consentGiven)
+	if err != nil {
+		log.Printf("Erro ao carregar paciente %d para o login no portal: %v", patientID, err)
+		c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Não foi possível entrar no portal."})
+		return
+	}
+
+	session := sessions.Default(c)
+	session.Set("patient_id", patientID)
+	session.Set("patient_name", patientName)
+	session.Save()
+	AddPatientAuditLog(h.DB, c, auditAction, "Paciente", patientID)
+	if consentGiven {
+		c.Redirect(http.StatusFound, next)
+		return
+	}
+	c.Redirect(http.StatusFound, "/portal/consent")
+}
+
+// randomLoginCode sorteia um código numérico de 6 dígitos.
+func randomLoginCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// hashLoginCode guarda o código apenas como HMAC-SHA256 do token do desafio e do código, com a
+// chave do servidor: quem lê o banco vê o token, mas sem a chave não consegue testar os 10⁶ códigos.
+func hashLoginCode(linkToken, code string) string {
+	mac := hmac.New(sha256.New, loginCodeKey())
+	mac.Write([]byte(linkToken + ":" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+var (
+	loginCodeKeyOnce  sync.Once
+	loginCodeKeyBytes []byte
+)
+
+// loginCodeKey lê PORTAL_LOGIN_SECRET, a chave do HMAC dos códigos de acesso. Sem a variável, usa
+// uma chave aleatória gerada ao iniciar o servidor: os códigos pendentes deixam de valer a cada
+// reinício, o que só obriga o paciente a pedir um novo código.
+func loginCodeKey() []byte {
+	loginCodeKeyOnce.Do(func() {
+		if secret := os.Getenv("PORTAL_LOGIN_SECRET"); secret != "" {
+			loginCodeKeyBytes = []byte(secret)
+			return
+		}
+		log.Printf("AVISO: PORTAL_LOGIN_SECRET não configurado; usando uma chave temporária para os códigos de acesso do portal.")
+		loginCodeKeyBytes = make([]byte, 32)
+		if _, err := rand.Read(loginCodeKeyBytes); err != nil {
+			log.Fatalf("Falha ao gerar a chave dos códigos de acesso do portal: %v", err)
+		}
+	})
+	return loginCodeKeyBytes
+}
+
+// portalBaseURL é o endereço público usado nos links enviados aos pacientes, lido de
+// PORTAL_BASE_URL. O link nunca é montado a partir da requisição: com um cabeçalho Host forjado, a
+// clínica enviaria ao paciente um link válido apontando para outro site. Vazio quando não configurado.
+func portalBaseURL() string {
+	return strings.TrimRight(strings.TrimSpace(os.Getenv("PORTAL_BASE_URL")), "/")
+}
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"mediflow/storage"
+)
+
+// Finalidades dos links do portal. A finalidade define os padrões de validade e de uso único
+// sugeridos ao emitir o link e aparece na auditoria de cada acesso.
+const (
+	tokenPurposeConsent = "consentimento"
+	tokenPurposeIntake  = "anamnese"
+	tokenPurposeAccess  = "acesso"
+)
+
+// portalTokenPurposes lista as finalidades na ordem exibida no formulário de emissão.
+var portalTokenPurposes = []string{tokenPurposeConsent, tokenPurposeIntake, tokenPurposeAccess}
+
+// portalTokenPurposeNames traduz as finalidades para exibição.
+var portalTokenPurposeNames = map[string]string{
+	tokenPurposeConsent: "Termo de consentimento",
+	tokenPurposeIntake:  "Ficha de anamnese",
+	tokenPurposeAccess:  "Acesso ao portal",
+}
+
+// portalTokenDefaults são a validade e o uso único padrão de cada finalidade.
+var portalTokenDefaults = map[string]struct {
+	Validity  time.Duration
+	SingleUse bool
+}{
+	tokenPurposeConsent: {7 * 24 * time.Hour, true},
+	tokenPurposeIntake:  {14 * 24 * time.Hour, false},
+	tokenPurposeAccess:  {30 * 24 * time.Hour, false},
+}
+
+// PortalTokenOption é uma finalidade oferecida no formulário de emissão, com os padrões sugeridos.
+type PortalTokenOption struct {
+	Value     string
+	Label     string
+	Days      int
+	SingleUse bool
+}
+
+// portalTokenOptions monta as opções do formulário de emissão de links.
+func portalTokenOptions() []PortalTokenOption {
+	options := make([]PortalTokenOption, 0, len(portalTokenPurposes))
+	for _, purpose := range portalTokenPurposes {
+		defaults := portalTokenDefaults[purpose]
+		options = append(options, PortalTokenOption{
+			Value:     purpose,
+			Label:     portalTokenPurposeNames[purpose],
+			Days:      int(defaults.Validity.Hours() / 24),
+			SingleUse: defaults.SingleUse,
+		})
+	}
+	return options
+}
+
+// Limite de validade aceito ao emitir um link manualmente.
+const maxPortalTokenValidity = 90 * 24 * time.Hour
+
+// activePortalTokenSQL é a subconsulta que devolve o link ativo mais recente do paciente (da
+// tabela patients, sem alias), usada nas telas que oferecem o botão "Ver Link".
+const activePortalTokenSQL = `(SELECT t.token FROM portal_tokens t
+	WHERE t.patient_id = patients.id AND t.revoked_at IS NULL AND t.expires_at > NOW()
+	  AND (NOT t.single_use OR t.use_count = 0)
+	ORDER BY t.created_at DESC LIMIT 1)`
+
+// errPortalTokenInvalid indica um link inexistente, expirado, revogado ou de uso único já usado.
+var errPortalTokenInvalid = errors.New("link do portal inválido ou expirado")
+
+// issuePortalToken emite um novo link do portal para o paciente e revoga os links ativos da
+// mesma finalidade (gerar um novo link substitui o anterior). createdBy é o usuário da equipe que
+// emitiu o link (NULL para links emitidos pelo sistema). Aceita *sql.DB ou *sql.Tx; as entradas de
+// auditoria ficam com quem chama, que conhece o usuário logado.
+func issuePortalToken(db execer, patientID int, purpose string, validity time.Duration, singleUse bool, createdBy sql.NullInt64) (storage.PortalToken, error) {
+	token := storage.PortalToken{PatientID: patientID, Purpose: purpose, SingleUse: singleUse}
+	if _, ok := portalTokenDefaults[purpose]; !ok {
+		return token, fmt.Errorf("finalidade de link desconhecida: %s", purpose)
+	}
+
+	value, err := generateSecureToken(32)
+	if err != nil {
+		return token, err
+	}
+	now := time.Now()
+	if _, err := db.Exec(`UPDATE portal_tokens SET revoked_at = $1
+		WHERE patient_id = $2 AND purpose = $3 AND revoked_at IS NULL AND expires_at > $1`, now, patientID, purpose); err != nil {
+		return token, err
+	}
+
+	token.Token = value
+	token.ExpiresAt = now.Add(validity)
+	token.CreatedAt = now
+	err = db.QueryRow(`INSERT INTO portal_tokens (patient_id, token, purpose, single_use, expires_at, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		patientID, value, purpose, singleUse, token.ExpiresAt, createdBy, now).Scan(&token.ID)
+	return token, err
+}
+
+// consumePortalToken valida o link informado no login e registra o uso. A verificação e o
+// incremento acontecem no mesmo UPDATE, para que um link de uso único não seja aceito duas vezes
+// por requisições simultâneas.
+func consumePortalToken(db *sql.DB, value string) (storage.PortalToken, error) {
+	token := storage.PortalToken{Token: value}
+	if value == "" {
+		return token, errPortalTokenInvalid
+	}
+	err := db.QueryRow(`
+		UPDATE portal_tokens t SET use_count = t.use_count + 1, last_used_at = NOW()
+		FROM patients p
+		WHERE t.token = $1 AND p.id = t.patient_id AND p.deleted_at IS NULL
+		  AND t.revoked_at IS NULL AND t.expires_at > NOW()
+		  AND (NOT t.single_use OR t.use_count = 0)
+		RETURNING t.id, t.patient_id, t.purpose, t.single_use, t.expires_at, t.use_count`, value).
+		Scan(&token.ID, &token.PatientID, &token.Purpose, &token.SingleUse, &token.ExpiresAt, &token.UseCount)
+	if err == sql.ErrNoRows {
+		return token, errPortalTokenInvalid
+	}
+	return token, err
+}
+
+// revokePortalToken revoga um link ainda ativo do paciente. Devolve falso quando o link não existe
+// ou já estava revogado.
+func revokePortalToken(db *sql.DB, patientID, tokenID int) (bool, error) {
+	result, err := db.Exec("UPDATE portal_tokens SET revoked_at = NOW() WHERE id = $1 AND patient_id = $2 AND revoked_at IS NULL",
+		tokenID, patientID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// loadPortalTokens lista os links do portal emitidos para o paciente, dos mais recentes aos mais antigos.
+func loadPortalTokens(db *sql.DB, patientID int) ([]storage.PortalToken, error) {
+	rows, err := db.Query(`
+		SELECT t.id, t.patient_id, t.token, t.purpose, t.single_use, t.expires_at, t.use_count,
+		       t.last_used_at, t.revoked_at, COALESCE(u.name, ''), t.created_at
+		FROM portal_tokens t
+		LEFT JOIN users u ON t.created_by = u.id
+		WHERE t.patient_id = $1
+		ORDER BY t.created_at DESC`, patientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	loc := storage.ClinicLocation()
+	var tokens []storage.PortalToken
+	for rows.Next() {
+		var t storage.PortalToken
+		if err := rows.Scan(&t.ID, &t.PatientID, &t.Token, &t.Purpose, &t.SingleUse, &t.ExpiresAt, &t.UseCount,
+			&t.LastUsedAt, &t.RevokedAt, &t.CreatedByName, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		t.ExpiresAt, t.CreatedAt = t.ExpiresAt.In(loc), t.CreatedAt.In(loc)
+		if t.LastUsedAt.Valid {
+			t.LastUsedAt.Time = t.LastUsedAt.Time.In(loc)
+		}
+		if t.RevokedAt.Valid {
+			t.RevokedAt.Time = t.RevokedAt.Time.In(loc)
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// auditPortalTokenIssued registra na auditoria a emissão de um link pelo usuário logado.
+func auditPortalTokenIssued(db *sql.DB, c *gin.Context, token storage.PortalToken) {
+	usage := "múltiplos usos"
+	if token.SingleUse {
+		usage = "uso único"
+	}
+	AddAuditLog(LogAction{
+		DB:         db,
+		Context:    c,
+		Action:     fmt.Sprintf("Emitiu link do portal ID %d (%s, %s, válido até %s)", token.ID, token.Purpose, usage, token.ExpiresAt.In(storage.ClinicLocation()).Format("02/01/2006 15:04")),
+		TargetType: "Paciente",
+		TargetID:   token.PatientID,
+	})
+}
+
+// sessionUserID devolve o usuário da equipe logado, para gravar quem emitiu o link.
+func sessionUserID(c *gin.Context) sql.NullInt64 {
+	userID, ok := sessions.Default(c).Get("user_id").(int)
+	return sql.NullInt64{Int64: int64(userID), Valid: ok}
+}
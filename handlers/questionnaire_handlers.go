@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"mediflow/notifications"
+	"mediflow/storage"
+)
+
+// sessionQuestionnaire confere o acesso do terapeuta ao paciente e o instrumento pedido na URL.
+func (h *TerapeutaHandler) sessionQuestionnaire(c *gin.Context) (int, Questionnaire, bool) {
+	therapistID := sessions.Default(c).Get("user_id").(int)
+	patientID, _ := strconv.Atoi(c.Param("id"))
+	if !therapistHasPatient(h.DB, therapistID, patientID) {
+		c.HTML(http.StatusForbidden, "layouts/error.html", gin.H{"Title": "Acesso Negado", "Message": "Você não tem permissão para aplicar escalas a este paciente."})
+		return 0, Questionnaire{}, false
+	}
+	q, ok := questionnaireByCode(c.Param("code"))
+	if !ok {
+		c.HTML(http.StatusNotFound, "layouts/error.html", gin.H{"Title": "Não Encontrado", "Message": "Escala não encontrada."})
+		return 0, Questionnaire{}, false
+	}
+	return patientID, q, true
+}
+
+// ShowSessionQuestionnaire exibe a escala para o terapeuta preencher com o paciente na sessão.
+func (h *TerapeutaHandler) ShowSessionQuestionnaire(c *gin.Context) {
+	patientID, q, ok := h.sessionQuestionnaire(c)
+	if !ok {
+		return
+	}
+	h.renderSessionQuestionnaire(c, http.StatusOK, patientID, q, nil, nil)
+}
+
+// PostSessionQuestionnaire pontua e grava a escala aplicada na sessão.
+func (h *TerapeutaHandler) PostSessionQuestionnaire(c *gin.Context) {
+	patientID, q, ok := h.sessionQuestionnaire(c)
+	if !ok {
+		return
+	}
+	answers, values, errors := parseQuestionnaireAnswers(q, c.PostForm)
+	if len(errors) > 0 {
+		h.renderSessionQuestionnaire(c, http.StatusBadRequest, patientID, q, values, errors)
+		return
+	}
+
+	session := sessions.Default(c)
+	responseID, err := saveQuestionnaireAnswers(h.DB, q, patientID, 0, questionnaireSession, sessionUserID(c), answers)
+	if err != nil {
+		log.Printf("Erro ao salvar a escala %s do paciente %d: %v", q.Code, patientID, err)
+		session.AddFlash("Não foi possível salvar a escala.", "error")
+	} else {
+		score, severity, alert := q.Score(answers)
+		AddAuditLog(LogAction{
+			DB:         h.DB,
+			Context:    c,
+			Action:     fmt.Sprintf("Aplicou a escala %s na sessão (aplicação ID %d, pontuação %d/%d, %s)", q.Name, responseID, score, q.MaxScore(), severity),
+			TargetType: "Paciente",
+			TargetID:   patientID,
+		})
+		message := fmt.Sprintf("%s registrado: %d pontos (%s).", q.Name, score, severity)
+		if alert {
+			message += " " + q.AlertMessage
+		}
+		session.AddFlash(message, "success")
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, fmt.Sprintf("/terapeuta/pacientes/prontuario/%d", patientID))
+}
+
+// SendQuestionnaireToPatient deixa a escala pendente no portal para o paciente responder.
+func (h *TerapeutaHandler) SendQuestionnaireToPatient(c *gin.Context) {
+	patientID, q, ok := h.sessionQuestionnaire(c)
+	if !ok {
+		return
+	}
+	session := sessions.Default(c)
+	defer session.Save()
+	redirect := fmt.Sprintf("/terapeuta/pacientes/prontuario/%d", patientID)
+
+	// Uma única pendência por instrumento: reenviar não duplica o pedido
+	var responseID int
+	err := h.DB.QueryRow(`INSERT INTO questionnaire_responses (patient_id, questionnaire, status, source, requested_by)
+		SELECT $1, $2, $3, $4, $5
+		WHERE NOT EXISTS (SELECT 1 FROM questionnaire_responses WHERE patient_id = $1 AND questionnaire = $2 AND status = $3)
+		RETURNING id`, patientID, q.Code, questionnairePending, questionnairePortal, sessionUserID(c)).Scan(&responseID)
+	if err == sql.ErrNoRows {
+		session.AddFlash(fmt.Sprintf("O %s já está pendente no portal do paciente.", q.Name), "error")
+		c.Redirect(http.StatusFound, redirect)
+		return
+	}
+	if err != nil {
+		log.Printf("Erro ao enviar a escala %s ao paciente %d: %v", q.Code, patientID, err)
+		session.AddFlash("Não foi possível enviar a escala ao paciente.", "error")
+		c.Redirect(http.StatusFound, redirect)
+		return
+	}
+
+	AddAuditLog(LogAction{
+		DB:         h.DB,
+		Context:    c,
+		Action:     fmt.Sprintf("Enviou a escala %s para o paciente responder no portal (aplicação ID %d)", q.Name, responseID),
+		TargetType: "Paciente",
+		TargetID:   patientID,
+	})
+	session.AddFlash(fmt.Sprintf("%s enviado. O paciente verá o questionário ao entrar no portal.", q.Name), "success")
+	c.Redirect(http.StatusFound, redirect)
+}
+
+// renderSessionQuestionnaire desenha o formulário da escala para o terapeuta.
+func (h *TerapeutaHandler) renderSessionQuestionnaire(c *gin.Context, status, patientID int, q Questionnaire, values, errors map[string]string) {
+	var patientName string
+	if err := h.DB.QueryRow("SELECT name FROM patients WHERE id = $1", patientID).Scan(&patientName); err != nil {
+		log.Printf("Erro ao buscar paciente %d para a escala: %v", patientID, err)
+	}
+
+	c.HTML(status, "terapeuta/questionnaire.html", gin.H{
+		"Title":         q.Name,
+		"ActiveNav":     "dashboard",
+		"PatientID":     patientID,
+		"PatientName":   patientName,
+		"Questionnaire": q,
+		"Items":         questionnaireItemViews(q, values, errors),
+		"HasErrors":     len(errors) > 0,
+	})
+}
+
+// ShowPortalQuestionnaires lista as escalas que o terapeuta enviou e o paciente ainda não respondeu.
+func (h *PortalHandler) ShowPortalQuestionnaires(c *gin.Context) {
+	session := sessions.Default(c)
+	patientID, _ := session.Get("patient_id").(int)
+	errorFlashes := session.Flashes("error")
+	successFlashes := session.Flashes("success")
+	session.Save()
+
+	responses, err := loadPatientQuestionnaires(h.DB, patientID)
+	if err != nil {
+		log.Printf("Erro ao buscar escalas do paciente %d: %v", patientID, err)
+	}
+	var pending []storage.QuestionnaireResponse
+	for _, r := range responses {
+		if r.Status == questionnairePending {
+			pending = append(pending, r)
+		}
+	}
+
+	c.HTML(http.StatusOK, "portal/questionnaires.html", gin.H{
+		"Title":          "Questionários",
+		"PatientName":    session.Get("patient_name"),
+		"Pending":        pending,
+		"ErrorFlashes":   errorFlashes,
+		"SuccessFlashes": successFlashes,
+	})
+}
+
+// portalQuestionnaire busca a escala pendente da URL para o paciente logado.
+func (h *PortalHandler) portalQuestionnaire(c *gin.Context) (storage.QuestionnaireResponse, Questionnaire, bool) {
+	session := sessions.Default(c)
+	patientID, _ := session.Get("patient_id").(int)
+	responseID, _ := strconv.Atoi(c.Param("id"))
+
+	response, err := loadPendingQuestionnaire(h.DB, patientID, responseID)
+	q, known := questionnaireByCode(response.Questionnaire)
+	if err != nil || !known {
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Erro ao buscar a escala ID %d do paciente %d: %v", responseID, patientID, err)
+		}
+		session.AddFlash("Este questionário não está mais disponível.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/portal/escalas")
+		return response, q, false
+	}
+	return response, q, true
+}
+
+// ShowPortalQuestionnaire exibe uma escala pendente para o paciente responder.
+func (h *PortalHandler) ShowPortalQuestionnaire(c *gin.Context) {
+	response, q, ok := h.portalQuestionnaire(c)
+	if !ok {
+		return
+	}
+	h.renderPortalQuestionnaire(c, http.StatusOK, response, q, nil, nil)
+}
+
+// PostPortalQuestionnaire pontua e grava as respostas do paciente.
+func (h *PortalHandler) PostPortalQuestionnaire(c *gin.Context) {
+	response, q, ok := h.portalQuestionnaire(c)
+	if !ok {
+		return
+	}
+	answers, values, errors := parseQuestionnaireAnswers(q, c.PostForm)
+	if len(errors) > 0 {
+		h.renderPortalQuestionnaire(c, http.StatusBadRequest, response, q, values, errors)
+		return
+	}
+
+	session := sessions.Default(c)
+	_, err := saveQuestionnaireAnswers(h.DB, q, response.PatientID, response.ID, questionnairePortal, sql.NullInt64{}, answers)
+	if err != nil {
+		log.Printf("Erro ao salvar a escala ID %d: %v", response.ID, err)
+		session.AddFlash("Não foi possível salvar suas respostas. Tente novamente.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/portal/escalas")
+		return
+	}
+
+	AddPatientAuditLog(h.DB, c, fmt.Sprintf("Paciente respondeu pelo portal a escala %s (aplicação ID %d)", q.Name, response.ID), "Paciente", response.PatientID)
+	session.AddFlash("Obrigado! Suas respostas foram enviadas ao seu terapeuta.", "success")
+	if _, _, alert := q.Score(answers); alert {
+		h.notifyQuestionnaireAlert(c.Request.Context(), response, q)
+		session.AddFlash("Se você está pensando em se ferir, procure ajuda agora: ligue para o CVV no 188 (24 horas, gratuito) ou para o SAMU no 192, ou fale com a clínica.", "error")
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, "/portal/escalas")
+}
+
+// notifyQuestionnaireAlert avisa o terapeuta que enviou a escala (ou, sem ele, os terapeutas do
+// paciente) de que o item de alerta pontuou. Vai por e-mail, com o canal de log como último recurso.
+func (h *PortalHandler) notifyQuestionnaireAlert(ctx context.Context, response storage.QuestionnaireResponse, q Questionnaire) {
+	recipients, err := questionnaireAlertRecipients(h.DB, response.ID, response.PatientID)
+	if err != nil {
+		log.Printf("Erro ao buscar os terapeutas para o alerta da escala ID %d: %v", response.ID, err)
+		return
+	}
+	if len(recipients) == 0 {
+		log.Printf("AVISO: alerta da escala ID %d (paciente %d) sem terapeuta para avisar", response.ID, response.PatientID)
+		return
+	}
+
+	msg := notifications.Message{
+		Subject: fmt.Sprintf("Alerta: %s respondido no portal exige atenção", q.Name),
+		Body: fmt.Sprintf("O paciente de ID %d respondeu pelo portal a escala %s (aplicação ID %d).\n\n%s\n\n"+
+			"Acesse o prontuário do paciente no MediFlow para ver as respostas e entrar em contato.",
+			response.PatientID, q.Name, response.ID, q.AlertMessage),
+	}
+	for _, r := range recipients {
+		msg.To = r.Email
+		sent := false
+		for _, channel := range []string{notifications.ChannelEmail, notifications.ChannelLog} {
+			for _, notifier := range h.Notifiers {
+				if sent || notifier.Channel() != channel {
+					continue
+				}
+				sendCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+				err := notifier.Send(sendCtx, msg)
+				cancel()
+				if err != nil {
+					log.Printf("Erro ao enviar por %s o alerta da escala ID %d ao terapeuta ID %d: %v", channel, response.ID, r.ID, err)
+					continue
+				}
+				sent = true
+				AddSystemAuditLog(h.DB, fmt.Sprintf("Enviou por %s ao terapeuta ID %d o alerta da escala %s (aplicação ID %d)", channel, r.ID, q.Name, response.ID), "Paciente", response.PatientID)
+			}
+		}
+		if !sent {
+			log.Printf("ERRO: o alerta da escala ID %d não chegou ao terapeuta ID %d por nenhum canal", response.ID, r.ID)
+		}
+	}
+}
+
+// renderPortalQuestionnaire desenha o formulário da escala no portal.
+func (h *PortalHandler) renderPortalQuestionnaire(c *gin.Context, status int, response storage.QuestionnaireResponse, q Questionnaire, values, errors map[string]string) {
+	c.HTML(status, "portal/questionnaires.html", gin.H{
+		"Title":         q.Name,
+		"PatientName":   sessions.Default(c).Get("patient_name"),
+		"Response":      response,
+		"Questionnaire": q,
+		"Items":         questionnaireItemViews(q, values, errors),
+		"HasErrors":     len(errors) > 0,
+	})
+}
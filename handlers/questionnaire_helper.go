@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"mediflow/storage"
+)
+
+// Situação e origem de uma aplicação de escala.
+const (
+	questionnairePending  = "pendente"   // Enviada ao paciente, aguardando as respostas no portal
+	questionnaireAnswered = "respondido" // Respostas gravadas e pontuadas
+	questionnaireSession  = "sessao"     // Aplicada pelo terapeuta durante a sessão
+	questionnairePortal   = "portal"     // Respondida pelo paciente no portal
+)
+
+// QuestionnaireOption é uma alternativa de resposta, com os pontos que ela vale.
+type QuestionnaireOption struct {
+	Value int
+	Label string
+}
+
+// SeverityBand é uma faixa de pontuação total e a gravidade correspondente.
+type SeverityBand struct {
+	Min, Max int
+	Label    string
+}
+
+// Questionnaire é a definição de um instrumento padronizado: itens, alternativas, regra de
+// pontuação (soma dos itens) e faixas de gravidade. AlertItem, quando > 0, é o número do item que
+// exige atenção imediata do terapeuta se pontuar acima de zero.
+type Questionnaire struct {
+	Code         string
+	Name         string
+	Title        string
+	Instructions string
+	Items        []string
+	Options      []QuestionnaireOption
+	Bands        []SeverityBand
+	AlertItem    int
+	AlertMessage string
+}
+
+var frequencyOptions = []QuestionnaireOption{
+	{Value: 0, Label: "Nenhuma vez"},
+	{Value: 1, Label: "Vários dias"},
+	{Value: 2, Label: "Mais da metade dos dias"},
+	{Value: 3, Label: "Quase todos os dias"},
+}
+
+const frequencyInstructions = "Durante as últimas 2 semanas, com que frequência você foi incomodado(a) por qualquer um dos problemas abaixo?"
+
+// questionnaires são os instrumentos disponíveis, na ordem em que aparecem nas telas.
+var questionnaires = []Questionnaire{
+	{
+		Code:         "phq9",
+		Name:         "PHQ-9",
+		Title:        "Questionário sobre a Saúde do Paciente (PHQ-9)",
+		Instructions: frequencyInstructions,
+		Items: []string{
+			"Pouco interesse ou pouco prazer em fazer as coisas",
+			"Se sentir “para baixo”, deprimido(a) ou sem perspectiva",
+			"Dificuldade para pegar no sono ou permanecer dormindo, ou dormir mais do que de costume",
+			"Se sentir cansado(a) ou com pouca energia",
+			"Falta de apetite ou comendo demais",
+			"Se sentir mal consigo mesmo(a), ou achar que você é um fracasso ou que decepcionou sua família ou você mesmo(a)",
+			"Dificuldade para se concentrar nas coisas, como ler o jornal ou ver televisão",
+			"Lentidão para se movimentar ou falar, a ponto de as outras pessoas perceberem; ou o oposto: estar tão agitado(a) ou inquieto(a) que você fica andando de um lado para o outro muito mais do que de costume",
+			"Pensar em se ferir de alguma maneira ou que seria melhor estar morto(a)",
+		},
+		Options: frequencyOptions,
+		Bands: []SeverityBand{
+			{Min: 0, Max: 4, Label: "Mínima"},
+			{Min: 5, Max: 9, Label: "Leve"},
+			{Min: 10, Max: 14, Label: "Moderada"},
+			{Min: 15, Max: 19, Label: "Moderadamente grave"},
+			{Min: 20, Max: 27, Label: "Grave"},
+		},
+		AlertItem:    9,
+		AlertMessage: "Item 9 positivo: avaliar risco de autolesão ou suicídio.",
+	},
+	{
+		Code:         "gad7",
+		Name:         "GAD-7",
+		Title:        "Escala de Transtorno de Ansiedade Generalizada (GAD-7)",
+		Instructions: frequencyInstructions,
+		Items: []string{
+			"Sentir-se nervoso(a), ansioso(a) ou muito tenso(a)",
+			"Não ser capaz de impedir ou de controlar as preocupações",
+			"Preocupar-se muito com diversas coisas",
+			"Dificuldade para relaxar",
+			"Ficar tão agitado(a) que se torna difícil permanecer sentado(a)",
+			"Ficar facilmente aborrecido(a) ou irritado(a)",
+			"Sentir medo como se algo horrível fosse acontecer",
+		},
+		Options: frequencyOptions,
+		Bands: []SeverityBand{
+			{Min: 0, Max: 4, Label: "Mínima"},
+			{Min: 5, Max: 9, Label: "Leve"},
+			{Min: 10, Max: 14, Label: "Moderada"},
+			{Min: 15, Max: 21, Label: "Grave"},
+		},
+	},
+}
+
+// questionnaireByCode busca a definição do instrumento pelo código usado nas URLs e no banco.
+func questionnaireByCode(code string) (Questionnaire, bool) {
+	for _, q := range questionnaires {
+		if q.Code == code {
+			return q, true
+		}
+	}
+	return Questionnaire{}, false
+}
+
+// MaxScore é a pontuação máxima possível do instrumento.
+func (q Questionnaire) MaxScore() int {
+	highest := 0
+	for _, option := range q.Options {
+		if option.Value > highest {
+			highest = option.Value
+		}
+	}
+	return highest * len(q.Items)
+}
+
+// Score soma os itens e devolve a pontuação, a faixa de gravidade e se o item de alerta pontuou.
+func (q Questionnaire) Score(answers []int) (int, string, bool) {
+	score := 0
+	for _, answer := range answers {
+		score += answer
+	}
+	severity := ""
+	for _, band := range q.Bands {
+		if score >= band.Min && score <= band.Max {
+			severity = band.Label
+			break
+		}
+	}
+	alert := q.AlertItem > 0 && q.AlertItem <= len(answers) && answers[q.AlertItem-1] > 0
+	return score, severity, alert
+}
+
+// QuestionnaireItemView é um item do formulário com a resposta marcada e o erro de validação.
+type QuestionnaireItemView struct {
+	Number int
+	Text   string
+	Name   string
+	Value  string
+	Error  string
+}
+
+// questionnaireItemViews monta os itens do formulário a partir dos valores enviados.
+func questionnaireItemViews(q Questionnaire, values, errors map[string]string) []QuestionnaireItemView {
+	items := make([]QuestionnaireItemView, 0, len(q.Items))
+	for i, text := range q.Items {
+		name := fmt.Sprintf("item_%d", i+1)
+		items = append(items, QuestionnaireItemView{Number: i + 1, Text: text, Name: name, Value: values[name], Error: errors[name]})
+	}
+	return items
+}
+
+// parseQuestionnaireAnswers lê e valida as respostas do formulário; todos os itens são obrigatórios.
+func parseQuestionnaireAnswers(q Questionnaire, postForm func(string) string) ([]int, map[string]string, map[string]string) {
+	answers := make([]int, len(q.Items))
+	values := map[string]string{}
+	errors := map[string]string{}
+	for i := range q.Items {
+		name := fmt.Sprintf("item_%d", i+1)
+		values[name] = strings.TrimSpace(postForm(name))
+		n, err := strconv.Atoi(values[name])
+		valid := err == nil
+		if valid {
+			valid = false
+			for _, option := range q.Options {
+				if option.Value == n {
+					valid = true
+				}
+			}
+		}
+		if !valid {
+			errors[name] = "Escolha uma das alternativas."
+			continue
+		}
+		answers[i] = n
+	}
+	return answers, values, errors
+}
+
+// saveQuestionnaireAnswers pontua as respostas e as grava. Com responseID > 0 completa uma
+// aplicação pendente; caso contrário, cria uma nova. Devolve o ID da aplicação.
+func saveQuestionnaireAnswers(db execer, q Questionnaire, patientID, responseID int, source string, requestedBy sql.NullInt64, answers []int) (int, error) {
+	score, severity, alert := q.Score(answers)
+	answersJSON, err := json.Marshal(answers)
+	if err != nil {
+		return 0, err
+	}
+
+	if responseID > 0 {
+		err = db.QueryRow(`UPDATE questionnaire_responses SET status = $1, source = $2, answers = $3, score = $4, severity = $5, alert = $6, completed_at = NOW()
+			WHERE id = $7 AND patient_id = $8 AND status = $9 RETURNING id`,
+			questionnaireAnswered, source, string(answersJSON), score, severity, alert, responseID, patientID, questionnairePending).Scan(&responseID)
+		return responseID, err
+	}
+	err = db.QueryRow(`INSERT INTO questionnaire_responses (patient_id, questionnaire, status, source, requested_by, answers, score, severity, alert, completed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NOW()) RETURNING id`,
+		patientID, q.Code, questionnaireAnswered, source, requestedBy, string(answersJSON), score, severity, alert).Scan(&responseID)
+	return responseID, err
+}
+
+// alertRecipient é um terapeuta que recebe o aviso de uma escala com alerta.
+type alertRecipient struct {
+	ID    int
+	Email string
+}
+
+// questionnaireAlertRecipients devolve o terapeuta que enviou a escala ou, quando ela não tem
+// solicitante ativo, os terapeutas com consultas (não canceladas) do paciente.
+func questionnaireAlertRecipients(db *sql.DB, responseID, patientID int) ([]alertRecipient, error) {
+	rows, err := db.Query(`SELECT u.id, u.email FROM users u
+		WHERE u.user_type = 'terapeuta' AND u.deleted_at IS NULL AND (
+			u.id = (SELECT requested_by FROM questionnaire_responses WHERE id = $1)
+			OR (NOT EXISTS (SELECT 1 FROM questionnaire_responses r JOIN users ru ON ru.id = r.requested_by
+					WHERE r.id = $1 AND ru.user_type = 'terapeuta' AND ru.deleted_at IS NULL)
+				AND EXISTS (SELECT 1 FROM appointments a WHERE a.doctor_id = u.id AND a.patient_id = $2
+					AND a.status NOT IN ($3, 'cancelado', 'cancelado_tardio'))))
+		ORDER BY u.id`, responseID, patientID, statusBookingHold)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipients []alertRecipient
+	for rows.Next() {
+		var r alertRecipient
+		if err := rows.Scan(&r.ID, &r.Email); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, rows.Err()
+}
+
+const questionnaireSelectSQL = `SELECT r.id, r.patient_id, r.questionnaire, r.status, r.source, COALESCE(u.name, ''),
+	COALESCE(r.answers::text, '[]'), COALESCE(r.score, 0), COALESCE(r.severity, ''), r.alert, r.created_at, r.completed_at
+	FROM questionnaire_responses r LEFT JOIN users u ON r.requested_by = u.id `
+
+// scanQuestionnaireResponse lê uma linha de questionnaireSelectSQL e completa os dados do instrumento.
+func scanQuestionnaireResponse(scan func(dest ...interface{}) error) (storage.QuestionnaireResponse, error) {
+	var r storage.QuestionnaireResponse
+	var answers string
+	if err := scan(&r.ID, &r.PatientID, &r.Questionnaire, &r.Status, &r.Source, &r.RequestedBy,
+		&answers, &r.Score, &r.Severity, &r.Alert, &r.CreatedAt, &r.CompletedAt); err != nil {
+		return r, err
+	}
+	if err := json.Unmarshal([]byte(answers), &r.Answers); err != nil {
+		return r, err
+	}
+	loc := storage.ClinicLocation()
+	r.CreatedAt = r.CreatedAt.In(loc)
+	if r.CompletedAt.Valid {
+		r.CompletedAt.Time = r.CompletedAt.Time.In(loc)
+	}
+	if q, ok := questionnaireByCode(r.Questionnaire); ok {
+		r.Name, r.MaxScore = q.Name, q.MaxScore()
+		if r.Alert {
+			r.AlertMessage = q.AlertMessage
+		}
+	}
+	return r, nil
+}
+
+// loadPatientQuestionnaires lista as aplicações de escalas do paciente, da mais recente para a mais
+// antiga (as pendentes primeiro).
+func loadPatientQuestionnaires(db *sql.DB, patientID int) ([]storage.QuestionnaireResponse, error) {
+	rows, err := db.Query(questionnaireSelectSQL+"WHERE r.patient_id = $1 ORDER BY COALESCE(r.completed_at, 'infinity') DESC, r.id DESC", patientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var responses []storage.QuestionnaireResponse
+	for rows.Next() {
+		r, err := scanQuestionnaireResponse(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, r)
+	}
+	return responses, rows.Err()
+}
+
+// loadPendingQuestionnaire busca uma escala enviada ao paciente e ainda não respondida.
+func loadPendingQuestionnaire(db *sql.DB, patientID, responseID int) (storage.QuestionnaireResponse, error) {
+	return scanQuestionnaireResponse(db.QueryRow(questionnaireSelectSQL+"WHERE r.id = $1 AND r.patient_id = $2 AND r.status = $3",
+		responseID, patientID, questionnairePending).Scan)
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"strconv"
+	"testing"
+)
+
+// answersSumming monta respostas de n itens (0 a 3 cada) que somam total; o item de alerta, quando
+// informado, fica com alertValue e os demais completam a soma.
+func answersSumming(t *testing.T, n, total, alertItem, alertValue int) []int {
+	t.Helper()
+	answers := make([]int, n)
+	remaining := total
+	if alertItem > 0 {
+		answers[alertItem-1] = alertValue
+		remaining -= alertValue
+	}
+	for i := range answers {
+		if i == alertItem-1 {
+			continue
+		}
+		answers[i] = min(remaining, 3)
+		remaining -= answers[i]
+	}
+	if remaining != 0 {
+		t.Fatalf("não dá para somar %d em %d itens", total, n)
+	}
+	return answers
+}
+
+func TestQuestionnaireScoreBands(t *testing.T) {
+	tests := []struct {
+		code  string
+		score int
+		want  string
+	}{
+		{"phq9", 0, "Mínima"},
+		{"phq9", 4, "Mínima"},
+		{"phq9", 5, "Leve"},
+		{"phq9", 9, "Leve"},
+		{"phq9", 10, "Moderada"},
+		{"phq9", 14, "Moderada"},
+		{"phq9", 15, "Moderadamente grave"},
+		{"phq9", 19, "Moderadamente grave"},
+		{"phq9", 20, "Grave"},
+		{"phq9", 27, "Grave"},
+		{"gad7", 0, "Mínima"},
+		{"gad7", 4, "Mínima"},
+		{"gad7", 5, "Leve"},
+		{"gad7", 9, "Leve"},
+		{"gad7", 10, "Moderada"},
+		{"gad7", 14, "Moderada"},
+		{"gad7", 15, "Grave"},
+		{"gad7", 21, "Grave"},
+	}
+	for _, tt := range tests {
+		q, ok := questionnaireByCode(tt.code)
+		if !ok {
+			t.Fatalf("escala %s não encontrada", tt.code)
+		}
+		// O item de alerta só pontua quando os demais não bastam para chegar à soma
+		alertValue := 0
+		if q.AlertItem > 0 {
+			alertValue = max(0, tt.score-3*(len(q.Items)-1))
+		}
+		answers := answersSumming(t, len(q.Items), tt.score, q.AlertItem, alertValue)
+		score, severity, alert := q.Score(answers)
+		if score != tt.score || severity != tt.want {
+			t.Errorf("%s %v: recebeu %d (%s), esperava %d (%s)", q.Name, answers, score, severity, tt.score, tt.want)
+		}
+		if alert != (alertValue > 0) {
+			t.Errorf("%s %v: alerta %v", q.Name, answers, alert)
+		}
+	}
+}
+
+func TestQuestionnaireMaxScore(t *testing.T) {
+	for code, want := range map[string]int{"phq9": 27, "gad7": 21} {
+		q, _ := questionnaireByCode(code)
+		if got := q.MaxScore(); got != want {
+			t.Errorf("MaxScore de %s = %d, esperava %d", q.Name, got, want)
+		}
+		if last := q.Bands[len(q.Bands)-1]; last.Max != want {
+			t.Errorf("a última faixa de %s termina em %d, esperava %d", q.Name, last.Max, want)
+		}
+	}
+}
+
+func TestQuestionnaireAlertItem(t *testing.T) {
+	phq9, _ := questionnaireByCode("phq9")
+	for value := 0; value <= 3; value++ {
+		answers := answersSumming(t, len(phq9.Items), value, phq9.AlertItem, value)
+		if _, _, alert := phq9.Score(answers); alert != (value > 0) {
+			t.Errorf("item 9 = %d: alerta %v", value, alert)
+		}
+	}
+
+	// Os demais itens no máximo não disparam o alerta
+	answers := answersSumming(t, len(phq9.Items), 24, phq9.AlertItem, 0)
+	if _, severity, alert := phq9.Score(answers); alert || severity != "Grave" {
+		t.Errorf("item 9 zerado com 24 pontos: alerta %v, gravidade %s", alert, severity)
+	}
+
+	gad7, _ := questionnaireByCode("gad7")
+	if _, _, alert := gad7.Score([]int{3, 3, 3, 3, 3, 3, 3}); alert {
+		t.Error("o GAD-7 não tem item de alerta")
+	}
+}
+
+func TestParseQuestionnaireAnswers(t *testing.T) {
+	q, _ := questionnaireByCode("phq9")
+	form := map[string]string{}
+	for i := range q.Items {
+		form["item_"+strconv.Itoa(i+1)] = strconv.Itoa(i % 4)
+	}
+	form["item_1"] = " 2 "
+
+	answers, values, errors := parseQuestionnaireAnswers(q, func(name string) string { return form[name] })
+	if len(errors) > 0 {
+		t.Fatalf("respostas válidas recusadas: %v", errors)
+	}
+	want := []int{2, 1, 2, 3, 0, 1, 2, 3, 0}
+	for i := range want {
+		if answers[i] != want[i] {
+			t.Fatalf("respostas %v, esperava %v", answers, want)
+		}
+	}
+	if values["item_1"] != "2" {
+		t.Errorf("valor do item 1 = %q, esperava o número sem espaços", values["item_1"])
+	}
+
+	tests := []struct {
+		name, value string
+	}{
+		{"ausente", ""},
+		{"acima da escala", "4"},
+		{"negativo", "-1"},
+		{"não numérico", "muito"},
+		{"decimal", "1.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			invalid := map[string]string{}
+			for name, value := range form {
+				invalid[name] = value
+			}
+			invalid["item_9"] = tt.value
+			_, values, errors := parseQuestionnaireAnswers(q, func(name string) string { return invalid[name] })
+			if len(errors) != 1 || errors["item_9"] == "" {
+				t.Fatalf("item 9 = %q: erros %v, esperava só o do item 9", tt.value, errors)
+			}
+			if values["item_9"] != tt.value {
+				t.Errorf("o valor enviado não volta para o formulário: %q", values["item_9"])
+			}
+		})
+	}
+
+	// Formulário vazio: todos os itens são obrigatórios
+	_, _, errors = parseQuestionnaireAnswers(q, func(string) string { return "" })
+	if len(errors) != len(q.Items) {
+		t.Errorf("formulário vazio com %d erros, esperava %d", len(errors), len(q.Items))
+	}
+}
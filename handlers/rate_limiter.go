@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter limita quantas tentativas cada chave (em geral, o IP) pode fazer por janela de tempo
+// nos formulários públicos (agendamento online, login do portal). Os contadores ficam em memória:
+// reiniciar o servidor zera os limites, o que é aceitável para conter abusos.
+type RateLimiter struct {
+	Limit  int
+	Window time.Duration
+
+	mu        sync.Mutex
+	hits      map[string][]time.Time
+	lastSweep time.Time
+}
+
+// NewRateLimiter cria o limitador com até 'limit' tentativas por chave na janela. Com limit <= 0,
+// não há limite.
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{Limit: limit, Window: window, hits: make(map[string][]time.Time)}
+}
+
+// Allow registra uma tentativa da chave e indica se ela está dentro do limite.
+func (l *RateLimiter) Allow(key string, now time.Time) bool {
+	if l.Limit <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := now.Add(-l.Window)
+	// De tempos em tempos descarta as chaves sem tentativas recentes, para o mapa não crescer sem limite
+	if now.Sub(l.lastSweep) > l.Window {
+		for k, times := range l.hits {
+			if len(times) == 0 || !times[len(times)-1].After(cutoff) {
+				delete(l.hits, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	recent := l.hits[key][:0]
+	for _, t := range l.hits[key] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= l.Limit {
+		l.hits[key] = recent
+		return false
+	}
+	l.hits[key] = append(recent, now)
+	return true
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"mediflow/storage"
+)
+
+// saveRecordEntry grava a entrada do prontuário enviada pelo formulário como rascunho do autor, com
+// a nota estruturada do modelo escolhido e o progresso das metas do plano terapêutico ativo, e, se
+// o profissional usou o botão "Salvar e Assinar",
+// assina na mesma transação. Uma nota com campos obrigatórios vazios ou inválidos fica só no
+// rascunho. Registra a auditoria e a mensagem exibida na volta ao prontuário.
+func saveRecordEntry(db *sql.DB, c *gin.Context, patientID, authorID int, rec storage.PatientRecord) {
+	session := sessions.Default(c)
+	sign := c.PostForm("sign") == "1"
+
+	if templateID, _ := strconv.Atoi(c.PostForm("note_template_id")); templateID > 0 {
+		template, err := loadNoteTemplate(db, templateID)
+		if err != nil {
+			log.Printf("Erro ao buscar o modelo de nota ID %d: %v", templateID, err)
+			session.AddFlash("Não foi possível carregar o modelo de nota; a entrada não foi salva.", "error")
+			session.Save()
+			return
+		}
+		var problems []string
+		rec.Note, problems = noteFromForm(template, c.PostForm)
+		if sign && len(problems) > 0 {
+			sign = false
+			session.AddFlash("A entrada foi salva como rascunho, mas não pode ser assinada até que a nota esteja completa: "+strings.Join(problems, "; ")+".", "error")
+		}
+	}
+
+	var err error
+	if rec.GoalProgress, err = goalProgressFromForm(db, patientID, c.PostForm); err != nil {
+		log.Printf("Erro ao buscar o plano terapêutico do paciente %d: %v", patientID, err)
+		session.AddFlash("Não foi possível carregar o plano terapêutico; a entrada não foi salva.", "error")
+		session.Save()
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Erro ao iniciar transação do prontuário: %v", err)
+		session.AddFlash("Não foi possível salvar a entrada do prontuário.", "error")
+		session.Save()
+		return
+	}
+	defer tx.Rollback()
+
+	recordID, err := savePatientRecordDraft(tx, patientID, authorID, rec)
+	if err != nil {
+		log.Printf("Erro ao gravar entrada do prontuário do paciente %d: %v", patientID, err)
+		session.AddFlash("Não foi possível salvar a entrada do prontuário.", "error")
+		session.Save()
+		return
+	}
+	var signed storage.PatientRecord
+	if sign {
+		if signed, err = signPatientRecord(tx, recordID, authorID); err != nil {
+			log.Printf("Erro ao assinar a entrada ID %d do prontuário: %v", recordID, err)
+			session.AddFlash("Não foi possível assinar a entrada do prontuário.", "error")
+			session.Save()
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Erro ao comitar entrada do prontuário: %v", err)
+		session.AddFlash("Não foi possível salvar a entrada do prontuário.", "error")
+		session.Save()
+		return
+	}
+
+	action := fmt.Sprintf("Salvou rascunho da entrada ID %d do prontuário", recordID)
+	message := "Rascunho salvo. A entrada ainda pode ser alterada até ser assinada."
+	if sign {
+		action = fmt.Sprintf("Assinou a entrada ID %d do prontuário (hash %s)", recordID, signed.SignatureHash)
+		message = "Entrada assinada. A partir de agora ela não pode mais ser alterada; correções são feitas por adendo."
+	}
+	AddAuditLog(LogAction{
+		DB:         db,
+		Context:    c,
+		Action:     action,
+		TargetType: "Paciente",
+		TargetID:   patientID,
+	})
+	session.AddFlash(message, "success")
+	session.Save()
+}
+
+// postRecordAddendum grava o adendo enviado pelo formulário do histórico e volta ao prontuário.
+func postRecordAddendum(db *sql.DB, c *gin.Context, patientID int, redirect string) {
+	session := sessions.Default(c)
+	defer func() {
+		session.Save()
+		c.Redirect(http.StatusFound, redirect)
+	}()
+
+	recordID, err := strconv.Atoi(c.Param("recordId"))
+	if err != nil {
+		session.AddFlash("Entrada do prontuário não encontrada.", "error")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Erro ao iniciar transação do adendo: %v", err)
+		session.AddFlash("Não foi possível gravar o adendo.", "error")
+		return
+	}
+	defer tx.Rollback()
+
+	addendum, err := addPatientRecordAddendum(tx, patientID, recordID, session.Get("user_id").(int), c.PostForm("addendum_text"))
+	if err == nil {
+		err = tx.Commit()
+	}
+	switch {
+	case err == sql.ErrNoRows:
+		session.AddFlash("Entrada do prontuário não encontrada.", "error")
+		return
+	case errors.Is(err, errAddendumTextEmpty), errors.Is(err, errAddendumTooLong), errors.Is(err, errRecordNotSigned), errors.Is(err, errRecordIsAddendum):
+		session.AddFlash("Adendo não gravado: "+err.Error()+".", "error")
+		return
+	case err != nil:
+		log.Printf("Erro ao gravar adendo à entrada ID %d do prontuário: %v", recordID, err)
+		session.AddFlash("Não foi possível gravar o adendo.", "error")
+		return
+	}
+
+	AddAuditLog(LogAction{
+		DB:         db,
+		Context:    c,
+		Action:     fmt.Sprintf("Adicionou o adendo ID %d à entrada ID %d do prontuário (hash %s)", addendum.ID, recordID, addendum.SignatureHash),
+		TargetType: "Paciente",
+		TargetID:   patientID,
+	})
+	session.AddFlash("Adendo gravado e assinado.", "success")
+}
+
+// PostRecordAddendum grava um adendo a uma entrada assinada do prontuário de um paciente do terapeuta.
+func (h *TerapeutaHandler) PostRecordAddendum(c *gin.Context) {
+	therapistID := sessions.Default(c).Get("user_id").(int)
+	patientID, _ := strconv.Atoi(c.Param("id"))
+	if !therapistHasPatient(h.DB, therapistID, patientID) {
+		c.HTML(http.StatusForbidden, "layouts/error.html", gin.H{"Title": "Acesso Negado", "Message": "Você não tem permissão para alterar o prontuário deste paciente."})
+		return
+	}
+	postRecordAddendum(h.DB, c, patientID, fmt.Sprintf("/terapeuta/pacientes/prontuario/%d", patientID))
+}
+
+// PostRecordAddendum grava um adendo a uma entrada assinada do prontuário.
+func (h *AdminHandler) PostRecordAddendum(c *gin.Context) {
+	patientID, _ := strconv.Atoi(c.Param("id"))
+	postRecordAddendum(h.DB, c, patientID, fmt.Sprintf("/admin/patients/edit/%d", patientID))
+}
+
+// emotionalLevelsJSON responde a série dos seis níveis emocionais do paciente, uma posição por
+// sessão, com o período e a média móvel pedidos em from, to e window.
+func emotionalLevelsJSON(db *sql.DB, c *gin.Context, patientID int) {
+	q, err := parseLevelSeriesQuery(c.Query)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Filtro inválido: " + err.Error() + "."})
+		return
+	}
+	sessions, series, err := loadLevelSeries(db, patientID, q)
+	if err != nil {
+		log.Printf("Erro ao buscar a série de níveis do paciente %d: %v", patientID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Falha ao buscar os níveis do paciente."})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"patient_id": patientID,
+		"from":       q.From,
+		"to":         q.To,
+		"window":     q.Window,
+		"sessions":   sessions,
+		"series":     series,
+	})
+}
+
+// GetEmotionalLevels devolve em JSON a série de níveis emocionais de um paciente do terapeuta.
+func (h *TerapeutaHandler) GetEmotionalLevels(c *gin.Context) {
+	patientID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID de paciente inválido."})
+		return
+	}
+	if !therapistHasPatient(h.DB, sessions.Default(c).Get("user_id").(int), patientID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Você não tem permissão para ver os dados deste paciente."})
+		return
+	}
+	emotionalLevelsJSON(h.DB, c, patientID)
+}
+
+// GetEmotionalLevels devolve em JSON a série de níveis emocionais do paciente.
+func (h *AdminHandler) GetEmotionalLevels(c *gin.Context) {
+	patientID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ID de paciente inválido."})
+		return
+	}
+	emotionalLevelsJSON(h.DB, c, patientID)
+}
@@ -0,0 +1,300 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"mediflow/storage"
+)
+
+var (
+	errRecordSigned      = errors.New("entrada do prontuário já assinada")
+	errRecordNotSigned   = errors.New("só é possível adicionar adendo a uma entrada assinada")
+	errRecordIsAddendum  = errors.New("o adendo deve se referir à entrada original, não a outro adendo")
+	errAddendumTextEmpty = errors.New("o texto do adendo é obrigatório")
+	errAddendumTooLong   = fmt.Errorf("o adendo pode ter no máximo %d caracteres", addendumMaxLen)
+)
+
+// addendumMaxLen limita o texto de um adendo.
+const addendumMaxLen = 5000
+
+const patientRecordSelectSQL = `SELECT r.id, r.patient_id, r.doctor_id, u.name, r.record_date,
+	COALESCE(r.anxiety_level, 0), COALESCE(r.anger_level, 0), COALESCE(r.fear_level, 0),
+	COALESCE(r.sadness_level, 0), COALESCE(r.joy_level, 0), COALESCE(r.energy_level, 0),
+	COALESCE(r.main_complaint, ''), COALESCE(r.complaint_history, ''), COALESCE(r.signs_symptoms, ''),
+	COALESCE(r.current_treatment, ''), COALESCE(r.notes, ''),
+	r.addendum_of, r.signed_at, COALESCE(r.signed_by, 0), COALESCE(s.name, ''), COALESCE(r.signature_hash, ''),
+	r.note_data::text,
+	(SELECT json_agg(json_build_object('goal_id', gp.goal_id, 'goal', g.description, 'progress', gp.progress, 'note', COALESCE(gp.note, '')) ORDER BY gp.goal_id)
+		FROM record_goal_progress gp JOIN treatment_goals g ON gp.goal_id = g.id WHERE gp.record_id = r.id)::text
+	FROM patient_records r
+	JOIN users u ON r.doctor_id = u.id
+	LEFT JOIN users s ON r.signed_by = s.id `
+
+// scanPatientRecord lê uma linha de patientRecordSelectSQL.
+func scanPatientRecord(scan func(dest ...interface{}) error) (storage.PatientRecord, error) {
+	var rec storage.PatientRecord
+	var note, progress sql.NullString
+	err := scan(&rec.ID, &rec.PatientID, &rec.DoctorID, &rec.DoctorName, &rec.RecordDate,
+		&rec.AnxietyLevel, &rec.AngerLevel, &rec.FearLevel, &rec.SadnessLevel, &rec.JoyLevel, &rec.EnergyLevel,
+		&rec.MainComplaint, &rec.ComplaintHistory, &rec.SignsSymptoms, &rec.CurrentTreatment, &rec.Notes,
+		&rec.AddendumOf, &rec.SignedAt, &rec.SignedBy, &rec.SignerName, &rec.SignatureHash, &note, &progress)
+	if err != nil {
+		return rec, err
+	}
+	if note.Valid {
+		rec.Note = &storage.StructuredNote{}
+		if err := json.Unmarshal([]byte(note.String), rec.Note); err != nil {
+			return rec, err
+		}
+	}
+	if progress.Valid {
+		if err := json.Unmarshal([]byte(progress.String), &rec.GoalProgress); err != nil {
+			return rec, err
+		}
+	}
+	loc := storage.ClinicLocation()
+	rec.RecordDate = rec.RecordDate.In(loc)
+	if rec.SignedAt.Valid {
+		rec.SignedAt.Time = rec.SignedAt.Time.In(loc)
+	}
+	return rec, nil
+}
+
+// signedGoalProgress é a parte do progresso das metas coberta pela assinatura. A descrição da meta
+// fica de fora: ela pode ser reescrita no plano sem invalidar as entradas já assinadas.
+type signedGoalProgress struct {
+	GoalID   int    `json:"goal_id"`
+	Progress int    `json:"progress"`
+	Note     string `json:"note"`
+}
+
+// patientRecordSignature calcula o hash SHA-256 que sela a entrada: conteúdo clínico, autor, data,
+// quem assinou e quando. Num adendo, entra também o hash da entrada original, o que amarra a
+// correção exatamente ao texto que ela corrige. A nota estruturada entra re-serializada pela
+// struct, e não como o texto do JSONB, cuja formatação o PostgreSQL normaliza.
+func patientRecordSignature(rec storage.PatientRecord, originalHash string) string {
+	var goals []signedGoalProgress
+	for _, p := range rec.GoalProgress {
+		goals = append(goals, signedGoalProgress{p.GoalID, p.Progress, p.Note})
+	}
+	payload, _ := json.Marshal(struct {
+		ID               int                     `json:"id"`
+		PatientID        int                     `json:"patient_id"`
+		DoctorID         int                     `json:"doctor_id"`
+		RecordDate       string                  `json:"record_date"`
+		Levels           []int                   `json:"levels"`
+		MainComplaint    string                  `json:"main_complaint"`
+		ComplaintHistory string                  `json:"complaint_history"`
+		SignsSymptoms    string                  `json:"signs_symptoms"`
+		CurrentTreatment string                  `json:"current_treatment"`
+		Notes            string                  `json:"notes"`
+		AddendumOf       int64                   `json:"addendum_of"`
+		OriginalHash     string                  `json:"original_hash"`
+		SignedBy         int                     `json:"signed_by"`
+		SignedAt         string                  `json:"signed_at"`
+		Note             *storage.StructuredNote `json:"note,omitempty"`
+		Goals            []signedGoalProgress    `json:"goals,omitempty"`
+	}{
+		rec.ID, rec.PatientID, rec.DoctorID, rec.RecordDate.UTC().Format(time.RFC3339Nano),
+		[]int{rec.AnxietyLevel, rec.AngerLevel, rec.FearLevel, rec.SadnessLevel, rec.JoyLevel, rec.EnergyLevel},
+		rec.MainComplaint, rec.ComplaintHistory, rec.SignsSymptoms, rec.CurrentTreatment, rec.Notes,
+		rec.AddendumOf.Int64, originalHash, rec.SignedBy, rec.SignedAt.Time.UTC().Format(time.RFC3339Nano),
+		rec.Note, goals,
+	})
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// savePatientRecordDraft grava a entrada do formulário como rascunho do autor, com o progresso das
+// metas. Cada autor tem no máximo um rascunho por paciente: se já existe, ele é atualizado; senão,
+// uma nova entrada é criada. Devolve o ID da entrada.
+func savePatientRecordDraft(tx execer, patientID, authorID int, rec storage.PatientRecord) (int, error) {
+	var noteTemplateID, noteData interface{}
+	if rec.Note != nil {
+		data, err := json.Marshal(rec.Note)
+		if err != nil {
+			return 0, err
+		}
+		noteTemplateID, noteData = rec.Note.TemplateID, string(data)
+	}
+
+	var recordID int
+	err := tx.QueryRow(`SELECT id FROM patient_records
+		WHERE patient_id = $1 AND doctor_id = $2 AND signed_at IS NULL AND addendum_of IS NULL
+		ORDER BY record_date DESC LIMIT 1 FOR UPDATE`, patientID, authorID).Scan(&recordID)
+	if err == sql.ErrNoRows {
+		err = tx.QueryRow(`INSERT INTO patient_records (
+				patient_id, doctor_id, anxiety_level, anger_level, fear_level, sadness_level,
+				joy_level, energy_level, main_complaint, complaint_history, signs_symptoms,
+				current_treatment, notes, note_template_id, note_data, record_date
+			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, NOW()) RETURNING id`,
+			patientID, authorID, rec.AnxietyLevel, rec.AngerLevel, rec.FearLevel, rec.SadnessLevel,
+			rec.JoyLevel, rec.EnergyLevel, rec.MainComplaint, rec.ComplaintHistory, rec.SignsSymptoms,
+			rec.CurrentTreatment, rec.Notes, noteTemplateID, noteData).Scan(&recordID)
+	} else if err == nil {
+		_, err = tx.Exec(`UPDATE patient_records SET
+				anxiety_level = $1, anger_level = $2, fear_level = $3, sadness_level = $4, joy_level = $5, energy_level = $6,
+				main_complaint = $7, complaint_history = $8, signs_symptoms = $9, current_treatment = $10, notes = $11,
+				note_template_id = $12, note_data = $13, record_date = NOW()
+			WHERE id = $14`,
+			rec.AnxietyLevel, rec.AngerLevel, rec.FearLevel, rec.SadnessLevel, rec.JoyLevel, rec.EnergyLevel,
+			rec.MainComplaint, rec.ComplaintHistory, rec.SignsSymptoms, rec.CurrentTreatment, rec.Notes,
+			noteTemplateID, noteData, recordID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return recordID, saveRecordGoalProgress(tx, recordID, rec.GoalProgress)
+}
+
+// signPatientRecord assina a entrada: grava quem assinou, quando e o hash do conteúdo. Depois disso
+// o gatilho protect_signed_patient_records recusa qualquer alteração ou remoção da linha.
+func signPatientRecord(tx execer, recordID, signerID int) (storage.PatientRecord, error) {
+	rec, err := scanPatientRecord(tx.QueryRow(patientRecordSelectSQL+"WHERE r.id = $1 FOR UPDATE OF r", recordID).Scan)
+	if err != nil {
+		return rec, err
+	}
+	if rec.SignedAt.Valid {
+		return rec, errRecordSigned
+	}
+
+	var originalHash string
+	if rec.AddendumOf.Valid {
+		if err := tx.QueryRow("SELECT signature_hash FROM patient_records WHERE id = $1", rec.AddendumOf.Int64).Scan(&originalHash); err != nil {
+			return rec, err
+		}
+	}
+
+	rec = sealPatientRecord(rec, signerID, originalHash, time.Now())
+	_, err = tx.Exec("UPDATE patient_records SET signed_at = $1, signed_by = $2, signature_hash = $3 WHERE id = $4",
+		rec.SignedAt.Time, signerID, rec.SignatureHash, recordID)
+	return rec, err
+}
+
+// sealPatientRecord preenche a assinatura da entrada: quem assinou, o instante e o hash.
+func sealPatientRecord(rec storage.PatientRecord, signerID int, originalHash string, now time.Time) storage.PatientRecord {
+	// O PostgreSQL guarda microssegundos: truncar aqui garante que o hash recalculado a partir do
+	// banco use exatamente o mesmo instante
+	rec.SignedAt = sql.NullTime{Time: now.Truncate(time.Microsecond), Valid: true}
+	rec.SignedBy = signerID
+	rec.SignatureHash = patientRecordSignature(rec, originalHash)
+	return rec
+}
+
+// addPatientRecordAddendum grava e assina um adendo à entrada assinada recordID. O texto do adendo
+// fica no campo de notas; os demais campos clínicos ficam vazios.
+func addPatientRecordAddendum(tx execer, patientID, recordID, authorID int, text string) (storage.PatientRecord, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return storage.PatientRecord{}, errAddendumTextEmpty
+	}
+	if len([]rune(text)) > addendumMaxLen {
+		return storage.PatientRecord{}, errAddendumTooLong
+	}
+
+	var signed bool
+	var addendumOf sql.NullInt64
+	err := tx.QueryRow("SELECT signed_at IS NOT NULL, addendum_of FROM patient_records WHERE id = $1 AND patient_id = $2",
+		recordID, patientID).Scan(&signed, &addendumOf)
+	if err != nil {
+		return storage.PatientRecord{}, err
+	}
+	if addendumOf.Valid {
+		return storage.PatientRecord{}, errRecordIsAddendum
+	}
+	if !signed {
+		return storage.PatientRecord{}, errRecordNotSigned
+	}
+
+	var addendumID int
+	err = tx.QueryRow(`INSERT INTO patient_records (patient_id, doctor_id, notes, addendum_of, record_date)
+		VALUES ($1, $2, $3, $4, NOW()) RETURNING id`, patientID, authorID, text, recordID).Scan(&addendumID)
+	if err != nil {
+		return storage.PatientRecord{}, err
+	}
+	return signPatientRecord(tx, addendumID, authorID)
+}
+
+// loadPatientRecordHistory lista as entradas do prontuário, da mais recente para a mais antiga, com
+// os adendos agrupados sob a entrada que corrigem. Cada assinatura é conferida contra o conteúdo atual.
+func loadPatientRecordHistory(db *sql.DB, patientID int) ([]storage.PatientRecord, error) {
+	rows, err := db.Query(patientRecordSelectSQL+"WHERE r.patient_id = $1 ORDER BY r.record_date ASC, r.id ASC", patientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var all []storage.PatientRecord
+	for rows.Next() {
+		rec, err := scanPatientRecord(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return groupPatientRecordHistory(all), nil
+}
+
+// groupPatientRecordHistory confere a assinatura de cada entrada (em ordem cronológica) e agrupa os
+// adendos sob a entrada que corrigem, devolvendo as entradas da mais recente para a mais antiga.
+func groupPatientRecordHistory(all []storage.PatientRecord) []storage.PatientRecord {
+	hashes := map[int]string{}
+	for _, rec := range all {
+		hashes[rec.ID] = rec.SignatureHash
+	}
+
+	addenda := map[int64][]storage.PatientRecord{}
+	for i := range all {
+		rec := &all[i]
+		if rec.SignedAt.Valid {
+			rec.SignatureValid = patientRecordSignature(*rec, hashes[int(rec.AddendumOf.Int64)]) == rec.SignatureHash
+		}
+		if rec.AddendumOf.Valid {
+			addenda[rec.AddendumOf.Int64] = append(addenda[rec.AddendumOf.Int64], *rec)
+		}
+	}
+
+	var history []storage.PatientRecord
+	for i := len(all) - 1; i >= 0; i-- {
+		if all[i].AddendumOf.Valid {
+			continue
+		}
+		rec := all[i]
+		rec.Addenda = addenda[int64(rec.ID)]
+		history = append(history, rec)
+	}
+	return history
+}
+
+// recordSummaryText descreve as entradas do prontuário, em ordem cronológica, com as notas
+// estruturadas achatadas em texto, o progresso das metas e os adendos logo abaixo da sessão que
+// corrigem, para a entrada do resumo por IA.
+func recordSummaryText(history []storage.PatientRecord) string {
+	var b strings.Builder
+	b.WriteString("Histórico de Sessões do Paciente:\n\n")
+	for i := len(history) - 1; i >= 0; i-- {
+		rec := history[i]
+		b.WriteString(fmt.Sprintf("Sessão em %s (com Dr(a). %s):\n", rec.RecordDate.Format("02/01/2006"), rec.DoctorName))
+		b.WriteString(fmt.Sprintf("- Níveis (0-10): Ansiedade(%d), Raiva(%d), Medo(%d), Tristeza(%d), Alegria(%d), Energia(%d)\n",
+			rec.AnxietyLevel, rec.AngerLevel, rec.FearLevel, rec.SadnessLevel, rec.JoyLevel, rec.EnergyLevel))
+		b.WriteString(fmt.Sprintf("- Queixa Principal da Sessão: %s\n", rec.MainComplaint))
+		b.WriteString(fmt.Sprintf("- Notas do Terapeuta: %s\n", rec.Notes))
+		b.WriteString(noteText(rec.Note))
+		b.WriteString(goalProgressText(rec.GoalProgress))
+		for _, a := range rec.Addenda {
+			b.WriteString(fmt.Sprintf("- Adendo de %s (Dr(a). %s): %s\n", a.RecordDate.Format("02/01/2006"), a.DoctorName, a.Notes))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
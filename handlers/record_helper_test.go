@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"mediflow/storage"
+)
+
+// testPatientRecord é uma entrada como signPatientRecord a lê do banco antes de assinar.
+func testPatientRecord(t *testing.T) storage.PatientRecord {
+	t.Helper()
+	return storage.PatientRecord{
+		ID: 10, PatientID: 2, DoctorID: 3, RecordDate: utc(t, "2024-05-01 13:00").Add(123456 * time.Microsecond),
+		AnxietyLevel: 7, SadnessLevel: 4, EnergyLevel: 5,
+		MainComplaint: "Insônia", Notes: "Paciente relata <piora> & melhora parcial.",
+		Note: &storage.StructuredNote{TemplateID: 1, Template: "SOAP", Sections: []storage.NoteSection{
+			{Title: "Subjetivo", Fields: []storage.NoteField{{Name: "s", Label: "Relato", Kind: "textarea", Value: "Dorme mal — acorda às 3h."}}},
+		}},
+		GoalProgress: []storage.GoalProgress{{GoalID: 5, Goal: "Dormir 7 horas", Progress: 40, Note: "Melhorou"}},
+	}
+}
+
+// roundTrip imita a gravação e a releitura da entrada pelo banco: instantes em microssegundos e no
+// fuso da clínica e a nota estruturada relida do texto normalizado do JSONB (chaves reordenadas,
+// espaços e caracteres sem escape).
+func roundTrip(t *testing.T, rec storage.PatientRecord) storage.PatientRecord {
+	t.Helper()
+	loc := storage.ClinicLocation()
+	rec.RecordDate = time.UnixMicro(rec.RecordDate.UnixMicro()).In(loc)
+	if rec.SignedAt.Valid {
+		rec.SignedAt.Time = time.UnixMicro(rec.SignedAt.Time.UnixMicro()).In(loc)
+	}
+	jsonb := `{"template": "SOAP", "sections": [{"title": "Subjetivo", "fields": [{"kind": "textarea", "name": "s", "label": "Relato", "value": "Dorme mal — acorda às 3h."}]}], "template_id": 1}`
+	rec.Note = &storage.StructuredNote{}
+	if err := json.Unmarshal([]byte(jsonb), rec.Note); err != nil {
+		t.Fatal(err)
+	}
+	rec.GoalProgress = []storage.GoalProgress{{GoalID: 5, Goal: "Dormir 7 horas por noite", Progress: 40, Note: "Melhorou"}}
+	return rec
+}
+
+func TestPatientRecordSignatureSurvivesRoundTrip(t *testing.T) {
+	signed := sealPatientRecord(testPatientRecord(t), 3, "", utc(t, "2024-05-01 14:00").Add(987654321*time.Nanosecond))
+	stored := roundTrip(t, signed)
+	if got := patientRecordSignature(stored, ""); got != signed.SignatureHash {
+		t.Fatalf("o hash mudou depois da gravação: %s, assinado %s", got, signed.SignatureHash)
+	}
+}
+
+func TestSealPatientRecordTruncatesToMicroseconds(t *testing.T) {
+	now := utc(t, "2024-05-01 14:00").Add(987654321 * time.Nanosecond)
+	signed := sealPatientRecord(testPatientRecord(t), 3, "", now)
+	if want := utc(t, "2024-05-01 14:00").Add(987654 * time.Microsecond); !signed.SignedAt.Time.Equal(want) || !signed.SignedAt.Valid {
+		t.Fatalf("SignedAt = %v, esperava %v", signed.SignedAt.Time, want)
+	}
+	if signed.SignedBy != 3 {
+		t.Errorf("SignedBy = %d, esperava 3", signed.SignedBy)
+	}
+
+	// Sem o truncamento, o hash gravado não conferiria com o instante relido do banco
+	untruncated := testPatientRecord(t)
+	untruncated.SignedAt = sql.NullTime{Time: now, Valid: true}
+	untruncated.SignedBy = 3
+	if patientRecordSignature(untruncated, "") == signed.SignatureHash {
+		t.Error("os nanossegundos não entram no hash; o teste de truncamento não diz nada")
+	}
+}
+
+func TestAddendumSignatureTiedToOriginal(t *testing.T) {
+	signedAt := utc(t, "2024-05-01 14:00")
+	original := sealPatientRecord(testPatientRecord(t), 3, "", signedAt)
+	addendum := storage.PatientRecord{ID: 11, PatientID: 2, DoctorID: 3, RecordDate: signedAt.Add(time.Hour),
+		Notes: "Correção: a insônia começou em março.", AddendumOf: sql.NullInt64{Int64: 10, Valid: true}}
+	addendum = sealPatientRecord(addendum, 3, original.SignatureHash, signedAt.Add(time.Hour))
+
+	if patientRecordSignature(addendum, original.SignatureHash) != addendum.SignatureHash {
+		t.Fatal("o adendo não confere com o hash da entrada original")
+	}
+	if patientRecordSignature(addendum, "") == addendum.SignatureHash {
+		t.Error("o hash do adendo não depende do hash da entrada original")
+	}
+	other := sealPatientRecord(testPatientRecord(t), 3, "", signedAt.Add(time.Second))
+	if patientRecordSignature(addendum, other.SignatureHash) == addendum.SignatureHash {
+		t.Error("o adendo confere com outra versão da entrada original")
+	}
+
+	history := groupPatientRecordHistory([]storage.PatientRecord{roundTrip(t, original), addendum})
+	if len(history) != 1 || len(history[0].Addenda) != 1 {
+		t.Fatalf("histórico %+v, esperava a entrada com um adendo", history)
+	}
+	if !history[0].SignatureValid || !history[0].Addenda[0].SignatureValid {
+		t.Errorf("assinaturas válidas: entrada %v, adendo %v", history[0].SignatureValid, history[0].Addenda[0].SignatureValid)
+	}
+}
+
+func TestSignatureValidDetectsChanges(t *testing.T) {
+	signedAt := utc(t, "2024-05-01 14:00")
+	changes := map[string]func(*storage.PatientRecord){
+		"notas":           func(r *storage.PatientRecord) { r.Notes += " " },
+		"nível":           func(r *storage.PatientRecord) { r.AnxietyLevel = 8 },
+		"queixa":          func(r *storage.PatientRecord) { r.MainComplaint = "Ansiedade" },
+		"autor":           func(r *storage.PatientRecord) { r.DoctorID = 4 },
+		"data da sessão":  func(r *storage.PatientRecord) { r.RecordDate = r.RecordDate.Add(time.Microsecond) },
+		"quem assinou":    func(r *storage.PatientRecord) { r.SignedBy = 4 },
+		"data assinatura": func(r *storage.PatientRecord) { r.SignedAt.Time = r.SignedAt.Time.Add(time.Microsecond) },
+		"nota":            func(r *storage.PatientRecord) { r.Note.Sections[0].Fields[0].Value = "Dorme bem." },
+		"progresso":       func(r *storage.PatientRecord) { r.GoalProgress[0].Progress = 50 },
+	}
+	for name, change := range changes {
+		t.Run(name, func(t *testing.T) {
+			stored := roundTrip(t, sealPatientRecord(testPatientRecord(t), 3, "", signedAt))
+			change(&stored)
+			history := groupPatientRecordHistory([]storage.PatientRecord{stored})
+			if history[0].SignatureValid {
+				t.Fatal("a assinatura continua válida depois da alteração")
+			}
+		})
+	}
+
+	// Entrada intacta (a descrição da meta pode mudar no plano) e rascunho sem assinatura
+	stored := roundTrip(t, sealPatientRecord(testPatientRecord(t), 3, "", signedAt))
+	draft := testPatientRecord(t)
+	draft.ID = 12
+	history := groupPatientRecordHistory([]storage.PatientRecord{stored, draft})
+	if len(history) != 2 || history[0].ID != 12 || history[0].SignatureValid || !history[1].SignatureValid {
+		t.Fatalf("histórico %+v: esperava o rascunho primeiro e a assinatura intacta válida", history)
+	}
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// AppointmentConflict descreve uma consulta já existente que colide com o horário solicitado.
+type AppointmentConflict struct {
+	ID          int
+	PatientID   int
+	DoctorID    int
+	StartTime   time.Time
+	EndTime     time.Time
+	PatientName string
+	DoctorName  string
+}
+
+// validateAppointmentSlot aplica as regras da agenda ao horário pedido: primeiro a disponibilidade
+// do terapeuta e depois os conflitos com outras consultas. Devolve a mensagem a ser exibida no
+// formulário, ou "" quando o horário pode ser gravado. excludeIDs lista consultas que não contam
+// como conflito (a própria consulta em edição, ou as ocorrências de uma série sendo deslocada).
+func validateAppointmentSlot(db *sql.DB, doctorID, patientID int, start, end time.Time, excludeIDs ...int) (string, error) {
+	schedule, err := loadTherapistSchedule(db, doctorID, start, end)
+	if err != nil {
+		return "", err
+	}
+	if schedule.Configured() && !schedule.Covers(start, end) {
+		return outsideAvailabilityMessage, nil
+	}
+
+	conflicts, err := findAppointmentConflicts(db, doctorID, patientID, start, end, excludeIDs)
+	if err != nil {
+		return "", err
+	}
+	if len(conflicts) > 0 {
+		return conflictMessage(conflicts, doctorID), nil
+	}
+	return "", nil
+}
+
+// findAppointmentConflicts busca consultas ativas (não canceladas, nem canceladas tardiamente) do terapeuta OU do paciente
+// cujo intervalo [início, fim) se sobrepõe ao intervalo informado.
+// excludeIDs permite ignorar a própria consulta durante uma edição (vazio para novas consultas).
+func findAppointmentConflicts(db *sql.DB, doctorID, patientID int, start, end time.Time, excludeIDs []int) ([]AppointmentConflict, error) {
+	query := `
+		SELECT a.id, a.patient_id, a.doctor_id, a.start_time, a.end_time, p.name, u.name
+		FROM appointments a
+		JOIN patients p ON a.patient_id = p.id
+		JOIN users u ON a.doctor_id = u.id
+		WHERE a.status NOT IN ('cancelado', 'cancelado_tardio')
+		  AND NOT (a.id = ANY($1))
+		  AND (a.doctor_id = $2 OR a.patient_id = $3)
+		  AND a.start_time < $5 AND a.end_time > $4
+		ORDER BY a.start_time ASC`
+
+	// O array nunca é nulo: ANY(NULL) descartaria todas as linhas
+	excluded := make([]int64, 0, len(excludeIDs))
+	for _, id := range excludeIDs {
+		excluded = append(excluded, int64(id))
+	}
+
+	rows, err := db.Query(query, pq.Array(excluded), doctorID, patientID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conflicts []AppointmentConflict
+	for rows.Next() {
+		var conflict AppointmentConflict
+		if err := rows.Scan(&conflict.ID, &conflict.PatientID, &conflict.DoctorID, &conflict.StartTime, &conflict.EndTime, &conflict.PatientName, &conflict.DoctorName); err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts, rows.Err()
+}
+
+// conflictMessage monta a mensagem exibida no formulário quando há choque de horários.
+func conflictMessage(conflicts []AppointmentConflict, doctorID int) string {
+	var details []string
+	for _, conflict := range conflicts {
+		who := "O paciente " + conflict.PatientName + " já possui consulta"
+		if conflict.DoctorID == doctorID {
+			who = "O terapeuta " + conflict.DoctorName + " já atende " + conflict.PatientName
+		}
+		details = append(details, fmt.Sprintf("%s em %s às %s–%s (consulta #%d)",
+			who,
+			conflict.StartTime.Format("02/01/2006"),
+			conflict.StartTime.Format("15:04"),
+			conflict.EndTime.Format("15:04"),
+			conflict.ID,
+		))
+	}
+	return "Conflito de horário: " + strings.Join(details, "; ") + "."
+}
+
+// isOverlapViolation indica se o erro veio da restrição de exclusão que impede
+// sobreposição de consultas no banco (proteção contra requisições concorrentes).
+func isOverlapViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23P01" // exclusion_violation
+	}
+	return false
+}
+
+// overlapViolationMessage é a mensagem genérica usada quando a checagem prévia passou,
+// mas o banco recusou a gravação porque outra requisição ocupou o horário no meio tempo.
+const overlapViolationMessage = "Conflito de horário: o terapeuta ou o paciente acabou de ser agendado neste horário. Atualize a página e escolha outro horário."
+
+// NewAppointment reúne os dados de uma consulta avulsa a ser gravada.
+type NewAppointment struct {
+	PatientID     int
+	DoctorID      int
+	Start         time.Time
+	Duration      time.Duration
+	Status        string
+	Notes         string
+	ServiceTypeID sql.NullInt64
+	Price         float64
+	HoldExpiresAt sql.NullTime // Apenas para pedidos de agendamento online ('pre_agendado')
+}
+
+// insertAppointment grava uma consulta avulsa e devolve o seu ID. É compartilhada pelos painéis
+// da secretária e do administrador, pela lista de espera e pelo agendamento online; as validações
+// de horário ficam com quem chama. Aceita *sql.DB ou *sql.Tx.
+func insertAppointment(db execer, a NewAppointment) (int, error) {
+	now := time.Now()
+	var id int
+	err := db.QueryRow(`INSERT INTO appointments (patient_id, doctor_id, start_time, end_time, status, notes, price, service_type_id, duration_minutes, hold_expires_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, $9, $10, $11, $11) RETURNING id`,
+		a.PatientID, a.DoctorID, a.Start, a.Start.Add(a.Duration), a.Status, a.Notes, a.Price, a.ServiceTypeID,
+		int(a.Duration.Minutes()), a.HoldExpiresAt, now).Scan(&id)
+	return id, err
+}
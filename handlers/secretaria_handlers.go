@@ -9,6 +9,7 @@ import (
 	"time"
 	"fmt"
 	
+	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"mediflow/storage"
 )
@@ -18,79 +19,30 @@ type SecretariaHandler struct {
 	DB *sql.DB
 }
 
-// AppointmentDetails é uma struct para organizar os dados da agenda para o template.
-type AppointmentDetails struct {
-	ID          int
-	StartTime   time.Time
-	PatientName string
-	DoctorName  string
-	Status      string
-	PatientID   int
-}
-
-// DaySchedule é uma struct para organizar os dados da agenda para o template.
-type DaySchedule struct {
-	Date         time.Time
-	Appointments []AppointmentDetails
-}
-
 // ViewAgenda renderiza o novo dashboard de agenda da secretária.
 func (h *SecretariaHandler) ViewAgenda(c *gin.Context) {
-	dateParam := c.Query("date")
-	var referenceDate time.Time
-	if dateParam == "" {
-		referenceDate = time.Now()
-	} else {
-		referenceDate, _ = time.Parse("2006-01-02", dateParam)
-	}
-
-	weekday := int(referenceDate.Weekday())
-	startOfWeek := referenceDate.AddDate(0, 0, -weekday)
-	endOfWeek := startOfWeek.AddDate(0, 0, 7)
-
-	query := `
-        SELECT a.id, a.start_time, a.status, p.name as patient_name, u.name as doctor_name, p.id as patient_id
-        FROM appointments a
-        JOIN patients p ON a.patient_id = p.id
-        JOIN users u ON a.doctor_id = u.id
-        WHERE a.start_time >= $1 AND a.start_time < $2
-        ORDER BY a.start_time ASC
-    `
-	rows, err := h.DB.Query(query, startOfWeek, endOfWeek)
+	// Horários liberados por cancelamentos que combinam com a lista de espera
+	waitlistOffers, err := loadPendingWaitlistOffers(h.DB)
 	if err != nil {
-		log.Printf("Erro ao buscar agendamentos para a agenda: %v", err)
-		c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Não foi possível carregar a agenda."})
-		return
-	}
-	defer rows.Close()
-
-	appointmentsByDay := make(map[string][]AppointmentDetails)
-	for rows.Next() {
-		var app AppointmentDetails
-		if err := rows.Scan(&app.ID, &app.StartTime, &app.Status, &app.PatientName, &app.DoctorName, &app.PatientID); err != nil {
-			continue
-		}
-		dayKey := app.StartTime.Format("2006-01-02")
-		appointmentsByDay[dayKey] = append(appointmentsByDay[dayKey], app)
+		log.Printf("Erro ao buscar ofertas da lista de espera: %v", err)
 	}
-
-	var weekSchedule []DaySchedule
-	for i := 0; i < 7; i++ {
-		day := startOfWeek.AddDate(0, 0, i)
-		dayKey := day.Format("2006-01-02")
-		weekSchedule = append(weekSchedule, DaySchedule{
-			Date:         day,
-			Appointments: appointmentsByDay[dayKey],
-		})
+	// Pedidos de agendamento online aguardando confirmação
+	bookingRequests, err := loadBookingRequests(h.DB)
+	if err != nil {
+		log.Printf("Erro ao buscar pedidos de agendamento online: %v", err)
 	}
-
-	c.HTML(http.StatusOK, "secretaria/secretaria_dashboard.html", gin.H{
-		"Title":        "Agenda da Clínica",
-		"WeekSchedule": weekSchedule,
-		"PrevWeekLink": "/secretaria/dashboard?date=" + startOfWeek.AddDate(0, 0, -7).Format("2006-01-02"),
-		"NextWeekLink": "/secretaria/dashboard?date=" + startOfWeek.AddDate(0, 0, 7).Format("2006-01-02"),
-		"TodayLink":    "/secretaria/dashboard",
-		"ActiveNav":    "agenda",
+	session := sessions.Default(c)
+	errorFlashes := session.Flashes("error")
+	successFlashes := session.Flashes("success")
+	session.Save()
+
+	renderAgenda(c, h.DB, "secretaria/secretaria_dashboard.html", "/secretaria/dashboard", "secretaria", gin.H{
+		"BookingRequests":  bookingRequests,
+		"WaitlistOffers":   waitlistOffers,
+		"WaitlistReturnTo": "dashboard",
+		"PriorityNames":    waitlistPriorityNames,
+		"ErrorFlashes":     errorFlashes,
+		"SuccessFlashes":   successFlashes,
 	})
 }
 
@@ -181,7 +133,7 @@ func (h *SecretariaHandler) GetPatientProfile(c *gin.Context) {
 	}
 
 	var patient storage.Patient
-	query := "SELECT id, name, consent_given_at, access_token FROM patients WHERE id = $1"
+	query := "SELECT id, name, consent_given_at, " + activePortalTokenSQL + " FROM patients WHERE id = $1"
 	
 	// CORREÇÃO: Adicionado o 'patientID' que estava faltando para o parâmetro $1
 	err = h.DB.QueryRow(query, patientID).Scan(&patient.ID, &patient.Name, &patient.ConsentGivenAt, &patient.AccessToken)
@@ -196,6 +148,16 @@ func (h *SecretariaHandler) GetPatientProfile(c *gin.Context) {
 		return
 	}
 
+	session := sessions.Default(c)
+	errorFlashes := session.Flashes("error")
+	successFlashes := session.Flashes("success")
+	session.Save()
+
+	noShows, lateCancels, err := noShowCounts(h.DB, patientID)
+	if err != nil {
+		log.Printf("Erro ao contar faltas do paciente (secretária): %v", err)
+	}
+
 	futureAppointments, _ := getAppointmentsByTime(h.DB, patientID, ">=")
 	pastAppointments, _ := getAppointmentsByTime(h.DB, patientID, "<")
 
@@ -211,13 +173,38 @@ func (h *SecretariaHandler) GetPatientProfile(c *gin.Context) {
 		}
 	}
 
+	serviceTypes, err := loadServiceTypes(h.DB, true)
+	if err != nil {
+		log.Printf("Erro ao buscar tipos de sessão (secretária): %v", err)
+	}
+
+	waitlistEntries, err := patientWaitlistEntries(h.DB, patientID)
+	if err != nil {
+		log.Printf("Erro ao buscar a lista de espera do paciente: %v", err)
+	}
+
+	activeConsent, hasConsent, err := activePatientConsent(h.DB, patientID)
+	if err != nil {
+		log.Printf("Erro ao buscar o aceite vigente do paciente (secretária): %v", err)
+	}
+
 	c.HTML(http.StatusOK, "secretaria/patient_profile.html", gin.H{
 		"Title":              "Agendamentos de " + patient.Name,
 		"Patient":            patient,
 		"FutureAppointments": futureAppointments,
 		"PastAppointments":   pastAppointments,
 		"Doctors":            doctors,
+		"ServiceTypes":       serviceTypes,
+		"NoShowCount":        noShows,
+		"LateCancelCount":    lateCancels,
+		"WaitlistEntries":    waitlistEntries,
+		"ActiveConsent":      activeConsent,
+		"HasConsent":         hasConsent,
+		"WeekdayNames":       weekdayNames,
+		"PriorityNames":      waitlistPriorityNames,
 		"ActiveNav":          "patients",
+		"ErrorFlashes":       errorFlashes,
+		"SuccessFlashes":     successFlashes,
 	})
 }
 
@@ -231,13 +218,30 @@ func (h *SecretariaHandler) PostNewAppointment(c *gin.Context) {
 	patientID, _ := strconv.Atoi(patientIDStr)
 	doctorID, _ := strconv.Atoi(doctorIDStr)
 
-	startTime, err := time.Parse("2006-01-02 15:04", dateStr+" "+timeStr)
+	startTime, err := parseClinicDateTime(dateStr, timeStr)
 	if err != nil {
+		if err == errNonexistentLocalTime {
+			session := sessions.Default(c)
+			session.AddFlash(err.Error(), "error")
+			session.Save()
+		}
 		log.Printf("Erro ao converter data/hora do agendamento (secretária): %v", err)
 		c.Redirect(http.StatusFound, "/secretaria/patients/profile/"+patientIDStr)
 		return
 	}
-	endTime := startTime.Add(1 * time.Hour)
+
+	session := sessions.Default(c)
+
+	// A duração e o preço vêm do tipo de sessão escolhido (com o preço do terapeuta, se houver)
+	service, err := serviceFromForm(h.DB, c, doctorID)
+	if err != nil {
+		log.Printf("Erro ao carregar tipo de sessão (secretária): %v", err)
+		session.AddFlash("Tipo de sessão inválido.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/secretaria/patients/profile/"+patientIDStr)
+		return
+	}
+	endTime := startTime.Add(service.Duration)
 
 	var status string
 	if startTime.Before(time.Now()) {
@@ -246,40 +250,94 @@ func (h *SecretariaHandler) PostNewAppointment(c *gin.Context) {
 		status = "agendado"
 	}
 
-	query := `INSERT INTO appointments (patient_id, doctor_id, start_time, end_time, status, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`
-	_, err = h.DB.Exec(query, patientID, doctorID, startTime, endTime, status, time.Now(), time.Now())
+	// Consultas recorrentes geram uma série com uma linha por ocorrência
+	rule, recurring, err := parseSeriesRule(c)
+	if err != nil {
+		session.AddFlash("Recorrência inválida: "+err.Error()+".", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/secretaria/patients/profile/"+patientIDStr)
+		return
+	}
+	if recurring {
+		bookSeries(c, h.DB, SeriesBooking{
+			PatientID:     patientID,
+			DoctorID:      doctorID,
+			Start:         startTime,
+			Duration:      service.Duration,
+			ServiceTypeID: service.ServiceTypeID,
+			Status:        "agendado",
+			Price:         service.Price,
+			SkipConflicts: c.PostForm("skip_conflicts") != "",
+		}, rule)
+		c.Redirect(http.StatusFound, "/secretaria/patients/profile/"+patientIDStr)
+		return
+	}
+
+	// Verifica a disponibilidade do terapeuta e se ele ou o paciente já possuem consulta no mesmo intervalo
+	message, err := validateAppointmentSlot(h.DB, doctorID, patientID, startTime, endTime)
+	if err != nil {
+		log.Printf("Erro ao validar horário do agendamento (secretária): %v", err)
+	} else if message != "" {
+		session.AddFlash(message, "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/secretaria/patients/profile/"+patientIDStr)
+		return
+	}
+
+	_, err = insertAppointment(h.DB, NewAppointment{
+		PatientID:     patientID,
+		DoctorID:      doctorID,
+		Start:         startTime,
+		Duration:      service.Duration,
+		Status:        status,
+		ServiceTypeID: service.ServiceTypeID,
+		Price:         service.Price,
+	})
 	if err != nil {
 		log.Printf("Erro ao agendar nova consulta (secretária): %v", err)
+		if isOverlapViolation(err) {
+			session.AddFlash(overlapViolationMessage, "error")
+			session.Save()
+		}
 	}
 
 	c.Redirect(http.StatusFound, "/secretaria/patients/profile/"+patientIDStr)
 }
 
-// CancelAppointment (Desmarcar) atualiza o status de uma consulta para 'cancelado'.
+// CancelAppointment (Desmarcar) cancela uma consulta aplicando a política de cancelamento
+// ('cancelado' ou 'cancelado_tardio', com taxa quando configurada).
 func (h *SecretariaHandler) CancelAppointment(c *gin.Context) {
 	appointmentID := c.Param("id")
 	patientID := c.Query("patient_id")
 
-	log.Printf("[DEBUG] Tentando cancelar consulta ID: %s para paciente ID: %s", appointmentID, patientID)
-
-	query := `UPDATE appointments SET status = 'cancelado', updated_at = $1 WHERE id = $2`
-	result, err := h.DB.Exec(query, time.Now(), appointmentID)
-	if err != nil {
-		log.Printf("ERRO DE BANCO DE DADOS ao cancelar consulta: %v", err)
-		c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{
-			"Title":   "Erro Interno",
-			"Message": "Ocorreu um erro ao tentar desmarcar a consulta.",
-		})
+	// Cancelamento de "esta e as seguintes" ou da série inteira
+	if scope := seriesScope(c); scope != scopeOccurrence {
+		cancelSeries(c, h.DB, safeAtoi(appointmentID), scope)
+		c.Redirect(http.StatusFound, "/secretaria/patients/profile/"+patientID)
 		return
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		log.Printf("AVISO: Nenhuma consulta foi desmarcada. ID da consulta (%s) pode não existir.", appointmentID)
-	} else {
-		log.Printf("SUCESSO: Consulta ID %s desmarcada.", appointmentID)
-	}
+	log.Printf("[DEBUG] Tentando cancelar consulta ID: %s para paciente ID: %s", appointmentID, patientID)
+
+	recordAppointmentOutcome(c, h.DB, safeAtoi(appointmentID), "cancelado")
+	c.Redirect(http.StatusFound, "/secretaria/patients/profile/"+patientID)
+}
+
+// MarkNoShow registra a falta do paciente em uma consulta que já passou.
+func (h *SecretariaHandler) MarkNoShow(c *gin.Context) {
+	appointmentID := c.Param("id")
+	patientID := c.Query("patient_id")
 
+	recordAppointmentOutcome(c, h.DB, safeAtoi(appointmentID), "faltou")
+	c.Redirect(http.StatusFound, "/secretaria/patients/profile/"+patientID)
+}
+
+// ConfirmAppointment confirma uma consulta que a tarefa automática deixou pendente de confirmação.
+func (h *SecretariaHandler) ConfirmAppointment(c *gin.Context) {
+	appointmentID := c.Param("id")
+	patientID := c.Query("patient_id")
+
+	confirmAppointment(c, h.DB, safeAtoi(appointmentID))
 	c.Redirect(http.StatusFound, "/secretaria/patients/profile/"+patientID)
 }
 
@@ -320,16 +378,20 @@ func (h *SecretariaHandler) GetEditAppointmentForm(c *gin.Context) {
 
 	var app storage.Appointment
 	var patientName string
-	query := `SELECT a.id, a.patient_id, a.doctor_id, a.start_time, p.name 
+	query := `SELECT a.id, a.patient_id, a.doctor_id, a.start_time, a.series_id, p.name 
               FROM appointments a JOIN patients p ON a.patient_id = p.id 
               WHERE a.id = $1`
-	err := h.DB.QueryRow(query, appointmentID).Scan(&app.ID, &app.PatientID, &app.DoctorID, &app.StartTime, &patientName)
+	err := h.DB.QueryRow(query, appointmentID).Scan(&app.ID, &app.PatientID, &app.DoctorID, &app.StartTime, &app.SeriesID, &patientName)
 	if err != nil {
 		log.Printf("Erro ao buscar consulta para edição: %v", err)
 		c.HTML(http.StatusNotFound, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Consulta não encontrada."})
 		return
 	}
 
+	session := sessions.Default(c)
+	errorFlashes := session.Flashes("error")
+	session.Save()
+
 	var doctors []storage.User
 	rows, _ := h.DB.Query("SELECT id, name FROM users WHERE user_type = 'terapeuta'")
 	if rows != nil {
@@ -349,6 +411,7 @@ func (h *SecretariaHandler) GetEditAppointmentForm(c *gin.Context) {
 		"PatientName": patientName,
 		"Doctors":     doctors,
 		"ActiveNav":   "patients",
+		"ErrorFlashes": errorFlashes,
 	})
 }
 
@@ -363,18 +426,72 @@ func (h *SecretariaHandler) PostEditAppointment(c *gin.Context) {
 
 	doctorID, _ := strconv.Atoi(doctorIDStr)
 
-	startTime, err := time.Parse("2006-01-02 15:04", dateStr+" "+timeStr)
+	startTime, err := parseClinicDateTime(dateStr, timeStr)
 	if err != nil {
+		if err == errNonexistentLocalTime {
+			session := sessions.Default(c)
+			session.AddFlash(err.Error(), "error")
+			session.Save()
+		}
 		log.Printf("Erro ao converter data/hora na edição: %v", err)
 		c.Redirect(http.StatusFound, "/secretaria/patients/profile/"+patientIDStr)
 		return
 	}
-	endTime := startTime.Add(1 * time.Hour)
+
+	// Ao remarcar, a consulta mantém a duração do tipo de sessão gravada no agendamento
+	duration, err := appointmentDuration(h.DB, appointmentIDStr)
+	if err != nil {
+		log.Printf("Erro ao buscar duração da consulta: %v", err)
+		c.Redirect(http.StatusFound, "/secretaria/patients/profile/"+patientIDStr)
+		return
+	}
+	endTime := startTime.Add(duration)
+
+	session := sessions.Default(c)
+	editFormURL := "/secretaria/appointments/edit/" + appointmentIDStr + "?patient_id=" + patientIDStr
+
+	// O paciente é lido do banco para não depender do parâmetro da URL na checagem de conflitos
+	var appointmentPatientID int
+	var appointmentStatus string
+	err = h.DB.QueryRow("SELECT patient_id, status FROM appointments WHERE id = $1", appointmentIDStr).Scan(&appointmentPatientID, &appointmentStatus)
+	if err != nil {
+		log.Printf("Erro ao buscar consulta para edição: %v", err)
+		c.Redirect(http.StatusFound, "/secretaria/patients/profile/"+patientIDStr)
+		return
+	}
+
+	// Edição de "esta e as seguintes" ou da série inteira
+	if scope := seriesScope(c); scope != scopeOccurrence {
+		if !editSeries(c, h.DB, safeAtoi(appointmentIDStr), scope, doctorID, startTime) {
+			c.Redirect(http.StatusFound, editFormURL)
+			return
+		}
+		c.Redirect(http.StatusFound, "/secretaria/patients/profile/"+patientIDStr)
+		return
+	}
+
+	if !isCancelledStatus(appointmentStatus) {
+		message, err := validateAppointmentSlot(h.DB, doctorID, appointmentPatientID, startTime, endTime, safeAtoi(appointmentIDStr))
+		if err != nil {
+			log.Printf("Erro ao validar horário na edição: %v", err)
+		} else if message != "" {
+			session.AddFlash(message, "error")
+			session.Save()
+			c.Redirect(http.StatusFound, editFormURL)
+			return
+		}
+	}
 
 	query := `UPDATE appointments SET doctor_id = $1, start_time = $2, end_time = $3, updated_at = $4 WHERE id = $5`
 	_, err = h.DB.Exec(query, doctorID, startTime, endTime, time.Now(), appointmentIDStr)
 	if err != nil {
 		log.Printf("Erro ao atualizar consulta: %v", err)
+		if isOverlapViolation(err) {
+			session.AddFlash(overlapViolationMessage, "error")
+			session.Save()
+			c.Redirect(http.StatusFound, editFormURL)
+			return
+		}
 	}
 
 	c.Redirect(http.StatusFound, "/secretaria/patients/profile/"+patientIDStr)
@@ -383,9 +500,11 @@ func (h *SecretariaHandler) PostEditAppointment(c *gin.Context) {
 // Função de ajuda para buscar consultas (agora com preço e status de pagamento)
 func getAppointmentsByTime(db *sql.DB, patientID int, comparison string) ([]map[string]interface{}, error) {
 	query := `
-		SELECT a.id, a.start_time, a.status, a.notes, u.name as doctor_name, a.price, a.payment_status
+		SELECT a.id, a.start_time, a.end_time, a.status, a.notes, u.name as doctor_name, a.price, a.payment_status, a.series_id,
+		       COALESCE(st.name, '') as service_name
 		FROM appointments a
 		JOIN users u ON a.doctor_id = u.id
+		LEFT JOIN service_types st ON a.service_type_id = st.id
 		WHERE a.patient_id = $1 AND a.start_time ` + comparison + ` $2
 		ORDER BY a.start_time DESC
 	`
@@ -398,14 +517,16 @@ func getAppointmentsByTime(db *sql.DB, patientID int, comparison string) ([]map[
 	var appointments []map[string]interface{}
 	for rows.Next() {
 		var appID int
-		var startTime time.Time
+		var startTime, endTime time.Time
 		var status string
+		var serviceName string
 		var doctorName sql.NullString
 		var notes sql.NullString
 		var price sql.NullFloat64
 		var paymentStatus sql.NullString
+		var seriesID sql.NullInt64
 
-		if err := rows.Scan(&appID, &startTime, &status, &notes, &doctorName, &price, &paymentStatus); err != nil {
+		if err := rows.Scan(&appID, &startTime, &endTime, &status, &notes, &doctorName, &price, &paymentStatus, &seriesID, &serviceName); err != nil {
 			log.Printf("Erro ao escanear linha de consulta: %v", err)
 			continue
 		}
@@ -413,44 +534,139 @@ func getAppointmentsByTime(db *sql.DB, patientID int, comparison string) ([]map[
 		appointmentData := map[string]interface{}{
 			"ID":            appID,
 			"StartTime":     startTime,
+			"EndTime":       endTime,
+			"ServiceName":   serviceName,
 			"Status":        status,
 			"DoctorName":    doctorName.String,
 			"Notes":         notes.String,
 			"Price":         price.Float64,
 			"PaymentStatus": paymentStatus.String,
+			"SeriesID":      seriesID.Int64,
 		}
 		appointments = append(appointments, appointmentData)
 	}
 	return appointments, nil
 }
 
-// handlers/secretaria_handlers.go
-// Adicione esta nova função
-
-// ShowPatientToken exibe o link de acesso único para o paciente recém-criado.
+// ShowPatientToken exibe os links de acesso ao portal do paciente, com o formulário para gerar um
+// novo link e a opção de revogar os links ativos.
 func (h *SecretariaHandler) ShowPatientToken(c *gin.Context) {
-	patientID := c.Param("id")
+	patientID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Redirect(http.StatusFound, "/secretaria/patients")
+		return
+	}
 
-	var name, token string
-	err := h.DB.QueryRow("SELECT name, access_token FROM patients WHERE id = $1", patientID).Scan(&name, &token)
+	var name string
+	var consentGiven bool
+	err = h.DB.QueryRow("SELECT name, consent_given_at IS NOT NULL FROM patients WHERE id = $1 AND deleted_at IS NULL", patientID).
+		Scan(&name, &consentGiven)
 	if err != nil {
 		// Tratar erro, talvez redirecionar para a lista de pacientes
 		c.Redirect(http.StatusFound, "/secretaria/patients")
 		return
 	}
 
-	// Constrói a URL completa para o portal do paciente
-	baseURL := "http://" + c.Request.Host // Ex: http://localhost:8080
-	portalURL := fmt.Sprintf("%s/portal/login/%s", baseURL, token)
+	tokens, err := loadPortalTokens(h.DB, patientID)
+	if err != nil {
+		log.Printf("Erro ao buscar links do portal do paciente %d: %v", patientID, err)
+	}
+	session := sessions.Default(c)
+	errorFlashes := session.Flashes("error")
+	successFlashes := session.Flashes("success")
+	session.Save()
+
+	// Finalidade sugerida: o termo enquanto não houver consentimento, depois o acesso geral
+	purpose := tokenPurposeAccess
+	if !consentGiven {
+		purpose = tokenPurposeConsent
+	}
 
 	c.HTML(http.StatusOK, "secretaria/show_token.html", gin.H{
-		"Title":     "Link de Acesso do Paciente",
-		"PatientName": name,
-		"PortalURL": portalURL,
-		"ActiveNav": "new_patient",
+		"Title":          "Links de Acesso do Paciente",
+		"PatientID":      patientID,
+		"PatientName":    name,
+		"BaseURL":        "http://" + c.Request.Host, // Ex: http://localhost:8080
+		"Tokens":         tokens,
+		"PurposeOptions": portalTokenOptions(),
+		"PurposeNames":   portalTokenPurposeNames,
+		"DefaultPurpose": purpose,
+		"ErrorFlashes":   errorFlashes,
+		"SuccessFlashes": successFlashes,
+		"ActiveNav":      "new_patient",
 	})
 }
 
+// PostPatientToken gera um novo link do portal, substituindo os links ativos da mesma finalidade.
+func (h *SecretariaHandler) PostPatientToken(c *gin.Context) {
+	patientID := c.Param("id")
+	h.issuePatientToken(c, safeAtoi(patientID))
+	c.Redirect(http.StatusFound, "/secretaria/pacientes/token/"+patientID)
+}
+
+// issuePatientToken valida o formulário e emite o link, deixando as mensagens na sessão.
+func (h *SecretariaHandler) issuePatientToken(c *gin.Context, patientID int) {
+	session := sessions.Default(c)
+	defer session.Save()
+
+	purpose := c.PostForm("purpose")
+	defaults, ok := portalTokenDefaults[purpose]
+	if !ok {
+		session.AddFlash("Finalidade do link inválida.", "error")
+		return
+	}
+	validity := defaults.Validity
+	if days, err := strconv.Atoi(c.PostForm("validity_days")); err == nil {
+		validity = time.Duration(days) * 24 * time.Hour
+	}
+	if validity <= 0 || validity > maxPortalTokenValidity {
+		session.AddFlash(fmt.Sprintf("A validade do link deve ser de 1 a %d dias.", int(maxPortalTokenValidity.Hours()/24)), "error")
+		return
+	}
+
+	var exists bool
+	if err := h.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM patients WHERE id = $1 AND deleted_at IS NULL)", patientID).Scan(&exists); err != nil || !exists {
+		session.AddFlash("Paciente não encontrado.", "error")
+		return
+	}
+
+	token, err := issuePortalToken(h.DB, patientID, purpose, validity, c.PostForm("single_use") != "", sessionUserID(c))
+	if err != nil {
+		log.Printf("Erro ao emitir link do portal para o paciente %d: %v", patientID, err)
+		session.AddFlash("Não foi possível gerar o link.", "error")
+		return
+	}
+	auditPortalTokenIssued(h.DB, c, token)
+	session.AddFlash("Novo link gerado. Os links anteriores com a mesma finalidade foram revogados.", "success")
+}
+
+// RevokePatientToken revoga um link do portal do paciente.
+func (h *SecretariaHandler) RevokePatientToken(c *gin.Context) {
+	patientID := c.Param("id")
+	tokenID := safeAtoi(c.Param("tokenId"))
+	session := sessions.Default(c)
+
+	revoked, err := revokePortalToken(h.DB, safeAtoi(patientID), tokenID)
+	switch {
+	case err != nil:
+		log.Printf("Erro ao revogar o link do portal ID %d: %v", tokenID, err)
+		session.AddFlash("Não foi possível revogar o link.", "error")
+	case !revoked:
+		session.AddFlash("O link já estava revogado.", "error")
+	default:
+		AddAuditLog(LogAction{
+			DB:         h.DB,
+			Context:    c,
+			Action:     fmt.Sprintf("Revogou o link do portal ID %d", tokenID),
+			TargetType: "Paciente",
+			TargetID:   safeAtoi(patientID),
+		})
+		session.AddFlash("Link revogado.", "success")
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, "/secretaria/pacientes/token/"+patientID)
+}
+
 // handlers/secretaria_handlers.go
 
 // MarkAppointmentAsPaid atualiza o status de pagamento de uma consulta para 'pago'.
@@ -0,0 +1,450 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// maxSeriesOccurrences limita o tamanho de uma série (dois anos de sessões semanais).
+const maxSeriesOccurrences = 104
+
+// Abrangência de uma edição ou cancelamento em consultas que pertencem a uma série.
+const (
+	scopeOccurrence = "occurrence" // Apenas esta ocorrência
+	scopeFollowing  = "following"  // Esta e as seguintes
+	scopeSeries     = "series"     // Série inteira
+)
+
+// seriesFrequencyNames traduz as frequências aceitas para exibição.
+var seriesFrequencyNames = map[string]string{
+	"semanal":   "Semanal",
+	"quinzenal": "Quinzenal",
+	"mensal":    "Mensal",
+}
+
+// SeriesRule descreve a recorrência pedida no formulário: a frequência e o critério de término
+// (data final inclusiva ou número de ocorrências).
+type SeriesRule struct {
+	Frequency string
+	Until     time.Time
+	Count     int
+}
+
+// SeriesBooking reúne os dados comuns a todas as ocorrências de uma nova série.
+type SeriesBooking struct {
+	PatientID     int
+	DoctorID      int
+	Start         time.Time
+	Duration      time.Duration
+	ServiceTypeID sql.NullInt64
+	Status        string
+	Notes         string
+	Price         float64
+	SkipConflicts bool // Cria as ocorrências livres e ignora as que colidem
+}
+
+// SeriesResult informa o que aconteceu ao criar ou alterar uma série.
+// Conflicts lista as ocorrências recusadas, já formatadas para exibição.
+type SeriesResult struct {
+	SeriesID  int
+	Affected  int
+	Conflicts []string
+	Cancelled []int // IDs das consultas canceladas, para ofertar os horários à lista de espera
+}
+
+// parseSeriesRule lê a recorrência do formulário. O segundo retorno é falso quando
+// a consulta não se repete.
+func parseSeriesRule(c *gin.Context) (SeriesRule, bool, error) {
+	rule := SeriesRule{Frequency: c.PostForm("recurrence")}
+	if rule.Frequency == "" {
+		return rule, false, nil
+	}
+	if _, ok := seriesFrequencyNames[rule.Frequency]; !ok {
+		return rule, true, fmt.Errorf("frequência de recorrência inválida")
+	}
+
+	if untilStr := c.PostForm("recurrence_until"); untilStr != "" {
+		until, err := parseClinicDate(untilStr)
+		if err != nil {
+			return rule, true, fmt.Errorf("data final da recorrência inválida")
+		}
+		rule.Until = until
+	}
+	if countStr := c.PostForm("recurrence_count"); countStr != "" {
+		count, err := strconv.Atoi(countStr)
+		if err != nil || count < 1 {
+			return rule, true, fmt.Errorf("número de ocorrências inválido")
+		}
+		rule.Count = count
+	}
+	if rule.Until.IsZero() && rule.Count == 0 {
+		return rule, true, fmt.Errorf("informe a data final ou o número de ocorrências da recorrência")
+	}
+	return rule, true, nil
+}
+
+// Occurrences gera os inícios de cada ocorrência a partir da primeira, no mesmo horário de parede
+// mesmo que haja mudança de horário de verão no meio da série. Nas séries mensais, meses que não
+// possuem o dia da primeira consulta (ex.: dia 31) são pulados.
+func (r SeriesRule) Occurrences(first time.Time) []time.Time {
+	limit := maxSeriesOccurrences
+	if r.Count > 0 && r.Count < limit {
+		limit = r.Count
+	}
+	var untilEnd time.Time
+	if !r.Until.IsZero() {
+		untilEnd = wallTime(r.Until.Year(), r.Until.Month(), r.Until.Day()+1, 0, 0, 0, first.Location())
+	}
+
+	var occurrences []time.Time
+	for i := 0; len(occurrences) < limit && i < maxSeriesOccurrences*2; i++ {
+		var next time.Time
+		switch r.Frequency {
+		case "semanal":
+			next = addWallDate(first, 0, 0, 7*i)
+		case "quinzenal":
+			next = addWallDate(first, 0, 0, 14*i)
+		case "mensal":
+			next = addWallDate(first, 0, i, 0)
+			if next.Day() != first.Day() {
+				continue
+			}
+		}
+		if !untilEnd.IsZero() && !next.Before(untilEnd) {
+			break
+		}
+		occurrences = append(occurrences, next)
+	}
+	return occurrences
+}
+
+// createAppointmentSeries grava a série e suas ocorrências em uma única transação.
+// Sem SkipConflicts, qualquer ocorrência em conflito impede a criação da série inteira;
+// nesse caso o resultado volta com SeriesID zero e a lista de conflitos preenchida.
+func createAppointmentSeries(db *sql.DB, booking SeriesBooking, rule SeriesRule) (SeriesResult, error) {
+	var result SeriesResult
+
+	var accepted []time.Time
+	for _, start := range rule.Occurrences(booking.Start) {
+		if booking.Status != "cancelado" {
+			message, err := validateAppointmentSlot(db, booking.DoctorID, booking.PatientID, start, start.Add(booking.Duration))
+			if err != nil {
+				return result, err
+			}
+			if message != "" {
+				result.Conflicts = append(result.Conflicts, start.Format("02/01/2006 15:04")+": "+message)
+				continue
+			}
+		}
+		accepted = append(accepted, start)
+	}
+	if len(accepted) == 0 || (len(result.Conflicts) > 0 && !booking.SkipConflicts) {
+		return result, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	var until interface{}
+	if !rule.Until.IsZero() {
+		until = rule.Until.Format("2006-01-02")
+	}
+	var count interface{}
+	if rule.Count > 0 {
+		count = rule.Count
+	}
+	err = tx.QueryRow(`INSERT INTO appointment_series (patient_id, doctor_id, frequency, first_start, until_date, occurrence_count)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		booking.PatientID, booking.DoctorID, rule.Frequency, booking.Start, until, count).Scan(&result.SeriesID)
+	if err != nil {
+		return result, err
+	}
+
+	now := time.Now()
+	for _, start := range accepted {
+		status := booking.Status
+		if status == "agendado" && start.Before(now) {
+			status = "concluido"
+		}
+		_, err = tx.Exec(`INSERT INTO appointments (patient_id, doctor_id, start_time, end_time, status, notes, price, series_id, service_type_id, duration_minutes, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+			booking.PatientID, booking.DoctorID, start, start.Add(booking.Duration), status, booking.Notes, booking.Price, result.SeriesID,
+			booking.ServiceTypeID, int(booking.Duration.Minutes()), now, now)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return result, err
+	}
+	result.Affected = len(accepted)
+	return result, nil
+}
+
+// seriesTarget é uma ocorrência afetada por uma edição em série.
+type seriesTarget struct {
+	ID        int
+	PatientID int
+	Status    string
+	Start     time.Time
+	End       time.Time
+}
+
+// loadSeriesTargets busca as ocorrências atingidas pela abrangência escolhida, a partir da consulta
+// de referência. Além dela própria, só ocorrências ainda agendadas são alteradas.
+func loadSeriesTargets(db *sql.DB, appointmentID int, scope string) (int, []seriesTarget, error) {
+	var seriesID sql.NullInt64
+	var referenceStart time.Time
+	err := db.QueryRow("SELECT series_id, start_time FROM appointments WHERE id = $1", appointmentID).Scan(&seriesID, &referenceStart)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !seriesID.Valid || scope == scopeOccurrence {
+		return 0, nil, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT id, patient_id, status, start_time, end_time FROM appointments
+		WHERE series_id = $1
+		  AND (id = $2 OR status = 'agendado')
+		  AND ($3 = 'series' OR start_time >= $4)
+		ORDER BY start_time ASC`, seriesID.Int64, appointmentID, scope, referenceStart)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	var targets []seriesTarget
+	for rows.Next() {
+		var target seriesTarget
+		if err := rows.Scan(&target.ID, &target.PatientID, &target.Status, &target.Start, &target.End); err != nil {
+			return 0, nil, err
+		}
+		targets = append(targets, target)
+	}
+	return int(seriesID.Int64), targets, rows.Err()
+}
+
+// updateAppointmentSeries desloca as ocorrências da série pela mesma diferença aplicada à consulta
+// de referência (mantendo a duração de cada uma) e troca o terapeuta. O deslocamento é feito no
+// calendário da clínica, para que a série mantenha o horário local mesmo entre mudanças de horário de verão. Conflitos impedem a alteração
+// de todas as ocorrências. Se a consulta não pertence a uma série, Affected volta zero.
+func updateAppointmentSeries(db *sql.DB, appointmentID int, scope string, doctorID int, newStart time.Time) (SeriesResult, error) {
+	var result SeriesResult
+
+	seriesID, targets, err := loadSeriesTargets(db, appointmentID, scope)
+	if err != nil || len(targets) == 0 {
+		return result, err
+	}
+	result.SeriesID = seriesID
+
+	var oldStart time.Time
+	ids := make([]int, 0, len(targets))
+	for _, target := range targets {
+		ids = append(ids, target.ID)
+		if target.ID == appointmentID {
+			oldStart = target.Start
+		}
+	}
+	shift := func(t time.Time) time.Time { return shiftWallClock(t, oldStart, newStart) }
+
+	for _, target := range targets {
+		start, end := shift(target.Start), shift(target.End)
+		message, err := validateAppointmentSlot(db, doctorID, target.PatientID, start, end, ids...)
+		if err != nil {
+			return result, err
+		}
+		if message != "" {
+			result.Conflicts = append(result.Conflicts, start.Format("02/01/2006 15:04")+": "+message)
+		}
+	}
+	if len(result.Conflicts) > 0 {
+		return result, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	// As ocorrências podem trocar de lugar entre si; a sobreposição é verificada só no commit
+	if _, err := tx.Exec("SET CONSTRAINTS appointments_doctor_no_overlap, appointments_patient_no_overlap DEFERRED"); err != nil {
+		return result, err
+	}
+	now := time.Now()
+	for _, target := range targets {
+		_, err := tx.Exec(`UPDATE appointments SET doctor_id = $1, start_time = $2, end_time = $3, updated_at = $4 WHERE id = $5`,
+			doctorID, shift(target.Start), shift(target.End), now, target.ID)
+		if err != nil {
+			return result, err
+		}
+	}
+	if scope == scopeSeries {
+		if _, err := tx.Exec("UPDATE appointment_series SET doctor_id = $1 WHERE id = $2", doctorID, seriesID); err != nil {
+			return result, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return result, err
+	}
+	result.Affected = len(targets)
+	return result, nil
+}
+
+// cancelAppointmentSeries cancela as ocorrências da série conforme a abrangência escolhida. Cada
+// ocorrência passa pela política de cancelamento (as que estão dentro da janela viram cancelamento
+// tardio). Se a consulta não pertence a uma série, Affected volta zero e nada é alterado.
+func cancelAppointmentSeries(db *sql.DB, appointmentID int, scope string) (SeriesResult, error) {
+	var result SeriesResult
+
+	seriesID, targets, err := loadSeriesTargets(db, appointmentID, scope)
+	if err != nil || len(targets) == 0 {
+		return result, err
+	}
+	result.SeriesID = seriesID
+
+	// A consulta de referência pode já estar encerrada; só as demais são canceladas
+	ids := make([]int, 0, len(targets))
+	for _, target := range targets {
+		if isCancelledStatus(target.Status) || target.Status == "faltou" {
+			continue
+		}
+		ids = append(ids, target.ID)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	policy := loadCancellationPolicy()
+	now := time.Now()
+	for _, id := range ids {
+		if _, _, err := closeAppointment(tx, policy, id, "cancelado", now); err != nil {
+			return result, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return result, err
+	}
+	result.Affected = len(ids)
+	result.Cancelled = ids
+	return result, nil
+}
+
+// seriesScope lê a abrangência pedida (formulário ou query string); o padrão é só a ocorrência.
+func seriesScope(c *gin.Context) string {
+	scope := c.PostForm("scope")
+	if scope == "" {
+		scope = c.Query("scope")
+	}
+	switch scope {
+	case scopeFollowing, scopeSeries:
+		return scope
+	default:
+		return scopeOccurrence
+	}
+}
+
+// bookSeries cria a série pedida no formulário e registra o resultado na sessão (flashes) e na auditoria.
+// É compartilhada pelos painéis da secretária e do administrador.
+func bookSeries(c *gin.Context, db *sql.DB, booking SeriesBooking, rule SeriesRule) {
+	session := sessions.Default(c)
+	defer session.Save()
+
+	result, err := createAppointmentSeries(db, booking, rule)
+	if err != nil {
+		log.Printf("Erro ao criar série de consultas: %v", err)
+		if isOverlapViolation(err) {
+			session.AddFlash(overlapViolationMessage, "error")
+		} else {
+			session.AddFlash("Não foi possível criar a série de consultas.", "error")
+		}
+		return
+	}
+	if result.SeriesID == 0 {
+		if len(result.Conflicts) == 0 {
+			session.AddFlash("Nenhuma ocorrência gerada: verifique a data final da recorrência.", "error")
+			return
+		}
+		session.AddFlash("Série não criada. Ocorrências em conflito: "+strings.Join(result.Conflicts, " "), "error")
+		return
+	}
+
+	AddAuditLog(LogAction{
+		DB:         db,
+		Context:    c,
+		Action:     fmt.Sprintf("Criou série %s com %d consulta(s) para o paciente ID %d", strings.ToLower(seriesFrequencyNames[rule.Frequency]), result.Affected, booking.PatientID),
+		TargetType: "Série de Consultas",
+		TargetID:   result.SeriesID,
+	})
+	if len(result.Conflicts) > 0 {
+		session.AddFlash(fmt.Sprintf("Série criada com %d consulta(s). Datas puladas por conflito: %s", result.Affected, strings.Join(result.Conflicts, " ")), "error")
+	}
+}
+
+// editSeries aplica a edição a várias ocorrências e registra o resultado. Devolve falso quando
+// a edição foi recusada (conflitos ou erro) e o usuário deve voltar ao formulário.
+func editSeries(c *gin.Context, db *sql.DB, appointmentID int, scope string, doctorID int, newStart time.Time) bool {
+	session := sessions.Default(c)
+	defer session.Save()
+
+	result, err := updateAppointmentSeries(db, appointmentID, scope, doctorID, newStart)
+	if err != nil {
+		log.Printf("Erro ao atualizar série de consultas: %v", err)
+		if isOverlapViolation(err) {
+			session.AddFlash(overlapViolationMessage, "error")
+		} else {
+			session.AddFlash("Não foi possível atualizar as consultas da série.", "error")
+		}
+		return false
+	}
+	if len(result.Conflicts) > 0 {
+		session.AddFlash("Nenhuma consulta foi alterada. Ocorrências em conflito: "+strings.Join(result.Conflicts, " "), "error")
+		return false
+	}
+
+	AddAuditLog(LogAction{
+		DB:         db,
+		Context:    c,
+		Action:     fmt.Sprintf("Alterou %d consulta(s) da série a partir da consulta ID %d", result.Affected, appointmentID),
+		TargetType: "Série de Consultas",
+		TargetID:   result.SeriesID,
+	})
+	return true
+}
+
+// cancelSeries cancela várias ocorrências e registra a ação na auditoria.
+func cancelSeries(c *gin.Context, db *sql.DB, appointmentID int, scope string) {
+	result, err := cancelAppointmentSeries(db, appointmentID, scope)
+	if err != nil {
+		log.Printf("Erro ao cancelar consultas da série: %v", err)
+		return
+	}
+	AddAuditLog(LogAction{
+		DB:         db,
+		Context:    c,
+		Action:     fmt.Sprintf("Cancelou %d consulta(s) da série a partir da consulta ID %d", result.Affected, appointmentID),
+		TargetType: "Série de Consultas",
+		TargetID:   result.SeriesID,
+	})
+	if offers := notifyWaitlist(db, result.Cancelled...); offers > 0 {
+		session := sessions.Default(c)
+		session.AddFlash(waitlistOffersMessage(offers), "success")
+		session.Save()
+	}
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOccurrencesKeepWallClockAcrossDST(t *testing.T) {
+	tests := []struct {
+		name  string
+		zone  string
+		first string
+		rule  SeriesRule
+		want  []string // Horário de parede de cada ocorrência, no fuso da série
+	}{
+		{
+			name:  "semanal atravessa o fim do verão em Nova York",
+			zone:  "America/New_York",
+			first: "2024-10-27 10:00",
+			rule:  SeriesRule{Frequency: "semanal", Count: 3},
+			want:  []string{"2024-10-27 10:00 EDT", "2024-11-03 10:00 EST", "2024-11-10 10:00 EST"},
+		},
+		{
+			name:  "quinzenal atravessa o início do verão em Nova York",
+			zone:  "America/New_York",
+			first: "2024-03-03 09:00",
+			rule:  SeriesRule{Frequency: "quinzenal", Count: 2},
+			want:  []string{"2024-03-03 09:00 EST", "2024-03-17 09:00 EDT"},
+		},
+		{
+			name:  "semanal às 00:30 cai no dia sem meia-noite em São Paulo (2018)",
+			zone:  "America/Sao_Paulo",
+			first: "2018-10-28 00:30",
+			rule:  SeriesRule{Frequency: "semanal", Count: 3},
+			want:  []string{"2018-10-28 00:30 -03", "2018-11-04 01:30 -02", "2018-11-11 00:30 -02"},
+		},
+		{
+			name:  "data final inclui o último dia inteiro",
+			zone:  "America/Sao_Paulo",
+			first: "2018-10-27 23:30",
+			rule:  SeriesRule{Frequency: "semanal", Until: time.Date(2018, time.November, 3, 0, 0, 0, 0, time.UTC)},
+			want:  []string{"2018-10-27 23:30 -03", "2018-11-03 23:30 -03"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc := mustLoad(t, tt.zone)
+			first, err := time.ParseInLocation("2006-01-02 15:04", tt.first, loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, o := range tt.rule.Occurrences(first) {
+				got = append(got, o.In(loc).Format("2006-01-02 15:04 MST"))
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("recebeu %v, esperava %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("recebeu %v, esperava %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
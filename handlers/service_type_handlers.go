@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"mediflow/storage"
+)
+
+// ServiceTypeHandler gerencia o catálogo de tipos de sessão e os preços por terapeuta.
+type ServiceTypeHandler struct {
+	DB *sql.DB
+}
+
+// ViewServiceTypes lista o catálogo de tipos de sessão.
+func (h *ServiceTypeHandler) ViewServiceTypes(c *gin.Context) {
+	session := sessions.Default(c)
+	errorFlashes := session.Flashes("error")
+	successFlashes := session.Flashes("success")
+	session.Save()
+
+	serviceTypes, err := loadServiceTypes(h.DB, false)
+	if err != nil {
+		log.Printf("Erro ao buscar tipos de sessão: %v", err)
+		c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Não foi possível carregar os tipos de sessão."})
+		return
+	}
+
+	c.HTML(http.StatusOK, "admin/service_types.html", gin.H{
+		"Title":          "Tipos de Sessão",
+		"ServiceTypes":   serviceTypes,
+		"ActiveNav":      "services",
+		"ErrorFlashes":   errorFlashes,
+		"SuccessFlashes": successFlashes,
+	})
+}
+
+// PostNewServiceType cadastra um novo tipo de sessão.
+func (h *ServiceTypeHandler) PostNewServiceType(c *gin.Context) {
+	session := sessions.Default(c)
+
+	st, ok := serviceTypeFromForm(c)
+	if !ok {
+		session.AddFlash("Informe nome, duração (em minutos) e preço válidos.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, "/admin/service-types")
+		return
+	}
+
+	var id int
+	err := h.DB.QueryRow("INSERT INTO service_types (name, duration_minutes, default_price) VALUES ($1, $2, $3) RETURNING id",
+		st.Name, st.DurationMinutes, st.DefaultPrice).Scan(&id)
+	if err != nil {
+		log.Printf("Erro ao inserir tipo de sessão: %v", err)
+		session.AddFlash("Não foi possível salvar o tipo de sessão.", "error")
+	} else {
+		AddAuditLog(LogAction{
+			DB:         h.DB,
+			Context:    c,
+			Action:     fmt.Sprintf("Criou o tipo de sessão '%s' (%d min, R$ %.2f)", st.Name, st.DurationMinutes, st.DefaultPrice),
+			TargetType: "Tipo de Sessão",
+			TargetID:   id,
+		})
+		session.AddFlash("Tipo de sessão criado com sucesso!", "success")
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, "/admin/service-types")
+}
+
+// GetEditServiceTypeForm exibe o tipo de sessão com seus preços diferenciados por terapeuta.
+func (h *ServiceTypeHandler) GetEditServiceTypeForm(c *gin.Context) {
+	session := sessions.Default(c)
+	errorFlashes := session.Flashes("error")
+	successFlashes := session.Flashes("success")
+	session.Save()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Redirect(http.StatusFound, "/admin/service-types")
+		return
+	}
+
+	var st storage.ServiceType
+	err = h.DB.QueryRow("SELECT id, name, duration_minutes, default_price, active FROM service_types WHERE id = $1", id).
+		Scan(&st.ID, &st.Name, &st.DurationMinutes, &st.DefaultPrice, &st.Active)
+	if err != nil {
+		log.Printf("Erro ao buscar tipo de sessão %d: %v", id, err)
+		c.HTML(http.StatusNotFound, "layouts/error.html", gin.H{"Title": "Não Encontrado", "Message": "Tipo de sessão não encontrado."})
+		return
+	}
+
+	var prices []storage.TherapistServicePrice
+	rows, err := h.DB.Query(`
+		SELECT tsp.doctor_id, u.name, tsp.service_type_id, tsp.price
+		FROM therapist_service_prices tsp
+		JOIN users u ON tsp.doctor_id = u.id
+		WHERE tsp.service_type_id = $1
+		ORDER BY u.name ASC`, id)
+	if err != nil {
+		log.Printf("Erro ao buscar preços por terapeuta: %v", err)
+	} else {
+		defer rows.Close()
+		for rows.Next() {
+			var price storage.TherapistServicePrice
+			if err := rows.Scan(&price.DoctorID, &price.DoctorName, &price.ServiceTypeID, &price.Price); err == nil {
+				prices = append(prices, price)
+			}
+		}
+	}
+
+	var doctors []storage.User
+	doctorRows, err := h.DB.Query("SELECT id, name FROM users WHERE user_type = 'terapeuta' AND deleted_at IS NULL ORDER BY name ASC")
+	if err == nil {
+		defer doctorRows.Close()
+		for doctorRows.Next() {
+			var doc storage.User
+			if err := doctorRows.Scan(&doc.ID, &doc.Name); err == nil {
+				doctors = append(doctors, doc)
+			}
+		}
+	}
+
+	c.HTML(http.StatusOK, "admin/service_type_form.html", gin.H{
+		"Title":          "Editar Tipo de Sessão",
+		"ServiceType":    st,
+		"Prices":         prices,
+		"Doctors":        doctors,
+		"ActiveNav":      "services",
+		"ErrorFlashes":   errorFlashes,
+		"SuccessFlashes": successFlashes,
+	})
+}
+
+// PostEditServiceType atualiza nome, duração e preço padrão. Consultas já marcadas mantêm
+// a duração e o preço copiados no momento do agendamento.
+func (h *ServiceTypeHandler) PostEditServiceType(c *gin.Context) {
+	session := sessions.Default(c)
+	idStr := c.Param("id")
+	editURL := "/admin/service-types/edit/" + idStr
+
+	st, ok := serviceTypeFromForm(c)
+	if !ok {
+		session.AddFlash("Informe nome, duração (em minutos) e preço válidos.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, editURL)
+		return
+	}
+
+	_, err := h.DB.Exec("UPDATE service_types SET name = $1, duration_minutes = $2, default_price = $3, updated_at = NOW() WHERE id = $4",
+		st.Name, st.DurationMinutes, st.DefaultPrice, idStr)
+	if err != nil {
+		log.Printf("Erro ao atualizar tipo de sessão: %v", err)
+		session.AddFlash("Não foi possível atualizar o tipo de sessão.", "error")
+	} else {
+		AddAuditLog(LogAction{
+			DB:         h.DB,
+			Context:    c,
+			Action:     fmt.Sprintf("Atualizou o tipo de sessão '%s' (%d min, R$ %.2f)", st.Name, st.DurationMinutes, st.DefaultPrice),
+			TargetType: "Tipo de Sessão",
+			TargetID:   safeAtoi(idStr),
+		})
+		session.AddFlash("Tipo de sessão atualizado!", "success")
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, editURL)
+}
+
+// ToggleServiceType ativa ou desativa um tipo de sessão. Tipos inativos deixam de aparecer
+// nos formulários de agendamento, mas continuam nas consultas já gravadas.
+func (h *ServiceTypeHandler) ToggleServiceType(c *gin.Context) {
+	session := sessions.Default(c)
+	idStr := c.Param("id")
+
+	var active bool
+	err := h.DB.QueryRow("UPDATE service_types SET active = NOT active, updated_at = NOW() WHERE id = $1 RETURNING active", idStr).Scan(&active)
+	if err != nil {
+		log.Printf("Erro ao alterar situação do tipo de sessão: %v", err)
+		session.AddFlash("Não foi possível alterar o tipo de sessão.", "error")
+	} else {
+		action := "Desativou"
+		if active {
+			action = "Reativou"
+		}
+		AddAuditLog(LogAction{
+			DB:         h.DB,
+			Context:    c,
+			Action:     fmt.Sprintf("%s o tipo de sessão ID %s", action, idStr),
+			TargetType: "Tipo de Sessão",
+			TargetID:   safeAtoi(idStr),
+		})
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, "/admin/service-types")
+}
+
+// PostTherapistPrice cria ou atualiza o preço diferenciado de um terapeuta para o tipo de sessão.
+func (h *ServiceTypeHandler) PostTherapistPrice(c *gin.Context) {
+	session := sessions.Default(c)
+	idStr := c.Param("id")
+	editURL := "/admin/service-types/edit/" + idStr
+
+	doctorID, errDoctor := strconv.Atoi(c.PostForm("doctor_id"))
+	price, errPrice := strconv.ParseFloat(strings.Replace(c.PostForm("price"), ",", ".", 1), 64)
+	if errDoctor != nil || errPrice != nil || price < 0 {
+		session.AddFlash("Selecione o terapeuta e informe um preço válido.", "error")
+		session.Save()
+		c.Redirect(http.StatusFound, editURL)
+		return
+	}
+
+	_, err := h.DB.Exec(`INSERT INTO therapist_service_prices (doctor_id, service_type_id, price) VALUES ($1, $2, $3)
+		ON CONFLICT (doctor_id, service_type_id) DO UPDATE SET price = EXCLUDED.price`, doctorID, idStr, price)
+	if err != nil {
+		log.Printf("Erro ao salvar preço do terapeuta: %v", err)
+		session.AddFlash("Não foi possível salvar o preço do terapeuta.", "error")
+	} else {
+		AddAuditLog(LogAction{
+			DB:         h.DB,
+			Context:    c,
+			Action:     fmt.Sprintf("Definiu preço de R$ %.2f para o terapeuta ID %d no tipo de sessão ID %s", price, doctorID, idStr),
+			TargetType: "Tipo de Sessão",
+			TargetID:   safeAtoi(idStr),
+		})
+		session.AddFlash("Preço do terapeuta salvo!", "success")
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, editURL)
+}
+
+// DeleteTherapistPrice remove o preço diferenciado; o terapeuta volta a usar o preço padrão.
+func (h *ServiceTypeHandler) DeleteTherapistPrice(c *gin.Context) {
+	session := sessions.Default(c)
+	idStr := c.Param("id")
+	doctorIDStr := c.Param("doctorId")
+
+	_, err := h.DB.Exec("DELETE FROM therapist_service_prices WHERE service_type_id = $1 AND doctor_id = $2", idStr, doctorIDStr)
+	if err != nil {
+		log.Printf("Erro ao remover preço do terapeuta: %v", err)
+		session.AddFlash("Não foi possível remover o preço do terapeuta.", "error")
+	} else {
+		AddAuditLog(LogAction{
+			DB:         h.DB,
+			Context:    c,
+			Action:     fmt.Sprintf("Removeu o preço diferenciado do terapeuta ID %s no tipo de sessão ID %s", doctorIDStr, idStr),
+			TargetType: "Tipo de Sessão",
+			TargetID:   safeAtoi(idStr),
+		})
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, "/admin/service-types/edit/"+idStr)
+}
+
+// serviceTypeFromForm lê e valida os campos do formulário de tipo de sessão.
+func serviceTypeFromForm(c *gin.Context) (storage.ServiceType, bool) {
+	var st storage.ServiceType
+	st.Name = strings.TrimSpace(c.PostForm("name"))
+	duration, errDuration := strconv.Atoi(c.PostForm("duration_minutes"))
+	price, errPrice := strconv.ParseFloat(strings.Replace(c.PostForm("default_price"), ",", ".", 1), 64)
+	if st.Name == "" || errDuration != nil || duration <= 0 || errPrice != nil || price < 0 {
+		return st, false
+	}
+	st.DurationMinutes = duration
+	st.DefaultPrice = price
+	return st, true
+}
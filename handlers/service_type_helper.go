@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"mediflow/storage"
+)
+
+// defaultAppointmentDuration é usada quando a consulta não tem tipo de sessão associado.
+const defaultAppointmentDuration = 60 * time.Minute
+
+// loadServiceTypes lista o catálogo de tipos de sessão. Com activeOnly, só os disponíveis para agendamento.
+func loadServiceTypes(db *sql.DB, activeOnly bool) ([]storage.ServiceType, error) {
+	query := `SELECT id, name, duration_minutes, default_price, active FROM service_types`
+	if activeOnly {
+		query += ` WHERE active = TRUE`
+	}
+	query += ` ORDER BY name ASC`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var serviceTypes []storage.ServiceType
+	for rows.Next() {
+		var st storage.ServiceType
+		if err := rows.Scan(&st.ID, &st.Name, &st.DurationMinutes, &st.DefaultPrice, &st.Active); err != nil {
+			return nil, err
+		}
+		serviceTypes = append(serviceTypes, st)
+	}
+	return serviceTypes, rows.Err()
+}
+
+// resolveServiceType busca o tipo de sessão e o preço que vale para o terapeuta
+// (o preço diferenciado do terapeuta, quando existir, ou o preço padrão).
+func resolveServiceType(db *sql.DB, serviceTypeID, doctorID int) (storage.ServiceType, float64, error) {
+	var st storage.ServiceType
+	var price float64
+	err := db.QueryRow(`
+		SELECT st.id, st.name, st.duration_minutes, st.default_price, st.active,
+		       COALESCE(tsp.price, st.default_price)
+		FROM service_types st
+		LEFT JOIN therapist_service_prices tsp ON tsp.service_type_id = st.id AND tsp.doctor_id = $2
+		WHERE st.id = $1`, serviceTypeID, doctorID).
+		Scan(&st.ID, &st.Name, &st.DurationMinutes, &st.DefaultPrice, &st.Active, &price)
+	return st, price, err
+}
+
+// appointmentService é o resultado da escolha do tipo de sessão no formulário de agendamento.
+type appointmentService struct {
+	ServiceTypeID sql.NullInt64
+	Duration      time.Duration
+	Price         float64
+}
+
+// serviceFromForm lê o tipo de sessão escolhido e devolve a duração e o preço a copiar para a consulta.
+// Sem tipo de sessão, mantém a duração padrão de uma hora e preço zero. Tipos desativados não podem
+// ser usados em novas consultas.
+func serviceFromForm(db *sql.DB, c *gin.Context, doctorID int) (appointmentService, error) {
+	service := appointmentService{Duration: defaultAppointmentDuration}
+
+	serviceTypeID, err := strconv.Atoi(c.PostForm("service_type_id"))
+	if err != nil || serviceTypeID == 0 {
+		return service, nil
+	}
+	st, price, err := resolveServiceType(db, serviceTypeID, doctorID)
+	if err != nil {
+		return service, err
+	}
+	if !st.Active {
+		return service, fmt.Errorf("tipo de sessão %d inativo", serviceTypeID)
+	}
+	service.ServiceTypeID = sql.NullInt64{Int64: int64(st.ID), Valid: true}
+	service.Duration = time.Duration(st.DurationMinutes) * time.Minute
+	service.Price = price
+	return service, nil
+}
+
+// appointmentDuration devolve a duração gravada em uma consulta existente, usada ao remarcá-la.
+func appointmentDuration(db *sql.DB, appointmentID string) (time.Duration, error) {
+	var start, end time.Time
+	if err := db.QueryRow("SELECT start_time, end_time FROM appointments WHERE id = $1", appointmentID).Scan(&start, &end); err != nil {
+		return 0, err
+	}
+	return end.Sub(start), nil
+}
@@ -6,7 +6,6 @@ import (
     "net/http"
     "strconv"
     "time"
-    "fmt"     // <-- ADICIONE/CONFIRME ESTA LINHA
     "strings" // <-- ADICIONE ESTA LINHA
 	
 	"github.com/gin-contrib/sessions"
@@ -25,6 +24,7 @@ type TerapeutaHandler struct {
 type TerapeutaDashboardData struct {
 	UpcomingAppointments []AppointmentDetails
 	MyPatients           []storage.Patient
+	PendingIntakes       []PendingIntake // Fichas de anamnese enviadas aguardando revisão
 }
 
 // TerapeutaDashboard busca os dados e renderiza a página inicial do terapeuta.
@@ -36,13 +36,16 @@ func (h *TerapeutaHandler) TerapeutaDashboard(c *gin.Context) {
 
 	// 1. Buscar as próximas 10 consultas do terapeuta
 	queryAppointments := `
-		SELECT a.id, a.start_time, p.name as patient_name, p.id as patient_id
+		SELECT a.id, a.start_time, a.end_time, p.name as patient_name, p.id as patient_id, COALESCE(st.name, '') as service_name
 		FROM appointments a
 		JOIN patients p ON a.patient_id = p.id
+		LEFT JOIN service_types st ON a.service_type_id = st.id
 		WHERE a.doctor_id = $1 AND a.start_time >= $2 AND a.status = 'agendado'
 		ORDER BY a.start_time ASC
 		LIMIT 10`
 
+	// Os horários são exibidos no fuso do terapeuta (o da clínica, salvo atendimento online de outro fuso)
+	loc := therapistLocation(h.DB, userID)
 	rows, err := h.DB.Query(queryAppointments, userID, time.Now())
 	if err != nil {
 		log.Printf("Erro ao buscar agendamentos do terapeuta: %v", err)
@@ -50,7 +53,8 @@ func (h *TerapeutaHandler) TerapeutaDashboard(c *gin.Context) {
 		defer rows.Close()
 		for rows.Next() {
 			var app AppointmentDetails
-			rows.Scan(&app.ID, &app.StartTime, &app.PatientName, &app.PatientID)
+			rows.Scan(&app.ID, &app.StartTime, &app.EndTime, &app.PatientName, &app.PatientID, &app.ServiceName)
+			app.StartTime, app.EndTime = app.StartTime.In(loc), app.EndTime.In(loc)
 			data.UpcomingAppointments = append(data.UpcomingAppointments, app)
 		}
 	}
@@ -78,11 +82,41 @@ func (h *TerapeutaHandler) TerapeutaDashboard(c *gin.Context) {
 		}
 	}
 
+	// 3. Fichas de anamnese enviadas pelos pacientes, aguardando revisão
+	data.PendingIntakes, err = loadPendingIntakes(h.DB, userID)
+	if err != nil {
+		log.Printf("Erro ao buscar fichas de anamnese pendentes do terapeuta: %v", err)
+	}
+
+	// 4. Link de assinatura da agenda (iCalendar), se já foi gerado
+	var calendarToken sql.NullString
+	var calendarFullNames bool
+	if err := h.DB.QueryRow("SELECT calendar_token, calendar_full_names FROM users WHERE id = $1", userID).Scan(&calendarToken, &calendarFullNames); err != nil {
+		log.Printf("Erro ao buscar link da agenda do terapeuta: %v", err)
+	}
+	calendarURL := ""
+	if calendarToken.Valid {
+		calendarURL = calendarFeedURL(calendarToken.String)
+	}
+	ownTimezone := ""
+	if loc.String() != storage.ClinicLocation().String() {
+		ownTimezone = loc.String()
+	}
+	errorFlashes := session.Flashes("error")
+	successFlashes := session.Flashes("success")
+	session.Save()
+
 	c.HTML(http.StatusOK, "terapeuta/terapeuta_dashboard.html", gin.H{
 		"Title":     "Meu Dashboard",
 		"Data":      data,
 		"ActiveNav": "dashboard",
 		"SearchTerm": searchTerm, // Passa o termo de busca de volta para o HTML		
+		"CalendarFeedURL":   calendarURL,
+		"CalendarFeedPath":  portalBaseURL() == "", // Sem PORTAL_BASE_URL, o link não tem o endereço do servidor
+		"CalendarFullNames": calendarFullNames,
+		"OwnTimezone":       ownTimezone,
+		"ErrorFlashes":      errorFlashes,
+		"SuccessFlashes":    successFlashes,
 	})
 }
 
@@ -96,9 +130,7 @@ func (h *TerapeutaHandler) ShowPatientRecord(c *gin.Context) {
 	patientID, _ := strconv.Atoi(patientIDStr)
 
 	// Verificação de Segurança: Este terapeuta tem acesso a este paciente?
-	var count int
-	err := h.DB.QueryRow("SELECT COUNT(*) FROM appointments WHERE patient_id = $1 AND doctor_id = $2", patientID, therapistID).Scan(&count)
-	if err != nil || count == 0 {
+	if !therapistHasPatient(h.DB, therapistID, patientID) {
 		c.HTML(http.StatusForbidden, "layouts/error.html", gin.H{"Title": "Acesso Negado", "Message": "Você não tem permissão para ver o prontuário deste paciente."})
 		return
 	}
@@ -115,6 +147,12 @@ func (h *TerapeutaHandler) ShowPatientRecord(c *gin.Context) {
 	pageData.Action = "/terapeuta/pacientes/prontuario/" + patientIDStr
 	pageData.ActiveNav = "dashboard" // Mantém o dashboard como ativo no menu
 	pageData.UserType = "terapeuta" // <-- LINHA ADICIONADA AQUI
+	pageData.UserID = therapistID
+	setRecordNoteForm(h.DB, &pageData, c.Query("modelo"))
+	setLevelCharts(h.DB, &pageData, c.Query)
+	pageData.ErrorFlashes = session.Flashes("error")
+	pageData.SuccessFlashes = session.Flashes("success")
+	session.Save()
 	
 	// Renderiza o MESMO template que o admin usa, garantindo que sejam idênticos.
 	c.HTML(http.StatusOK, "admin/patient_form.html", pageData)
@@ -129,10 +167,7 @@ func (h *TerapeutaHandler) ProcessPatientRecord(c *gin.Context) {
 	patientID, _ := strconv.Atoi(patientIDStr)
 
 	// Verificação de Segurança
-	var count int
-	// CORREÇÃO: Usar QueryRow e Scan corretamente
-	err := h.DB.QueryRow("SELECT COUNT(*) FROM appointments WHERE patient_id = $1 AND doctor_id = $2", patientID, therapistID).Scan(&count)
-	if err != nil || count == 0 {
+	if !therapistHasPatient(h.DB, therapistID, patientID) {
 		c.HTML(http.StatusForbidden, "layouts/error.html", gin.H{"Title": "Acesso Negado", "Message": "Você não tem permissão para alterar o prontuário deste paciente."})
 		return
 	}
@@ -156,7 +191,7 @@ func (h *TerapeutaHandler) ProcessPatientRecord(c *gin.Context) {
 	energy, _ := strconv.Atoi(c.PostForm("energy_level"))
 
 	// CORREÇÃO: Usar a atribuição correta para h.DB.Exec
-	_, err = h.DB.Exec(queryPatients,
+	_, err := h.DB.Exec(queryPatients,
 		c.PostForm("client_name"), c.PostForm("address_street"), c.PostForm("address_number"), c.PostForm("address_neighborhood"),
 		c.PostForm("address_city"), c.PostForm("address_state"), c.PostForm("phone"), c.PostForm("mobile"),
 		c.PostForm("dob"), age, c.PostForm("email"), c.PostForm("profession"),
@@ -169,32 +204,12 @@ func (h *TerapeutaHandler) ProcessPatientRecord(c *gin.Context) {
 		log.Printf("Erro ao ATUALIZAR paciente pelo terapeuta: %v", err)
 	}
 
-	// 2. Insere um novo registro no histórico
-	queryRecords := `
-		INSERT INTO patient_records (
-			patient_id, doctor_id, anxiety_level, anger_level, fear_level, sadness_level, 
-			joy_level, energy_level, main_complaint, complaint_history, signs_symptoms, 
-			current_treatment, notes, record_date
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`
-
-	// CORREÇÃO: Usar a atribuição correta para h.DB.Exec
-	_, err = h.DB.Exec(queryRecords,
-		patientID, therapistID, anxiety, anger, fear, sadness, joy, energy,
-		c.PostForm("main_complaint"), c.PostForm("complaint_history"), c.PostForm("signs_symptoms"),
-		c.PostForm("current_treatment"), c.PostForm("notes"), time.Now())
-
-	if err != nil {
-		log.Printf("Erro ao INSERIR registro de prontuário pelo terapeuta: %v", err)
-	} else {
-		logInfo := LogAction{
-			DB:         h.DB,
-			Context:    c,
-			Action:     "Adicionou nova entrada ao prontuário",
-			TargetType: "Paciente",
-			TargetID:   patientID,
-		}
-		AddAuditLog(logInfo)
-		}
+	// 2. Grava a entrada do prontuário (rascunho do terapeuta, ou assinada se ele escolheu assinar)
+	saveRecordEntry(h.DB, c, patientID, therapistID, storage.PatientRecord{
+		AnxietyLevel: anxiety, AngerLevel: anger, FearLevel: fear, SadnessLevel: sadness, JoyLevel: joy, EnergyLevel: energy,
+		MainComplaint: c.PostForm("main_complaint"), ComplaintHistory: c.PostForm("complaint_history"),
+		SignsSymptoms: c.PostForm("signs_symptoms"), CurrentTreatment: c.PostForm("current_treatment"), Notes: c.PostForm("notes"),
+	})
 
 	c.Redirect(http.StatusFound, "/terapeuta/pacientes/prontuario/"+patientIDStr)
 }
@@ -261,40 +276,26 @@ func (h *TerapeutaHandler) GetAISummary(c *gin.Context) {
 		return
 	}
 
-	// 1. Buscar e formatar o histórico do paciente (a mesma lógica de antes)
-	query := `
-		SELECT r.record_date, u.name as doctor_name, r.main_complaint, r.notes,
-			   r.anxiety_level, r.anger_level, r.fear_level, r.sadness_level, r.joy_level, r.energy_level
-		FROM patient_records r
-		JOIN users u ON r.doctor_id = u.id
-		WHERE r.patient_id = $1 ORDER BY r.record_date ASC
-	`
-	rows, err := h.DB.Query(query, patientID)
+	// 1. Buscar e formatar o histórico do paciente, com as notas estruturadas e os adendos
+	history, err := loadPatientRecordHistory(h.DB, patientID)
 	if err != nil {
 		log.Printf("Erro ao buscar histórico para resumo de IA: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Falha ao buscar dados do paciente."})
 		return
 	}
-	defer rows.Close()
 
 	var historico strings.Builder
-	historico.WriteString("Histórico de Sessões do Paciente:\n\n")
-	recordCount := 0
-	for rows.Next() {
-		recordCount++
-		var rec storage.PatientRecord
-		if err := rows.Scan(&rec.RecordDate, &rec.DoctorName, &rec.MainComplaint, &rec.Notes,
-			&rec.AnxietyLevel, &rec.AngerLevel, &rec.FearLevel, &rec.SadnessLevel, &rec.JoyLevel, &rec.EnergyLevel); err != nil {
-			continue
-		}
-		historico.WriteString(fmt.Sprintf("Sessão em %s (com Dr(a). %s):\n", rec.RecordDate.Format("02/01/2006"), rec.DoctorName))
-		historico.WriteString(fmt.Sprintf("- Níveis (0-10): Ansiedade(%d), Raiva(%d), Medo(%d), Tristeza(%d), Alegria(%d), Energia(%d)\n",
-			rec.AnxietyLevel, rec.AngerLevel, rec.FearLevel, rec.SadnessLevel, rec.JoyLevel, rec.EnergyLevel))
-		historico.WriteString(fmt.Sprintf("- Queixa Principal da Sessão: %s\n", rec.MainComplaint))
-		historico.WriteString(fmt.Sprintf("- Notas do Terapeuta: %s\n\n", rec.Notes))
+	historico.WriteString(recordSummaryText(history))
+	recordCount := len(history)
+
+	// Os check-ins do portal trazem como o próprio paciente avaliou seu estado antes de cada sessão
+	checkins, err := loadPatientCheckins(h.DB, patientID)
+	if err != nil {
+		log.Printf("Erro ao buscar check-ins para resumo de IA: %v", err)
 	}
+	historico.WriteString(checkinSummaryText(checkins))
 
-	if recordCount == 0 {
+	if recordCount == 0 && len(checkins) == 0 {
 		c.JSON(http.StatusOK, gin.H{"summary": "Não há dados de prontuário suficientes para gerar um resumo."})
 		return
 	}
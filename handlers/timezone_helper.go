@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"mediflow/storage"
+)
+
+// errNonexistentLocalTime é devolvido para horários que não existem no fuso da clínica
+// (o relógio é adiantado no início do horário de verão).
+var errNonexistentLocalTime = errors.New("o horário informado não existe no fuso da clínica (mudança de horário de verão)")
+
+// timezoneSuggestions são oferecidos no formulário de fuso do terapeuta; qualquer nome IANA é aceito.
+var timezoneSuggestions = []string{
+	"America/Sao_Paulo", "America/Manaus", "America/Cuiaba", "America/Belem", "America/Fortaleza",
+	"America/Recife", "America/Rio_Branco", "America/Noronha", "America/New_York", "America/Los_Angeles",
+	"Europe/Lisbon", "Europe/London", "Europe/Madrid", "Europe/Berlin", "Asia/Tokyo", "UTC",
+}
+
+// clinicNow devolve o instante atual no fuso da clínica.
+func clinicNow() time.Time {
+	return time.Now().In(storage.ClinicLocation())
+}
+
+// clinicToday devolve a meia-noite de hoje no fuso da clínica.
+func clinicToday() time.Time {
+	return dateOnly(clinicNow())
+}
+
+// parseClinicDate lê uma data AAAA-MM-DD como meia-noite no fuso da clínica (ou o primeiro horário
+// do dia, nos fusos em que o horário de verão começa à meia-noite).
+func parseClinicDate(value string) (time.Time, error) {
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return date, err
+	}
+	return wallTime(date.Year(), date.Month(), date.Day(), 0, 0, 0, storage.ClinicLocation()), nil
+}
+
+// wallTime é time.Date para horários de parede, com uma diferença: um horário pulado pelo início do
+// horário de verão avança pela duração do salto (02:30 vira 03:30), em vez de recuar para o dia ou a
+// hora anterior como faz time.Date. Assim a meia-noite de um dia sem meia-noite (America/Sao_Paulo
+// até 2019) continua no mesmo dia. Na hora repetida do fim do horário de verão vale a primeira.
+func wallTime(year int, month time.Month, day, hour, min, sec int, loc *time.Location) time.Time {
+	t := time.Date(year, month, day, hour, min, sec, 0, loc)
+	want := time.Date(year, month, day, hour, min, sec, 0, time.UTC)
+	if got := civilDate(t).Add(wallClock(t)); got.Before(want) {
+		t = t.Add(want.Sub(got))
+	}
+	return t
+}
+
+// addWallDate soma anos, meses e dias ao calendário de 't', mantendo o horário de parede no fuso de 't'.
+func addWallDate(t time.Time, years, months, days int) time.Time {
+	return wallTime(t.Year()+years, t.Month()+time.Month(months), t.Day()+days, t.Hour(), t.Minute(), t.Second(), t.Location())
+}
+
+// parseClinicDateTime lê a data (AAAA-MM-DD) e o horário (HH:MM) digitados nos formulários como
+// horário local da clínica. Horários pulados pelo início do horário de verão são recusados em vez
+// de serem deslocados silenciosamente; no fim do horário de verão, a hora repetida vale a primeira.
+func parseClinicDateTime(dateStr, clock string) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02 15:04", dateStr+" "+clock, storage.ClinicLocation())
+	if err != nil {
+		return t, err
+	}
+	if t.Format("2006-01-02 15:04") != dateStr+" "+clock {
+		return t, errNonexistentLocalTime
+	}
+	return t, nil
+}
+
+// shiftWallClock aplica a 't' a mesma mudança de calendário (dias e horário de parede) que leva
+// 'from' a 'to', no fuso da clínica. Ao contrário de somar uma duração, mantém o horário local das
+// consultas de uma série quando há mudança de horário de verão entre elas.
+func shiftWallClock(t, from, to time.Time) time.Time {
+	loc := storage.ClinicLocation()
+	t, from, to = t.In(loc), from.In(loc), to.In(loc)
+	days := int(civilDate(to).Sub(civilDate(from)).Hours() / 24)
+	clock := wallClock(to) - wallClock(from)
+	return wallTime(t.Year(), t.Month(), t.Day()+days, t.Hour(), t.Minute(), t.Second()+int(clock.Seconds()), loc)
+}
+
+// civilDate devolve a data de parede de 't' em UTC, onde todo dia tem 24 horas.
+func civilDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// wallClock devolve o horário de parede de 't' como duração desde a meia-noite.
+func wallClock(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
+
+// therapistLocation devolve o fuso do terapeuta (atendimentos online de outro fuso) ou o fuso da
+// clínica quando ele não tem um fuso próprio.
+func therapistLocation(db *sql.DB, doctorID int) *time.Location {
+	var name sql.NullString
+	if err := db.QueryRow("SELECT timezone FROM users WHERE id = $1", doctorID).Scan(&name); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Erro ao buscar o fuso do terapeuta %d: %v", doctorID, err)
+		}
+		return storage.ClinicLocation()
+	}
+	return locationOrClinic(name.String)
+}
+
+// locationOrClinic carrega o fuso pelo nome, usando o fuso da clínica se estiver vazio ou inválido.
+func locationOrClinic(name string) *time.Location {
+	if name == "" {
+		return storage.ClinicLocation()
+	}
+	loc, err := storage.LoadTimezone(name)
+	if err != nil {
+		log.Printf("Fuso horário inválido %q: %v", name, err)
+		return storage.ClinicLocation()
+	}
+	return loc
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// Os testes do pacote rodam com a clínica em America/New_York, que tem horário de verão: começa no
+// segundo domingo de março (02:00 → 03:00) e termina no primeiro domingo de novembro (02:00 → 01:00).
+func TestMain(m *testing.M) {
+	os.Setenv("CLINIC_TIMEZONE", "America/New_York")
+	os.Exit(m.Run())
+}
+
+// mustLoad carrega um fuso IANA ou interrompe o teste.
+func mustLoad(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+// utc monta um instante em UTC a partir de "AAAA-MM-DD HH:MM".
+func utc(t *testing.T, value string) time.Time {
+	t.Helper()
+	v, err := time.Parse("2006-01-02 15:04", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestParseClinicDateTimeDST(t *testing.T) {
+	tests := []struct {
+		name        string
+		date, clock string
+		want        string // instante esperado em UTC; vazio quando deve haver erro
+		nonexistent bool
+	}{
+		{"horário de inverno", "2024-01-15", "10:00", "2024-01-15 15:00", false},
+		{"horário de verão", "2024-07-15", "10:00", "2024-07-15 14:00", false},
+		{"último minuto antes do salto", "2024-03-10", "01:59", "2024-03-10 06:59", false},
+		{"horário pulado no início do verão", "2024-03-10", "02:00", "", true},
+		{"meio do horário pulado", "2024-03-10", "02:30", "", true},
+		{"fim do salto", "2024-03-10", "03:00", "2024-03-10 07:00", false},
+		{"hora repetida vale a primeira", "2024-11-03", "01:30", "2024-11-03 05:30", false},
+		{"depois da hora repetida", "2024-11-03", "02:00", "2024-11-03 07:00", false},
+		{"data inválida", "2024-02-30", "10:00", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseClinicDateTime(tt.date, tt.clock)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("esperava erro, recebeu %v", got)
+				}
+				if (err == errNonexistentLocalTime) != tt.nonexistent {
+					t.Fatalf("erro inesperado: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(utc(t, tt.want)) {
+				t.Fatalf("recebeu %v (%v UTC), esperava %s UTC", got, got.UTC(), tt.want)
+			}
+		})
+	}
+}
+
+func TestShiftWallClockDST(t *testing.T) {
+	ny := mustLoad(t, "America/New_York")
+	at := func(value string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", value, ny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		name        string
+		t, from, to string
+		want        string // horário de parede esperado em Nova York
+	}{
+		{"mudança de horário atravessa o fim do verão", "2024-11-05 10:00", "2024-10-29 10:00", "2024-10-29 11:00", "2024-11-05 11:00"},
+		{"mudança de dia atravessa o fim do verão", "2024-11-05 10:00", "2024-10-29 10:00", "2024-10-30 10:00", "2024-11-06 10:00"},
+		{"mudança de uma semana atravessa o início do verão", "2024-03-19 09:00", "2024-03-05 09:00", "2024-03-12 09:00", "2024-03-26 09:00"},
+		{"horário novo cai no salto e avança", "2024-03-10 01:00", "2024-03-03 01:00", "2024-03-03 02:30", "2024-03-10 03:30"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := shiftWallClock(at(tt.t), at(tt.from), at(tt.to)).In(ny)
+			if got.Format("2006-01-02 15:04") != tt.want {
+				t.Fatalf("recebeu %v, esperava %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWallTimeDayWithoutMidnight(t *testing.T) {
+	// Em America/Sao_Paulo até 2019, o horário de verão começava à meia-noite: 04/11/2018 não teve 00:00
+	sp := mustLoad(t, "America/Sao_Paulo")
+	tests := []struct {
+		date string
+		want string
+	}{
+		{"2018-11-04", "2018-11-04 01:00"},
+		{"2018-11-05", "2018-11-05 00:00"},
+		{"2019-02-17", "2019-02-17 00:00"}, // Fim do horário de verão: as 23h do dia 16 se repetem
+	}
+	for _, tt := range tests {
+		d, _ := time.Parse("2006-01-02", tt.date)
+		got := wallTime(d.Year(), d.Month(), d.Day(), 0, 0, 0, sp)
+		if got.Format("2006-01-02 15:04") != tt.want {
+			t.Errorf("%s: recebeu %v, esperava %s", tt.date, got, tt.want)
+		}
+		if got := dateOnly(got.Add(12 * time.Hour)); got.Format("2006-01-02") != tt.date {
+			t.Errorf("dateOnly(%s 12h) = %v", tt.date, got)
+		}
+	}
+}
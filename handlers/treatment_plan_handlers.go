@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"mediflow/storage"
+)
+
+// treatmentPlanPatient confere o acesso do terapeuta ao paciente da URL.
+func (h *TerapeutaHandler) treatmentPlanPatient(c *gin.Context) (int, bool) {
+	therapistID := sessions.Default(c).Get("user_id").(int)
+	patientID, _ := strconv.Atoi(c.Param("id"))
+	if !therapistHasPatient(h.DB, therapistID, patientID) {
+		c.HTML(http.StatusForbidden, "layouts/error.html", gin.H{"Title": "Acesso Negado", "Message": "Você não tem permissão para ver o plano terapêutico deste paciente."})
+		return 0, false
+	}
+	return patientID, true
+}
+
+// ShowTreatmentPlan exibe o plano terapêutico do paciente para revisão: problemas, metas, o
+// progresso de cada meta ao longo das sessões e os planos anteriores.
+func (h *TerapeutaHandler) ShowTreatmentPlan(c *gin.Context) {
+	patientID, ok := h.treatmentPlanPatient(c)
+	if !ok {
+		return
+	}
+	session := sessions.Default(c)
+	errorFlashes := session.Flashes("error")
+	successFlashes := session.Flashes("success")
+	session.Save()
+
+	var patientName string
+	if err := h.DB.QueryRow("SELECT name FROM patients WHERE id = $1", patientID).Scan(&patientName); err != nil {
+		log.Printf("Erro ao buscar paciente %d para o plano terapêutico: %v", patientID, err)
+	}
+	plans, err := loadTreatmentPlans(h.DB, patientID)
+	if err != nil {
+		log.Printf("Erro ao buscar planos terapêuticos do paciente %d: %v", patientID, err)
+	}
+
+	var active *storage.TreatmentPlan
+	if len(plans) > 0 && plans[0].Status == planActive {
+		active, plans = &plans[0], plans[1:]
+	}
+	c.HTML(http.StatusOK, "terapeuta/treatment_plan.html", gin.H{
+		"Title":          "Plano Terapêutico",
+		"ActiveNav":      "dashboard",
+		"PatientID":      patientID,
+		"PatientName":    patientName,
+		"Plan":           active,
+		"PastPlans":      plans,
+		"NewGoal":        storage.TreatmentGoal{},
+		"ErrorFlashes":   errorFlashes,
+		"SuccessFlashes": successFlashes,
+	})
+}
+
+// PostTreatmentPlan cria o plano ativo do paciente ou, se ele já existe, atualiza os problemas, a
+// data de revisão e a situação. Concluir ou encerrar o plano o move para o histórico.
+func (h *TerapeutaHandler) PostTreatmentPlan(c *gin.Context) {
+	patientID, ok := h.treatmentPlanPatient(c)
+	if !ok {
+		return
+	}
+	session := sessions.Default(c)
+	defer session.Save()
+	redirect := fmt.Sprintf("/terapeuta/pacientes/%d/plano", patientID)
+
+	planID, _ := strconv.Atoi(c.PostForm("plan_id"))
+	form, err := treatmentPlanFromForm(c.PostForm, planID == 0)
+	if err != nil {
+		session.AddFlash("Plano não gravado: "+err.Error()+".", "error")
+		c.Redirect(http.StatusFound, redirect)
+		return
+	}
+
+	var action string
+	if planID == 0 {
+		err = h.DB.QueryRow(`INSERT INTO treatment_plans (patient_id, doctor_id, problems, review_date)
+			VALUES ($1, $2, $3, $4) RETURNING id`, patientID, sessionUserID(c), form.Problems, form.ReviewDate).Scan(&planID)
+		if isUniqueViolation(err) {
+			session.AddFlash("O paciente já tem um plano terapêutico ativo.", "error")
+			c.Redirect(http.StatusFound, redirect)
+			return
+		}
+		action = fmt.Sprintf("Criou o plano terapêutico ID %d", planID)
+	} else {
+		var result sql.Result
+		result, err = h.DB.Exec(`UPDATE treatment_plans SET problems = $1, review_date = $2, status = $3, updated_at = NOW()
+			WHERE id = $4 AND patient_id = $5 AND status = $6`,
+			form.Problems, form.ReviewDate, form.Status, planID, patientID, planActive)
+		if err == nil {
+			if n, _ := result.RowsAffected(); n == 0 {
+				err = sql.ErrNoRows
+			}
+		}
+		if err == sql.ErrNoRows {
+			session.AddFlash("Plano terapêutico não encontrado ou já encerrado.", "error")
+			c.Redirect(http.StatusFound, redirect)
+			return
+		}
+		action = fmt.Sprintf("Atualizou o plano terapêutico ID %d (situação: %s)", planID, form.Status)
+	}
+	if err != nil {
+		log.Printf("Erro ao gravar plano terapêutico do paciente %d: %v", patientID, err)
+		session.AddFlash("Não foi possível gravar o plano terapêutico.", "error")
+		c.Redirect(http.StatusFound, redirect)
+		return
+	}
+
+	AddAuditLog(LogAction{
+		DB:         h.DB,
+		Context:    c,
+		Action:     action,
+		TargetType: "Paciente",
+		TargetID:   patientID,
+	})
+	message := "Plano terapêutico gravado."
+	if form.Status != planActive {
+		message = fmt.Sprintf("Plano terapêutico %s. Ele continua disponível no histórico de planos.", strings.ToLower(storage.TreatmentPlan{Status: form.Status}.StatusLabel()))
+	}
+	session.AddFlash(message, "success")
+	c.Redirect(http.StatusFound, redirect)
+}
+
+// PostTreatmentGoal adiciona uma meta ao plano ativo do paciente ou, com goalId na URL, atualiza uma
+// meta existente. Metas não são removidas: para deixar de trabalhar uma meta, ela é suspensa.
+func (h *TerapeutaHandler) PostTreatmentGoal(c *gin.Context) {
+	patientID, ok := h.treatmentPlanPatient(c)
+	if !ok {
+		return
+	}
+	session := sessions.Default(c)
+	defer session.Save()
+	redirect := fmt.Sprintf("/terapeuta/pacientes/%d/plano", patientID)
+
+	goalID, _ := strconv.Atoi(c.Param("goalId"))
+	form, err := treatmentGoalFromForm(c.PostForm, goalID == 0)
+	if err != nil {
+		session.AddFlash("Meta não gravada: "+err.Error()+".", "error")
+		c.Redirect(http.StatusFound, redirect)
+		return
+	}
+
+	var action string
+	if goalID == 0 {
+		err = h.DB.QueryRow(`INSERT INTO treatment_goals (plan_id, description, measure, interventions, target_date)
+			SELECT id, $2, $3, NULLIF($4, ''), $5 FROM treatment_plans WHERE patient_id = $1 AND status = $6
+			RETURNING id`, patientID, form.Description, form.Measure, form.Interventions, form.TargetDate, planActive).Scan(&goalID)
+		action = fmt.Sprintf("Adicionou a meta ID %d ao plano terapêutico", goalID)
+	} else {
+		err = h.DB.QueryRow(`UPDATE treatment_goals g SET description = $1, measure = $2, interventions = NULLIF($3, ''),
+				target_date = $4, status = $5, updated_at = NOW()
+			FROM treatment_plans p
+			WHERE g.id = $6 AND g.plan_id = p.id AND p.patient_id = $7 AND p.status = $8
+			RETURNING g.id`, form.Description, form.Measure, form.Interventions, form.TargetDate, form.Status,
+			goalID, patientID, planActive).Scan(&goalID)
+		action = fmt.Sprintf("Atualizou a meta ID %d do plano terapêutico (situação: %s)", goalID, form.Status)
+	}
+	if err == sql.ErrNoRows {
+		session.AddFlash("Meta não gravada: o paciente não tem plano terapêutico ativo com essa meta.", "error")
+		c.Redirect(http.StatusFound, redirect)
+		return
+	}
+	if err != nil {
+		log.Printf("Erro ao gravar meta do plano terapêutico do paciente %d: %v", patientID, err)
+		session.AddFlash("Não foi possível gravar a meta.", "error")
+		c.Redirect(http.StatusFound, redirect)
+		return
+	}
+
+	AddAuditLog(LogAction{
+		DB:         h.DB,
+		Context:    c,
+		Action:     action,
+		TargetType: "Paciente",
+		TargetID:   patientID,
+	})
+	session.AddFlash("Meta gravada.", "success")
+	c.Redirect(http.StatusFound, redirect)
+}
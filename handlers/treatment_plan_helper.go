@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"mediflow/storage"
+)
+
+// Situações do plano terapêutico e das metas.
+const (
+	planActive    = "ativo"
+	planCompleted = "concluido"
+	planClosed    = "encerrado"
+
+	goalInProgress = "em_andamento"
+	goalAchieved   = "atingida"
+	goalSuspended  = "suspensa"
+)
+
+var (
+	errPlanProblemsEmpty   = errors.New("descreva os problemas trabalhados no plano")
+	errPlanStatusInvalid   = errors.New("situação do plano inválida")
+	errGoalDescription     = errors.New("descreva a meta")
+	errGoalMeasure         = errors.New("informe como a meta será medida")
+	errGoalStatusInvalid   = errors.New("situação da meta inválida")
+	errGoalTargetDate      = errors.New("data-alvo inválida")
+	errPlanReviewDate      = errors.New("data de revisão inválida")
+	errTreatmentTextTooBig = fmt.Errorf("os campos do plano podem ter no máximo %d caracteres", treatmentTextMaxLen)
+)
+
+// treatmentTextMaxLen limita cada campo de texto do plano e das metas.
+const treatmentTextMaxLen = 5000
+
+// goalProgressField é o nome, no formulário do prontuário, do percentual registrado para a meta;
+// goalNoteField, o da observação.
+func goalProgressField(goalID int) string { return fmt.Sprintf("goal_%d_progress", goalID) }
+func goalNoteField(goalID int) string     { return fmt.Sprintf("goal_%d_note", goalID) }
+
+// GoalProgressInput é uma meta do plano ativo no formulário do prontuário, com o que já está no
+// rascunho da sessão. Value vazio quer dizer que a meta não foi trabalhada na sessão.
+type GoalProgressInput struct {
+	storage.TreatmentGoal
+	Field     string
+	NoteField string
+	Value     string
+	Note      string
+}
+
+// treatmentPlanForm são os campos do formulário do plano, já validados.
+type treatmentPlanForm struct {
+	Problems   string
+	Status     string
+	ReviewDate sql.NullTime
+}
+
+// treatmentGoalForm são os campos do formulário de meta, já validados.
+type treatmentGoalForm struct {
+	Description   string
+	Measure       string
+	Interventions string
+	TargetDate    sql.NullTime
+	Status        string
+}
+
+// parseTreatmentDate lê uma data opcional do formulário (AAAA-MM-DD).
+func parseTreatmentDate(value string) (sql.NullTime, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return sql.NullTime{}, true
+	}
+	date, err := parseClinicDate(value)
+	if err != nil {
+		return sql.NullTime{}, false
+	}
+	return sql.NullTime{Time: date, Valid: true}, true
+}
+
+// treatmentPlanFromForm lê o formulário do plano. Um plano novo é sempre criado como ativo.
+func treatmentPlanFromForm(postForm func(string) string, isNew bool) (treatmentPlanForm, error) {
+	form := treatmentPlanForm{Problems: strings.TrimSpace(postForm("problems")), Status: planActive}
+	if !isNew {
+		form.Status = postForm("status")
+	}
+	switch {
+	case form.Problems == "":
+		return form, errPlanProblemsEmpty
+	case len([]rune(form.Problems)) > treatmentTextMaxLen:
+		return form, errTreatmentTextTooBig
+	case form.Status != planActive && form.Status != planCompleted && form.Status != planClosed:
+		return form, errPlanStatusInvalid
+	}
+	var ok bool
+	if form.ReviewDate, ok = parseTreatmentDate(postForm("review_date")); !ok {
+		return form, errPlanReviewDate
+	}
+	return form, nil
+}
+
+// treatmentGoalFromForm lê o formulário de meta. Uma meta nova começa em andamento.
+func treatmentGoalFromForm(postForm func(string) string, isNew bool) (treatmentGoalForm, error) {
+	form := treatmentGoalForm{
+		Description:   strings.TrimSpace(postForm("description")),
+		Measure:       strings.TrimSpace(postForm("measure")),
+		Interventions: strings.TrimSpace(postForm("interventions")),
+		Status:        goalInProgress,
+	}
+	if !isNew {
+		form.Status = postForm("status")
+	}
+	switch {
+	case form.Description == "":
+		return form, errGoalDescription
+	case form.Measure == "":
+		return form, errGoalMeasure
+	case len([]rune(form.Description)) > treatmentTextMaxLen, len([]rune(form.Measure)) > treatmentTextMaxLen,
+		len([]rune(form.Interventions)) > treatmentTextMaxLen:
+		return form, errTreatmentTextTooBig
+	case form.Status != goalInProgress && form.Status != goalAchieved && form.Status != goalSuspended:
+		return form, errGoalStatusInvalid
+	}
+	var ok bool
+	if form.TargetDate, ok = parseTreatmentDate(postForm("target_date")); !ok {
+		return form, errGoalTargetDate
+	}
+	return form, nil
+}
+
+const treatmentPlanSelectSQL = `SELECT p.id, p.patient_id, p.doctor_id, u.name, p.problems, p.status,
+	p.review_date, p.created_at, p.updated_at
+	FROM treatment_plans p
+	JOIN users u ON p.doctor_id = u.id `
+
+// scanTreatmentPlan lê uma linha de treatmentPlanSelectSQL.
+func scanTreatmentPlan(scan func(dest ...interface{}) error) (storage.TreatmentPlan, error) {
+	var plan storage.TreatmentPlan
+	err := scan(&plan.ID, &plan.PatientID, &plan.DoctorID, &plan.DoctorName, &plan.Problems, &plan.Status,
+		&plan.ReviewDate, &plan.CreatedAt, &plan.UpdatedAt)
+	return plan, err
+}
+
+// loadTreatmentPlans lista os planos do paciente, o ativo primeiro e depois os demais do mais recente
+// para o mais antigo, cada um com as metas e o progresso registrado nas sessões.
+func loadTreatmentPlans(db *sql.DB, patientID int) ([]storage.TreatmentPlan, error) {
+	rows, err := db.Query(treatmentPlanSelectSQL+"WHERE p.patient_id = $1 ORDER BY p.status = $2 DESC, p.created_at DESC", patientID, planActive)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plans []storage.TreatmentPlan
+	for rows.Next() {
+		plan, err := scanTreatmentPlan(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, plan)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range plans {
+		if plans[i].Goals, err = loadTreatmentGoals(db, plans[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return plans, nil
+}
+
+// loadActiveTreatmentPlan busca o plano ativo do paciente com as metas. Devolve sql.ErrNoRows se
+// não há plano ativo.
+func loadActiveTreatmentPlan(db *sql.DB, patientID int) (storage.TreatmentPlan, error) {
+	plan, err := scanTreatmentPlan(db.QueryRow(treatmentPlanSelectSQL+"WHERE p.patient_id = $1 AND p.status = $2", patientID, planActive).Scan)
+	if err != nil {
+		return plan, err
+	}
+	plan.Goals, err = loadTreatmentGoals(db, plan.ID)
+	return plan, err
+}
+
+// loadTreatmentGoals busca as metas do plano, na ordem em que foram criadas, com o progresso de
+// cada uma em ordem cronológica.
+func loadTreatmentGoals(db *sql.DB, planID int) ([]storage.TreatmentGoal, error) {
+	rows, err := db.Query(`SELECT id, plan_id, description, measure, COALESCE(interventions, ''), target_date, status
+		FROM treatment_goals WHERE plan_id = $1 ORDER BY id`, planID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var goals []storage.TreatmentGoal
+	index := map[int]int{}
+	for rows.Next() {
+		var g storage.TreatmentGoal
+		if err := rows.Scan(&g.ID, &g.PlanID, &g.Description, &g.Measure, &g.Interventions, &g.TargetDate, &g.Status); err != nil {
+			return nil, err
+		}
+		index[g.ID] = len(goals)
+		goals = append(goals, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(goals) == 0 {
+		return goals, nil
+	}
+
+	progressRows, err := db.Query(`SELECT gp.goal_id, g.description, gp.progress, COALESCE(gp.note, ''), r.id, r.record_date, u.name, r.signed_at IS NOT NULL
+		FROM record_goal_progress gp
+		JOIN treatment_goals g ON gp.goal_id = g.id
+		JOIN patient_records r ON gp.record_id = r.id
+		JOIN users u ON r.doctor_id = u.id
+		WHERE g.plan_id = $1
+		ORDER BY r.record_date, r.id`, planID)
+	if err != nil {
+		return nil, err
+	}
+	defer progressRows.Close()
+
+	loc := storage.ClinicLocation()
+	for progressRows.Next() {
+		var p storage.GoalProgress
+		if err := progressRows.Scan(&p.GoalID, &p.Goal, &p.Progress, &p.Note, &p.RecordID, &p.RecordDate, &p.DoctorName, &p.Signed); err != nil {
+			return nil, err
+		}
+		p.RecordDate = p.RecordDate.In(loc)
+		if i, ok := index[p.GoalID]; ok {
+			goals[i].Progress = append(goals[i].Progress, p)
+		}
+	}
+	return goals, progressRows.Err()
+}
+
+// goalProgressInputs monta as metas em andamento do plano para o formulário do prontuário,
+// preenchidas com o progresso do rascunho (draft), se houver.
+func goalProgressInputs(plan storage.TreatmentPlan, draft []storage.GoalProgress) []GoalProgressInput {
+	saved := map[int]storage.GoalProgress{}
+	for _, p := range draft {
+		saved[p.GoalID] = p
+	}
+	var inputs []GoalProgressInput
+	for _, goal := range plan.Goals {
+		if goal.Status != goalInProgress {
+			continue
+		}
+		input := GoalProgressInput{TreatmentGoal: goal, Field: goalProgressField(goal.ID), NoteField: goalNoteField(goal.ID)}
+		if p, ok := saved[goal.ID]; ok {
+			input.Value, input.Note = strconv.Itoa(p.Progress), p.Note
+		}
+		inputs = append(inputs, input)
+	}
+	return inputs
+}
+
+// goalProgressFromForm lê o progresso das metas em andamento do plano ativo enviado com a entrada do
+// prontuário. Metas sem percentual não foram trabalhadas na sessão e ficam de fora.
+func goalProgressFromForm(db *sql.DB, patientID int, postForm func(string) string) ([]storage.GoalProgress, error) {
+	plan, err := loadActiveTreatmentPlan(db, patientID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var progress []storage.GoalProgress
+	for _, goal := range plan.Goals {
+		if goal.Status != goalInProgress {
+			continue
+		}
+		value, err := strconv.Atoi(postForm(goalProgressField(goal.ID)))
+		if err != nil || value < 0 || value > 100 {
+			continue
+		}
+		note := strings.TrimSpace(postForm(goalNoteField(goal.ID)))
+		progress = append(progress, storage.GoalProgress{GoalID: goal.ID, Goal: goal.Description, Progress: value, Note: note})
+	}
+	return progress, nil
+}
+
+// saveRecordGoalProgress substitui o progresso das metas gravado no rascunho da entrada. O gatilho
+// protect_signed_goal_progress recusa a troca se a entrada já estiver assinada.
+func saveRecordGoalProgress(tx execer, recordID int, progress []storage.GoalProgress) error {
+	if _, err := tx.Exec("DELETE FROM record_goal_progress WHERE record_id = $1", recordID); err != nil {
+		return err
+	}
+	for _, p := range progress {
+		_, err := tx.Exec("INSERT INTO record_goal_progress (record_id, goal_id, progress, note) VALUES ($1, $2, $3, NULLIF($4, ''))",
+			recordID, p.GoalID, p.Progress, p.Note)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// goalProgressText descreve o progresso das metas registrado na entrada, para o resumo por IA.
+func goalProgressText(progress []storage.GoalProgress) string {
+	if len(progress) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("- Progresso nas metas do plano terapêutico:\n")
+	for _, p := range progress {
+		b.WriteString(fmt.Sprintf("    %s: %d%%", p.Goal, p.Progress))
+		if p.Note != "" {
+			b.WriteString(" — " + p.Note)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
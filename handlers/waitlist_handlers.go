@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"mediflow/storage"
+)
+
+// WaitlistHandler gerencia a lista de espera da secretária: cadastro dos pacientes que querem
+// antecipar a consulta e o agendamento, em um clique, dos horários liberados por cancelamentos.
+type WaitlistHandler struct {
+	DB *sql.DB
+}
+
+// ViewWaitlist lista as entradas ativas e as ofertas pendentes.
+func (h *WaitlistHandler) ViewWaitlist(c *gin.Context) {
+	session := sessions.Default(c)
+	errorFlashes := session.Flashes("error")
+	successFlashes := session.Flashes("success")
+	session.Save()
+
+	entries, err := loadWaitlistEntries(h.DB)
+	if err != nil {
+		log.Printf("Erro ao buscar a lista de espera: %v", err)
+		c.HTML(http.StatusInternalServerError, "layouts/error.html", gin.H{"Title": "Erro", "Message": "Não foi possível carregar a lista de espera."})
+		return
+	}
+	offers, err := loadPendingWaitlistOffers(h.DB)
+	if err != nil {
+		log.Printf("Erro ao buscar ofertas da lista de espera: %v", err)
+	}
+
+	c.HTML(http.StatusOK, "secretaria/waitlist.html", gin.H{
+		"Title":            "Lista de Espera",
+		"Entries":          entries,
+		"WaitlistOffers":   offers,
+		"WaitlistReturnTo": "waitlist",
+		"WeekdayNames":     weekdayNames,
+		"PriorityNames":    waitlistPriorityNames,
+		"ActiveNav":        "waitlist",
+		"ErrorFlashes":     errorFlashes,
+		"SuccessFlashes":   successFlashes,
+	})
+}
+
+// PostWaitlistEntry inclui o paciente na lista de espera, com terapeuta e tipo de sessão
+// opcionais e até três janelas de dia/horário.
+func (h *WaitlistHandler) PostWaitlistEntry(c *gin.Context) {
+	session := sessions.Default(c)
+	patientIDStr := c.PostForm("patient_id")
+	profileURL := "/secretaria/patients/profile/" + patientIDStr
+
+	patientID, err := strconv.Atoi(patientIDStr)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/secretaria/patients")
+		return
+	}
+	priority, err := strconv.Atoi(c.DefaultPostForm("priority", "2"))
+	if err != nil || waitlistPriorityNames[priority] == "" {
+		priority = 2
+	}
+	var doctorID, serviceTypeID sql.NullInt64
+	if id, err := strconv.Atoi(c.PostForm("doctor_id")); err == nil && id > 0 {
+		doctorID = sql.NullInt64{Int64: int64(id), Valid: true}
+	}
+	if id, err := strconv.Atoi(c.PostForm("service_type_id")); err == nil && id > 0 {
+		serviceTypeID = sql.NullInt64{Int64: int64(id), Valid: true}
+	}
+
+	windows, err := waitlistWindowsFromForm(c)
+	if err != nil {
+		session.AddFlash(err.Error(), "error")
+		session.Save()
+		c.Redirect(http.StatusFound, profileURL)
+		return
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		log.Printf("Erro ao iniciar transação da lista de espera: %v", err)
+		c.Redirect(http.StatusFound, profileURL)
+		return
+	}
+	defer tx.Rollback()
+
+	var entryID int
+	err = tx.QueryRow(`INSERT INTO waitlist_entries (patient_id, doctor_id, service_type_id, priority, notes)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		patientID, doctorID, serviceTypeID, priority, strings.TrimSpace(c.PostForm("notes"))).Scan(&entryID)
+	if err == nil {
+		for _, w := range windows {
+			if _, err = tx.Exec("INSERT INTO waitlist_windows (entry_id, weekday, start_time, end_time) VALUES ($1, $2, $3, $4)",
+				entryID, w.Weekday, w.StartTime, w.EndTime); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Erro ao incluir paciente %d na lista de espera: %v", patientID, err)
+		session.AddFlash("Não foi possível incluir o paciente na lista de espera.", "error")
+	} else {
+		AddAuditLog(LogAction{
+			DB:         h.DB,
+			Context:    c,
+			Action:     fmt.Sprintf("Incluiu o paciente ID %d na lista de espera (prioridade %s)", patientID, waitlistPriorityNames[priority]),
+			TargetType: "Lista de Espera",
+			TargetID:   entryID,
+		})
+		session.AddFlash("Paciente incluído na lista de espera.", "success")
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, profileURL)
+}
+
+// RemoveWaitlistEntry tira o paciente da lista de espera.
+func (h *WaitlistHandler) RemoveWaitlistEntry(c *gin.Context) {
+	session := sessions.Default(c)
+	idStr := c.Param("id")
+
+	_, err := h.DB.Exec("UPDATE waitlist_entries SET status = 'removido', updated_at = NOW() WHERE id = $1 AND status = 'aguardando'", idStr)
+	if err != nil {
+		log.Printf("Erro ao remover entrada da lista de espera: %v", err)
+		session.AddFlash("Não foi possível remover o paciente da lista de espera.", "error")
+	} else {
+		AddAuditLog(LogAction{
+			DB:         h.DB,
+			Context:    c,
+			Action:     fmt.Sprintf("Removeu a entrada ID %s da lista de espera", idStr),
+			TargetType: "Lista de Espera",
+			TargetID:   safeAtoi(idStr),
+		})
+		session.AddFlash("Paciente removido da lista de espera.", "success")
+	}
+	session.Save()
+	c.Redirect(http.StatusFound, "/secretaria/waitlist")
+}
+
+// BookWaitlistOffer agenda o paciente da oferta no horário liberado. A duração e o preço vêm do
+// tipo de sessão da entrada (ou, sem ele, do tipo da consulta cancelada); as demais ofertas do
+// mesmo horário são descartadas e o paciente sai da lista de espera.
+func (h *WaitlistHandler) BookWaitlistOffer(c *gin.Context) {
+	returnURL := "/secretaria/dashboard"
+	if c.PostForm("return_to") == "waitlist" {
+		returnURL = "/secretaria/waitlist"
+	}
+	if patientID, ok := h.bookOffer(c, safeAtoi(c.Param("id"))); ok {
+		returnURL = "/secretaria/patients/profile/" + strconv.Itoa(patientID)
+	}
+	c.Redirect(http.StatusFound, returnURL)
+}
+
+// bookOffer cria a consulta da oferta e devolve o paciente agendado. As mensagens para o
+// usuário ficam na sessão.
+func (h *WaitlistHandler) bookOffer(c *gin.Context, offerID int) (int, bool) {
+	session := sessions.Default(c)
+	defer session.Save()
+
+	var entryID, patientID, doctorID, freedAppointmentID int
+	var start, end time.Time
+	var serviceTypeID sql.NullInt64
+	err := h.DB.QueryRow(`
+		SELECT o.entry_id, w.patient_id, o.doctor_id, o.freed_appointment_id, o.start_time, o.end_time,
+		       COALESCE(w.service_type_id, a.service_type_id)
+		FROM waitlist_offers o
+		JOIN waitlist_entries w ON o.entry_id = w.id
+		JOIN appointments a ON o.freed_appointment_id = a.id
+		WHERE o.id = $1 AND o.status = 'pendente' AND w.status = 'aguardando'`, offerID).
+		Scan(&entryID, &patientID, &doctorID, &freedAppointmentID, &start, &end, &serviceTypeID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Erro ao buscar oferta %d da lista de espera: %v", offerID, err)
+		}
+		session.AddFlash("Esta oferta não está mais disponível.", "error")
+		return 0, false
+	}
+
+	duration := end.Sub(start)
+	price := 0.0
+	if serviceTypeID.Valid {
+		st, therapistPrice, err := resolveServiceType(h.DB, int(serviceTypeID.Int64), doctorID)
+		if err != nil {
+			log.Printf("Erro ao carregar tipo de sessão da oferta %d: %v", offerID, err)
+			session.AddFlash("Tipo de sessão inválido.", "error")
+			return 0, false
+		}
+		duration = time.Duration(st.DurationMinutes) * time.Minute
+		price = therapistPrice
+	}
+	end = start.Add(duration)
+
+	message, err := validateAppointmentSlot(h.DB, doctorID, patientID, start, end)
+	if err != nil {
+		log.Printf("Erro ao validar horário da oferta %d: %v", offerID, err)
+	} else if message != "" {
+		session.AddFlash(message, "error")
+		return 0, false
+	}
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		log.Printf("Erro ao iniciar transação da oferta %d: %v", offerID, err)
+		return 0, false
+	}
+	defer tx.Rollback()
+
+	appointmentID, err := insertAppointment(tx, NewAppointment{
+		PatientID:     patientID,
+		DoctorID:      doctorID,
+		Start:         start,
+		Duration:      duration,
+		Status:        "agendado",
+		ServiceTypeID: serviceTypeID,
+		Price:         price,
+	})
+	if err == nil {
+		_, err = tx.Exec("UPDATE waitlist_offers SET status = 'aceita' WHERE id = $1", offerID)
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE waitlist_offers SET status = 'descartada' WHERE status = 'pendente' AND (freed_appointment_id = $1 OR entry_id = $2)",
+			freedAppointmentID, entryID)
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE waitlist_entries SET status = 'atendido', updated_at = NOW() WHERE id = $1", entryID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Erro ao agendar a oferta %d da lista de espera: %v", offerID, err)
+		if isOverlapViolation(err) {
+			session.AddFlash(overlapViolationMessage, "error")
+		} else {
+			session.AddFlash("Não foi possível agendar a consulta.", "error")
+		}
+		return 0, false
+	}
+
+	AddAuditLog(LogAction{
+		DB:         h.DB,
+		Context:    c,
+		Action:     fmt.Sprintf("Agendou pela lista de espera a consulta ID %d (horário liberado pela consulta ID %d)", appointmentID, freedAppointmentID),
+		TargetType: "Consulta",
+		TargetID:   appointmentID,
+	})
+	session.AddFlash(fmt.Sprintf("Consulta agendada para %s. Verifique se o paciente tem outra consulta a desmarcar.", start.Format("02/01/2006 às 15:04")), "success")
+	return patientID, true
+}
+
+// DismissWaitlistOffer descarta uma oferta (por exemplo, o paciente recusou o horário). O paciente
+// continua na lista de espera.
+func (h *WaitlistHandler) DismissWaitlistOffer(c *gin.Context) {
+	session := sessions.Default(c)
+	idStr := c.Param("id")
+
+	if _, err := h.DB.Exec("UPDATE waitlist_offers SET status = 'descartada' WHERE id = $1 AND status = 'pendente'", idStr); err != nil {
+		log.Printf("Erro ao descartar oferta da lista de espera: %v", err)
+		session.AddFlash("Não foi possível descartar a oferta.", "error")
+	}
+	session.Save()
+	if c.Query("return_to") == "waitlist" {
+		c.Redirect(http.StatusFound, "/secretaria/waitlist")
+		return
+	}
+	c.Redirect(http.StatusFound, "/secretaria/dashboard")
+}
+
+// waitlistWindowsFromForm lê as janelas de dia/horário (campos repetidos window_weekday,
+// window_start e window_end). Linhas sem dia escolhido são ignoradas.
+func waitlistWindowsFromForm(c *gin.Context) ([]storage.WaitlistWindow, error) {
+	weekdays := c.PostFormArray("window_weekday")
+	starts := c.PostFormArray("window_start")
+	ends := c.PostFormArray("window_end")
+
+	var windows []storage.WaitlistWindow
+	for i, weekdayStr := range weekdays {
+		weekday, err := strconv.Atoi(weekdayStr)
+		if err != nil {
+			continue
+		}
+		w := storage.WaitlistWindow{Weekday: weekday, StartTime: "00:00", EndTime: "23:59"}
+		if i < len(starts) && starts[i] != "" {
+			w.StartTime = starts[i]
+		}
+		if i < len(ends) && ends[i] != "" {
+			w.EndTime = ends[i]
+		}
+		if weekday < 0 || weekday > 6 || !validClock(w.StartTime) || !validClock(w.EndTime) || w.EndTime <= w.StartTime {
+			return nil, errors.New("Janela de horário inválida: o horário final deve ser depois do inicial.")
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"mediflow/storage"
+)
+
+// waitlistPriorityNames traduz a prioridade da lista de espera para exibição.
+var waitlistPriorityNames = map[int]string{1: "Alta", 2: "Normal", 3: "Baixa"}
+
+// offerFreedSlot procura, na lista de espera, pacientes compatíveis com o horário liberado pelo
+// cancelamento da consulta e registra uma oferta para cada um. Só horários futuros são ofertados.
+// Compatível significa: mesmo terapeuta (ou "qualquer um"), uma janela de dia/horário que contenha
+// o horário inteiro (ou nenhuma janela cadastrada) e nenhuma outra consulta do paciente no período.
+// Devolve o número de ofertas criadas.
+func offerFreedSlot(db *sql.DB, appointmentID int) (int, error) {
+	var doctorID, patientID int
+	var start, end time.Time
+	err := db.QueryRow("SELECT doctor_id, patient_id, start_time, end_time FROM appointments WHERE id = $1", appointmentID).
+		Scan(&doctorID, &patientID, &start, &end)
+	if err != nil {
+		return 0, err
+	}
+	if !start.After(time.Now()) {
+		return 0, nil
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO waitlist_offers (entry_id, freed_appointment_id, doctor_id, start_time, end_time)
+		SELECT w.id, $1, $2, $4, $5
+		FROM waitlist_entries w
+		WHERE w.status = 'aguardando'
+		  AND (w.doctor_id IS NULL OR w.doctor_id = $2)
+		  AND w.patient_id <> $3
+		  AND (NOT EXISTS (SELECT 1 FROM waitlist_windows ww WHERE ww.entry_id = w.id)
+		       OR EXISTS (SELECT 1 FROM waitlist_windows ww
+		                  WHERE ww.entry_id = w.id AND ww.weekday = $6
+		                    AND ww.start_time <= $7::time AND ww.end_time >= $8::time))
+		  AND NOT EXISTS (SELECT 1 FROM appointments a
+		                  WHERE a.patient_id = w.patient_id
+		                    AND a.status NOT IN ('cancelado', 'cancelado_tardio')
+		                    AND a.start_time < $5 AND a.end_time > $4)
+		ON CONFLICT (entry_id, freed_appointment_id) DO NOTHING`,
+		appointmentID, doctorID, patientID, start, end,
+		int(start.Weekday()), start.Format("15:04"), end.Format("15:04"))
+	if err != nil {
+		return 0, err
+	}
+	created, _ := result.RowsAffected()
+	if created > 0 {
+		log.Printf("Lista de espera: %d oferta(s) criada(s) para o horário liberado pela consulta ID %d", created, appointmentID)
+	}
+	return int(created), nil
+}
+
+// notifyWaitlist chama offerFreedSlot registrando falhas no log; o cancelamento já foi gravado
+// e não deve ser desfeito por um erro na lista de espera.
+func notifyWaitlist(db *sql.DB, appointmentIDs ...int) int {
+	total := 0
+	for _, id := range appointmentIDs {
+		created, err := offerFreedSlot(db, id)
+		if err != nil {
+			log.Printf("Erro ao procurar a lista de espera para a consulta ID %d: %v", id, err)
+			continue
+		}
+		total += created
+	}
+	return total
+}
+
+// loadPendingWaitlistOffers lista as ofertas pendentes cujo horário ainda é futuro e continua
+// livre para o terapeuta, da maior para a menor prioridade.
+func loadPendingWaitlistOffers(db *sql.DB) ([]storage.WaitlistOffer, error) {
+	rows, err := db.Query(`
+		SELECT o.id, o.entry_id, w.patient_id, p.name, o.doctor_id, u.name, o.start_time, o.end_time, w.priority, o.status
+		FROM waitlist_offers o
+		JOIN waitlist_entries w ON o.entry_id = w.id
+		JOIN patients p ON w.patient_id = p.id
+		JOIN users u ON o.doctor_id = u.id
+		WHERE o.status = 'pendente' AND w.status = 'aguardando' AND o.start_time > NOW()
+		  AND NOT EXISTS (SELECT 1 FROM appointments a
+		                  WHERE a.doctor_id = o.doctor_id
+		                    AND a.status NOT IN ('cancelado', 'cancelado_tardio')
+		                    AND a.start_time < o.end_time AND a.end_time > o.start_time)
+		ORDER BY o.start_time ASC, w.priority ASC, w.created_at ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var offers []storage.WaitlistOffer
+	for rows.Next() {
+		var o storage.WaitlistOffer
+		if err := rows.Scan(&o.ID, &o.EntryID, &o.PatientID, &o.PatientName, &o.DoctorID, &o.DoctorName, &o.StartTime, &o.EndTime, &o.Priority, &o.Status); err != nil {
+			return nil, err
+		}
+		offers = append(offers, o)
+	}
+	return offers, rows.Err()
+}
+
+// loadWaitlistEntries lista as entradas ativas da lista de espera com suas janelas de horário.
+func loadWaitlistEntries(db *sql.DB) ([]storage.WaitlistEntry, error) {
+	rows, err := db.Query(`
+		SELECT w.id, w.patient_id, p.name, w.doctor_id, COALESCE(u.name, ''), w.service_type_id, COALESCE(st.name, ''),
+		       w.priority, COALESCE(w.notes, ''), w.status, w.created_at
+		FROM waitlist_entries w
+		JOIN patients p ON w.patient_id = p.id
+		LEFT JOIN users u ON w.doctor_id = u.id
+		LEFT JOIN service_types st ON w.service_type_id = st.id
+		WHERE w.status = 'aguardando'
+		ORDER BY w.priority ASC, w.created_at ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []storage.WaitlistEntry
+	index := make(map[int]int)
+	for rows.Next() {
+		var e storage.WaitlistEntry
+		if err := rows.Scan(&e.ID, &e.PatientID, &e.PatientName, &e.DoctorID, &e.DoctorName, &e.ServiceTypeID, &e.ServiceName,
+			&e.Priority, &e.Notes, &e.Status, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		index[e.ID] = len(entries)
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	windowRows, err := db.Query(`
+		SELECT ww.entry_id, ww.weekday, to_char(ww.start_time, 'HH24:MI'), to_char(ww.end_time, 'HH24:MI')
+		FROM waitlist_windows ww
+		JOIN waitlist_entries w ON ww.entry_id = w.id
+		WHERE w.status = 'aguardando'
+		ORDER BY ww.weekday, ww.start_time`)
+	if err != nil {
+		return nil, err
+	}
+	defer windowRows.Close()
+	for windowRows.Next() {
+		var entryID int
+		var window storage.WaitlistWindow
+		if err := windowRows.Scan(&entryID, &window.Weekday, &window.StartTime, &window.EndTime); err != nil {
+			return nil, err
+		}
+		if i, ok := index[entryID]; ok {
+			entries[i].Windows = append(entries[i].Windows, window)
+		}
+	}
+	return entries, windowRows.Err()
+}
+
+// waitlistOffersMessage avisa quantos pacientes da lista de espera podem ocupar o horário liberado.
+func waitlistOffersMessage(offers int) string {
+	if offers == 1 {
+		return "1 paciente da lista de espera pode ocupar o horário liberado. Veja as ofertas na agenda."
+	}
+	return fmt.Sprintf("%d pacientes da lista de espera podem ocupar o horário liberado. Veja as ofertas na agenda.", offers)
+}
+
+// patientWaitlistEntries devolve as entradas ativas do paciente na lista de espera.
+func patientWaitlistEntries(db *sql.DB, patientID int) ([]storage.WaitlistEntry, error) {
+	entries, err := loadWaitlistEntries(db)
+	if err != nil {
+		return nil, err
+	}
+	var mine []storage.WaitlistEntry
+	for _, e := range entries {
+		if e.PatientID == patientID {
+			mine = append(mine, e)
+		}
+	}
+	return mine, nil
+}
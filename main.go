@@ -1,19 +1,26 @@
 package main
 
 import (
+	"context"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/render"
 	"github.com/joho/godotenv"
+	"mediflow/attachments"
 	"mediflow/handlers"
+	"mediflow/notifications"
 	"mediflow/storage"
 	"mediflow/services"
 )
@@ -113,6 +120,18 @@ func RoleRequired(requiredRole string) gin.HandlerFunc {
 	}
 }
 
+// trustedProxiesFromEnv lê TRUSTED_PROXIES: IPs ou faixas CIDR, separados por vírgula, dos proxies
+// reversos cujo X-Forwarded-For é aceito. Vazio (padrão) não confia em nenhum proxy.
+func trustedProxiesFromEnv() []string {
+	var proxies []string
+	for _, value := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			proxies = append(proxies, value)
+		}
+	}
+	return proxies
+}
+
 func main() {
 	if err := godotenv.Load(); err != nil {
 		log.Fatalf("Erro ao carregar o arquivo .env: %v", err)
@@ -152,10 +171,27 @@ func main() {
 	patientHandler := &handlers.PatientHandler{DB: db}
 	adminHandler := &handlers.AdminHandler{DB: db, AIService: aiService}
 	secretariaHandler := &handlers.SecretariaHandler{DB: db}
-    portalHandler := &handlers.PortalHandler{DB: db} // Adicionar novo handler
+	notifiers := notifications.NotifiersFromEnv()
+	portalHandler := handlers.NewPortalHandler(db, notifiers)
+	attachmentStore, err := attachments.StoreFromEnv()
+	if err != nil {
+		log.Fatalf("Falha ao preparar o armazenamento de anexos: %v", err)
+	}
+	attachmentHandler := handlers.NewAttachmentHandler(db, attachmentStore, attachments.ScannerFromEnv(), attachments.MaxSizeFromEnv())
     terapeutaHandler := &handlers.TerapeutaHandler{DB: db, AIService: aiService}
+	availabilityHandler := &handlers.AvailabilityHandler{DB: db}
+	serviceTypeHandler := &handlers.ServiceTypeHandler{DB: db}
+	noteTemplateHandler := &handlers.NoteTemplateHandler{DB: db}
+	consentTermHandler := &handlers.ConsentTermHandler{DB: db}
+	calendarHandler := &handlers.CalendarHandler{DB: db}
+	waitlistHandler := &handlers.WaitlistHandler{DB: db}
+	bookingHandler := handlers.NewBookingHandler(db)
 	
 	router := gin.Default()
+	// Sem proxies confiáveis, c.ClientIP() é o endereço da conexão e o X-Forwarded-For do cliente é ignorado
+	if err := router.SetTrustedProxies(trustedProxiesFromEnv()); err != nil {
+		log.Fatalf("TRUSTED_PROXIES inválido: %v", err)
+	}
 	router.HTMLRender = newMultiTemplateRenderer("templates")
 	store := cookie.NewStore([]byte("nova-chave-secreta-agosto-2025"))
 	store.Options(sessions.Options{Path: "/", HttpOnly: true, MaxAge: 86400 * 7})
@@ -167,13 +203,22 @@ func main() {
 	router.GET("/login", authHandler.GetLogin)
 	router.POST("/login", authHandler.PostLogin)
 	router.GET("/logout", authHandler.Logout)
+	router.GET("/calendar/:token", calendarHandler.TherapistFeed) // Feed iCalendar, autenticado pelo token secreto
+	router.GET("/agendar", bookingHandler.ShowBookingPage) // Agendamento online (pacientes e interessados)
+	router.POST("/agendar", bookingHandler.PostBooking)
 
 	portal := router.Group("/portal")
     {
         portal.GET("/login", portalHandler.ShowTokenLoginPage)
         portal.GET("/login/:token", portalHandler.ShowTokenLoginPage)
         portal.POST("/login", portalHandler.ProcessTokenLogin)
+        portal.POST("/entrar", portalHandler.RequestPortalCode)
+        portal.GET("/entrar/codigo", portalHandler.ShowPortalCodeForm)
+        portal.POST("/entrar/codigo", portalHandler.PostPortalCode)
+        portal.GET("/entrar/link/:token", portalHandler.ShowPortalMagicLink)
+        portal.POST("/entrar/link", portalHandler.PostPortalMagicLink)
         portal.GET("/success", portalHandler.ShowSuccessPage)
+        portal.GET("/logout", portalHandler.PortalLogout)
     }
 
 	
@@ -182,25 +227,60 @@ func main() {
 	{
 		portalProtected.GET("/consent", portalHandler.ShowConsentForm)
 		portalProtected.POST("/consent", portalHandler.ProcessConsentForm)
+		portalProtected.POST("/consent/revoke", portalHandler.RevokeConsent)
+		portalProtected.GET("/consent/receipt/:id", portalHandler.DownloadConsentReceipt)
+	}
+	// O restante do portal exige o aceite vigente do termo de consentimento
+	portalConsented := router.Group("/portal", handlers.AuthPatientRequired(), handlers.ConsentRequired(db))
+	{
+		portalConsented.GET("/appointments", portalHandler.ShowPortalAppointments)
+		portalConsented.POST("/appointments/:id/cancel", portalHandler.CancelPortalAppointment)
+		portalConsented.GET("/appointments/:id/reschedule", portalHandler.ShowPortalReschedule)
+		portalConsented.POST("/appointments/:id/reschedule", portalHandler.PostPortalReschedule)
+		portalConsented.GET("/appointments/:id/checkin", portalHandler.ShowPortalCheckin)
+		portalConsented.POST("/appointments/:id/checkin", portalHandler.PostPortalCheckin)
+		portalConsented.GET("/escalas", portalHandler.ShowPortalQuestionnaires)
+		portalConsented.GET("/escalas/:id", portalHandler.ShowPortalQuestionnaire)
+		portalConsented.POST("/escalas/:id", portalHandler.PostPortalQuestionnaire)
+		portalConsented.GET("/anamnese", portalHandler.ShowPortalIntake)
+		portalConsented.GET("/anamnese/etapa/:step", portalHandler.ShowPortalIntakeStep)
+		portalConsented.POST("/anamnese/etapa/:step", portalHandler.PostPortalIntakeStep)
+		portalConsented.GET("/anamnese/revisao", portalHandler.ShowPortalIntakeReview)
+		portalConsented.POST("/anamnese/enviar", portalHandler.SubmitPortalIntake)
 	}
 
 	// Grupos de Rotas Protegidas
 	secretariaGroup := router.Group("/secretaria", AuthRequired(), RoleRequired("secretaria"))
 	{
 		secretariaGroup.GET("/dashboard", secretariaHandler.ViewAgenda)
+		secretariaGroup.GET("/agenda.ics", calendarHandler.ExportWeek)
+		secretariaGroup.GET("/agenda.json", handlers.AgendaJSON(db))
 
 		secretariaGroup.GET("/pacientes/novo", patientHandler.GetNewPatientForm)
 		secretariaGroup.POST("/pacientes/novo", patientHandler.CreatePatient)
 
 		secretariaGroup.GET("/patients", secretariaHandler.ViewPatients)
 		secretariaGroup.GET("/patients/profile/:id", secretariaHandler.GetPatientProfile)
+		secretariaGroup.GET("/patients/:id/consents/:consentId/receipt", consentTermHandler.DownloadPatientConsentReceipt)
 		secretariaGroup.POST("/appointments/new", secretariaHandler.PostNewAppointment)
 		secretariaGroup.GET("/appointments/cancel/:id", secretariaHandler.CancelAppointment)
+		secretariaGroup.GET("/appointments/no-show/:id", secretariaHandler.MarkNoShow)
+		secretariaGroup.GET("/appointments/confirm/:id", secretariaHandler.ConfirmAppointment)
 		secretariaGroup.GET("/patients/search", secretariaHandler.SearchPatientsAPI)
 		secretariaGroup.GET("/appointments/edit/:id", secretariaHandler.GetEditAppointmentForm)
 		secretariaGroup.POST("/appointments/edit/:id", secretariaHandler.PostEditAppointment)
         secretariaGroup.GET("/pacientes/token/:id", secretariaHandler.ShowPatientToken)
+		secretariaGroup.POST("/pacientes/token/:id", secretariaHandler.PostPatientToken)
+		secretariaGroup.POST("/pacientes/token/:id/revoke/:tokenId", secretariaHandler.RevokePatientToken)
 		secretariaGroup.GET("/appointments/mark-as-paid/:id", secretariaHandler.MarkAppointmentAsPaid)		
+		secretariaGroup.GET("/availability/slots", availabilityHandler.FreeSlotsAPI)
+		secretariaGroup.GET("/waitlist", waitlistHandler.ViewWaitlist)
+		secretariaGroup.POST("/waitlist/new", waitlistHandler.PostWaitlistEntry)
+		secretariaGroup.GET("/waitlist/remove/:id", waitlistHandler.RemoveWaitlistEntry)
+		secretariaGroup.POST("/waitlist/offers/:id/book", waitlistHandler.BookWaitlistOffer)
+		secretariaGroup.GET("/waitlist/offers/:id/dismiss", waitlistHandler.DismissWaitlistOffer)
+		secretariaGroup.POST("/bookings/:id/confirm", bookingHandler.ConfirmBookingRequest)
+		secretariaGroup.POST("/bookings/:id/reject", bookingHandler.RejectBookingRequest)
 	}
 
 	terapeutaGroup := router.Group("/terapeuta", AuthRequired(), RoleRequired("terapeuta"))
@@ -208,37 +288,85 @@ func main() {
         terapeutaGroup.GET("/dashboard", terapeutaHandler.TerapeutaDashboard)
 		terapeutaGroup.GET("/pacientes/prontuario/:id", terapeutaHandler.ShowPatientRecord)
 		terapeutaGroup.POST("/pacientes/prontuario/:id", terapeutaHandler.ProcessPatientRecord)
+		terapeutaGroup.POST("/pacientes/prontuario/:id/adendos/:recordId", terapeutaHandler.PostRecordAddendum)
+		terapeutaGroup.POST("/pacientes/prontuario/:id/anexos", attachmentHandler.UploadAttachment)
+		terapeutaGroup.GET("/pacientes/prontuario/:id/anexos/:attachmentId", attachmentHandler.DownloadAttachment)
+		terapeutaGroup.POST("/pacientes/prontuario/:id/anexos/:attachmentId/excluir", attachmentHandler.DeleteAttachment)
 		terapeutaGroup.GET("/pacientes/search", terapeutaHandler.SearchMyPatientsAPI)
+		terapeutaGroup.GET("/pacientes/:id/anamnese", terapeutaHandler.ShowIntakeReview)
+		terapeutaGroup.GET("/pacientes/:id/escalas/:code", terapeutaHandler.ShowSessionQuestionnaire)
+		terapeutaGroup.POST("/pacientes/:id/escalas/:code", terapeutaHandler.PostSessionQuestionnaire)
+		terapeutaGroup.POST("/pacientes/:id/escalas/:code/enviar", terapeutaHandler.SendQuestionnaireToPatient)
+		terapeutaGroup.GET("/pacientes/:id/plano", terapeutaHandler.ShowTreatmentPlan)
+		terapeutaGroup.POST("/pacientes/:id/plano", terapeutaHandler.PostTreatmentPlan)
+		terapeutaGroup.POST("/pacientes/:id/plano/metas", terapeutaHandler.PostTreatmentGoal)
+		terapeutaGroup.POST("/pacientes/:id/plano/metas/:goalId", terapeutaHandler.PostTreatmentGoal)
+		terapeutaGroup.POST("/pacientes/:id/anamnese/aprovar", terapeutaHandler.ApproveIntake)
+		terapeutaGroup.POST("/pacientes/:id/anamnese/devolver", terapeutaHandler.ReturnIntake)
 		terapeutaGroup.GET("/pacientes/:id/ai-summary", terapeutaHandler.GetAISummary) // <-- ADICIONE ESTA LINHA
+		terapeutaGroup.GET("/pacientes/:id/emotional-levels", terapeutaHandler.GetEmotionalLevels)
+		terapeutaGroup.POST("/calendar/feed", calendarHandler.PostCalendarFeed)
+		terapeutaGroup.POST("/calendar/feed/revoke", calendarHandler.RevokeCalendarFeed)
 	}
 
 	adminGroup := router.Group("/admin", AuthRequired(), RoleRequired("admin"))
 	{
 		adminGroup.GET("/dashboard", handlers.AdminDashboard)
 		adminGroup.GET("/agenda", adminHandler.ViewAgenda) // NOVA ROTA
+		adminGroup.GET("/agenda.ics", calendarHandler.ExportWeek)
+		adminGroup.GET("/agenda.json", handlers.AgendaJSON(db))
 		adminGroup.GET("/users", adminHandler.ViewUsers)
 		adminGroup.GET("/users/new", adminHandler.GetNewUserForm)
 		adminGroup.POST("/users/new", adminHandler.PostNewUser)
 		adminGroup.GET("/users/edit/:id", adminHandler.GetEditUserForm)
 		adminGroup.POST("/users/edit/:id", adminHandler.PostEditUser)
 		adminGroup.GET("/users/delete/:id", adminHandler.DeleteUser)
+		adminGroup.GET("/users/availability/:id", availabilityHandler.ShowAvailability)
+		adminGroup.POST("/users/availability/:id/blocks", availabilityHandler.PostAvailabilityBlock)
+		adminGroup.GET("/users/availability/:id/blocks/delete/:blockId", availabilityHandler.DeleteAvailabilityBlock)
+		adminGroup.POST("/users/availability/:id/exceptions", availabilityHandler.PostAvailabilityException)
+		adminGroup.POST("/users/availability/:id/timezone", availabilityHandler.PostTherapistTimezone)
+		adminGroup.GET("/users/availability/:id/exceptions/delete/:exceptionId", availabilityHandler.DeleteAvailabilityException)
+		adminGroup.GET("/availability/slots", availabilityHandler.FreeSlotsAPI)
+		adminGroup.GET("/service-types", serviceTypeHandler.ViewServiceTypes)
+		adminGroup.POST("/service-types/new", serviceTypeHandler.PostNewServiceType)
+		adminGroup.GET("/service-types/edit/:id", serviceTypeHandler.GetEditServiceTypeForm)
+		adminGroup.POST("/service-types/edit/:id", serviceTypeHandler.PostEditServiceType)
+		adminGroup.GET("/service-types/toggle/:id", serviceTypeHandler.ToggleServiceType)
+		adminGroup.POST("/service-types/:id/prices", serviceTypeHandler.PostTherapistPrice)
+		adminGroup.GET("/service-types/:id/prices/delete/:doctorId", serviceTypeHandler.DeleteTherapistPrice)
+		adminGroup.GET("/note-templates", noteTemplateHandler.ViewNoteTemplates)
+		adminGroup.POST("/note-templates/new", noteTemplateHandler.PostNoteTemplate)
+		adminGroup.GET("/note-templates/edit/:id", noteTemplateHandler.GetEditNoteTemplateForm)
+		adminGroup.POST("/note-templates/edit/:id", noteTemplateHandler.PostEditNoteTemplate)
+		adminGroup.GET("/note-templates/toggle/:id", noteTemplateHandler.ToggleNoteTemplate)
+		adminGroup.GET("/consent-terms", consentTermHandler.ViewConsentTerms)
+		adminGroup.POST("/consent-terms/new", consentTermHandler.PostConsentTerm)
 		adminGroup.GET("/patients", adminHandler.ViewPatients)
 		adminGroup.GET("/patients/new", adminHandler.GetNewPatientForm)
 		adminGroup.POST("/patients/new", adminHandler.PostNewPatient)
 		adminGroup.GET("/patients/edit/:id", adminHandler.GetEditPatientForm)
 		adminGroup.POST("/patients/edit/:id", adminHandler.PostEditPatient)
+		adminGroup.POST("/patients/edit/:id/adendos/:recordId", adminHandler.PostRecordAddendum)
+		adminGroup.POST("/patients/edit/:id/anexos", attachmentHandler.UploadAttachment)
+		adminGroup.GET("/patients/edit/:id/anexos/:attachmentId", attachmentHandler.DownloadAttachment)
+		adminGroup.POST("/patients/edit/:id/anexos/:attachmentId/excluir", attachmentHandler.DeleteAttachment)
 		adminGroup.GET("/patients/delete/:id", adminHandler.DeletePatient)
 		adminGroup.GET("/patients/search", adminHandler.SearchPatientsAPI)
 		adminGroup.GET("/patients/profile/:id", adminHandler.GetPatientProfile)
+		adminGroup.GET("/patients/:id/consents/:consentId/receipt", consentTermHandler.DownloadPatientConsentReceipt)
 		adminGroup.POST("/appointments/new", adminHandler.PostNewAppointment)
 		adminGroup.GET("/monitoring", adminHandler.SystemMonitoring)
 
 		adminGroup.GET("/appointments/edit/:id", adminHandler.GetEditAppointmentForm)
 		adminGroup.POST("/appointments/edit/:id", adminHandler.PostEditAppointment)
 		adminGroup.GET("/appointments/cancel/:id", adminHandler.CancelAppointment)
+		adminGroup.GET("/appointments/no-show/:id", adminHandler.MarkNoShow)
+		adminGroup.GET("/appointments/confirm/:id", adminHandler.ConfirmAppointment)
 		adminGroup.GET("/appointments/mark-as-paid/:id", adminHandler.MarkAppointmentAsPaid)
 	    adminGroup.GET("/audit-logs", adminHandler.ViewAuditLogs)
 		adminGroup.GET("/pacientes/:id/ai-summary", adminHandler.GetAISummary) // <-- ADICIONE ESTA LINHA
+		adminGroup.GET("/pacientes/:id/emotional-levels", adminHandler.GetEmotionalLevels)
 
 	}
 
@@ -250,8 +378,40 @@ func main() {
 	if port == "" {
 		port = "8080"
 	}
-	log.Printf("Servidor iniciado em http://localhost:%s", port)
-	if err := router.Run("0.0.0.0:" + port); err != nil {
-		log.Fatalf("Erro ao iniciar o servidor: %v", err)
+
+	// Contexto cancelado em Ctrl+C / SIGTERM: encerra o servidor e as tarefas em segundo plano
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var jobs sync.WaitGroup
+	statusJob := handlers.NewAppointmentStatusJob(db)
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		statusJob.Run(ctx)
+	}()
+	reminders := notifications.NewReminderScheduler(db, notifiers)
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		reminders.Run(ctx)
+	}()
+
+	srv := &http.Server{Addr: "0.0.0.0:" + port, Handler: router}
+	go func() {
+		log.Printf("Servidor iniciado em http://localhost:%s", port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Erro ao iniciar o servidor: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Encerrando o servidor...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Erro ao encerrar o servidor: %v", err)
 	}
+	jobs.Wait()
+	log.Println("Servidor encerrado.")
 }
@@ -0,0 +1,49 @@
+package notifications
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// NotifiersFromEnv monta os canais listados em NOTIFICATION_CHANNELS (separados por vírgula;
+// padrão "log"). Canais sem a configuração necessária são ignorados com um aviso no log.
+//
+//	email     SMTP_HOST, SMTP_PORT (padrão 587), SMTP_USERNAME, SMTP_PASSWORD, SMTP_FROM
+//	sms       SMS_GATEWAY_URL, SMS_GATEWAY_TOKEN
+//	whatsapp  WHATSAPP_GATEWAY_URL, WHATSAPP_GATEWAY_TOKEN
+//	log       NOTIFICATION_LOG_FILE (vazio = log do servidor)
+func NotifiersFromEnv() []Notifier {
+	channels := os.Getenv("NOTIFICATION_CHANNELS")
+	if channels == "" {
+		channels = ChannelLog
+	}
+
+	var notifiers []Notifier
+	for _, channel := range strings.Split(channels, ",") {
+		switch channel = strings.TrimSpace(strings.ToLower(channel)); channel {
+		case "":
+		case ChannelEmail:
+			host := os.Getenv("SMTP_HOST")
+			if host == "" {
+				log.Println("AVISO: canal 'email' selecionado, mas SMTP_HOST não foi encontrado no .env.")
+				continue
+			}
+			notifiers = append(notifiers, NewSMTPNotifier(host, os.Getenv("SMTP_PORT"),
+				os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), os.Getenv("SMTP_FROM")))
+		case ChannelSMS, ChannelWhatsApp:
+			prefix := strings.ToUpper(channel)
+			url := os.Getenv(prefix + "_GATEWAY_URL")
+			if url == "" {
+				log.Printf("AVISO: canal '%s' selecionado, mas %s_GATEWAY_URL não foi encontrado no .env.", channel, prefix)
+				continue
+			}
+			notifiers = append(notifiers, NewGatewayNotifier(channel, url, os.Getenv(prefix+"_GATEWAY_TOKEN")))
+		case ChannelLog:
+			notifiers = append(notifiers, NewLogNotifier(os.Getenv("NOTIFICATION_LOG_FILE")))
+		default:
+			log.Printf("AVISO: canal de notificação desconhecido '%s' ignorado.", channel)
+		}
+	}
+	return notifiers
+}
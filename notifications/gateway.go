@@ -0,0 +1,73 @@
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// GatewayNotifier envia SMS ou WhatsApp por um gateway HTTP. O gateway recebe um POST JSON
+// {"channel", "to", "message"} com o token no cabeçalho Authorization (Bearer) e deve responder
+// com um status 2xx quando aceitar a mensagem. Provedores com outro formato ficam atrás de um
+// pequeno serviço adaptador que fala este contrato.
+type GatewayNotifier struct {
+	channel string
+	url     string
+	token   string
+	client  *http.Client
+}
+
+// gatewayRequest é o corpo enviado ao gateway.
+type gatewayRequest struct {
+	Channel string `json:"channel"`
+	To      string `json:"to"`
+	Message string `json:"message"`
+}
+
+// NewGatewayNotifier cria o canal de SMS (ChannelSMS) ou WhatsApp (ChannelWhatsApp).
+func NewGatewayNotifier(channel, url, token string) *GatewayNotifier {
+	return &GatewayNotifier{
+		channel: channel,
+		url:     url,
+		token:   token,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Channel implementa Notifier.
+func (n *GatewayNotifier) Channel() string { return n.channel }
+
+// Send implementa Notifier.
+func (n *GatewayNotifier) Send(ctx context.Context, msg Message) error {
+	if msg.To == "" {
+		return ErrNoRecipient
+	}
+	payload, err := json.Marshal(gatewayRequest{Channel: n.channel, To: msg.To, Message: msg.Body})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.token)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("gateway de %s indisponível: %w", n.channel, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("gateway de %s respondeu %s: %s", n.channel, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
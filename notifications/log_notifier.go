@@ -0,0 +1,46 @@
+package notifications
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogNotifier não envia nada: grava as mensagens em um arquivo (ou no log do servidor, sem
+// arquivo). Serve para desenvolvimento e para conferir o texto dos lembretes.
+type LogNotifier struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// NewLogNotifier cria o canal de log. Com path vazio, as mensagens vão para o log padrão.
+func NewLogNotifier(path string) *LogNotifier {
+	return &LogNotifier{Path: path}
+}
+
+// Channel implementa Notifier.
+func (n *LogNotifier) Channel() string { return ChannelLog }
+
+// Send implementa Notifier.
+func (n *LogNotifier) Send(ctx context.Context, msg Message) error {
+	entry := fmt.Sprintf("[%s] Para: %s\nAssunto: %s\n%s\n---\n", time.Now().Format(time.RFC3339), msg.To, msg.Subject, msg.Body)
+	if n.Path == "" {
+		log.Print("Notificação (log): " + entry)
+		return nil
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f, err := os.OpenFile(n.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(entry); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
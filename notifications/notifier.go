@@ -0,0 +1,34 @@
+// Package notifications envia mensagens aos pacientes (lembretes de consulta) por canais
+// intercambiáveis: e-mail via SMTP, SMS e WhatsApp via gateways HTTP e um canal de log para
+// desenvolvimento.
+package notifications
+
+import (
+	"context"
+	"errors"
+)
+
+// Canais suportados. O canal define qual contato do paciente é usado como destinatário.
+const (
+	ChannelEmail    = "email"
+	ChannelSMS      = "sms"
+	ChannelWhatsApp = "whatsapp"
+	ChannelLog      = "log"
+)
+
+// ErrNoRecipient indica que o paciente não tem o contato exigido pelo canal.
+var ErrNoRecipient = errors.New("paciente sem contato para este canal")
+
+// Message é uma notificação pronta para envio. To é o e-mail ou o telefone, conforme o canal.
+type Message struct {
+	To      string
+	Subject string // Usado apenas por canais que têm assunto (e-mail)
+	Body    string
+}
+
+// Notifier é o contrato de um canal de envio. Send deve devolver erro sempre que não houver
+// certeza de que a mensagem foi aceita pelo provedor.
+type Notifier interface {
+	Channel() string
+	Send(ctx context.Context, msg Message) error
+}
@@ -0,0 +1,256 @@
+package notifications
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"mediflow/storage"
+)
+
+// Situação de cada envio em notification_deliveries.
+const (
+	deliverySending   = "enviando"
+	deliverySent      = "enviado"
+	deliveryFailed    = "falhou"
+	deliveryNoContact = "sem_contato"
+)
+
+// ReminderScheduler envia lembretes das consultas 'agendado' com as antecedências configuradas:
+//
+//	REMINDER_HOURS_BEFORE           antecedências em horas, separadas por vírgula (padrão "48,2")
+//	REMINDER_JOB_INTERVAL_MINUTES   intervalo entre execuções (padrão 5; 0 desativa)
+//	REMINDER_MAX_ATTEMPTS           tentativas por lembrete e canal antes de desistir (padrão 3)
+//
+// Cada combinação consulta/horário/lembrete/canal é reservada em notification_deliveries antes do
+// envio, com uma restrição UNIQUE: um lembrete enviado (ou cujo envio foi interrompido) nunca é
+// repetido, nem após reiniciar o servidor ou com mais de uma instância rodando. Apenas falhas são
+// retentadas. O horário da consulta faz parte da chave, então uma remarcação (pela equipe, pelo
+// portal, pela série ou pela lista de espera) volta a gerar os lembretes para o novo horário.
+type ReminderScheduler struct {
+	DB          *sql.DB
+	Notifiers   []Notifier
+	Offsets     []time.Duration // Em ordem decrescente
+	Interval    time.Duration
+	MaxAttempts int
+}
+
+// dueAppointment é uma consulta que deve receber um lembrete.
+type dueAppointment struct {
+	ID          int
+	Start       time.Time
+	PatientName string
+	Email       string
+	Phone       string
+	DoctorName  string
+}
+
+// NewReminderScheduler cria o agendador a partir das variáveis de ambiente.
+func NewReminderScheduler(db *sql.DB, notifiers []Notifier) *ReminderScheduler {
+	s := &ReminderScheduler{DB: db, Notifiers: notifiers, Interval: 5 * time.Minute, MaxAttempts: 3}
+	if minutes, err := strconv.Atoi(os.Getenv("REMINDER_JOB_INTERVAL_MINUTES")); err == nil && minutes >= 0 {
+		s.Interval = time.Duration(minutes) * time.Minute
+	}
+	if attempts, err := strconv.Atoi(os.Getenv("REMINDER_MAX_ATTEMPTS")); err == nil && attempts > 0 {
+		s.MaxAttempts = attempts
+	}
+
+	hours := os.Getenv("REMINDER_HOURS_BEFORE")
+	if hours == "" {
+		hours = "48,2"
+	}
+	for _, value := range strings.Split(hours, ",") {
+		h, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || h <= 0 {
+			log.Printf("AVISO: antecedência de lembrete inválida '%s' ignorada.", value)
+			continue
+		}
+		s.Offsets = append(s.Offsets, time.Duration(h*float64(time.Hour)))
+	}
+	sort.Slice(s.Offsets, func(i, j int) bool { return s.Offsets[i] > s.Offsets[j] })
+	return s
+}
+
+// Run executa o agendador imediatamente e depois a cada intervalo, até o contexto ser cancelado.
+func (s *ReminderScheduler) Run(ctx context.Context) {
+	if s.Interval <= 0 || len(s.Offsets) == 0 || len(s.Notifiers) == 0 {
+		log.Println("Lembretes de consulta desativados.")
+		return
+	}
+	channels := make([]string, len(s.Notifiers))
+	for i, n := range s.Notifiers {
+		channels[i] = n.Channel()
+	}
+	log.Printf("Lembretes de consulta iniciados (a cada %s, antecedências %v, canais %s).", s.Interval, s.Offsets, strings.Join(channels, ", "))
+
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.RunOnce(ctx, time.Now()); err != nil {
+			log.Printf("Erro ao enviar lembretes de consulta: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			log.Println("Lembretes de consulta encerrados.")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce envia os lembretes devidos em 'now' e devolve quantos foram enviados. Cada antecedência
+// cobre as consultas que começam entre ela e a próxima menor: uma consulta marcada em cima da hora
+// recebe apenas o lembrete mais próximo, e não todos os atrasados de uma vez.
+func (s *ReminderScheduler) RunOnce(ctx context.Context, now time.Time) (int, error) {
+	sent := 0
+	for i, offset := range s.Offsets {
+		var lower time.Duration
+		if i+1 < len(s.Offsets) {
+			lower = s.Offsets[i+1]
+		}
+		appointments, err := s.dueAppointments(ctx, now.Add(lower), now.Add(offset))
+		if err != nil {
+			return sent, err
+		}
+		for _, appt := range appointments {
+			for _, notifier := range s.Notifiers {
+				ok, err := s.deliver(ctx, appt, reminderKey(offset), notifier, now)
+				if err != nil {
+					return sent, err
+				}
+				if ok {
+					sent++
+				}
+			}
+		}
+	}
+	return sent, nil
+}
+
+// dueAppointments lista as consultas 'agendado' que começam em (from, to].
+func (s *ReminderScheduler) dueAppointments(ctx context.Context, from, to time.Time) ([]dueAppointment, error) {
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT a.id, a.start_time, p.name, COALESCE(p.email, ''),
+		       COALESCE(NULLIF(p.mobile, ''), p.phone, ''), u.name
+		FROM appointments a
+		JOIN patients p ON a.patient_id = p.id
+		JOIN users u ON a.doctor_id = u.id
+		WHERE a.status = 'agendado' AND p.deleted_at IS NULL
+		  AND a.start_time > $1 AND a.start_time <= $2
+		ORDER BY a.start_time ASC`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var appointments []dueAppointment
+	for rows.Next() {
+		var a dueAppointment
+		if err := rows.Scan(&a.ID, &a.Start, &a.PatientName, &a.Email, &a.Phone, &a.DoctorName); err != nil {
+			return nil, err
+		}
+		appointments = append(appointments, a)
+	}
+	return appointments, rows.Err()
+}
+
+// deliver reserva o envio e o realiza. Devolve falso quando o lembrete já foi tratado (enviado,
+// em andamento, sem contato ou sem tentativas restantes) ou quando o envio falhou; o erro
+// devolvido é apenas de banco de dados, já que falhas do canal ficam registradas na tabela.
+func (s *ReminderScheduler) deliver(ctx context.Context, appt dueAppointment, reminder string, notifier Notifier, now time.Time) (bool, error) {
+	recipient := recipientFor(notifier.Channel(), appt)
+
+	var deliveryID int
+	err := s.DB.QueryRowContext(ctx, `
+		INSERT INTO notification_deliveries (appointment_id, start_time, reminder, channel, recipient, status, attempts, last_attempt_at)
+		VALUES ($1, $2, $3, $4, $5, $6, 1, $7)
+		ON CONFLICT (appointment_id, start_time, reminder, channel) DO UPDATE
+		SET status = $6, attempts = notification_deliveries.attempts + 1, recipient = $5, last_attempt_at = $7
+		WHERE notification_deliveries.status = $8 AND notification_deliveries.attempts < $9
+		RETURNING id`,
+		appt.ID, appt.Start, reminder, notifier.Channel(), recipient, deliverySending, now, deliveryFailed, s.MaxAttempts).Scan(&deliveryID)
+	if err == sql.ErrNoRows {
+		return false, nil // Já tratado por esta ou outra execução
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if recipient == "" {
+		_, err := s.DB.ExecContext(ctx, "UPDATE notification_deliveries SET status = $1, last_error = $2 WHERE id = $3",
+			deliveryNoContact, ErrNoRecipient.Error(), deliveryID)
+		return false, err
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	if sendErr := notifier.Send(sendCtx, reminderMessage(appt, recipient)); sendErr != nil {
+		log.Printf("Falha ao enviar lembrete %s da consulta ID %d por %s: %v", reminder, appt.ID, notifier.Channel(), sendErr)
+		_, err := s.DB.ExecContext(context.Background(), "UPDATE notification_deliveries SET status = $1, last_error = $2 WHERE id = $3",
+			deliveryFailed, truncate(sendErr.Error(), 1000), deliveryID)
+		return false, err
+	}
+
+	_, err = s.DB.ExecContext(context.Background(), "UPDATE notification_deliveries SET status = $1, last_error = NULL, sent_at = $2 WHERE id = $3",
+		deliverySent, time.Now(), deliveryID)
+	return true, err
+}
+
+// recipientFor escolhe o contato do paciente usado pelo canal.
+func recipientFor(channel string, appt dueAppointment) string {
+	switch channel {
+	case ChannelEmail:
+		return appt.Email
+	case ChannelSMS, ChannelWhatsApp:
+		return appt.Phone
+	default:
+		for _, contact := range []string{appt.Email, appt.Phone, appt.PatientName} {
+			if contact != "" {
+				return contact
+			}
+		}
+		return ""
+	}
+}
+
+// reminderMessage monta o texto do lembrete, com o horário no fuso da clínica.
+func reminderMessage(appt dueAppointment, recipient string) Message {
+	start := appt.Start.In(storage.ClinicLocation())
+	firstName := appt.PatientName
+	if fields := strings.Fields(firstName); len(fields) > 0 {
+		firstName = fields[0]
+	}
+	return Message{
+		To:      recipient,
+		Subject: "Lembrete: sua sessão em " + start.Format("02/01 às 15:04"),
+		Body: fmt.Sprintf("Olá, %s!\n\nLembramos que sua sessão com %s está marcada para %s às %s.\n"+
+			"Se não puder comparecer, avise a clínica com antecedência.",
+			firstName, appt.DoctorName, start.Format("02/01/2006"), start.Format("15:04")),
+	}
+}
+
+// reminderKey identifica o lembrete pela antecedência ("48h", "90min").
+func reminderKey(offset time.Duration) string {
+	if offset%time.Hour == 0 {
+		return fmt.Sprintf("%dh", int(offset.Hours()))
+	}
+	return fmt.Sprintf("%dmin", int(offset.Minutes()))
+}
+
+// truncate limita o tamanho das mensagens de erro gravadas, sem cortar caracteres UTF-8.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
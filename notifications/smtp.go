@@ -0,0 +1,78 @@
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTPNotifier envia e-mails por um servidor SMTP, com STARTTLS quando o servidor oferece.
+type SMTPNotifier struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// NewSMTPNotifier cria o canal de e-mail. Sem usuário, o envio é feito sem autenticação.
+func NewSMTPNotifier(host, port, username, password, from string) *SMTPNotifier {
+	if port == "" {
+		port = "587"
+	}
+	if from == "" {
+		from = username
+	}
+	return &SMTPNotifier{Host: host, Port: port, Username: username, Password: password, From: from}
+}
+
+// Channel implementa Notifier.
+func (n *SMTPNotifier) Channel() string { return ChannelEmail }
+
+// Send implementa Notifier. net/smtp não aceita contexto; o prazo do contexto é aplicado à conexão.
+func (n *SMTPNotifier) Send(ctx context.Context, msg Message) error {
+	if msg.To == "" {
+		return ErrNoRecipient
+	}
+	if strings.ContainsAny(msg.To, "\r\n") {
+		return fmt.Errorf("destinatário inválido")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		var auth smtp.Auth
+		if n.Username != "" {
+			auth = smtp.PlainAuth("", n.Username, n.Password, n.Host)
+		}
+		done <- smtp.SendMail(net.JoinHostPort(n.Host, n.Port), auth, n.From, []string{msg.To}, n.buildMessage(msg))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("falha no envio SMTP: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// buildMessage monta o e-mail em texto puro UTF-8, com o assunto codificado (RFC 2047).
+func (n *SMTPNotifier) buildMessage(msg Message) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", n.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,75 @@
+// static/js/slot_picker.js
+
+// Lista os horários livres do terapeuta escolhido na data informada e
+// preenche o campo de horário ao clicar em um deles.
+document.addEventListener('DOMContentLoaded', function() {
+    const picker = document.getElementById('slot-picker');
+    if (!picker) return;
+
+    const doctorSelect = document.getElementById('doctor_id');
+    const dateInput = document.getElementById('appointment_date');
+    const timeInput = document.getElementById('start_time');
+    const serviceSelect = document.getElementById('service_type_id');
+    const slotsUrl = picker.dataset.url;
+
+    function render(message, slots) {
+        picker.innerHTML = '';
+        if (message) {
+            const p = document.createElement('p');
+            p.className = 'slot-picker-message';
+            p.textContent = message;
+            picker.appendChild(p);
+        }
+        (slots || []).forEach(function(slot) {
+            const btn = document.createElement('button');
+            btn.type = 'button';
+            btn.className = 'slot-button';
+            btn.textContent = `${slot.start_time}–${slot.end_time}`;
+            btn.addEventListener('click', function() {
+                timeInput.value = slot.start_time;
+                picker.querySelectorAll('.slot-button').forEach(b => b.classList.remove('selected'));
+                btn.classList.add('selected');
+            });
+            picker.appendChild(btn);
+        });
+    }
+
+    async function loadSlots() {
+        const doctorId = doctorSelect.value;
+        const date = dateInput.value;
+        if (!doctorId || !date) {
+            render('Selecione o terapeuta e a data para ver os horários livres.');
+            return;
+        }
+
+        render('Carregando horários...');
+        try {
+            // A duração dos horários acompanha o tipo de sessão escolhido
+            let duration = 60;
+            if (serviceSelect && serviceSelect.selectedOptions.length > 0) {
+                duration = serviceSelect.selectedOptions[0].dataset.duration || duration;
+            }
+            const response = await fetch(`${slotsUrl}?doctor_id=${doctorId}&from=${date}&to=${date}&duration=${duration}`);
+            const data = await response.json();
+            if (!response.ok) {
+                render(data.error || 'Não foi possível carregar os horários.');
+                return;
+            }
+            if (!data.configured) {
+                render('Este terapeuta não possui expediente cadastrado. Informe o horário manualmente.');
+            } else if (data.slots.length === 0) {
+                render('Nenhum horário livre nesta data.');
+            } else {
+                render('Horários livres:', data.slots);
+            }
+        } catch (error) {
+            console.error('Erro ao buscar horários livres:', error);
+            render('Erro de comunicação ao buscar horários.');
+        }
+    }
+
+    doctorSelect.addEventListener('change', loadSlots);
+    dateInput.addEventListener('change', loadSlots);
+    if (serviceSelect) serviceSelect.addEventListener('change', loadSlots);
+    loadSlots();
+});
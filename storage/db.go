@@ -22,8 +22,10 @@ func NewDBConnection() (*sql.DB, error) {
 		dbPort = "5432"
 	}
 
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		dbHost, dbPort, dbUser, dbPass, dbName)
+	// A sessão usa o fuso da clínica: os TIMESTAMPTZ voltam no horário local da clínica e
+	// conversões feitas no SQL (::date, ::time) seguem o mesmo calendário da aplicação
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable timezone=%s",
+		dbHost, dbPort, dbUser, dbPass, dbName, ClinicLocation().String())
 
 	db, err := sql.Open(dbType, connStr)
 	if err != nil {
@@ -2,6 +2,8 @@ package storage
 
 import (
 	"database/sql"
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -12,6 +14,7 @@ type User struct {
 	Email        string    `json:"email"`
 	PasswordHash string    `json:"-"`
 	UserType     string    `json:"user_type"`
+	Timezone     string    `json:"timezone"` // Fuso IANA próprio do terapeuta; vazio = fuso da clínica
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 }
@@ -19,7 +22,7 @@ type User struct {
 // Patient contém todos os dados do formulário inicial e cadastrais.
 type Patient struct {
 	ID                        int          `json:"id"`
-	AccessToken               sql.NullString `json:"access_token"`
+	AccessToken               sql.NullString `json:"access_token"` // Link ativo mais recente do portal (portal_tokens)
 	ConsentGivenAt            sql.NullTime `json:"consent_given_at"`
 	ConsentDate               string       `form:"consent_date" json:"consent_date"`
 	ConsentName               string       `form:"consent_name_inline" json:"consent_name"`
@@ -96,6 +99,162 @@ type PatientRecord struct {
 	CurrentTreatment string    `form:"current_treatment" json:"current_treatment"`
 	Notes            string    `form:"notes" json:"notes"`
 	DoctorName       string    // Campo auxiliar para exibir o nome do médico
+	AddendumOf       sql.NullInt64   // Entrada original corrigida por este adendo
+	SignedAt         sql.NullTime    // Assinatura: a partir dela a entrada fica imutável
+	SignedBy         int
+	SignerName       string
+	SignatureHash    string
+	SignatureValid   bool            // O conteúdo atual confere com o hash gravado na assinatura
+	Addenda          []PatientRecord // Adendos da entrada, do mais antigo para o mais recente
+	Note             *StructuredNote // Nota da sessão preenchida num modelo (SOAP, DAP...), se houver
+	GoalProgress     []GoalProgress  // Progresso registrado nesta sessão para as metas do plano terapêutico
+}
+
+// StructuredNote é a nota da sessão preenchida num modelo, gravada em patient_records.note_data.
+// Guarda títulos e rótulos como estavam no registro, para que a entrada continue legível (e a
+// assinatura continue conferindo) mesmo que o modelo seja alterado depois.
+type StructuredNote struct {
+	TemplateID int           `json:"template_id"`
+	Template   string        `json:"template"`
+	Sections   []NoteSection `json:"sections"`
+}
+
+// NoteSection é uma seção da nota estruturada (por exemplo, o "S" do SOAP).
+type NoteSection struct {
+	Title  string      `json:"title"`
+	Fields []NoteField `json:"fields"`
+}
+
+// NoteField é um campo respondido da nota estruturada.
+type NoteField struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+// TreatmentPlan representa a tabela 'treatment_plans': o plano terapêutico de um paciente, com
+// os problemas trabalhados e as metas. Cada paciente tem no máximo um plano ativo.
+type TreatmentPlan struct {
+	ID         int
+	PatientID  int
+	DoctorID   int
+	DoctorName string // Terapeuta que elaborou o plano
+	Problems   string
+	Status     string       // 'ativo', 'concluido' ou 'encerrado'
+	ReviewDate sql.NullTime // Próxima revisão prevista
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	Goals      []TreatmentGoal
+}
+
+// TreatmentGoal representa a tabela 'treatment_goals': uma meta mensurável do plano, com as
+// intervenções previstas e a data-alvo.
+type TreatmentGoal struct {
+	ID            int
+	PlanID        int
+	Description   string
+	Measure       string // Critério que indica que a meta foi atingida
+	Interventions string
+	TargetDate    sql.NullTime
+	Status        string         // 'em_andamento', 'atingida' ou 'suspensa'
+	Progress      []GoalProgress // Progresso registrado nas sessões, da mais antiga para a mais recente
+}
+
+// StatusLabel devolve a situação do plano para exibição.
+func (p TreatmentPlan) StatusLabel() string {
+	switch p.Status {
+	case "concluido":
+		return "Concluído"
+	case "encerrado":
+		return "Encerrado"
+	default:
+		return "Ativo"
+	}
+}
+
+// StatusLabel devolve a situação da meta para exibição.
+func (g TreatmentGoal) StatusLabel() string {
+	switch g.Status {
+	case "atingida":
+		return "Atingida"
+	case "suspensa":
+		return "Suspensa"
+	default:
+		return "Em andamento"
+	}
+}
+
+// LatestProgress devolve o último progresso registrado para a meta, ou nil se ainda não há nenhum.
+func (g TreatmentGoal) LatestProgress() *GoalProgress {
+	if len(g.Progress) == 0 {
+		return nil
+	}
+	return &g.Progress[len(g.Progress)-1]
+}
+
+// Overdue indica se a meta ainda está em andamento depois da data-alvo.
+func (g TreatmentGoal) Overdue() bool {
+	if g.Status != "em_andamento" || !g.TargetDate.Valid {
+		return false
+	}
+	now := time.Now().In(ClinicLocation())
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	target := g.TargetDate.Time
+	return time.Date(target.Year(), target.Month(), target.Day(), 0, 0, 0, 0, time.UTC).Before(today)
+}
+
+// GoalProgress representa a tabela 'record_goal_progress': o progresso de uma meta registrado numa
+// entrada do prontuário.
+type GoalProgress struct {
+	GoalID     int       `json:"goal_id"`
+	Goal       string    `json:"goal"`     // Descrição da meta, para exibição
+	Progress   int       `json:"progress"` // 0 a 100%
+	Note       string    `json:"note"`
+	RecordID   int       `json:"-"`
+	RecordDate time.Time `json:"-"`
+	DoctorName string    `json:"-"`
+	Signed     bool      `json:"-"`
+}
+
+// PatientAttachment representa a tabela 'patient_attachments': um arquivo anexado ao prontuário do
+// paciente. O conteúdo fica no armazenamento de anexos, sob StorageKey.
+type PatientAttachment struct {
+	ID             int
+	PatientID      int
+	UploadedBy     int
+	UploadedByName string
+	Category       string // 'encaminhamento', 'exame', 'desenho' ou 'outro'
+	Description    string
+	FileName       string
+	ContentType    string // Tipo identificado pelo conteúdo do arquivo
+	SizeBytes      int64
+	SHA256         string
+	StorageKey     string
+	ScanStatus     string // 'limpo' ou 'nao_verificado'
+	CreatedAt      time.Time
+}
+
+// CategoryLabel devolve a categoria do anexo para exibição.
+func (a PatientAttachment) CategoryLabel() string {
+	switch a.Category {
+	case "encaminhamento":
+		return "Encaminhamento"
+	case "exame":
+		return "Exame"
+	case "desenho":
+		return "Desenho"
+	default:
+		return "Outro"
+	}
+}
+
+// SizeLabel devolve o tamanho do arquivo em KB ou MB, com vírgula decimal.
+func (a PatientAttachment) SizeLabel() string {
+	if a.SizeBytes < 1<<20 {
+		return fmt.Sprintf("%d KB", (a.SizeBytes+1023)/1024)
+	}
+	return strings.Replace(fmt.Sprintf("%.1f MB", float64(a.SizeBytes)/(1<<20)), ".", ",", 1)
 }
 
 // Appointment representa a tabela 'appointments' no banco de dados.
@@ -107,11 +266,239 @@ type Appointment struct {
 	EndTime   time.Time `json:"end_time"`
 	Notes     string    `json:"notes"`
 	Status    string    `json:"status"`
+	SeriesID  sql.NullInt64 `json:"series_id"`
+	ServiceTypeID   sql.NullInt64 `json:"service_type_id"`
+	DurationMinutes int           `json:"duration_minutes"`
 	Price         float64 `json:"price"`
 	PaymentStatus string  `json:"payment_status"`	
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
+
+// ServiceType representa a tabela 'service_types': um tipo de sessão oferecido pela clínica.
+type ServiceType struct {
+	ID              int     `json:"id"`
+	Name            string  `form:"name" json:"name"`
+	DurationMinutes int     `form:"duration_minutes" json:"duration_minutes"`
+	DefaultPrice    float64 `form:"default_price" json:"default_price"`
+	Active          bool    `json:"active"`
+}
+
+// TherapistServicePrice representa a tabela 'therapist_service_prices': o preço de um
+// serviço que substitui o preço padrão para um terapeuta.
+type TherapistServicePrice struct {
+	DoctorID      int     `json:"doctor_id"`
+	DoctorName    string  `json:"doctor_name"`
+	ServiceTypeID int     `json:"service_type_id"`
+	Price         float64 `json:"price"`
+}
+
+// AppointmentSeries representa a tabela 'appointment_series': a regra de recorrência
+// que gerou um conjunto de consultas.
+type AppointmentSeries struct {
+	ID              int           `json:"id"`
+	PatientID       int           `json:"patient_id"`
+	DoctorID        int           `json:"doctor_id"`
+	Frequency       string        `json:"frequency"` // 'semanal', 'quinzenal' ou 'mensal'
+	FirstStart      time.Time     `json:"first_start"`
+	UntilDate       sql.NullTime  `json:"until_date"`
+	OccurrenceCount sql.NullInt64 `json:"occurrence_count"`
+	CreatedAt       time.Time     `json:"created_at"`
+}
+
+// AvailabilityBlock representa a tabela 'therapist_availability': um bloco semanal recorrente
+// de atendimento (ou de intervalo) de um terapeuta.
+type AvailabilityBlock struct {
+	ID        int    `json:"id"`
+	DoctorID  int    `json:"doctor_id"`
+	Weekday   int    `form:"weekday" json:"weekday"`       // 0 = domingo ... 6 = sábado
+	StartTime string `form:"start_time" json:"start_time"` // HH:MM
+	EndTime   string `form:"end_time" json:"end_time"`     // HH:MM
+	BlockType string `form:"block_type" json:"block_type"` // 'trabalho' ou 'intervalo'
+}
+
+// AvailabilityException representa a tabela 'therapist_availability_exceptions': um período
+// específico (férias, folga, compromisso) em que o terapeuta não atende.
+type AvailabilityException struct {
+	ID        int       `json:"id"`
+	DoctorID  int       `json:"doctor_id"`
+	StartDate time.Time `json:"start_date"`
+	EndDate   time.Time `json:"end_date"`
+	StartTime string    `json:"start_time"` // vazio = dia inteiro
+	EndTime   string    `json:"end_time"`
+	Reason    string    `json:"reason"`
+}
+
+// WaitlistEntry representa a tabela 'waitlist_entries': um paciente que aceita antecipar a
+// consulta caso um horário compatível seja liberado.
+type WaitlistEntry struct {
+	ID            int
+	PatientID     int
+	PatientName   string
+	DoctorID      sql.NullInt64 // nulo = qualquer terapeuta
+	DoctorName    string
+	ServiceTypeID sql.NullInt64
+	ServiceName   string
+	Priority      int // 1 = alta, 2 = normal, 3 = baixa
+	Notes         string
+	Status        string // 'aguardando', 'atendido' ou 'removido'
+	CreatedAt     time.Time
+	Windows       []WaitlistWindow
+}
+
+// WaitlistWindow representa a tabela 'waitlist_windows': um dia da semana e faixa de horário
+// em que o paciente pode ser atendido. Entrada sem janelas aceita qualquer horário.
+type WaitlistWindow struct {
+	Weekday   int    // 0 = domingo ... 6 = sábado
+	StartTime string // HH:MM
+	EndTime   string // HH:MM
+}
+
+// WaitlistOffer representa a tabela 'waitlist_offers': um horário liberado por cancelamento
+// que combina com uma entrada da lista de espera.
+type WaitlistOffer struct {
+	ID          int
+	EntryID     int
+	PatientID   int
+	PatientName string
+	DoctorID    int
+	DoctorName  string
+	StartTime   time.Time
+	EndTime     time.Time
+	Priority    int
+	Status      string // 'pendente', 'aceita' ou 'descartada'
+}
+
+// PortalToken representa a tabela 'portal_tokens': um link de acesso ao portal do paciente,
+// com finalidade, validade, uso único ou múltiplo e revogação.
+type PortalToken struct {
+	ID            int
+	PatientID     int
+	Token         string
+	Purpose       string // 'consentimento', 'anamnese' ou 'acesso'
+	SingleUse     bool
+	ExpiresAt     time.Time
+	UseCount      int
+	LastUsedAt    sql.NullTime
+	RevokedAt     sql.NullTime
+	CreatedByName string // Usuário da equipe que emitiu o link; vazio quando emitido pelo sistema
+	CreatedAt     time.Time
+}
+
+// State resume a situação do link: "ativo", "revogado", "expirado" ou "usado" (uso único já consumido).
+func (t PortalToken) State() string {
+	switch {
+	case t.RevokedAt.Valid:
+		return "revogado"
+	case !t.ExpiresAt.After(time.Now()):
+		return "expirado"
+	case t.SingleUse && t.UseCount > 0:
+		return "usado"
+	default:
+		return "ativo"
+	}
+}
+
+// ConsentTerm representa a tabela 'consent_terms': uma versão imutável do termo de consentimento.
+type ConsentTerm struct {
+	ID                int
+	Version           int
+	Title             string
+	Body              string
+	ContentHash       string // SHA-256 do texto, em hexadecimal
+	RequiresReconsent bool
+	CreatedByName     string
+	CreatedAt         time.Time
+}
+
+// PatientConsent representa a tabela 'patient_consents': o aceite de uma versão do termo pelo
+// paciente, com a evidência registrada no momento do aceite e, se houver, da revogação.
+type PatientConsent struct {
+	ID               int
+	PatientID        int
+	TermID           int
+	TermVersion      int
+	TermTitle        string
+	ContentHash      string
+	ConsentName      string
+	ConsentCpfRg     string
+	AcceptedAt       time.Time
+	IPAddress        string
+	RemoteAddr       string // Endereço da conexão; difere de IPAddress quando o acesso veio por um proxy confiável
+	UserAgent        string
+	RevokedAt        sql.NullTime
+	RevocationReason string
+	RevocationIP     string
+	RevocationRemote string
+	Superseded       bool // Uma versão posterior do termo exige novo aceite
+}
+
+// State resume a situação do aceite: "vigente", "revogado" ou "substituído".
+func (pc PatientConsent) State() string {
+	switch {
+	case pc.RevokedAt.Valid:
+		return "revogado"
+	case pc.Superseded:
+		return "substituído"
+	default:
+		return "vigente"
+	}
+}
+
+// PatientIntake representa a tabela 'patient_intakes': a ficha de anamnese preenchida pelo
+// paciente no portal, salva como rascunho entre as etapas e enviada para a revisão do terapeuta.
+type PatientIntake struct {
+	ID          int
+	PatientID   int
+	Status      string            // 'rascunho', 'enviado', 'devolvido' ou 'aprovado'
+	Data        map[string]string // Respostas, pela coluna correspondente da tabela patients
+	SubmittedAt sql.NullTime
+	ReviewedBy  string // Nome do terapeuta que revisou
+	ReviewedAt  sql.NullTime
+	ReviewNotes string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// SessionCheckin representa a tabela 'session_checkins': o check-in que o paciente responde no
+// portal antes de uma consulta.
+type SessionCheckin struct {
+	ID               int
+	AppointmentID    int // 0 quando a consulta foi excluída
+	PatientID        int
+	AppointmentStart time.Time
+	DoctorName       string
+	AnxietyLevel     int
+	AngerLevel       int
+	FearLevel        int
+	SadnessLevel     int
+	JoyLevel         int
+	EnergyLevel      int
+	Notes            string
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
+
+// QuestionnaireResponse representa a tabela 'questionnaire_responses': uma aplicação de escala
+// padronizada (PHQ-9, GAD-7), pendente no portal ou já respondida e pontuada.
+type QuestionnaireResponse struct {
+	ID            int
+	PatientID     int
+	Questionnaire string // Código do instrumento: 'phq9' ou 'gad7'
+	Name          string // Nome do instrumento, para exibição
+	Status        string // 'pendente' ou 'respondido'
+	Source        string // 'sessao' ou 'portal'
+	RequestedBy   string // Terapeuta que aplicou ou enviou a escala
+	Answers       []int
+	Score         int
+	MaxScore      int
+	Severity      string
+	Alert         bool
+	AlertMessage  string
+	CreatedAt     time.Time
+	CompletedAt   sql.NullTime
+}
+
 // storage/models.go
 
 // AuditLog representa a tabela 'audit_logs' no banco de dados.
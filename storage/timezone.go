@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	_ "time/tzdata" // Embute a base de fusos IANA para servidores sem /usr/share/zoneinfo
+)
+
+// DefaultClinicTimezone é usado quando CLINIC_TIMEZONE não está configurado.
+const DefaultClinicTimezone = "America/Sao_Paulo"
+
+var (
+	clinicLocation     *time.Location
+	clinicLocationOnce sync.Once
+)
+
+// ClinicLocation devolve o fuso horário da clínica (CLINIC_TIMEZONE, um nome IANA como
+// "America/Sao_Paulo"). Datas digitadas nos formulários, os dias da agenda e a exibição dos
+// horários usam este fuso. Um nome inválido é registrado no log e substituído pelo padrão.
+func ClinicLocation() *time.Location {
+	clinicLocationOnce.Do(func() {
+		name := os.Getenv("CLINIC_TIMEZONE")
+		if name == "" {
+			name = DefaultClinicTimezone
+		}
+		loc, err := LoadTimezone(name)
+		if err != nil {
+			log.Printf("CLINIC_TIMEZONE inválido (%q): %v. Usando %s.", name, err, DefaultClinicTimezone)
+			loc, _ = time.LoadLocation(DefaultClinicTimezone)
+		}
+		clinicLocation = loc
+	})
+	return clinicLocation
+}
+
+// LoadTimezone carrega um fuso IANA. Diferente de time.LoadLocation, recusa o nome vazio e
+// "Local", que dependeriam da configuração do servidor.
+func LoadTimezone(name string) (*time.Location, error) {
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("fuso horário não informado")
+	}
+	return time.LoadLocation(name)
+}